@@ -0,0 +1,110 @@
+package capture
+
+import (
+	"encoding/binary"
+	"io"
+	"time"
+)
+
+// pcapng blocks and options used by the tap (draft-ietf-opsawg-pcapng)
+const (
+	ngBlockSHB = 0x0a0d0d0a
+	ngBlockIDB = 0x00000001
+	ngBlockEPB = 0x00000006
+
+	ngByteOrderMagic = 0x1a2b3c4d
+	ngOptEnd         = 0
+	ngOptComment     = 1
+	ngOptUserAppl    = 4
+
+	// LINKTYPE_RAW, packets start with the IPv4 or IPv6 header
+	ngLinkTypeRaw = 101
+)
+
+// ngWriter writes a pcapng file with one raw IP interface. Unlike the
+// gopacket writer it can attach a comment to every packet.
+type ngWriter struct {
+	w io.Writer
+}
+
+func newNgWriter(w io.Writer) (*ngWriter, int, error) {
+	n := &ngWriter{w: w}
+
+	shb := binary.LittleEndian.AppendUint32(nil, ngByteOrderMagic)
+	shb = binary.LittleEndian.AppendUint16(shb, 1) // major version
+	shb = binary.LittleEndian.AppendUint16(shb, 0) // minor version
+	shb = binary.LittleEndian.AppendUint64(shb, ^uint64(0))
+	shb = appendNgOption(shb, ngOptUserAppl, "b4")
+	shb = appendNgOption(shb, ngOptEnd, "")
+	written, err := n.block(ngBlockSHB, shb)
+	if err != nil {
+		return nil, written, err
+	}
+
+	idb := binary.LittleEndian.AppendUint16(nil, ngLinkTypeRaw)
+	idb = binary.LittleEndian.AppendUint16(idb, 0)
+	idb = binary.LittleEndian.AppendUint32(idb, 0) // no snap length
+	m, err := n.block(ngBlockIDB, idb)
+	return n, written + m, err
+}
+
+// packet writes data as an enhanced packet block of interface 0 and returns
+// the bytes written.
+func (n *ngWriter) packet(ts time.Time, data []byte, comment string) (int, error) {
+	us := uint64(ts.UnixMicro())
+
+	epb := binary.LittleEndian.AppendUint32(nil, 0) // interface ID
+	epb = binary.LittleEndian.AppendUint32(epb, uint32(us>>32))
+	epb = binary.LittleEndian.AppendUint32(epb, uint32(us))
+	epb = binary.LittleEndian.AppendUint32(epb, uint32(len(data)))
+	epb = binary.LittleEndian.AppendUint32(epb, uint32(len(data)))
+	epb = append(epb, data...)
+	epb = append(epb, make([]byte, pad4(len(data)))...)
+	if comment != "" {
+		epb = appendNgOption(epb, ngOptComment, comment)
+		epb = appendNgOption(epb, ngOptEnd, "")
+	}
+	return n.block(ngBlockEPB, epb)
+}
+
+// PcapNGWriter writes raw IP packets to a pcapng file, each with an
+// optional comment shown by Wireshark.
+type PcapNGWriter struct {
+	ng *ngWriter
+}
+
+// NewPcapNGWriter writes the section and interface headers to w.
+func NewPcapNGWriter(w io.Writer) (*PcapNGWriter, error) {
+	ng, _, err := newNgWriter(w)
+	if err != nil {
+		return nil, err
+	}
+	return &PcapNGWriter{ng: ng}, nil
+}
+
+// WritePacket writes one IPv4 or IPv6 packet captured at ts.
+func (p *PcapNGWriter) WritePacket(ts time.Time, data []byte, comment string) error {
+	_, err := p.ng.packet(ts, data, comment)
+	return err
+}
+
+func (n *ngWriter) block(typ uint32, body []byte) (int, error) {
+	total := uint32(12 + len(body))
+	b := make([]byte, 0, total)
+	b = binary.LittleEndian.AppendUint32(b, typ)
+	b = binary.LittleEndian.AppendUint32(b, total)
+	b = append(b, body...)
+	b = binary.LittleEndian.AppendUint32(b, total)
+	return n.w.Write(b)
+}
+
+func appendNgOption(b []byte, code uint16, value string) []byte {
+	b = binary.LittleEndian.AppendUint16(b, code)
+	b = binary.LittleEndian.AppendUint16(b, uint16(len(value)))
+	b = append(b, value...)
+	return append(b, make([]byte, pad4(len(value)))...)
+}
+
+func pad4(n int) int {
+	return (4 - n%4) % 4
+}
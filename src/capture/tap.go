@@ -0,0 +1,490 @@
+package capture
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/daniellavrushin/b4/log"
+)
+
+const (
+	DefaultTapMaxBytes = 64 << 20
+
+	// Flows whose original was tapped are kept this long for the packets
+	// sent on their behalf
+	tapFlowTTL      = time.Minute
+	tapMaxFlows     = 4096
+	tapFlushEvery   = time.Second
+	tapCommentLimit = 512
+)
+
+// TapOptions limits what a tap records.
+type TapOptions struct {
+	// Domain, when set, only records flows to it or its subdomains.
+	Domain string `json:"domain"`
+	// IP, an address or CIDR, only records flows from or to it.
+	IP string `json:"ip"`
+	// MaxBytes stops the tap once the file reaches this size.
+	MaxBytes int64 `json:"max_bytes"`
+}
+
+type TapStatus struct {
+	Active    bool       `json:"active"`
+	Path      string     `json:"path,omitempty"`
+	Started   time.Time  `json:"started,omitempty"`
+	Options   TapOptions `json:"options"`
+	Packets   int        `json:"packets"`
+	Bytes     int64      `json:"bytes"`
+	Truncated bool       `json:"truncated"`
+}
+
+// Tap writes queued packets and every packet sent on their behalf to a
+// pcapng file, each with a comment naming its set, strategy and role.
+type Tap struct {
+	mu     sync.Mutex
+	file   *os.File
+	buf    *bufio.Writer
+	ng     *ngWriter
+	ipNet  *net.IPNet
+	flows  map[tapFlowKey]*tapFlow
+	status TapStatus
+}
+
+type tapFlowKey struct {
+	proto  uint8
+	lo, hi string // endpoints ordered, both directions share the key
+}
+
+type tapFlow struct {
+	orig     []byte
+	domain   string
+	set      string
+	strategy string
+	seen     time.Time
+}
+
+var (
+	tapMu     sync.Mutex
+	activeTap atomic.Pointer[Tap]
+	lastTap   TapStatus
+)
+
+// TapEnabled reports whether a tap is recording, cheap enough for every
+// packet.
+func TapEnabled() bool {
+	return activeTap.Load() != nil
+}
+
+// StartTap starts recording to a new pcapng file at path, replacing a
+// running tap.
+func StartTap(path string, opts TapOptions) error {
+	opts.Domain = strings.ToLower(strings.TrimSuffix(strings.TrimSpace(opts.Domain), "."))
+	opts.IP = strings.TrimSpace(opts.IP)
+	if opts.MaxBytes <= 0 {
+		opts.MaxBytes = DefaultTapMaxBytes
+	}
+
+	var ipNet *net.IPNet
+	if opts.IP != "" {
+		if _, n, err := net.ParseCIDR(opts.IP); err == nil {
+			ipNet = n
+		} else if ip := net.ParseIP(opts.IP); ip != nil {
+			bits := 8 * len(ip)
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 32
+			}
+			ipNet = &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}
+		} else {
+			return fmt.Errorf("invalid IP filter %q", opts.IP)
+		}
+	}
+
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	buf := bufio.NewWriter(f)
+	ng, n, err := newNgWriter(buf)
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	t := &Tap{
+		file:  f,
+		buf:   buf,
+		ng:    ng,
+		ipNet: ipNet,
+		flows: make(map[tapFlowKey]*tapFlow),
+		status: TapStatus{
+			Active:  true,
+			Path:    path,
+			Started: time.Now(),
+			Options: opts,
+			Bytes:   int64(n),
+		},
+	}
+
+	tapMu.Lock()
+	if old := activeTap.Swap(t); old != nil {
+		lastTap = old.close()
+	}
+	tapMu.Unlock()
+
+	go t.flushLoop()
+	log.Infof("Packet tap started: %s (domain: %q, ip: %q, max %d bytes)", path, opts.Domain, opts.IP, opts.MaxBytes)
+	return nil
+}
+
+// StopTap stops the running tap and returns its final status.
+func StopTap() TapStatus {
+	tapMu.Lock()
+	defer tapMu.Unlock()
+	if t := activeTap.Swap(nil); t != nil {
+		lastTap = t.close()
+		log.Infof("Packet tap stopped: %s (%d packets, %d bytes)", lastTap.Path, lastTap.Packets, lastTap.Bytes)
+	}
+	return lastTap
+}
+
+// GetTapStatus returns the status of the running tap, or of the last one.
+func GetTapStatus() TapStatus {
+	if t := activeTap.Load(); t != nil {
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		return t.status
+	}
+	tapMu.Lock()
+	defer tapMu.Unlock()
+	return lastTap
+}
+
+// TapOriginal records a queued packet once it is classified, and remembers
+// its flow so the packets later sent for it are recorded too.
+func TapOriginal(pkt []byte, domain, set, strategy string) {
+	t := activeTap.Load()
+	if t == nil {
+		return
+	}
+	key, src, dst, ok := tapKey(pkt)
+	if !ok || !t.wants(domain, src, dst) {
+		return
+	}
+
+	now := time.Now()
+	flow := &tapFlow{
+		orig:     append([]byte(nil), pkt...),
+		domain:   domain,
+		set:      set,
+		strategy: strategy,
+		seen:     now,
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if len(t.flows) >= tapMaxFlows {
+		for k, f := range t.flows {
+			if now.Sub(f.seen) > tapFlowTTL {
+				delete(t.flows, k)
+			}
+		}
+	}
+	if len(t.flows) < tapMaxFlows-1 {
+		t.flows[key] = flow
+		// IP fragments after the first have no ports, they are found by
+		// their addresses alone
+		t.flows[newTapFlowKey(key.proto, src, 0, dst, 0)] = flow
+	}
+	t.write(now, pkt, tapComment("original", flow))
+}
+
+// TapSent records a packet b4 sends if it belongs to a tapped flow, with
+// its role guessed from how it differs from the original.
+func TapSent(pkt []byte) {
+	t := activeTap.Load()
+	if t == nil {
+		return
+	}
+	key, src, dst, ok := tapKey(pkt)
+	if !ok {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	flow, ok := t.flows[key]
+	if !ok && isFragment(pkt) {
+		flow, ok = t.flows[newTapFlowKey(key.proto, src, 0, dst, 0)]
+	}
+	if !ok {
+		return
+	}
+	now := time.Now()
+	flow.seen = now
+	t.write(now, pkt, tapComment(PacketRole(flow.orig, pkt), flow))
+}
+
+func (t *Tap) wants(domain string, src, dst net.IP) bool {
+	opts := t.status.Options
+	if opts.Domain != "" && domain != opts.Domain && !strings.HasSuffix(domain, "."+opts.Domain) {
+		return false
+	}
+	if t.ipNet != nil && !t.ipNet.Contains(src) && !t.ipNet.Contains(dst) {
+		return false
+	}
+	return true
+}
+
+// write appends a packet, the caller holds t.mu. The tap stops itself
+// when the file would grow past its limit.
+func (t *Tap) write(ts time.Time, pkt []byte, comment string) {
+	if !t.status.Active {
+		return
+	}
+	// Block overhead: 28 header bytes, padding and the comment option
+	if size := int64(32 + len(pkt) + len(comment) + 12); t.status.Bytes+size > t.status.Options.MaxBytes {
+		t.status.Truncated = true
+		t.status.Active = false
+		go func() {
+			tapMu.Lock()
+			defer tapMu.Unlock()
+			if activeTap.CompareAndSwap(t, nil) {
+				lastTap = t.close()
+				log.Infof("Packet tap reached its size limit: %s", lastTap.Path)
+			}
+		}()
+		return
+	}
+	n, err := t.ng.packet(ts, pkt, comment)
+	t.status.Bytes += int64(n)
+	if err != nil {
+		log.Errorf("Packet tap write failed: %v", err)
+		return
+	}
+	t.status.Packets++
+}
+
+func (t *Tap) flushLoop() {
+	ticker := time.NewTicker(tapFlushEvery)
+	defer ticker.Stop()
+	for range ticker.C {
+		t.mu.Lock()
+		if t.file == nil {
+			t.mu.Unlock()
+			return
+		}
+		_ = t.buf.Flush()
+		t.mu.Unlock()
+	}
+}
+
+func (t *Tap) close() TapStatus {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.file != nil {
+		_ = t.buf.Flush()
+		_ = t.file.Close()
+		t.file = nil
+	}
+	t.status.Active = false
+	return t.status
+}
+
+func tapComment(role string, f *tapFlow) string {
+	c := fmt.Sprintf("role=%s set=%q strategy=%q", role, f.set, f.strategy)
+	if f.domain != "" {
+		c += " domain=" + f.domain
+	}
+	if len(c) > tapCommentLimit {
+		c = c[:tapCommentLimit]
+	}
+	return c
+}
+
+// tapKey returns the flow key and addresses of an IPv4 or IPv6 packet.
+// Fragments without a transport header get the ports of 0.
+func tapKey(pkt []byte) (tapFlowKey, net.IP, net.IP, bool) {
+	proto, src, dst, l4, ok := parseIP(pkt)
+	if !ok {
+		return tapFlowKey{}, nil, nil, false
+	}
+	var sport, dport uint16
+	if (proto == 6 || proto == 17) && len(l4) >= 4 {
+		sport = binary.BigEndian.Uint16(l4[0:2])
+		dport = binary.BigEndian.Uint16(l4[2:4])
+	}
+	return newTapFlowKey(proto, src, sport, dst, dport), src, dst, true
+}
+
+func newTapFlowKey(proto uint8, src net.IP, sport uint16, dst net.IP, dport uint16) tapFlowKey {
+	a := net.JoinHostPort(src.String(), fmt.Sprint(sport))
+	b := net.JoinHostPort(dst.String(), fmt.Sprint(dport))
+	if a > b {
+		a, b = b, a
+	}
+	return tapFlowKey{proto: proto, lo: a, hi: b}
+}
+
+// parseIP returns the transport protocol, addresses and transport header
+// of a packet. Non-first IPv4 fragments and IPv6 fragments carry the
+// protocol of the fragmented packet but no transport header.
+func parseIP(pkt []byte) (proto uint8, src, dst net.IP, l4 []byte, ok bool) {
+	if len(pkt) < 20 {
+		return 0, nil, nil, nil, false
+	}
+	switch pkt[0] >> 4 {
+	case 4:
+		ihl := int(pkt[0]&0x0f) * 4
+		if ihl < 20 || len(pkt) < ihl {
+			return 0, nil, nil, nil, false
+		}
+		l4 = pkt[ihl:]
+		if binary.BigEndian.Uint16(pkt[6:8])&0x1fff != 0 {
+			l4 = nil
+		}
+		return pkt[9], net.IP(pkt[12:16]), net.IP(pkt[16:20]), l4, true
+	case 6:
+		if len(pkt) < 40 {
+			return 0, nil, nil, nil, false
+		}
+		next, off := pkt[6], 40
+		for {
+			switch next {
+			case 0, 43, 60:
+				if len(pkt) < off+2 {
+					return 0, nil, nil, nil, false
+				}
+				next, off = pkt[off], off+int(pkt[off+1])*8+8
+				continue
+			case 44:
+				if len(pkt) < off+8 {
+					return 0, nil, nil, nil, false
+				}
+				if binary.BigEndian.Uint16(pkt[off+2:off+4])&0xfff8 != 0 {
+					return pkt[off], net.IP(pkt[8:24]), net.IP(pkt[24:40]), nil, true
+				}
+				next, off = pkt[off], off+8
+				continue
+			}
+			break
+		}
+		if len(pkt) < off {
+			return 0, nil, nil, nil, false
+		}
+		return next, net.IP(pkt[8:24]), net.IP(pkt[24:40]), pkt[off:], true
+	}
+	return 0, nil, nil, nil, false
+}
+
+func isFragment(pkt []byte) bool {
+	switch pkt[0] >> 4 {
+	case 4:
+		return binary.BigEndian.Uint16(pkt[6:8])&0x3fff != 0 // MF or offset
+	case 6:
+		next, off := pkt[6], 40
+		for len(pkt) >= off+2 {
+			switch next {
+			case 44:
+				return true
+			case 0, 43, 60:
+				next, off = pkt[off], off+int(pkt[off+1])*8+8
+			default:
+				return false
+			}
+		}
+	}
+	return false
+}
+
+func ttlOf(pkt []byte) uint8 {
+	if pkt[0]>>4 == 4 {
+		return pkt[8]
+	}
+	return pkt[7]
+}
+
+// PacketRole names what a packet sent for orig is: a fragment or segment
+// of it, a decoy, a desync RST, or orig itself sent unchanged.
+func PacketRole(orig, sent []byte) string {
+	_, osrc, _, ol4, ok := parseIP(orig)
+	if !ok {
+		return "unknown"
+	}
+	proto, ssrc, _, sl4, ok := parseIP(sent)
+	if !ok {
+		return "unknown"
+	}
+	reply := !ssrc.Equal(osrc)
+
+	if isFragment(sent) {
+		return "ip-fragment"
+	}
+
+	switch proto {
+	case 6:
+		if len(sl4) < 20 || len(ol4) < 20 {
+			return "unknown"
+		}
+		flags := sl4[13]
+		switch {
+		case flags&0x04 != 0:
+			return "desync-rst"
+		case flags&0x02 != 0:
+			if reply {
+				return "syn-ack"
+			}
+			if sl4[13] == ol4[13] && len(sent) == len(orig) && string(sent) == string(orig) {
+				return "original"
+			}
+			return "fake-syn"
+		}
+		if reply {
+			return "reply"
+		}
+		sOff, oOff := int(sl4[12]>>4)*4, int(ol4[12]>>4)*4
+		if len(sl4) < sOff || len(ol4) < oOff {
+			return "unknown"
+		}
+		sPayload, oPayload := sl4[sOff:], ol4[oOff:]
+		if len(sPayload) == 0 {
+			return "ack"
+		}
+		rel := int(int32(binary.BigEndian.Uint32(sl4[4:8]) - binary.BigEndian.Uint32(ol4[4:8])))
+		if rel >= 0 && rel+len(sPayload) <= len(oPayload) && string(oPayload[rel:rel+len(sPayload)]) == string(sPayload) {
+			if len(sPayload) == len(oPayload) {
+				if ttlOf(sent) < ttlOf(orig) {
+					return "fake"
+				}
+				return "original"
+			}
+			return "segment"
+		}
+		return "fake"
+
+	case 17:
+		if reply {
+			return "reply"
+		}
+		if len(sl4) < 8 || len(ol4) < 8 {
+			return "unknown"
+		}
+		if string(sl4[8:]) == string(ol4[8:]) {
+			if ttlOf(sent) < ttlOf(orig) {
+				return "fake"
+			}
+			return "original"
+		}
+		if ttlOf(sent) < ttlOf(orig) {
+			return "fake"
+		}
+		return "segment"
+	}
+	return "unknown"
+}
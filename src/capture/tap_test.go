@@ -0,0 +1,166 @@
+package capture
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+)
+
+// tcpPacket builds an IPv4 TCP packet from 10.0.0.2:40000 to 1.2.3.4:443.
+func tcpPacket(ttl, flags byte, seq uint32, payload []byte) []byte {
+	pkt := make([]byte, 40+len(payload))
+	pkt[0] = 0x45
+	binary.BigEndian.PutUint16(pkt[2:4], uint16(len(pkt)))
+	pkt[8] = ttl
+	pkt[9] = 6
+	copy(pkt[12:16], []byte{10, 0, 0, 2})
+	copy(pkt[16:20], []byte{1, 2, 3, 4})
+	binary.BigEndian.PutUint16(pkt[20:22], 40000)
+	binary.BigEndian.PutUint16(pkt[22:24], 443)
+	binary.BigEndian.PutUint32(pkt[24:28], seq)
+	pkt[32] = 5 << 4
+	pkt[33] = flags
+	copy(pkt[40:], payload)
+	return pkt
+}
+
+func readTap(t *testing.T, path string) ([][]byte, []byte) {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := pcapgo.NewNgReader(bytes.NewReader(data), pcapgo.DefaultNgReaderOptions)
+	if err != nil {
+		t.Fatalf("not a pcapng file: %v", err)
+	}
+	if r.LinkType() != layers.LinkTypeRaw {
+		t.Errorf("link type %v, want raw", r.LinkType())
+	}
+	var pkts [][]byte
+	for {
+		p, _, err := r.ReadPacketData()
+		if err != nil {
+			break
+		}
+		pkts = append(pkts, p)
+	}
+	return pkts, data
+}
+
+func TestTapRecordsFlow(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tap.pcapng")
+	if err := StartTap(path, TapOptions{Domain: "example.com"}); err != nil {
+		t.Fatal(err)
+	}
+
+	hello := bytes.Repeat([]byte{0x16}, 100)
+	orig := tcpPacket(64, 0x18, 1000, hello)
+	TapOriginal(orig, "www.example.com", "main", "frag=tcp")
+	TapSent(tcpPacket(3, 0x18, 1000, bytes.Repeat([]byte{0xaa}, 100)))
+	TapSent(tcpPacket(64, 0x18, 1000, hello[:10]))
+	TapSent(tcpPacket(64, 0x18, 1010, hello[10:]))
+
+	// Other domains and unrelated flows are left out
+	TapOriginal(tcpPacket(64, 0x18, 5, hello), "other.org", "main", "frag=tcp")
+	other := tcpPacket(64, 0x18, 1000, hello)
+	binary.BigEndian.PutUint16(other[20:22], 40001)
+	TapSent(other)
+
+	status := StopTap()
+	if status.Active || status.Packets != 4 {
+		t.Fatalf("status %+v, want 4 packets and inactive", status)
+	}
+	if TapEnabled() {
+		t.Fatal("tap still enabled after stop")
+	}
+
+	pkts, data := readTap(t, path)
+	if len(pkts) != 4 {
+		t.Fatalf("read %d packets, want 4", len(pkts))
+	}
+	if !bytes.Equal(pkts[0], orig) {
+		t.Error("first packet is not the original")
+	}
+	for _, c := range []string{`role=original set="main" strategy="frag=tcp" domain=www.example.com`, "role=fake", "role=segment"} {
+		if !bytes.Contains(data, []byte(c)) {
+			t.Errorf("comment %q not found", c)
+		}
+	}
+}
+
+func TestTapIPFilter(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tap.pcapng")
+	if err := StartTap(path, TapOptions{IP: "1.2.3.0/24"}); err != nil {
+		t.Fatal(err)
+	}
+	pkt := tcpPacket(64, 0x18, 1, []byte("x"))
+	TapOriginal(pkt, "", "main", "")
+	binary.BigEndian.PutUint32(pkt[16:20], 0x05060708)
+	TapOriginal(pkt, "", "main", "")
+	if s := StopTap(); s.Packets != 1 {
+		t.Errorf("recorded %d packets, want 1", s.Packets)
+	}
+
+	if err := StartTap(path, TapOptions{IP: "not-an-ip"}); err == nil {
+		StopTap()
+		t.Error("invalid IP filter accepted")
+	}
+}
+
+func TestTapSizeLimit(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tap.pcapng")
+	if err := StartTap(path, TapOptions{MaxBytes: 1024}); err != nil {
+		t.Fatal(err)
+	}
+	pkt := tcpPacket(64, 0x18, 1, bytes.Repeat([]byte{1}, 300))
+	for i := 0; i < 10; i++ {
+		TapOriginal(pkt, "", "main", "")
+	}
+	s := GetTapStatus()
+	if !s.Truncated || s.Active || s.Bytes > 1024 {
+		t.Errorf("status %+v, want truncated below 1024 bytes", s)
+	}
+	StopTap()
+
+	if pkts, _ := readTap(t, path); len(pkts) != s.Packets {
+		t.Errorf("file has %d packets, status says %d", len(pkts), s.Packets)
+	}
+}
+
+func TestPacketRole(t *testing.T) {
+	payload := []byte("0123456789")
+	orig := tcpPacket(64, 0x18, 100, payload)
+
+	frag := append([]byte(nil), orig...)
+	binary.BigEndian.PutUint16(frag[6:8], 0x2000) // MF
+
+	reply := tcpPacket(64, 0x18, 0, payload)
+	copy(reply[12:16], []byte{1, 2, 3, 4})
+	copy(reply[16:20], []byte{10, 0, 0, 2})
+
+	tests := []struct {
+		name string
+		sent []byte
+		want string
+	}{
+		{"unchanged", orig, "original"},
+		{"segment", tcpPacket(64, 0x18, 104, payload[4:]), "segment"},
+		{"low ttl copy", tcpPacket(3, 0x18, 100, payload), "fake"},
+		{"other payload", tcpPacket(64, 0x18, 100, []byte("abcdefghij")), "fake"},
+		{"rst", tcpPacket(3, 0x14, 100, nil), "desync-rst"},
+		{"ack", tcpPacket(64, 0x10, 100, nil), "ack"},
+		{"ip fragment", frag, "ip-fragment"},
+		{"reply", reply, "reply"},
+	}
+	for _, tt := range tests {
+		if got := PacketRole(orig, tt.sent); got != tt.want {
+			t.Errorf("%s: role %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
@@ -21,6 +21,8 @@ func (c *Config) BindFlags(cmd *cobra.Command) {
 	cmd.Flags().BoolVarP(&c.System.Logging.Instaflush, "instaflush", "i", c.System.Logging.Instaflush, "Flush logs immediately")
 	cmd.Flags().BoolVar(&c.System.Logging.Syslog, "syslog", c.System.Logging.Syslog, "Enable syslog output")
 	cmd.Flags().StringVar(&c.System.Logging.ErrorFile, "error-file", c.System.Logging.ErrorFile, "Path to error log file (empty disables)")
+	cmd.Flags().BoolVar(&c.System.Logging.Connections.Enabled, "connection-log", c.System.Logging.Connections.Enabled, "Keep a history of connection decisions")
+	cmd.Flags().StringVar(&c.System.Logging.Connections.Dir, "connection-log-dir", c.System.Logging.Connections.Dir, "Directory of the connection history")
 
 	// Web Server configuration
 	cmd.Flags().IntVar(&c.System.WebServer.Port, "web-port", c.System.WebServer.Port, "Port for internal web server (0 disables)")
@@ -29,6 +29,11 @@ var DefaultSetConfig = SetConfig{
 		FakeSeqLength:  6,
 		FakeLen:        64,
 		FakingStrategy: "none",
+		FakePayload:    "zero",
+		FakeSNI:        "www.google.com",
+		SplitMode:      "ip",
+		CryptoFrames:   4,
+		ShuffleMode:    "reverse",
 		DPortFilter:    "",
 		FilterQUIC:     "disabled",
 		FilterSTUN:     true,
@@ -74,8 +79,20 @@ var DefaultSetConfig = SetConfig{
 
 	DNS: DNSConfig{
 		Enabled:       false,
+		Mode:          "redirect",
 		FragmentQuery: false,
 		TargetDNS:     "",
+		Upstream:      "https://1.1.1.1/dns-query",
+	},
+
+	HTTP: HTTPConfig{
+		Enabled:     false,
+		HostCase:    false,
+		ExtraSpace:  false,
+		SplitHost:   true,
+		FakeRequest: true,
+		FakeTTL:     7,
+		FakeHost:    "ya.ru",
 	},
 
 	Fragmentation: FragmentationConfig{
@@ -135,6 +152,30 @@ var DefaultSetConfig = SetConfig{
 		IPs:               []string{},
 		GeoSiteCategories: []string{},
 		GeoIpCategories:   []string{},
+		Devices:           []string{},
+		Subscriptions:     []ListSubscription{},
+	},
+
+	Schedule: ScheduleConfig{
+		Enabled:  false,
+		Timezone: "",
+		Windows:  []ScheduleWindow{},
+	},
+
+	Fallback: FallbackConfig{
+		Enabled:     false,
+		Variants:    []StrategyVariant{},
+		MaxFailures: 3,
+		TimeoutMs:   3000,
+		TTLMinutes:  60,
+	},
+
+	Health: HealthCheckConfig{
+		Enabled:          false,
+		URL:              "",
+		IntervalMinutes:  30,
+		FailureThreshold: 3,
+		AutoDiscover:     false,
 	},
 }
 
@@ -166,17 +207,34 @@ var DefaultConfig = Config{
 			GeoIpPath:   "",
 			GeoSiteURL:  "",
 			GeoIpURL:    "",
+
+			GeoSiteChecksumURL:  "",
+			GeoIpChecksumURL:    "",
+			AutoUpdate:          true,
+			UpdateIntervalHours: 24,
 		},
 
 		Tables: TablesConfig{
 			MonitorInterval: 10,
 			SkipSetup:       false,
+			IPSets: IPSetsConfig{
+				Enabled:     false,
+				TargetsOnly: false,
+				QueueAll:    false,
+			},
 		},
 
 		WebServer: WebServerConfig{
 			Port:        7000,
 			BindAddress: "0.0.0.0",
 			IsEnabled:   true,
+			Auth: AuthConfig{
+				Enabled:         false,
+				SessionTTLHours: 24,
+				Users:           []AuthUser{},
+				Tokens:          []AuthToken{},
+			},
+			AllowedOrigins: []string{},
 		},
 
 		Logging: Logging{
@@ -184,6 +242,12 @@ var DefaultConfig = Config{
 			Instaflush: true,
 			Syslog:     false,
 			ErrorFile:  "/var/log/b4/errors.log",
+			Connections: ConnectionLogConfig{
+				Enabled:   true,
+				Dir:       "/var/log/b4",
+				MaxSizeMB: 4,
+				MaxFiles:  4,
+			},
 		},
 
 		Checker: DiscoveryConfig{
@@ -192,6 +256,7 @@ var DefaultConfig = Config{
 			ReferenceDomain:     "yandex.ru",
 			ReferenceDNS:        []string{"9.9.9.9", "1.1.1.1", "8.8.8.8", "9.9.1.1", "8.8.4.4"},
 			ValidationTries:     1,
+			ProbeMark:           1 << 14,
 		},
 		API: ApiConfig{
 			IPInfoToken: "",
@@ -208,6 +273,10 @@ func NewSetConfig() SetConfig {
 	cfg.Targets.IPs = append(make([]string, 0), DefaultSetConfig.Targets.IPs...)
 	cfg.Targets.GeoSiteCategories = append(make([]string, 0), DefaultSetConfig.Targets.GeoSiteCategories...)
 	cfg.Targets.GeoIpCategories = append(make([]string, 0), DefaultSetConfig.Targets.GeoIpCategories...)
+	cfg.Targets.Devices = append(make([]string, 0), DefaultSetConfig.Targets.Devices...)
+	cfg.Targets.Subscriptions = append(make([]ListSubscription, 0), DefaultSetConfig.Targets.Subscriptions...)
+	cfg.Schedule.Windows = append(make([]ScheduleWindow, 0), DefaultSetConfig.Schedule.Windows...)
+	cfg.Fallback.Variants = append(make([]StrategyVariant, 0), DefaultSetConfig.Fallback.Variants...)
 	cfg.Fragmentation.Combo.DecoySNIs = append(make([]string, 0), DefaultSetConfig.Fragmentation.Combo.DecoySNIs...)
 	cfg.Fragmentation.SeqOverlapPattern = append(make([]string, 0), DefaultSetConfig.Fragmentation.SeqOverlapPattern...)
 	cfg.Faking.TLSMod = append(make([]string, 0), DefaultSetConfig.Faking.TLSMod...)
@@ -0,0 +1,68 @@
+package config
+
+import "time"
+
+func (f *FallbackConfig) normalize() {
+	if f.Variants == nil {
+		f.Variants = []StrategyVariant{}
+	}
+	if f.MaxFailures < 1 {
+		f.MaxFailures = DefaultSetConfig.Fallback.MaxFailures
+	}
+	if f.TimeoutMs <= 0 {
+		f.TimeoutMs = DefaultSetConfig.Fallback.TimeoutMs
+	}
+	if f.TTLMinutes <= 0 {
+		f.TTLMinutes = DefaultSetConfig.Fallback.TTLMinutes
+	}
+}
+
+// Timeout is how long a ClientHello may go unanswered before it counts as
+// a failure.
+func (f *FallbackConfig) Timeout() time.Duration {
+	return time.Duration(f.TimeoutMs) * time.Millisecond
+}
+
+// TTL is how long a domain stays on the variant it was moved to.
+func (f *FallbackConfig) TTL() time.Duration {
+	return time.Duration(f.TTLMinutes) * time.Minute
+}
+
+// Chain returns the set itself followed by one derived set per fallback
+// variant. The derived sets share everything but the overridden fields with
+// the original and must be treated as read-only.
+func (set *SetConfig) Chain() []*SetConfig {
+	chain := []*SetConfig{set}
+	if !set.Fallback.Enabled {
+		return chain
+	}
+	for _, v := range set.Fallback.Variants {
+		chain = append(chain, set.withVariant(v))
+	}
+	return chain
+}
+
+func (set *SetConfig) withVariant(v StrategyVariant) *SetConfig {
+	derived := *set
+
+	if v.Strategy != "" {
+		derived.Fragmentation.Strategy = v.Strategy
+	}
+	if v.SNIPosition > 0 {
+		derived.Fragmentation.SNIPosition = v.SNIPosition
+	}
+	derived.Fragmentation.MiddleSNI = v.MiddleSNI
+	derived.Fragmentation.ReverseOrder = v.ReverseOrder
+
+	derived.Faking.SNI = v.FakeSNI
+	if v.FakeSNI && derived.Faking.SNISeqLength < 1 {
+		derived.Faking.SNISeqLength = 1
+	}
+	if v.FakeStrategy != "" {
+		derived.Faking.Strategy = v.FakeStrategy
+	}
+	if v.FakeTTL > 0 {
+		derived.Faking.TTL = v.FakeTTL
+	}
+	return &derived
+}
@@ -0,0 +1,54 @@
+package config
+
+import "testing"
+
+func TestSetChain(t *testing.T) {
+	set := NewSetConfig()
+	set.Fragmentation.Strategy = "combo"
+	set.Faking.Strategy = "pastseq"
+	set.Faking.TTL = 7
+
+	if chain := set.Chain(); len(chain) != 1 || chain[0] != &set {
+		t.Fatalf("disabled fallback should only return the set itself, got %d", len(chain))
+	}
+
+	set.Fallback.Enabled = true
+	set.Fallback.Variants = []StrategyVariant{
+		{Strategy: "disorder", MiddleSNI: true},
+		{FakeSNI: true, FakeStrategy: "ttl", FakeTTL: 3},
+	}
+
+	chain := set.Chain()
+	if len(chain) != 3 {
+		t.Fatalf("expected 3 chain entries, got %d", len(chain))
+	}
+	if chain[1].Fragmentation.Strategy != "disorder" || !chain[1].Fragmentation.MiddleSNI {
+		t.Errorf("variant 1 did not override fragmentation: %+v", chain[1].Fragmentation)
+	}
+	if chain[1].Faking.SNI {
+		t.Error("variant 1 should not send a fake SNI")
+	}
+	if chain[2].Fragmentation.Strategy != "combo" {
+		t.Errorf("variant 2 should keep the set strategy, got %s", chain[2].Fragmentation.Strategy)
+	}
+	if !chain[2].Faking.SNI || chain[2].Faking.Strategy != "ttl" || chain[2].Faking.TTL != 3 {
+		t.Errorf("variant 2 did not override faking: %+v", chain[2].Faking)
+	}
+	if set.Fragmentation.Strategy != "combo" || set.Faking.TTL != 7 {
+		t.Error("deriving variants must not modify the set")
+	}
+}
+
+func TestFallbackNormalize(t *testing.T) {
+	f := FallbackConfig{}
+	f.normalize()
+
+	if f.Variants == nil {
+		t.Error("variants should be initialized")
+	}
+	if f.MaxFailures != DefaultSetConfig.Fallback.MaxFailures ||
+		f.TimeoutMs != DefaultSetConfig.Fallback.TimeoutMs ||
+		f.TTLMinutes != DefaultSetConfig.Fallback.TTLMinutes {
+		t.Errorf("expected defaults, got %+v", f)
+	}
+}
@@ -0,0 +1,55 @@
+package config
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/daniellavrushin/b4/sni/domainrule"
+)
+
+func (h *HealthCheckConfig) normalize() {
+	h.URL = strings.TrimSpace(h.URL)
+	if h.IntervalMinutes <= 0 {
+		h.IntervalMinutes = DefaultSetConfig.Health.IntervalMinutes
+	}
+	if h.FailureThreshold < 1 {
+		h.FailureThreshold = DefaultSetConfig.Health.FailureThreshold
+	}
+}
+
+func (h *HealthCheckConfig) validate(set *SetConfig) error {
+	if !h.Enabled {
+		return nil
+	}
+	probe := set.HealthProbeURL()
+	if probe == "" {
+		return fmt.Errorf("set '%s': health check needs a probe URL or a domain target", set.Name)
+	}
+	u, err := url.Parse(probe)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("set '%s': invalid health check URL %q", set.Name, probe)
+	}
+	return nil
+}
+
+// Interval is the time between two health checks of the set.
+func (h *HealthCheckConfig) Interval() time.Duration {
+	return time.Duration(h.IntervalMinutes) * time.Minute
+}
+
+// HealthProbeURL is the URL fetched by the set's health check, the first
+// domain target when none is configured. Keyword and regexp targets have no
+// host to fetch.
+func (set *SetConfig) HealthProbeURL() string {
+	if set.Health.URL != "" {
+		return set.Health.URL
+	}
+	for _, d := range set.Targets.SNIDomains {
+		if host, ok := domainrule.Host(d); ok {
+			return "https://" + host + "/"
+		}
+	}
+	return ""
+}
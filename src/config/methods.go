@@ -3,13 +3,17 @@ package config
 import (
 	"encoding/json"
 	"fmt"
+	"net/url"
 	"os"
 	"path/filepath"
+	"slices"
 	"sort"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/daniellavrushin/b4/geodat"
+	"github.com/daniellavrushin/b4/lists"
 	"github.com/daniellavrushin/b4/log"
 	"github.com/daniellavrushin/b4/utils"
 )
@@ -110,6 +114,48 @@ func (c *Config) Validate() error {
 		}
 	}
 
+	origins := make([]string, 0, len(c.System.WebServer.AllowedOrigins))
+	for _, o := range c.System.WebServer.AllowedOrigins {
+		o = strings.TrimSuffix(strings.ToLower(strings.TrimSpace(o)), "/")
+		if o == "" {
+			continue
+		}
+		u, err := url.Parse(o)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || u.Path != "" {
+			return fmt.Errorf("invalid allowed origin %q, expected scheme://host[:port]", o)
+		}
+		origins = append(origins, o)
+	}
+	c.System.WebServer.AllowedOrigins = origins
+
+	conns := &c.System.Logging.Connections
+	if conns.MaxSizeMB <= 0 {
+		conns.MaxSizeMB = DefaultConfig.System.Logging.Connections.MaxSizeMB
+	}
+	if conns.MaxFiles <= 0 {
+		conns.MaxFiles = DefaultConfig.System.Logging.Connections.MaxFiles
+	}
+	if conns.Enabled && conns.Dir == "" {
+		return fmt.Errorf("connection log is enabled but no directory is set")
+	}
+
+	if c.System.Geo.UpdateIntervalHours <= 0 {
+		c.System.Geo.UpdateIntervalHours = DefaultConfig.System.Geo.UpdateIntervalHours
+	}
+
+	auth := &c.System.WebServer.Auth
+	if auth.SessionTTLHours <= 0 {
+		auth.SessionTTLHours = DefaultConfig.System.WebServer.Auth.SessionTTLHours
+	}
+	if auth.Enabled && len(auth.Users) == 0 {
+		return fmt.Errorf("web server auth is enabled but no users are configured")
+	}
+	for i := range auth.Tokens {
+		if auth.Tokens[i].Scope != AuthScopeFull {
+			auth.Tokens[i].Scope = AuthScopeRead
+		}
+	}
+
 	c.MainSet = nil
 	for _, set := range c.Sets {
 		if set.Id == MAIN_SET_ID {
@@ -147,16 +193,75 @@ func (c *Config) Validate() error {
 			}
 		}
 
-		if set.Id == MAIN_SET_ID {
-			continue
+		if err := set.Schedule.validate(set.Name); err != nil {
+			return err
 		}
-		if set.TCP.ConnBytesLimit > c.MainSet.TCP.ConnBytesLimit {
-			set.TCP.ConnBytesLimit = c.MainSet.TCP.ConnBytesLimit
+
+		for i := range set.Targets.Subscriptions {
+			sub := &set.Targets.Subscriptions[i]
+			sub.URL = strings.TrimSpace(sub.URL)
+			if sub.URL == "" {
+				return fmt.Errorf("set '%s': list subscription has no URL or path", set.Name)
+			}
+			if sub.Format == "" {
+				sub.Format = lists.FormatPlain
+			}
+			if !slices.Contains(lists.Formats, sub.Format) {
+				return fmt.Errorf("set '%s': unknown list format %q", set.Name, sub.Format)
+			}
+			if sub.IntervalHours <= 0 {
+				sub.IntervalHours = DefaultListIntervalHours
+			}
 		}
-		if set.UDP.ConnBytesLimit > c.MainSet.UDP.ConnBytesLimit {
-			set.UDP.ConnBytesLimit = c.MainSet.UDP.ConnBytesLimit
+
+		// With targets_only the firewall queues nothing but traffic to the
+		// kernel IP sets, so a set matching domains alone only sees the
+		// connections whose IPs were learned from a plain DNS answer
+		if ipSets := c.System.Tables.IPSets; ipSets.Enabled && ipSets.TargetsOnly && set.Enabled &&
+			(len(set.Targets.SNIDomains) > 0 || len(set.Targets.GeoSiteCategories) > 0) &&
+			len(set.Targets.IPs) == 0 && len(set.Targets.GeoIpCategories) == 0 && len(set.Targets.Subscriptions) == 0 {
+			return fmt.Errorf("set '%s' targets only domains, which ip_sets.targets_only does not queue; add IP targets or turn targets_only off", set.Name)
 		}
 
+		set.Fallback.normalize()
+
+		set.Health.normalize()
+		if err := set.Health.validate(set); err != nil {
+			return err
+		}
+
+		if set.UDP.FakePayload == "" {
+			set.UDP.FakePayload = DefaultSetConfig.UDP.FakePayload
+		}
+		if set.UDP.FakePayload == "quic_initial" && set.UDP.FakeSNI == "" {
+			set.UDP.FakeSNI = DefaultSetConfig.UDP.FakeSNI
+		}
+
+		if set.UDP.SplitMode == "" {
+			set.UDP.SplitMode = DefaultSetConfig.UDP.SplitMode
+		}
+		if set.UDP.CryptoFrames < 2 {
+			set.UDP.CryptoFrames = DefaultSetConfig.UDP.CryptoFrames
+		}
+
+		if set.DNS.Mode == "" {
+			set.DNS.Mode = DefaultSetConfig.DNS.Mode
+		}
+		if set.DNS.Enabled && set.DNS.Mode == "forward" {
+			u, err := url.Parse(set.DNS.Upstream)
+			if err != nil || (u.Scheme != "https" && u.Scheme != "tls") || u.Host == "" {
+				return fmt.Errorf("set '%s': DNS upstream must be an https:// (DoH) or tls:// (DoT) URL", set.Name)
+			}
+		}
+
+		if set.HTTP.Enabled && set.HTTP.FakeRequest {
+			if set.HTTP.FakeTTL == 0 {
+				set.HTTP.FakeTTL = DefaultSetConfig.HTTP.FakeTTL
+			}
+			if set.HTTP.FakeHost == "" {
+				set.HTTP.FakeHost = DefaultSetConfig.HTTP.FakeHost
+			}
+		}
 	}
 
 	if len(c.MainSet.Targets.GeoSiteCategories) > 0 && c.System.Geo.GeoSitePath == "" {
@@ -175,6 +280,13 @@ func (c *Config) Validate() error {
 		return fmt.Errorf("queue-num must be between 0 and 65535")
 	}
 
+	if c.System.Checker.ProbeMark == 0 {
+		c.System.Checker.ProbeMark = DefaultConfig.System.Checker.ProbeMark
+	}
+	if c.System.Checker.ProbeMark&c.Queue.Mark != 0 {
+		return fmt.Errorf("discovery probe mark 0x%x overlaps queue mark 0x%x", c.System.Checker.ProbeMark, c.Queue.Mark)
+	}
+
 	if len(c.Sets) >= 1 {
 		for _, set := range c.Sets {
 			if set.Id == "" {
@@ -260,6 +372,8 @@ func (c *Config) GetTargetsForSetWithCache(set *SetConfig, geositeDomains, geoip
 	if len(set.Targets.SNIDomains) > 0 {
 		domains = append(domains, set.Targets.SNIDomains...)
 	}
+	subDomains, subIps := c.SubscriptionTargets(set)
+	domains = append(domains, subDomains...)
 	set.Targets.DomainsToMatch = domains
 
 	if len(set.Targets.GeoIpCategories) > 0 && c.System.Geo.GeoIpPath != "" {
@@ -284,11 +398,60 @@ func (c *Config) GetTargetsForSetWithCache(set *SetConfig, geositeDomains, geoip
 	if len(set.Targets.IPs) > 0 {
 		ips = append(ips, set.Targets.IPs...)
 	}
+	ips = append(ips, subIps...)
 
 	set.Targets.IpsToMatch = ips
 	return domains, ips, nil
 }
 
+// SubscriptionTargets returns the domains and IPs of the lists a set
+// subscribes to, as last downloaded. Lists are never fetched here.
+func (c *Config) SubscriptionTargets(set *SetConfig) ([]string, []string) {
+	var domains, ips []string
+	for _, sub := range set.Targets.Subscriptions {
+		d, i := lists.Load(c.ListsDir(), sub.URL, sub.Format)
+		domains = append(domains, d...)
+		ips = append(ips, i...)
+	}
+	return domains, ips
+}
+
+// ListSubscriptions returns the lists subscribed to by enabled sets.
+func (c *Config) ListSubscriptions() []lists.Subscription {
+	var subs []lists.Subscription
+	for _, set := range c.Sets {
+		if !set.Enabled {
+			continue
+		}
+		for _, sub := range set.Targets.Subscriptions {
+			subs = append(subs, lists.Subscription{
+				URL:      sub.URL,
+				Format:   sub.Format,
+				Interval: time.Duration(sub.IntervalHours) * time.Hour,
+			})
+		}
+	}
+	return subs
+}
+
+// GeoUpdateSettings returns the geodata auto-update settings.
+func (c *Config) GeoUpdateSettings() geodat.UpdateSettings {
+	geo := c.System.Geo
+	return geodat.UpdateSettings{
+		Enabled:            geo.AutoUpdate,
+		Interval:           time.Duration(geo.UpdateIntervalHours) * time.Hour,
+		GeoSiteURL:         geo.GeoSiteURL,
+		GeoSiteChecksumURL: geo.GeoSiteChecksumURL,
+		GeoIpURL:           geo.GeoIpURL,
+		GeoIpChecksumURL:   geo.GeoIpChecksumURL,
+	}
+}
+
+// ListsDir is where downloaded list subscriptions are cached.
+func (c *Config) ListsDir() string {
+	return filepath.Join(filepath.Dir(c.ConfigPath), "lists")
+}
+
 func (c *Config) GetSetById(id string) *SetConfig {
 	for _, set := range c.Sets {
 		if set.Id == id {
@@ -400,6 +563,61 @@ func (cfg *Config) CollectUDPPorts() []string {
 	return ports
 }
 
+// HasHTTPSets reports whether any enabled set handles plain HTTP.
+// Used to decide whether port 80 needs to be queued.
+func (cfg *Config) HasHTTPSets() bool {
+	for _, set := range cfg.Sets {
+		if set.Enabled && set.HTTP.Enabled {
+			return true
+		}
+	}
+	return false
+}
+
+// MaxConnBytesLimits returns the largest TCP and UDP packet limits across
+// enabled sets. The firewall queues that many packets of every connection;
+// the workers enforce each set's own limit per flow.
+func (cfg *Config) MaxConnBytesLimits() (tcp, udp int) {
+	if cfg.MainSet != nil {
+		tcp = cfg.MainSet.TCP.ConnBytesLimit
+		udp = cfg.MainSet.UDP.ConnBytesLimit
+	}
+	for _, set := range cfg.Sets {
+		if !set.Enabled {
+			continue
+		}
+		if set.TCP.ConnBytesLimit > tcp {
+			tcp = set.TCP.ConnBytesLimit
+		}
+		if set.UDP.ConnBytesLimit > udp {
+			udp = set.UDP.ConnBytesLimit
+		}
+	}
+	return
+}
+
+// CollectTargetIPs returns the IPv4 and IPv6 IPs/CIDRs targeted by enabled sets.
+// Used to fill the kernel target IP sets.
+func (cfg *Config) CollectTargetIPs() (ipv4 []string, ipv6 []string) {
+	for _, set := range cfg.Sets {
+		if !set.Enabled {
+			continue
+		}
+		for _, ipStr := range set.Targets.IpsToMatch {
+			ipStr = strings.TrimSpace(ipStr)
+			if ipStr == "" {
+				continue
+			}
+			if strings.Contains(ipStr, ":") {
+				ipv6 = append(ipv6, ipStr)
+			} else {
+				ipv4 = append(ipv4, ipStr)
+			}
+		}
+	}
+	return
+}
+
 // CollectDuplicateIPs returns IPv4 and IPv6 IPs/CIDRs from sets with duplication enabled.
 // Used for firewall rules that queue packets without connbytes limit.
 func (cfg *Config) CollectDuplicateIPs() (ipv4 []string, ipv6 []string) {
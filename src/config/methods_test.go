@@ -115,6 +115,14 @@ func TestValidate(t *testing.T) {
 		}
 	})
 
+	t.Run("probe mark overlapping queue mark", func(t *testing.T) {
+		cfg := NewConfig()
+		cfg.System.Checker.ProbeMark = cfg.Queue.Mark
+		if err := cfg.Validate(); err == nil {
+			t.Error("expected error for probe mark sharing bits with queue mark")
+		}
+	})
+
 	t.Run("geosite categories without path", func(t *testing.T) {
 		cfg := NewConfig()
 		mainSet := NewSetConfig()
@@ -174,39 +182,24 @@ func TestValidate(t *testing.T) {
 		}
 	})
 
-	t.Run("set TCP ConnBytesLimit > main gets capped", func(t *testing.T) {
+	t.Run("set ConnBytesLimit above main is kept", func(t *testing.T) {
 		cfg := NewConfig()
 		cfg.Validate()
 
 		secondSet := NewSetConfig()
 		secondSet.Id = "second"
 		secondSet.TCP.ConnBytesLimit = cfg.MainSet.TCP.ConnBytesLimit + 10
-		cfg.Sets = append(cfg.Sets, &secondSet)
-
-		if err := cfg.Validate(); err != nil {
-			t.Fatalf("unexpected error: %v", err)
-		}
-		if secondSet.TCP.ConnBytesLimit != cfg.MainSet.TCP.ConnBytesLimit {
-			t.Errorf("expected TCP ConnBytesLimit to be capped to %d, got %d",
-				cfg.MainSet.TCP.ConnBytesLimit, secondSet.TCP.ConnBytesLimit)
-		}
-	})
-
-	t.Run("set UDP ConnBytesLimit > main gets capped", func(t *testing.T) {
-		cfg := NewConfig()
-		cfg.Validate()
-
-		secondSet := NewSetConfig()
-		secondSet.Id = "second"
 		secondSet.UDP.ConnBytesLimit = cfg.MainSet.UDP.ConnBytesLimit + 10
 		cfg.Sets = append(cfg.Sets, &secondSet)
 
 		if err := cfg.Validate(); err != nil {
 			t.Fatalf("unexpected error: %v", err)
 		}
-		if secondSet.UDP.ConnBytesLimit != cfg.MainSet.UDP.ConnBytesLimit {
-			t.Errorf("expected UDP ConnBytesLimit to be capped to %d, got %d",
-				cfg.MainSet.UDP.ConnBytesLimit, secondSet.UDP.ConnBytesLimit)
+		if secondSet.TCP.ConnBytesLimit != cfg.MainSet.TCP.ConnBytesLimit+10 {
+			t.Errorf("TCP ConnBytesLimit should not be capped, got %d", secondSet.TCP.ConnBytesLimit)
+		}
+		if secondSet.UDP.ConnBytesLimit != cfg.MainSet.UDP.ConnBytesLimit+10 {
+			t.Errorf("UDP ConnBytesLimit should not be capped, got %d", secondSet.UDP.ConnBytesLimit)
 		}
 	})
 	t.Run("set without id fails", func(t *testing.T) {
@@ -362,6 +355,110 @@ func TestGetTargetsForSet(t *testing.T) {
 			t.Errorf("expected 2 ips, got %d", len(ips))
 		}
 	})
+
+	t.Run("adds subscribed lists", func(t *testing.T) {
+		dir := t.TempDir()
+		listPath := filepath.Join(dir, "list.txt")
+		if err := os.WriteFile(listPath, []byte("sub.com\n9.9.9.9\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		cfg := NewConfig()
+		cfg.ConfigPath = filepath.Join(dir, "b4.json")
+		set := NewSetConfig()
+		set.Targets.SNIDomains = []string{"a.com"}
+		set.Targets.Subscriptions = []ListSubscription{{URL: listPath, Format: "plain"}}
+		set.Targets.Subscriptions = append(set.Targets.Subscriptions,
+			ListSubscription{URL: "https://example.com/never-fetched.txt", Format: "plain"})
+
+		domains, ips, err := cfg.GetTargetsForSet(&set)
+		if err != nil {
+			t.Fatalf("GetTargetsForSet failed: %v", err)
+		}
+
+		if len(domains) != 2 || domains[1] != "sub.com" {
+			t.Errorf("expected manual and subscribed domains, got %v", domains)
+		}
+		if len(ips) != 1 || ips[0] != "9.9.9.9" {
+			t.Errorf("expected subscribed ip, got %v", ips)
+		}
+	})
+}
+
+func TestValidateSubscriptions(t *testing.T) {
+	cfg := NewConfig()
+	cfg.Sets = []*SetConfig{cfg.MainSet}
+	cfg.MainSet.Targets.Subscriptions = []ListSubscription{{URL: " /etc/b4/list.txt "}}
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("Validate failed: %v", err)
+	}
+	sub := cfg.MainSet.Targets.Subscriptions[0]
+	if sub.URL != "/etc/b4/list.txt" || sub.Format != "plain" || sub.IntervalHours != DefaultListIntervalHours {
+		t.Errorf("defaults not applied: %+v", sub)
+	}
+
+	cfg.MainSet.Targets.Subscriptions[0].Format = "hosts"
+	if err := cfg.Validate(); err == nil {
+		t.Error("expected error for unknown format")
+	}
+
+	cfg.MainSet.Targets.Subscriptions[0] = ListSubscription{Format: "plain"}
+	if err := cfg.Validate(); err == nil {
+		t.Error("expected error for missing URL")
+	}
+}
+
+func TestValidateAllowedOrigins(t *testing.T) {
+	cfg := NewConfig()
+	cfg.System.WebServer.AllowedOrigins = []string{" HTTPS://Dash.lan:8443/ ", ""}
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("Validate failed: %v", err)
+	}
+	if got := cfg.System.WebServer.AllowedOrigins; len(got) != 1 || got[0] != "https://dash.lan:8443" {
+		t.Errorf("origins not normalized: %v", got)
+	}
+
+	for _, o := range []string{"dash.lan", "ftp://dash.lan", "https://dash.lan/ui"} {
+		cfg.System.WebServer.AllowedOrigins = []string{o}
+		if err := cfg.Validate(); err == nil {
+			t.Errorf("expected error for origin %q", o)
+		}
+	}
+}
+
+func TestValidateHealthCheck(t *testing.T) {
+	cfg := NewConfig()
+	cfg.Sets = []*SetConfig{cfg.MainSet}
+	cfg.MainSet.Health = HealthCheckConfig{Enabled: true}
+	cfg.MainSet.Targets.SNIDomains = []string{"keyword:video", "full:www.example.com"}
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("Validate failed: %v", err)
+	}
+	health := cfg.MainSet.Health
+	if health.IntervalMinutes != DefaultSetConfig.Health.IntervalMinutes || health.FailureThreshold != DefaultSetConfig.Health.FailureThreshold {
+		t.Errorf("defaults not applied: %+v", health)
+	}
+	if got := cfg.MainSet.HealthProbeURL(); got != "https://www.example.com/" {
+		t.Errorf("expected probe URL from the first domain, got %q", got)
+	}
+
+	cfg.MainSet.Health.URL = " http://example.com/check "
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("Validate failed: %v", err)
+	}
+	if got := cfg.MainSet.HealthProbeURL(); got != "http://example.com/check" {
+		t.Errorf("expected configured probe URL, got %q", got)
+	}
+
+	cfg.MainSet.Health.URL = "ftp://example.com"
+	if err := cfg.Validate(); err == nil {
+		t.Error("expected error for non-HTTP probe URL")
+	}
+
+	cfg.MainSet.Health.URL = ""
+	cfg.MainSet.Targets.SNIDomains = []string{"regexp:^video"}
+	if err := cfg.Validate(); err == nil {
+		t.Error("expected error without a probe URL")
+	}
 }
 
 func TestLoadTargets(t *testing.T) {
@@ -457,3 +554,103 @@ func TestResetToDefaults(t *testing.T) {
 			DefaultSetConfig.Fragmentation.SNIPosition, set.Fragmentation.SNIPosition)
 	}
 }
+
+func TestHasHTTPSets(t *testing.T) {
+	cfg := NewConfig()
+	set := NewSetConfig()
+	cfg.Sets = []*SetConfig{&set}
+
+	if cfg.HasHTTPSets() {
+		t.Error("HTTP should be disabled by default")
+	}
+
+	set.HTTP.Enabled = true
+	if !cfg.HasHTTPSets() {
+		t.Error("expected HTTP set to be detected")
+	}
+
+	set.Enabled = false
+	if cfg.HasHTTPSets() {
+		t.Error("disabled sets should be ignored")
+	}
+}
+
+func TestMaxConnBytesLimits(t *testing.T) {
+	cfg := NewConfig()
+	cfg.MainSet.TCP.ConnBytesLimit = 19
+	cfg.MainSet.UDP.ConnBytesLimit = 8
+
+	tcp, udp := cfg.MaxConnBytesLimits()
+	if tcp != 19 || udp != 8 {
+		t.Errorf("expected main set limits 19/8, got %d/%d", tcp, udp)
+	}
+
+	set := NewSetConfig()
+	set.Id = "second"
+	set.TCP.ConnBytesLimit = 40
+	set.UDP.ConnBytesLimit = 3
+	cfg.Sets = append(cfg.Sets, &set)
+
+	tcp, udp = cfg.MaxConnBytesLimits()
+	if tcp != 40 || udp != 8 {
+		t.Errorf("expected 40/8, got %d/%d", tcp, udp)
+	}
+
+	set.Enabled = false
+	if tcp, _ = cfg.MaxConnBytesLimits(); tcp != 19 {
+		t.Errorf("disabled sets should be ignored, got %d", tcp)
+	}
+}
+
+func TestCollectTargetIPs(t *testing.T) {
+	cfg := NewConfig()
+	set := NewSetConfig()
+	set.Id = "second"
+	set.Targets.IpsToMatch = []string{"1.2.3.0/24", " ", "2001:db8::/32", "10.0.0.1"}
+	cfg.Sets = append(cfg.Sets, &set)
+
+	v4, v6 := cfg.CollectTargetIPs()
+	if len(v4) != 2 || v4[0] != "1.2.3.0/24" || v4[1] != "10.0.0.1" {
+		t.Errorf("unexpected IPv4 targets %v", v4)
+	}
+	if len(v6) != 1 || v6[0] != "2001:db8::/32" {
+		t.Errorf("unexpected IPv6 targets %v", v6)
+	}
+
+	set.Enabled = false
+	if v4, v6 = cfg.CollectTargetIPs(); len(v4)+len(v6) != 0 {
+		t.Errorf("disabled sets should be ignored, got %v %v", v4, v6)
+	}
+}
+
+func TestValidateTargetsOnly(t *testing.T) {
+	cfg := NewConfig()
+	cfg.Sets = []*SetConfig{cfg.MainSet}
+	cfg.System.Tables.IPSets.Enabled = true
+	cfg.System.Tables.IPSets.TargetsOnly = true
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("a set without targets should pass: %v", err)
+	}
+
+	cfg.MainSet.Targets.SNIDomains = []string{"example.com"}
+	if err := cfg.Validate(); err == nil {
+		t.Error("expected error for a domain-only set with targets_only")
+	}
+
+	cfg.MainSet.Targets.IPs = []string{"192.0.2.0/24"}
+	if err := cfg.Validate(); err != nil {
+		t.Errorf("a set with IP targets should pass: %v", err)
+	}
+
+	cfg.MainSet.Targets.IPs = nil
+	cfg.MainSet.Enabled = false
+	if err := cfg.Validate(); err != nil {
+		t.Errorf("disabled sets should be ignored: %v", err)
+	}
+
+	cfg.MainSet.Enabled = true
+	cfg.System.Tables.IPSets.TargetsOnly = false
+	if err := cfg.Validate(); err != nil {
+		t.Errorf("domain-only sets are fine without targets_only: %v", err)
+	}
+}
@@ -35,6 +35,148 @@ var migrationRegistry = map[int]MigrationFunc{
 	16: migrateV16to17,
 	17: migrateV17to18, // Add TCP packet duplication config
 	18: migrateV18to19, // Add TLS certificate/key to web server config
+	19: migrateV19to20, // Add plain HTTP evasion config
+	20: migrateV20to21, // Add discovery probe mark
+	21: migrateV21to22, // Add web server authentication
+	22: migrateV22to23, // Add kernel IP sets config
+	23: migrateV23to24, // Add device targets to sets
+	24: migrateV24to25, // Add set schedules
+	25: migrateV25to26, // Add strategy fallback chains
+	26: migrateV26to27, // Add encrypted QUIC Initial fakes
+	27: migrateV27to28, // Add QUIC CRYPTO splitting
+	28: migrateV28to29, // Add DoH/DoT DNS forwarding
+	29: migrateV29to30, // Add connection event log
+	30: migrateV30to31, // Add list subscriptions to sets
+	31: migrateV31to32, // Add geodata auto-update
+	32: migrateV32to33, // Add set health checks
+}
+
+func migrateV32to33(c *Config, _ map[string]interface{}) error {
+	log.Tracef("Migration v32->v33: Adding set health checks")
+
+	for _, set := range c.Sets {
+		set.Health = DefaultSetConfig.Health
+	}
+	return nil
+}
+
+func migrateV31to32(c *Config, _ map[string]interface{}) error {
+	log.Tracef("Migration v31->v32: Adding geodata auto-update")
+
+	c.System.Geo.AutoUpdate = DefaultConfig.System.Geo.AutoUpdate
+	c.System.Geo.UpdateIntervalHours = DefaultConfig.System.Geo.UpdateIntervalHours
+	return nil
+}
+
+func migrateV30to31(c *Config, _ map[string]interface{}) error {
+	log.Tracef("Migration v30->v31: Adding list subscriptions to sets")
+
+	for _, set := range c.Sets {
+		if set.Targets.Subscriptions == nil {
+			set.Targets.Subscriptions = []ListSubscription{}
+		}
+	}
+	return nil
+}
+
+func migrateV29to30(c *Config, _ map[string]interface{}) error {
+	log.Tracef("Migration v29->v30: Adding connection event log")
+
+	c.System.Logging.Connections = DefaultConfig.System.Logging.Connections
+	return nil
+}
+
+func migrateV28to29(c *Config, _ map[string]interface{}) error {
+	log.Tracef("Migration v28->v29: Adding DoH/DoT DNS forwarding")
+
+	for _, set := range c.Sets {
+		set.DNS.Mode = DefaultSetConfig.DNS.Mode
+		set.DNS.Upstream = DefaultSetConfig.DNS.Upstream
+	}
+	return nil
+}
+
+func migrateV27to28(c *Config, _ map[string]interface{}) error {
+	log.Tracef("Migration v27->v28: Adding QUIC CRYPTO splitting")
+
+	for _, set := range c.Sets {
+		set.UDP.SplitMode = DefaultSetConfig.UDP.SplitMode
+		set.UDP.CryptoFrames = DefaultSetConfig.UDP.CryptoFrames
+		set.UDP.ShuffleMode = DefaultSetConfig.UDP.ShuffleMode
+	}
+	return nil
+}
+
+func migrateV26to27(c *Config, _ map[string]interface{}) error {
+	log.Tracef("Migration v26->v27: Adding UDP fake payload type")
+
+	for _, set := range c.Sets {
+		set.UDP.FakePayload = DefaultSetConfig.UDP.FakePayload
+		set.UDP.FakeSNI = DefaultSetConfig.UDP.FakeSNI
+	}
+	return nil
+}
+
+func migrateV25to26(c *Config, _ map[string]interface{}) error {
+	log.Tracef("Migration v25->v26: Adding strategy fallback chains to sets")
+
+	for _, set := range c.Sets {
+		set.Fallback = DefaultSetConfig.Fallback
+		set.Fallback.Variants = []StrategyVariant{}
+	}
+	return nil
+}
+
+func migrateV24to25(c *Config, _ map[string]interface{}) error {
+	log.Tracef("Migration v24->v25: Adding set schedules")
+
+	for _, set := range c.Sets {
+		if set.Schedule.Windows == nil {
+			set.Schedule.Windows = []ScheduleWindow{}
+		}
+	}
+	return nil
+}
+
+func migrateV23to24(c *Config, _ map[string]interface{}) error {
+	log.Tracef("Migration v23->v24: Adding device targets to sets")
+
+	for _, set := range c.Sets {
+		if set.Targets.Devices == nil {
+			set.Targets.Devices = []string{}
+		}
+	}
+	return nil
+}
+
+func migrateV22to23(c *Config, _ map[string]interface{}) error {
+	log.Tracef("Migration v22->v23: Adding kernel IP sets config")
+
+	c.System.Tables.IPSets = DefaultConfig.System.Tables.IPSets
+	return nil
+}
+
+func migrateV21to22(c *Config, _ map[string]interface{}) error {
+	log.Tracef("Migration v21->v22: Adding web server authentication config")
+
+	c.System.WebServer.Auth = DefaultConfig.System.WebServer.Auth
+	return nil
+}
+
+func migrateV20to21(c *Config, _ map[string]interface{}) error {
+	log.Tracef("Migration v20->v21: Adding discovery probe mark")
+
+	c.System.Checker.ProbeMark = DefaultConfig.System.Checker.ProbeMark
+	return nil
+}
+
+func migrateV19to20(c *Config, _ map[string]interface{}) error {
+	log.Tracef("Migration v19->v20: Adding plain HTTP evasion config")
+
+	for _, set := range c.Sets {
+		set.HTTP = DefaultSetConfig.HTTP
+	}
+	return nil
 }
 
 func migrateV18to19(c *Config, _ map[string]interface{}) error {
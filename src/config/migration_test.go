@@ -86,4 +86,18 @@ func TestApplyMigrations(t *testing.T) {
 		}
 	})
 
+	t.Run("v19 to v20 adds http config", func(t *testing.T) {
+		cfg := NewConfig()
+		set := NewSetConfig()
+		set.HTTP = HTTPConfig{}
+		cfg.Sets = []*SetConfig{&set}
+
+		if err := cfg.applyMigrations(19, map[string]interface{}{}); err != nil {
+			t.Fatalf("migration failed: %v", err)
+		}
+		if cfg.Sets[0].HTTP != DefaultSetConfig.HTTP {
+			t.Error("v19->v20 should populate HTTP defaults")
+		}
+	})
+
 }
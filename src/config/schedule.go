@@ -0,0 +1,184 @@
+package config
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/daniellavrushin/b4/log"
+)
+
+// scheduleHorizon bounds the search for the next schedule transition. A
+// weekly schedule always changes state within eight days, or never.
+const scheduleHorizon = 8
+
+// ScheduleAllDays is the weekday mask covering the whole week.
+const ScheduleAllDays uint8 = 0x7f
+
+// Location returns the time zone the schedule is evaluated in. Unknown zones
+// fall back to the system local time.
+func (s *ScheduleConfig) Location() *time.Location {
+	if s.Timezone == "" {
+		return time.Local
+	}
+	loc, err := time.LoadLocation(s.Timezone)
+	if err != nil {
+		return time.Local
+	}
+	return loc
+}
+
+// ActiveAt reports whether t falls into one of the schedule windows. A
+// disabled schedule or one without windows never restricts the set.
+func (s *ScheduleConfig) ActiveAt(t time.Time) bool {
+	if !s.Enabled || len(s.Windows) == 0 {
+		return true
+	}
+	return s.activeIn(t, s.Location())
+}
+
+func (s *ScheduleConfig) activeIn(t time.Time, loc *time.Location) bool {
+	t = t.In(loc)
+	for _, w := range s.Windows {
+		// A window crossing midnight may have started the day before.
+		for back := 0; back <= 1; back++ {
+			start, end, ok := w.on(t.Year(), t.Month(), t.Day()-back, loc)
+			if ok && !t.Before(start) && t.Before(end) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// NextTransition returns the next time after t at which the schedule turns
+// the set on or off.
+func (s *ScheduleConfig) NextTransition(t time.Time) (time.Time, bool) {
+	if !s.Enabled || len(s.Windows) == 0 {
+		return time.Time{}, false
+	}
+
+	loc := s.Location()
+	lt := t.In(loc)
+
+	var bounds []time.Time
+	for day := -1; day <= scheduleHorizon; day++ {
+		for _, w := range s.Windows {
+			start, end, ok := w.on(lt.Year(), lt.Month(), lt.Day()+day, loc)
+			if !ok {
+				continue
+			}
+			if start.After(t) {
+				bounds = append(bounds, start)
+			}
+			if end.After(t) {
+				bounds = append(bounds, end)
+			}
+		}
+	}
+	sort.Slice(bounds, func(i, j int) bool { return bounds[i].Before(bounds[j]) })
+
+	active := s.activeIn(t, loc)
+	for _, b := range bounds {
+		if s.activeIn(b, loc) != active {
+			return b, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// on returns the window instance starting on the given day, if the window
+// applies to that weekday.
+func (w *ScheduleWindow) on(year int, month time.Month, day int, loc *time.Location) (time.Time, time.Time, bool) {
+	startMin, err := parseClock(w.Start)
+	if err != nil {
+		return time.Time{}, time.Time{}, false
+	}
+	endMin, err := parseClock(w.End)
+	if err != nil {
+		return time.Time{}, time.Time{}, false
+	}
+
+	start := time.Date(year, month, day, startMin/60, startMin%60, 0, 0, loc)
+	if w.Days != 0 && w.Days&(1<<uint(start.Weekday())) == 0 {
+		return time.Time{}, time.Time{}, false
+	}
+
+	endDay := day
+	if endMin <= startMin {
+		endDay++
+	}
+	end := time.Date(year, month, endDay, endMin/60, endMin%60, 0, 0, loc)
+	return start, end, true
+}
+
+func (w *ScheduleWindow) validate() error {
+	if _, err := parseClock(w.Start); err != nil {
+		return fmt.Errorf("invalid start: %w", err)
+	}
+	if _, err := parseClock(w.End); err != nil {
+		return fmt.Errorf("invalid end: %w", err)
+	}
+	if w.Days&^ScheduleAllDays != 0 {
+		return fmt.Errorf("invalid weekday mask 0x%x", w.Days)
+	}
+	return nil
+}
+
+// parseClock parses "HH:MM" into minutes after midnight.
+func parseClock(s string) (int, error) {
+	var h, m int
+	if n, err := fmt.Sscanf(s, "%d:%d", &h, &m); err != nil || n != 2 {
+		return 0, fmt.Errorf("%q is not HH:MM", s)
+	}
+	if h < 0 || h > 23 || m < 0 || m > 59 {
+		return 0, fmt.Errorf("%q is out of range", s)
+	}
+	return h*60 + m, nil
+}
+
+func (s *ScheduleConfig) validate(setName string) error {
+	if s.Timezone != "" {
+		if _, err := time.LoadLocation(s.Timezone); err != nil {
+			log.Warnf("Set '%s' schedule timezone %q not found, using local time", setName, s.Timezone)
+		}
+	}
+	for i := range s.Windows {
+		if err := s.Windows[i].validate(); err != nil {
+			return fmt.Errorf("set '%s' schedule window %d: %w", setName, i+1, err)
+		}
+	}
+	return nil
+}
+
+// ActiveAt reports whether the set is enabled and inside its schedule.
+func (set *SetConfig) ActiveAt(t time.Time) bool {
+	return set.Enabled && set.Schedule.ActiveAt(t)
+}
+
+// ActiveSets returns the sets that are enabled and scheduled at t.
+func (cfg *Config) ActiveSets(t time.Time) []*SetConfig {
+	active := make([]*SetConfig, 0, len(cfg.Sets))
+	for _, set := range cfg.Sets {
+		if set.ActiveAt(t) {
+			active = append(active, set)
+		}
+	}
+	return active
+}
+
+// NextScheduleTransition returns the earliest time after t at which any
+// enabled set changes its scheduled state.
+func (cfg *Config) NextScheduleTransition(t time.Time) (time.Time, bool) {
+	var next time.Time
+	found := false
+	for _, set := range cfg.Sets {
+		if !set.Enabled {
+			continue
+		}
+		if at, ok := set.Schedule.NextTransition(t); ok && (!found || at.Before(next)) {
+			next, found = at, true
+		}
+	}
+	return next, found
+}
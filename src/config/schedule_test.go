@@ -0,0 +1,131 @@
+package config
+
+import (
+	"testing"
+	"time"
+)
+
+func TestScheduleActiveAt(t *testing.T) {
+	weekdays := uint8(0x3e) // Mon-Fri
+	s := ScheduleConfig{
+		Enabled:  true,
+		Timezone: "UTC",
+		Windows: []ScheduleWindow{
+			{Days: weekdays, Start: "18:00", End: "23:00"},
+			{Days: 1 << uint(time.Saturday), Start: "22:00", End: "02:00"},
+		},
+	}
+
+	at := func(day, hour, min int) time.Time {
+		// 2024-06-03 is a Monday
+		return time.Date(2024, 6, 3+day, hour, min, 0, 0, time.UTC)
+	}
+
+	tests := []struct {
+		name string
+		t    time.Time
+		want bool
+	}{
+		{"monday before window", at(0, 17, 59), false},
+		{"monday window start", at(0, 18, 0), true},
+		{"monday window end", at(0, 23, 0), false},
+		{"saturday evening not a weekday", at(5, 19, 0), false},
+		{"saturday late", at(5, 23, 30), true},
+		{"sunday after midnight", at(6, 1, 59), true},
+		{"sunday window over", at(6, 2, 0), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := s.ActiveAt(tt.t); got != tt.want {
+				t.Errorf("ActiveAt(%v) = %v, want %v", tt.t, got, tt.want)
+			}
+		})
+	}
+
+	t.Run("disabled schedule is always active", func(t *testing.T) {
+		d := s
+		d.Enabled = false
+		if !d.ActiveAt(at(0, 3, 0)) {
+			t.Error("disabled schedule should not restrict the set")
+		}
+	})
+}
+
+func TestScheduleNextTransition(t *testing.T) {
+	s := ScheduleConfig{
+		Enabled:  true,
+		Timezone: "UTC",
+		Windows: []ScheduleWindow{
+			{Start: "08:00", End: "12:00"},
+			{Start: "12:00", End: "13:00"},
+		},
+	}
+
+	now := time.Date(2024, 6, 3, 7, 0, 0, 0, time.UTC)
+	next, ok := s.NextTransition(now)
+	if !ok || !next.Equal(time.Date(2024, 6, 3, 8, 0, 0, 0, time.UTC)) {
+		t.Fatalf("expected 08:00, got %v (%v)", next, ok)
+	}
+
+	// Adjacent windows do not produce a transition at 12:00.
+	next, ok = s.NextTransition(time.Date(2024, 6, 3, 9, 0, 0, 0, time.UTC))
+	if !ok || !next.Equal(time.Date(2024, 6, 3, 13, 0, 0, 0, time.UTC)) {
+		t.Fatalf("expected 13:00, got %v (%v)", next, ok)
+	}
+
+	next, ok = s.NextTransition(time.Date(2024, 6, 3, 14, 0, 0, 0, time.UTC))
+	if !ok || !next.Equal(time.Date(2024, 6, 4, 8, 0, 0, 0, time.UTC)) {
+		t.Fatalf("expected next day 08:00, got %v (%v)", next, ok)
+	}
+
+	t.Run("timezone", func(t *testing.T) {
+		tz := s
+		tz.Timezone = "Europe/Moscow" // UTC+3
+		next, ok := tz.NextTransition(time.Date(2024, 6, 3, 4, 0, 0, 0, time.UTC))
+		if !ok || !next.Equal(time.Date(2024, 6, 3, 5, 0, 0, 0, time.UTC)) {
+			t.Fatalf("expected 05:00 UTC, got %v (%v)", next, ok)
+		}
+	})
+}
+
+func TestScheduleValidate(t *testing.T) {
+	cfg := NewConfig()
+	set := NewSetConfig()
+	set.Id = "s1"
+	set.Schedule = ScheduleConfig{Enabled: true, Windows: []ScheduleWindow{{Start: "25:00", End: "01:00"}}}
+	cfg.Sets = []*SetConfig{&set}
+
+	if err := cfg.Validate(); err == nil {
+		t.Error("expected error for invalid window start")
+	}
+
+	set.Schedule.Windows[0].Start = "20:00"
+	if err := cfg.Validate(); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestActiveSets(t *testing.T) {
+	cfg := NewConfig()
+	on := NewSetConfig()
+	on.Id, on.Enabled = "on", true
+	off := NewSetConfig()
+	off.Id, off.Enabled = "off", false
+	night := NewSetConfig()
+	night.Id, night.Enabled = "night", true
+	night.Schedule = ScheduleConfig{Enabled: true, Timezone: "UTC", Windows: []ScheduleWindow{{Start: "22:00", End: "06:00"}}}
+	cfg.Sets = []*SetConfig{&on, &off, &night}
+
+	noon := time.Date(2024, 6, 3, 12, 0, 0, 0, time.UTC)
+	if got := cfg.ActiveSets(noon); len(got) != 1 || got[0].Id != "on" {
+		t.Errorf("expected only 'on' at noon, got %d sets", len(got))
+	}
+	if got := cfg.ActiveSets(noon.Add(11 * time.Hour)); len(got) != 2 {
+		t.Errorf("expected 2 active sets at 23:00, got %d", len(got))
+	}
+
+	next, ok := cfg.NextScheduleTransition(noon)
+	if !ok || !next.Equal(time.Date(2024, 6, 3, 22, 0, 0, 0, time.UTC)) {
+		t.Errorf("expected 22:00, got %v (%v)", next, ok)
+	}
+}
@@ -11,6 +11,15 @@ const (
 	ConfigNone = "none"
 )
 
+const (
+	AuthScopeRead = "read"
+	AuthScopeFull = "full"
+)
+
+// DefaultListIntervalHours is how often a subscribed list is refreshed
+// when the subscription does not say.
+const DefaultListIntervalHours = 24
+
 const (
 	FakePayloadRandom = iota
 	FakePayloadCustom
@@ -80,7 +89,12 @@ type UDPConfig struct {
 	FakeSeqLength  int    `json:"fake_seq_length" bson:"fake_seq_length"`
 	FakeLen        int    `json:"fake_len" bson:"fake_len"`
 	FakingStrategy string `json:"faking_strategy" bson:"faking_strategy"`
-	DPortFilter    string `json:"dport_filter" bson:"dport_filter"` // can be a comma separated list of ports and port ranges, e.g. "80,443,1000-2000"
+	FakePayload    string `json:"fake_payload" bson:"fake_payload"`   // Values: "zero", "quic_initial"
+	FakeSNI        string `json:"fake_sni" bson:"fake_sni"`           // decoy SNI of "quic_initial" fakes
+	SplitMode      string `json:"split_mode" bson:"split_mode"`       // Values: "ip", "crypto"
+	CryptoFrames   int    `json:"crypto_frames" bson:"crypto_frames"` // all sent in the client's single Initial packet
+	ShuffleMode    string `json:"shuffle_mode" bson:"shuffle_mode"`   // "full", "reverse", "middle", "none"
+	DPortFilter    string `json:"dport_filter" bson:"dport_filter"`   // can be a comma separated list of ports and port ranges, e.g. "80,443,1000-2000"
 	FilterQUIC     string `json:"filter_quic" bson:"filter_quic"`
 	FilterSTUN     bool   `json:"filter_stun" bson:"filter_stun"`
 	ConnBytesLimit int    `json:"conn_bytes_limit" bson:"conn_bytes_limit"`
@@ -133,12 +147,22 @@ type SNIMutationConfig struct {
 }
 
 type TargetsConfig struct {
-	SNIDomains        []string `json:"sni_domains" bson:"sni_domains"`
-	IPs               []string `json:"ip" bson:"ip"`
-	GeoSiteCategories []string `json:"geosite_categories" bson:"geosite_categories"`
-	GeoIpCategories   []string `json:"geoip_categories" bson:"geoip_categories"`
-	DomainsToMatch    []string `json:"-" bson:"-"`
-	IpsToMatch        []string `json:"-" bson:"-"`
+	SNIDomains        []string           `json:"sni_domains" bson:"sni_domains"`
+	IPs               []string           `json:"ip" bson:"ip"`
+	GeoSiteCategories []string           `json:"geosite_categories" bson:"geosite_categories"`
+	GeoIpCategories   []string           `json:"geoip_categories" bson:"geoip_categories"`
+	Devices           []string           `json:"devices" bson:"devices"` // source MACs, IPs/CIDRs or device aliases, empty for all
+	Subscriptions     []ListSubscription `json:"subscriptions" bson:"subscriptions"`
+	DomainsToMatch    []string           `json:"-" bson:"-"`
+	IpsToMatch        []string           `json:"-" bson:"-"`
+}
+
+// ListSubscription is a domain or IP list kept up to date from a URL or a
+// local file.
+type ListSubscription struct {
+	URL           string `json:"url" bson:"url"`
+	Format        string `json:"format" bson:"format"` // plain, dnsmasq, clash, singbox or adguard
+	IntervalHours int    `json:"interval_hours" bson:"interval_hours"`
 }
 
 type SystemConfig struct {
@@ -151,16 +175,49 @@ type SystemConfig struct {
 }
 
 type TablesConfig struct {
-	MonitorInterval int  `json:"monitor_interval" bson:"monitor_interval"`
-	SkipSetup       bool `json:"skip_setup" bson:"skip_setup"`
+	MonitorInterval int          `json:"monitor_interval" bson:"monitor_interval"`
+	SkipSetup       bool         `json:"skip_setup" bson:"skip_setup"`
+	IPSets          IPSetsConfig `json:"ip_sets" bson:"ip_sets"`
+}
+
+// IPSetsConfig controls the kernel-side sets (nftables named sets or ipset)
+// holding the target IPs of all sets and the IPs learned from matched domains.
+type IPSetsConfig struct {
+	Enabled     bool `json:"enabled" bson:"enabled"`
+	TargetsOnly bool `json:"targets_only" bson:"targets_only"` // queue only traffic to IPs in the sets
+	QueueAll    bool `json:"queue_all" bson:"queue_all"`       // queue every packet to IPs in the sets, ignoring connbytes
 }
 
 type WebServerConfig struct {
-	Port        int    `json:"port" bson:"port"`
-	BindAddress string `json:"bind_address" bson:"bind_address"`
-	TLSCert     string `json:"tls_cert" bson:"tls_cert"`
-	TLSKey      string `json:"tls_key" bson:"tls_key"`
-	IsEnabled   bool   `json:"-" bson:"-"`
+	Port        int        `json:"port" bson:"port"`
+	BindAddress string     `json:"bind_address" bson:"bind_address"`
+	TLSCert     string     `json:"tls_cert" bson:"tls_cert"`
+	TLSKey      string     `json:"tls_key" bson:"tls_key"`
+	Auth        AuthConfig `json:"auth" bson:"auth"`
+	// Browser origins besides the UI's own that may call the API,
+	// e.g. "https://router.lan:8443"
+	AllowedOrigins []string `json:"allowed_origins" bson:"allowed_origins"`
+	IsEnabled      bool     `json:"-" bson:"-"`
+}
+
+type AuthConfig struct {
+	Enabled         bool        `json:"enabled" bson:"enabled"`
+	SessionTTLHours int         `json:"session_ttl_hours" bson:"session_ttl_hours"`
+	Users           []AuthUser  `json:"users" bson:"users"`
+	Tokens          []AuthToken `json:"tokens" bson:"tokens"`
+}
+
+type AuthUser struct {
+	Username     string `json:"username" bson:"username"`
+	PasswordHash string `json:"password_hash" bson:"password_hash"` // bcrypt
+}
+
+type AuthToken struct {
+	Id        string `json:"id" bson:"id"`
+	Name      string `json:"name" bson:"name"`
+	Hash      string `json:"hash" bson:"hash"`   // hex sha256 of the token
+	Scope     string `json:"scope" bson:"scope"` // "read", "full"
+	CreatedAt int64  `json:"created_at" bson:"created_at"`
 }
 
 type DiscoveryConfig struct {
@@ -169,13 +226,24 @@ type DiscoveryConfig struct {
 	ReferenceDomain     string   `yaml:"reference_domain" json:"reference_domain"`
 	ReferenceDNS        []string `yaml:"reference_dns" json:"reference_dns"`
 	ValidationTries     int      `yaml:"validation_tries" json:"validation_tries"`
+	ProbeMark           uint     `yaml:"probe_mark" json:"probe_mark"` // Socket mark of discovery probes, sandboxed in the queue workers
 }
 
 type Logging struct {
-	Level      log.Level `json:"level" bson:"level"`
-	Instaflush bool      `json:"instaflush" bson:"instaflush"`
-	Syslog     bool      `json:"syslog" bson:"syslog"`
-	ErrorFile  string    `json:"error_file" bson:"error_file"`
+	Level       log.Level           `json:"level" bson:"level"`
+	Instaflush  bool                `json:"instaflush" bson:"instaflush"`
+	Syslog      bool                `json:"syslog" bson:"syslog"`
+	ErrorFile   string              `json:"error_file" bson:"error_file"`
+	Connections ConnectionLogConfig `json:"connections" bson:"connections"`
+}
+
+// ConnectionLogConfig is the on-disk history of per-connection decisions,
+// kept as JSON lines and rotated by size.
+type ConnectionLogConfig struct {
+	Enabled   bool   `json:"enabled" bson:"enabled"`
+	Dir       string `json:"dir" bson:"dir"`
+	MaxSizeMB int    `json:"max_size_mb" bson:"max_size_mb"` // per file
+	MaxFiles  int    `json:"max_files" bson:"max_files"`     // including the current one
 }
 
 type SetConfig struct {
@@ -188,6 +256,56 @@ type SetConfig struct {
 	Targets       TargetsConfig       `json:"targets" bson:"targets"`
 	Enabled       bool                `json:"enabled" bson:"enabled"`
 	DNS           DNSConfig           `json:"dns" bson:"dns"`
+	HTTP          HTTPConfig          `json:"http" bson:"http"`
+	Schedule      ScheduleConfig      `json:"schedule" bson:"schedule"`
+	Fallback      FallbackConfig      `json:"fallback" bson:"fallback"`
+	Health        HealthCheckConfig   `json:"health" bson:"health"`
+}
+
+// HealthCheckConfig periodically fetches a probe URL through the set to
+// notice when its strategy stops working.
+type HealthCheckConfig struct {
+	Enabled          bool   `json:"enabled" bson:"enabled"`
+	URL              string `json:"url" bson:"url"` // empty for the first domain target
+	IntervalMinutes  int    `json:"interval_minutes" bson:"interval_minutes"`
+	FailureThreshold int    `json:"failure_threshold" bson:"failure_threshold"` // consecutive failures before alerting
+	AutoDiscover     bool   `json:"auto_discover" bson:"auto_discover"`         // propose a replacement when failing
+}
+
+// FallbackConfig lists strategy variants a domain moves through, in order,
+// when the set's own strategy keeps failing for it.
+type FallbackConfig struct {
+	Enabled     bool              `json:"enabled" bson:"enabled"`
+	Variants    []StrategyVariant `json:"variants" bson:"variants"`
+	MaxFailures int               `json:"max_failures" bson:"max_failures"` // failures before moving on
+	TimeoutMs   int               `json:"timeout_ms" bson:"timeout_ms"`     // wait for the ServerHello
+	TTLMinutes  int               `json:"ttl_minutes" bson:"ttl_minutes"`   // how long a domain keeps its variant
+}
+
+// StrategyVariant overrides the fragmentation and fake SNI settings of the
+// set it belongs to. Empty strings and zero numbers keep the set's own
+// setting, the flags always apply.
+type StrategyVariant struct {
+	Strategy     string `json:"strategy" bson:"strategy"`
+	SNIPosition  int    `json:"sni_position" bson:"sni_position"`
+	MiddleSNI    bool   `json:"middle_sni" bson:"middle_sni"`
+	ReverseOrder bool   `json:"reverse_order" bson:"reverse_order"`
+	FakeSNI      bool   `json:"fake_sni" bson:"fake_sni"`
+	FakeStrategy string `json:"fake_strategy" bson:"fake_strategy"`
+	FakeTTL      uint8  `json:"fake_ttl" bson:"fake_ttl"`
+}
+
+// ScheduleConfig limits an enabled set to the given time windows.
+type ScheduleConfig struct {
+	Enabled  bool             `json:"enabled" bson:"enabled"`
+	Timezone string           `json:"timezone" bson:"timezone"` // IANA name, empty for system local time
+	Windows  []ScheduleWindow `json:"windows" bson:"windows"`
+}
+
+type ScheduleWindow struct {
+	Days  uint8  `json:"days" bson:"days"`   // weekday mask, bit 0 is Sunday, 0 for every day
+	Start string `json:"start" bson:"start"` // "HH:MM"
+	End   string `json:"end" bson:"end"`     // "HH:MM", at or before Start to cross midnight
 }
 
 type GeoDatConfig struct {
@@ -195,6 +313,13 @@ type GeoDatConfig struct {
 	GeoIpPath   string `json:"ipdat_path" bson:"ipdat_path"`
 	GeoSiteURL  string `json:"sitedat_url" bson:"sitedat_url"`
 	GeoIpURL    string `json:"ipdat_url" bson:"ipdat_url"`
+
+	// Checksum URLs are optional, the data URL with a .sha256sum suffix is
+	// tried when they are empty
+	GeoSiteChecksumURL  string `json:"sitedat_checksum_url" bson:"sitedat_checksum_url"`
+	GeoIpChecksumURL    string `json:"ipdat_checksum_url" bson:"ipdat_checksum_url"`
+	AutoUpdate          bool   `json:"auto_update" bson:"auto_update"`
+	UpdateIntervalHours int    `json:"update_interval_hours" bson:"update_interval_hours"`
 }
 
 type ComboFragConfig struct {
@@ -224,11 +349,23 @@ func ResolveSeg2Delay(min, max int) int {
 
 type DNSConfig struct {
 	Enabled       bool   `json:"enabled" bson:"enabled"`
+	Mode          string `json:"mode" bson:"mode"` // "redirect" to TargetDNS, "forward" over DoH/DoT
 	TargetDNS     string `json:"target_dns" bson:"target_dns"`
 	FragmentQuery bool   `json:"fragment_query" bson:"fragment_query"`
+	Upstream      string `json:"upstream" bson:"upstream"` // https://host/dns-query or tls://host[:port]
 }
 
 type DuplicateConfig struct {
 	Enabled bool `json:"enabled" bson:"enabled"`
 	Count   int  `json:"count" bson:"count"` // Number of packet copies to send (original is dropped)
 }
+
+type HTTPConfig struct {
+	Enabled     bool   `json:"enabled" bson:"enabled"`           // Queue and handle plain HTTP (port 80) for this set
+	HostCase    bool   `json:"host_case" bson:"host_case"`       // Mix case of the Host header name and value
+	ExtraSpace  bool   `json:"extra_space" bson:"extra_space"`   // Move the space after "Host:" between method and URI
+	SplitHost   bool   `json:"split_host" bson:"split_host"`     // Split the TCP segment inside the Host value
+	FakeRequest bool   `json:"fake_request" bson:"fake_request"` // Send a low-TTL fake request before the real one
+	FakeTTL     uint8  `json:"fake_ttl" bson:"fake_ttl"`
+	FakeHost    string `json:"fake_host" bson:"fake_host"`
+}
@@ -0,0 +1,112 @@
+// Package connlog keeps a history of what b4 decided for each connection:
+// which device opened it, what it was for, which set matched and what was
+// done to it. Events are stored as JSON lines in size-rotated files.
+package connlog
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/daniellavrushin/b4/config"
+	"github.com/daniellavrushin/b4/log"
+)
+
+// Outcomes of a connection
+const (
+	// OutcomePassed connections were left alone, no set matched
+	OutcomePassed = "passed"
+	// OutcomeInjected connections had their packets replaced by the set's
+	// strategy
+	OutcomeInjected = "injected"
+	// OutcomeDuplicated connections had their packets sent several times
+	OutcomeDuplicated = "duplicated"
+	// OutcomeDropped connections were blocked by their set
+	OutcomeDropped = "dropped"
+	// OutcomeOverBudget connections matched a set but were past its packet
+	// limit and passed unchanged
+	OutcomeOverBudget = "over_budget"
+)
+
+type Event struct {
+	Time     time.Time `json:"time"`
+	Protocol string    `json:"protocol"` // TCP, TCP-SYN, TCP-DUP or UDP
+	MAC      string    `json:"mac,omitempty"`
+	Device   string    `json:"device,omitempty"` // alias of the MAC
+	SrcIP    string    `json:"src_ip"`
+	SrcPort  uint16    `json:"src_port"`
+	DstIP    string    `json:"dst_ip"`
+	DstPort  uint16    `json:"dst_port"`
+	Host     string    `json:"host,omitempty"` // SNI or HTTP Host
+	SetID    string    `json:"set_id,omitempty"`
+	Set      string    `json:"set,omitempty"`
+	Strategy string    `json:"strategy,omitempty"`
+	Outcome  string    `json:"outcome"`
+}
+
+var (
+	mu      sync.Mutex
+	current atomic.Pointer[Store]
+	active  config.ConnectionLogConfig
+)
+
+// Enabled reports whether events are being recorded, cheap enough for
+// every packet.
+func Enabled() bool {
+	return current.Load() != nil
+}
+
+// Record queues an event for writing. It never blocks, events are dropped
+// when the writer falls behind.
+func Record(e Event) {
+	if s := current.Load(); s != nil {
+		s.Record(e)
+	}
+}
+
+// Configure opens, reopens or closes the history to match cfg.
+func Configure(cfg config.ConnectionLogConfig) error {
+	mu.Lock()
+	defer mu.Unlock()
+
+	s := current.Load()
+	if s != nil && cfg == active {
+		return nil
+	}
+	if s != nil {
+		current.Store(nil)
+		s.Close()
+	}
+	active = config.ConnectionLogConfig{}
+	if !cfg.Enabled {
+		return nil
+	}
+
+	s, err := Open(cfg.Dir, int64(cfg.MaxSizeMB)<<20, cfg.MaxFiles)
+	if err != nil {
+		return err
+	}
+	active = cfg
+	current.Store(s)
+	log.Infof("Connection history: %s (%d files of %d MB)", s.path, cfg.MaxFiles, cfg.MaxSizeMB)
+	return nil
+}
+
+// Query returns the recorded events matching f, newest first.
+func Query(f Filter) ([]Event, error) {
+	s := current.Load()
+	if s == nil {
+		return []Event{}, nil
+	}
+	return s.Query(f)
+}
+
+// Close writes out pending events and stops recording.
+func Close() {
+	mu.Lock()
+	defer mu.Unlock()
+	if s := current.Swap(nil); s != nil {
+		s.Close()
+	}
+	active = config.ConnectionLogConfig{}
+}
@@ -0,0 +1,295 @@
+package connlog
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/daniellavrushin/b4/log"
+)
+
+const (
+	fileName = "connections.jsonl"
+
+	queueSize  = 4096
+	flushEvery = time.Second
+
+	DefaultQueryLimit = 100
+	MaxQueryLimit     = 5000
+)
+
+// Store appends events to dir/connections.jsonl. When the file would grow
+// past maxBytes it is renamed to connections.jsonl.1, shifting older files
+// up, and files past maxFiles are removed.
+type Store struct {
+	path     string
+	maxBytes int64
+	maxFiles int
+
+	mu   sync.Mutex
+	file *os.File
+	buf  *bufio.Writer
+	size int64
+
+	// Record holds closeMu for reading while it sends, so the queue is
+	// never written to once Close has set closed
+	closeMu sync.RWMutex
+	closed  bool
+
+	queue   chan Event
+	stop    chan struct{}
+	done    chan struct{}
+	dropped atomic.Uint64
+}
+
+// Filter selects events, zero fields match everything.
+type Filter struct {
+	// Domain matches the host and its subdomains.
+	Domain string
+	// Device matches the MAC, the device alias or the source IP.
+	Device string
+	// Set matches the set ID or name.
+	Set     string
+	Outcome string
+	Since   time.Time
+	Until   time.Time
+	// Limit caps the events returned, DefaultQueryLimit when zero.
+	Limit int
+}
+
+func Open(dir string, maxBytes int64, maxFiles int) (*Store, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create connection log directory: %w", err)
+	}
+	if maxFiles < 1 {
+		maxFiles = 1
+	}
+
+	s := &Store{
+		path:     filepath.Join(dir, fileName),
+		maxBytes: maxBytes,
+		maxFiles: maxFiles,
+		queue:    make(chan Event, queueSize),
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	if err := s.openFile(); err != nil {
+		return nil, err
+	}
+
+	go s.run()
+	return s, nil
+}
+
+// Record queues e, dropping it when the queue is full or the store is
+// closed.
+func (s *Store) Record(e Event) {
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	s.closeMu.RLock()
+	defer s.closeMu.RUnlock()
+	if s.closed {
+		return
+	}
+	select {
+	case s.queue <- e:
+	default:
+		s.dropped.Add(1)
+	}
+}
+
+// Close writes the queued events and closes the file. Events recorded
+// after it are dropped.
+func (s *Store) Close() {
+	s.closeMu.Lock()
+	if s.closed {
+		s.closeMu.Unlock()
+		return
+	}
+	s.closed = true
+	close(s.stop)
+	s.closeMu.Unlock()
+	<-s.done
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.file != nil {
+		_ = s.buf.Flush()
+		_ = s.file.Close()
+		s.file = nil
+	}
+	if n := s.dropped.Load(); n > 0 {
+		log.Warnf("Connection history dropped %d events", n)
+	}
+}
+
+func (s *Store) run() {
+	defer close(s.done)
+	ticker := time.NewTicker(flushEvery)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case e := <-s.queue:
+			s.write(e)
+		case <-ticker.C:
+			s.flush()
+		case <-s.stop:
+			// Nothing is queued anymore, write what is left
+			for {
+				select {
+				case e := <-s.queue:
+					s.write(e)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+func (s *Store) write(e Event) {
+	line, err := json.Marshal(e)
+	if err != nil {
+		return
+	}
+	line = append(line, '\n')
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.file == nil {
+		return
+	}
+	if s.size > 0 && s.size+int64(len(line)) > s.maxBytes {
+		if err := s.rotate(); err != nil {
+			log.Errorf("Failed to rotate connection history: %v", err)
+			return
+		}
+	}
+	n, err := s.buf.Write(line)
+	s.size += int64(n)
+	if err != nil {
+		log.Errorf("Failed to write connection history: %v", err)
+	}
+}
+
+func (s *Store) flush() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.file != nil {
+		_ = s.buf.Flush()
+	}
+}
+
+// rotate shifts the files up by one, the caller holds s.mu.
+func (s *Store) rotate() error {
+	_ = s.buf.Flush()
+	_ = s.file.Close()
+	s.file = nil
+
+	_ = os.Remove(s.rotated(s.maxFiles - 1))
+	for i := s.maxFiles - 2; i >= 0; i-- {
+		_ = os.Rename(s.rotated(i), s.rotated(i+1))
+	}
+	return s.openFile()
+}
+
+func (s *Store) openFile() error {
+	f, err := os.OpenFile(s.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	s.file = f
+	s.buf = bufio.NewWriterSize(f, 64*1024)
+	s.size = info.Size()
+	return nil
+}
+
+// rotated returns the path of the i-th file, 0 being the current one.
+func (s *Store) rotated(i int) string {
+	if i == 0 {
+		return s.path
+	}
+	return fmt.Sprintf("%s.%d", s.path, i)
+}
+
+// Query returns the events matching f, newest first.
+func (s *Store) Query(f Filter) ([]Event, error) {
+	if f.Limit <= 0 {
+		f.Limit = DefaultQueryLimit
+	}
+	if f.Limit > MaxQueryLimit {
+		f.Limit = MaxQueryLimit
+	}
+	f.Domain = strings.ToLower(strings.TrimSuffix(strings.TrimSpace(f.Domain), "."))
+	f.Device = strings.TrimSpace(f.Device)
+	f.Set = strings.TrimSpace(f.Set)
+	s.flush()
+
+	events := make([]Event, 0)
+	for i := 0; i < s.maxFiles && len(events) < f.Limit; i++ {
+		data, err := os.ReadFile(s.rotated(i))
+		if os.IsNotExist(err) {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		var oldest time.Time
+		lines := bytes.Split(data, []byte{'\n'})
+		for j := len(lines) - 1; j >= 0 && len(events) < f.Limit; j-- {
+			if len(lines[j]) == 0 {
+				continue
+			}
+			var e Event
+			if err := json.Unmarshal(lines[j], &e); err != nil {
+				continue // torn line after a crash
+			}
+			oldest = e.Time
+			if f.match(&e) {
+				events = append(events, e)
+			}
+		}
+		// Older files only hold older events
+		if !f.Since.IsZero() && !oldest.IsZero() && oldest.Before(f.Since) {
+			break
+		}
+	}
+	return events, nil
+}
+
+func (f *Filter) match(e *Event) bool {
+	if !f.Since.IsZero() && e.Time.Before(f.Since) {
+		return false
+	}
+	if !f.Until.IsZero() && e.Time.After(f.Until) {
+		return false
+	}
+	if f.Domain != "" && e.Host != f.Domain && !strings.HasSuffix(e.Host, "."+f.Domain) {
+		return false
+	}
+	if f.Device != "" && !strings.EqualFold(e.MAC, f.Device) && !strings.EqualFold(e.Device, f.Device) && e.SrcIP != f.Device {
+		return false
+	}
+	if f.Set != "" && e.SetID != f.Set && !strings.EqualFold(e.Set, f.Set) {
+		return false
+	}
+	if f.Outcome != "" && e.Outcome != f.Outcome {
+		return false
+	}
+	return true
+}
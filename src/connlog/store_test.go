@@ -0,0 +1,162 @@
+package connlog
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/daniellavrushin/b4/config"
+)
+
+func waitEvents(t *testing.T, s *Store, n int) []Event {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		events, err := s.Query(Filter{Limit: MaxQueryLimit})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(events) >= n || time.Now().After(deadline) {
+			return events
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestStoreQuery(t *testing.T) {
+	s, err := Open(t.TempDir(), 1<<20, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	base := time.Date(2026, 3, 1, 22, 0, 0, 0, time.UTC)
+	s.Record(Event{Time: base, Protocol: "TCP", MAC: "AA:BB:CC:DD:EE:FF", Device: "Phone", SrcIP: "192.168.1.20",
+		Host: "rr1.googlevideo.com", SetID: "yt", Set: "YouTube", Outcome: OutcomeInjected})
+	s.Record(Event{Time: base.Add(time.Hour), Protocol: "UDP", MAC: "AA:BB:CC:DD:EE:FF", Device: "Phone", SrcIP: "192.168.1.20",
+		Host: "www.youtube.com", SetID: "yt", Set: "YouTube", Outcome: OutcomeOverBudget})
+	s.Record(Event{Time: base.Add(2 * time.Hour), Protocol: "TCP", MAC: "11:22:33:44:55:66", SrcIP: "192.168.1.30",
+		Host: "example.com", Outcome: OutcomePassed})
+
+	if got := waitEvents(t, s, 3); len(got) != 3 || got[0].Host != "example.com" {
+		t.Fatalf("want 3 events newest first, got %+v", got)
+	}
+
+	tests := []struct {
+		name string
+		f    Filter
+		want int
+	}{
+		{"domain suffix", Filter{Domain: "googlevideo.com"}, 1},
+		{"domain is not a substring match", Filter{Domain: "tube.com"}, 0},
+		{"device alias", Filter{Device: "phone"}, 2},
+		{"device mac", Filter{Device: "aa:bb:cc:dd:ee:ff"}, 2},
+		{"device ip", Filter{Device: "192.168.1.30"}, 1},
+		{"set name", Filter{Set: "youtube"}, 2},
+		{"set id", Filter{Set: "yt"}, 2},
+		{"outcome", Filter{Outcome: OutcomePassed}, 1},
+		{"time range", Filter{Since: base.Add(30 * time.Minute), Until: base.Add(90 * time.Minute)}, 1},
+		{"limit", Filter{Limit: 2}, 2},
+	}
+	for _, tt := range tests {
+		got, err := s.Query(tt.f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(got) != tt.want {
+			t.Errorf("%s: got %d events, want %d", tt.name, len(got), tt.want)
+		}
+	}
+}
+
+func TestStoreRotation(t *testing.T) {
+	dir := t.TempDir()
+	s, err := Open(dir, 1024, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 100; i++ {
+		s.Record(Event{Time: time.Unix(int64(i), 0), Protocol: "TCP", Host: fmt.Sprintf("h%d.example", i), Outcome: OutcomePassed})
+	}
+	s.Close()
+
+	for i, name := range []string{fileName, fileName + ".1", fileName + ".2"} {
+		info, err := os.Stat(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatalf("file %d: %v", i, err)
+		}
+		if info.Size() > 1024 {
+			t.Errorf("%s is %d bytes, over the limit", name, info.Size())
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, fileName+".3")); !os.IsNotExist(err) {
+		t.Errorf("more files kept than configured")
+	}
+
+	// Reopening appends to the current file and queries across all of them
+	s, err = Open(dir, 1024, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	events, err := s.Query(Filter{Limit: MaxQueryLimit})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) == 0 || events[0].Host != "h99.example" {
+		t.Fatalf("newest event missing, got %d events", len(events))
+	}
+	for i := 1; i < len(events); i++ {
+		if events[i].Time.After(events[i-1].Time) {
+			t.Fatalf("events not newest first at %d", i)
+		}
+	}
+}
+
+// Workers keep recording while the history is reconfigured from the API.
+// Run with -race.
+func TestRecordDuringConfigure(t *testing.T) {
+	cfg := config.ConnectionLogConfig{Enabled: true, Dir: t.TempDir(), MaxSizeMB: 1, MaxFiles: 2}
+	if err := Configure(cfg); err != nil {
+		t.Fatal(err)
+	}
+	defer Close()
+
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+					Record(Event{Protocol: "TCP", Outcome: OutcomePassed})
+				}
+			}
+		}()
+	}
+
+	for i := 0; i < 50; i++ {
+		cfg.MaxFiles = 2 + i%2
+		if err := Configure(cfg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	close(stop)
+	wg.Wait()
+
+	s, err := Open(t.TempDir(), 1<<20, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+	s.Close()
+	s.Record(Event{Protocol: "TCP"})
+}
@@ -0,0 +1,108 @@
+package dhcp
+
+import (
+	"encoding/csv"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// === Kea ===
+// memfile CSV leases, one header line then one row per lease change. Rows
+// are appended, so the last row of an address wins; a lease is gone when it
+// expired or its state is not default (declined or reclaimed).
+
+type KeaSource struct {
+	path string
+}
+
+func (k *KeaSource) Name() string { return "kea" }
+func (k *KeaSource) Path() string { return k.path }
+
+func (k *KeaSource) Detect() bool {
+	_, err := os.Stat(k.path)
+	return err == nil
+}
+
+func (k *KeaSource) Parse() ([]Lease, error) {
+	file, err := os.Open(k.path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	r := csv.NewReader(file)
+	r.FieldsPerRecord = -1
+	r.ReuseRecord = true
+
+	header, err := r.Read()
+	if err != nil {
+		if err == io.EOF {
+			return nil, nil
+		}
+		return nil, err
+	}
+	col := make(map[string]int, len(header))
+	for i, name := range header {
+		col[name] = i
+	}
+	get := func(row []string, name string) string {
+		if i, ok := col[name]; ok && i < len(row) {
+			return row[i]
+		}
+		return ""
+	}
+
+	now := time.Now()
+	byIP := make(map[string]Lease)
+	var order []string
+	for {
+		row, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil || len(row) < len(header) {
+			// A row cut short by a concurrent write, skip it
+			continue
+		}
+
+		ip := get(row, "address")
+		if ip == "" {
+			continue
+		}
+		if _, seen := byIP[ip]; !seen {
+			order = append(order, ip)
+		}
+
+		expires := time.Unix(0, 0)
+		if ts, err := strconv.ParseInt(get(row, "expire"), 10, 64); err == nil {
+			expires = time.Unix(ts, 0)
+		}
+		mac := get(row, "hwaddr")
+		if mac == "" {
+			mac = macFromDUID(get(row, "duid"))
+		}
+		state := get(row, "state")
+		if (state != "" && state != "0") || expires.Before(now) || mac == "" {
+			byIP[ip] = Lease{}
+			continue
+		}
+
+		byIP[ip] = Lease{
+			MAC:      strings.ToUpper(mac),
+			IP:       ip,
+			Hostname: strings.TrimSuffix(get(row, "hostname"), "."),
+			Expires:  expires,
+		}
+	}
+
+	leases := make([]Lease, 0, len(order))
+	for _, ip := range order {
+		if lease := byIP[ip]; lease.MAC != "" {
+			leases = append(leases, lease)
+		}
+	}
+	return leases, nil
+}
@@ -0,0 +1,105 @@
+package dhcp
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeLeaseFile writes lines to a file in a temporary directory.
+func writeLeaseFile(t *testing.T, name string, lines ...string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(strings.Join(lines, "\n")), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func leaseSummary(leases []Lease) string {
+	parts := make([]string, len(leases))
+	for i, l := range leases {
+		parts[i] = l.IP + "=" + l.MAC
+		if l.Hostname != "" {
+			parts[i] += "(" + l.Hostname + ")"
+		}
+	}
+	return strings.Join(parts, " ")
+}
+
+const keaHeader4 = "address,hwaddr,client_id,valid_lifetime,expire,subnet_id,fqdn_fwd,fqdn_rev,hostname,state,user_context,pool_id"
+
+func keaRow4(ip, mac string, expire int64, hostname string, state int) string {
+	return fmt.Sprintf("%s,%s,01:%s,3600,%d,1,0,0,%s,%d,,0", ip, mac, mac, expire, hostname, state)
+}
+
+func TestKeaSourceV4(t *testing.T) {
+	now := time.Now().Unix()
+	path := writeLeaseFile(t, "kea-leases4.csv",
+		keaHeader4,
+		// renewed: the last row wins
+		keaRow4("192.168.1.10", "aa:bb:cc:00:00:10", now-100, "old", 0),
+		keaRow4("192.168.1.10", "aa:bb:cc:00:00:10", now+3600, "laptop.lan.", 0),
+		// declined and reclaimed after being handed out
+		keaRow4("192.168.1.11", "aa:bb:cc:00:00:11", now+3600, "", 0),
+		keaRow4("192.168.1.11", "aa:bb:cc:00:00:11", now+3600, "", 1),
+		keaRow4("192.168.1.12", "aa:bb:cc:00:00:12", now+3600, "", 0),
+		keaRow4("192.168.1.12", "aa:bb:cc:00:00:12", now-1, "", 2),
+		// expired
+		keaRow4("192.168.1.13", "aa:bb:cc:00:00:13", now-1, "", 0),
+		// the address moved to another device
+		keaRow4("192.168.1.14", "aa:bb:cc:00:00:14", now+3600, "", 0),
+		keaRow4("192.168.1.14", "aa:bb:cc:00:00:15", now+3600, "phone", 0),
+		keaRow4("192.168.1.16", "aa:bb:cc:00:00:16", now+3600, "", 0),
+		// a row cut short by a concurrent write does not drop the lease
+		"192.168.1.16,aa:bb:cc:00:00:16,01:aa",
+	)
+
+	leases, err := (&KeaSource{path: path}).Parse()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "192.168.1.10=AA:BB:CC:00:00:10(laptop.lan) 192.168.1.14=AA:BB:CC:00:00:15(phone) 192.168.1.16=AA:BB:CC:00:00:16"
+	if got := leaseSummary(leases); got != want {
+		t.Errorf("leases\n got %s\nwant %s", got, want)
+	}
+	if !leases[0].Expires.Equal(time.Unix(now+3600, 0)) {
+		t.Errorf("expiry of the renewed lease %v", leases[0].Expires)
+	}
+}
+
+func TestKeaSourceV6(t *testing.T) {
+	now := time.Now().Unix()
+	path := writeLeaseFile(t, "kea-leases6.csv",
+		"address,duid,valid_lifetime,expire,subnet_id,pref_lifetime,lease_type,iaid,prefix_len,fqdn_fwd,fqdn_rev,hostname,hwaddr,state,user_context,hwtype,hwaddr_source,pool_id",
+		// the MAC comes from the DUID when Kea did not record one
+		fmt.Sprintf("2001:db8::10,00:03:00:01:aa:bb:cc:00:00:20,3600,%d,1,1800,0,1,128,0,0,tv,,0,,1,0,0", now+3600),
+		fmt.Sprintf("2001:db8::11,00:02:00:00:ab:11:01,3600,%d,1,1800,0,1,128,0,0,,aa:bb:cc:00:00:21,0,,1,0,0", now+3600),
+		// an enterprise DUID names no device
+		fmt.Sprintf("2001:db8::12,00:02:00:00:ab:11:01,3600,%d,1,1800,0,1,128,0,0,,,0,,1,0,0", now+3600),
+	)
+
+	leases, err := (&KeaSource{path: path}).Parse()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "2001:db8::10=AA:BB:CC:00:00:20(tv) 2001:db8::11=AA:BB:CC:00:00:21"
+	if got := leaseSummary(leases); got != want {
+		t.Errorf("leases\n got %s\nwant %s", got, want)
+	}
+}
+
+func TestKeaSourceEmpty(t *testing.T) {
+	for _, lines := range [][]string{nil, {keaHeader4}} {
+		leases, err := (&KeaSource{path: writeLeaseFile(t, "kea.csv", lines...)}).Parse()
+		if err != nil || len(leases) != 0 {
+			t.Errorf("%d lines: %v, %v", len(lines), leases, err)
+		}
+	}
+	if _, err := (&KeaSource{path: filepath.Join(t.TempDir(), "missing.csv")}).Parse(); err == nil {
+		t.Error("expected an error for a missing file")
+	}
+}
@@ -2,6 +2,8 @@ package dhcp
 
 import (
 	"context"
+	"maps"
+	"slices"
 	"strings"
 	"sync"
 	"time"
@@ -9,8 +11,16 @@ import (
 	"github.com/daniellavrushin/b4/log"
 )
 
+// Lease files are re-read this long after the last change seen, a file
+// being rewritten produces a burst of events
+const watchDebounce = 500 * time.Millisecond
+
+// pollInterval refreshes the sources that cannot be watched: the neighbor
+// table, and all of them if inotify is not available
+const pollInterval = 30 * time.Second
+
 type Manager struct {
-	source    LeaseSource
+	sources   []LeaseSource
 	ipToMAC   map[string]string
 	macToIP   map[string]string
 	hostnames map[string]string // MAC → hostname
@@ -28,19 +38,48 @@ type DetectionResult struct {
 }
 
 func Detect() DetectionResult {
+	sources := detectSources()
+	if len(sources) == 0 {
+		return DetectionResult{Available: false}
+	}
+	name, path := sourceInfo(sources)
+	log.Infof("DHCP Server: detected %s at %s", name, path)
+	return DetectionResult{
+		Available: true,
+		Source:    name,
+		Path:      path,
+	}
+}
+
+// detectSources returns every source present, in the order of AllSources,
+// which is also their precedence when merging. Lease files are used even
+// while empty so leases handed out later are picked up.
+func detectSources() []LeaseSource {
+	var found []LeaseSource
+	seen := make(map[string]bool)
 	for _, src := range AllSources {
+		key := src.Name() + "|" + src.Path()
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
 		if src.Detect() {
-			if leases, err := src.Parse(); err == nil && len(leases) > 0 {
-				log.Infof("DHCP Server: detected %s at %s", src.Name(), src.Path())
-				return DetectionResult{
-					Available: true,
-					Source:    src.Name(),
-					Path:      src.Path(),
-				}
-			}
+			found = append(found, src)
+		}
+	}
+	return found
+}
+
+func sourceInfo(sources []LeaseSource) (name, path string) {
+	names := make([]string, 0, len(sources))
+	paths := make([]string, 0, len(sources))
+	for _, src := range sources {
+		if !slices.Contains(names, src.Name()) {
+			names = append(names, src.Name())
 		}
+		paths = append(paths, src.Path())
 	}
-	return DetectionResult{Available: false}
+	return strings.Join(names, "+"), strings.Join(paths, ", ")
 }
 
 func NewManager() *Manager {
@@ -60,34 +99,66 @@ func NewManager() *Manager {
 }
 
 func (m *Manager) detectSource() {
-	for _, src := range AllSources {
-		if src.Detect() {
-			if leases, err := src.Parse(); err == nil && len(leases) > 0 {
-				m.source = src
-				log.Infof("DHCP: detected %s at %s", src.Name(), src.Path())
-				return
-			}
-		}
+	m.sources = detectSources()
+	for _, src := range m.sources {
+		log.Infof("DHCP: detected %s at %s", src.Name(), src.Path())
+	}
+	if len(m.sources) == 0 {
+		log.Tracef("DHCP: no lease source detected")
 	}
-	log.Tracef("DHCP: no lease source detected")
 }
 
 func (m *Manager) Start() {
-	if m.source == nil {
+	if len(m.sources) == 0 {
 		return
 	}
 
 	m.refresh()
 
+	var files []string
+	polled := false
+	for _, src := range m.sources {
+		if _, ok := src.(*NeighborSource); ok {
+			polled = true
+			continue
+		}
+		files = append(files, src.Path())
+	}
+
+	changed := make(chan struct{}, 1)
+	if len(files) > 0 {
+		err := watchFiles(m.ctx, files, func() {
+			select {
+			case changed <- struct{}{}:
+			default:
+			}
+		})
+		if err != nil {
+			log.Warnf("DHCP: cannot watch lease files, polling them: %v", err)
+			polled = true
+		}
+	}
+
 	go func() {
-		ticker := time.NewTicker(30 * time.Second)
-		defer ticker.Stop()
+		var poll <-chan time.Time
+		if polled {
+			ticker := time.NewTicker(pollInterval)
+			defer ticker.Stop()
+			poll = ticker.C
+		}
+		debounce := time.NewTimer(watchDebounce)
+		debounce.Stop()
+		defer debounce.Stop()
 
 		for {
 			select {
 			case <-m.ctx.Done():
 				return
-			case <-ticker.C:
+			case <-changed:
+				debounce.Reset(watchDebounce)
+			case <-debounce.C:
+				m.refresh()
+			case <-poll:
 				m.refresh()
 			case <-m.refreshCh:
 				m.refresh()
@@ -95,49 +166,72 @@ func (m *Manager) Start() {
 		}
 	}()
 
-	log.Infof("DHCP manager started (source: %s)", m.source.Name())
+	name, _ := sourceInfo(m.sources)
+	log.Infof("DHCP manager started (source: %s)", name)
 }
 
 func (m *Manager) Stop() {
 	m.cancel()
 }
 
+// refresh merges the leases of all sources. The first source naming an IP
+// wins, and a MAC maps to its first IPv4 address when it has one.
 func (m *Manager) refresh() {
-	if m.source == nil {
+	if len(m.sources) == 0 {
 		return
 	}
 
-	leases, err := m.source.Parse()
-	if err != nil {
-		log.Tracef("DHCP: parse error: %v", err)
-		return
+	ipToMAC := make(map[string]string)
+	macToIP := make(map[string]string)
+	hostnames := make(map[string]string)
+
+	for _, src := range m.sources {
+		leases, err := src.Parse()
+		if err != nil {
+			log.Tracef("DHCP: %s parse error: %v", src.Name(), err)
+			continue
+		}
+		for _, lease := range leases {
+			mac := normalizeMAC(lease.MAC)
+			if _, ok := ipToMAC[lease.IP]; ok {
+				continue
+			}
+			ipToMAC[lease.IP] = mac
+			if cur, ok := macToIP[mac]; !ok || (!isIPv4(cur) && isIPv4(lease.IP)) {
+				macToIP[mac] = lease.IP
+			}
+			if lease.Hostname != "" && hostnames[mac] == "" {
+				hostnames[mac] = lease.Hostname
+			}
+		}
 	}
 
-	if len(leases) == 0 {
+	if len(ipToMAC) == 0 {
 		log.Tracef("DHCP: no leases found")
 		return
 	}
 
 	m.mu.Lock()
-	m.ipToMAC = make(map[string]string)
-	m.macToIP = make(map[string]string)
-	m.hostnames = make(map[string]string)
-
-	for _, lease := range leases {
-		mac := normalizeMAC(lease.MAC)
-		m.ipToMAC[lease.IP] = mac
-		m.macToIP[mac] = lease.IP
-		if lease.Hostname != "" {
-			m.hostnames[mac] = lease.Hostname
-		}
-		log.Tracef("DHCP: %s -> %s (%s)", lease.IP, mac, lease.Hostname)
-	}
-	count := len(m.ipToMAC)
+	unchanged := maps.Equal(m.ipToMAC, ipToMAC) && maps.Equal(m.hostnames, hostnames)
+	m.ipToMAC = ipToMAC
+	m.macToIP = macToIP
+	m.hostnames = hostnames
 	m.mu.Unlock()
 
-	log.Infof("DHCP: loaded %d leases", count)
+	if unchanged {
+		return
+	}
+	for ip, mac := range ipToMAC {
+		log.Tracef("DHCP: %s -> %s (%s)", ip, mac, hostnames[mac])
+	}
+	log.Infof("DHCP: loaded %d leases", len(ipToMAC))
 	m.notifyCallbacks()
 }
+
+func isIPv4(ip string) bool {
+	return !strings.Contains(ip, ":")
+}
+
 func (m *Manager) TriggerRefresh() {
 	select {
 	case m.refreshCh <- struct{}{}:
@@ -186,14 +280,16 @@ func (m *Manager) GetAllMappings() map[string]string {
 }
 
 func (m *Manager) IsAvailable() bool {
-	return m.source != nil
+	return len(m.sources) > 0
 }
 
+// SourceInfo returns the names of the sources in use joined by "+", and
+// their paths.
 func (m *Manager) SourceInfo() (name, path string) {
-	if m.source == nil {
+	if len(m.sources) == 0 {
 		return "", ""
 	}
-	return m.source.Name(), m.source.Path()
+	return sourceInfo(m.sources)
 }
 
 func (m *Manager) GetHostnameForMAC(mac string) string {
@@ -0,0 +1,45 @@
+package dhcp
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestDetectSourcesKeepsEmptyFiles(t *testing.T) {
+	saved := AllSources
+	defer func() { AllSources = saved }()
+
+	empty := writeLeaseFile(t, "dnsmasq.leases")
+	odhcpd := writeLeaseFile(t, "odhcpd",
+		"# br-lan d8c4978a9f7e ipv4 phone -1 5 32 192.168.1.100/32")
+	AllSources = []LeaseSource{
+		&DnsmasqSource{path: empty},
+		&KeaSource{path: filepath.Join(t.TempDir(), "missing.csv")},
+		&OdhcpdSource{path: odhcpd},
+		&DnsmasqSource{path: empty},
+	}
+
+	sources := detectSources()
+	if len(sources) != 2 || sources[0].Path() != empty || sources[1].Path() != odhcpd {
+		name, path := sourceInfo(sources)
+		t.Fatalf("detected %s at %s", name, path)
+	}
+
+	// Leases written to the empty file later are merged, and win
+	m := &Manager{sources: sources, refreshCh: make(chan struct{}, 1)}
+	m.refresh()
+	if mac := m.GetMACForIP("192.168.1.100"); mac != "D8:C4:97:8A:9F:7E" {
+		t.Errorf("odhcpd lease not loaded: %q", mac)
+	}
+	lease := fmt.Sprintf("%d aa:bb:cc:00:00:01 192.168.1.100 tv *\n", time.Now().Unix()+3600)
+	if err := os.WriteFile(empty, []byte(lease), 0644); err != nil {
+		t.Fatal(err)
+	}
+	m.refresh()
+	if mac := m.GetMACForIP("192.168.1.100"); mac != "AA:BB:CC:00:00:01" {
+		t.Errorf("lease from the once empty file not used: %q", mac)
+	}
+}
@@ -0,0 +1,131 @@
+package dhcp
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"net"
+	"os"
+	"strings"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// === Kernel neighbor table ===
+// ARP and NDP entries, covering devices with static IPs and IPv6-only
+// clients no DHCP server knows of. Read over netlink, /proc/net/arp when
+// netlink is not available (IPv4 only).
+
+type NeighborSource struct {
+	procPath string
+}
+
+func (n *NeighborSource) Name() string { return "neighbors" }
+func (n *NeighborSource) Path() string { return "netlink" }
+
+// Detect reports whether the table has devices, it exists on every system.
+func (n *NeighborSource) Detect() bool {
+	leases, err := n.Parse()
+	return err == nil && len(leases) > 0
+}
+
+func (n *NeighborSource) Parse() ([]Lease, error) {
+	leases, err := parseNeighborsNetlink()
+	if err == nil {
+		return leases, nil
+	}
+	return parseProcARP(n.procPath)
+}
+
+func parseNeighborsNetlink() ([]Lease, error) {
+	rib, err := syscall.NetlinkRIB(unix.RTM_GETNEIGH, unix.AF_UNSPEC)
+	if err != nil {
+		return nil, err
+	}
+	msgs, err := syscall.ParseNetlinkMessage(rib)
+	if err != nil {
+		return nil, err
+	}
+
+	var leases []Lease
+	for _, m := range msgs {
+		if m.Header.Type == unix.NLMSG_ERROR {
+			return nil, errors.New("netlink neighbor dump failed")
+		}
+		if m.Header.Type != unix.RTM_NEWNEIGH || len(m.Data) < unix.SizeofNdMsg {
+			continue
+		}
+		// struct ndmsg: family, pad, ifindex, state, flags, type
+		state := binary.NativeEndian.Uint16(m.Data[8:10])
+		if state&(unix.NUD_INCOMPLETE|unix.NUD_FAILED|unix.NUD_NOARP) != 0 {
+			continue
+		}
+
+		var ip net.IP
+		var mac net.HardwareAddr
+		for attrs := m.Data[unix.SizeofNdMsg:]; len(attrs) >= 4; {
+			l := int(binary.NativeEndian.Uint16(attrs[0:2]))
+			if l < 4 || l > len(attrs) {
+				break
+			}
+			switch binary.NativeEndian.Uint16(attrs[2:4]) {
+			case unix.NDA_DST:
+				ip = net.IP(attrs[4:l])
+			case unix.NDA_LLADDR:
+				mac = net.HardwareAddr(attrs[4:l])
+			}
+			attrs = attrs[min((l+3)&^3, len(attrs)):]
+		}
+
+		if lease, ok := neighborLease(ip, mac); ok {
+			leases = append(leases, lease)
+		}
+	}
+	return leases, nil
+}
+
+// Format: IP address, HW type, Flags, HW address, Mask, Device
+func parseProcARP(path string) ([]Lease, error) {
+	if path == "" {
+		path = "/proc/net/arp"
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var leases []Lease
+	scanner := bufio.NewScanner(file)
+	scanner.Scan() // header
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 4 || fields[2] == "0x0" {
+			continue
+		}
+		mac, err := net.ParseMAC(fields[3])
+		if err != nil {
+			continue
+		}
+		if lease, ok := neighborLease(net.ParseIP(fields[0]), mac); ok {
+			leases = append(leases, lease)
+		}
+	}
+	return leases, scanner.Err()
+}
+
+// neighborLease skips entries that are not devices: link-local and
+// multicast addresses, and all-zero or broadcast link addresses.
+func neighborLease(ip net.IP, mac net.HardwareAddr) (Lease, bool) {
+	if len(ip) != net.IPv4len && len(ip) != net.IPv6len || len(mac) != 6 {
+		return Lease{}, false
+	}
+	if ip.IsLinkLocalUnicast() || ip.IsMulticast() || ip.IsLoopback() || ip.IsUnspecified() {
+		return Lease{}, false
+	}
+	if mac.String() == "00:00:00:00:00:00" || mac.String() == "ff:ff:ff:ff:ff:ff" {
+		return Lease{}, false
+	}
+	return Lease{MAC: strings.ToUpper(mac.String()), IP: ip.String()}, true
+}
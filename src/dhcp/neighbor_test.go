@@ -0,0 +1,60 @@
+package dhcp
+
+import (
+	"net"
+	"path/filepath"
+	"testing"
+)
+
+func TestParseProcARP(t *testing.T) {
+	path := writeLeaseFile(t, "arp",
+		"IP address       HW type     Flags       HW address            Mask     Device",
+		"192.168.1.20     0x1         0x2         aa:bb:cc:00:00:20     *        br-lan",
+		"192.168.1.21     0x1         0x0         00:00:00:00:00:00     *        br-lan",
+		"192.168.1.22     0x1         0x2         00:00:00:00:00:00     *        br-lan",
+		"169.254.1.1      0x1         0x2         aa:bb:cc:00:00:23     *        br-lan",
+		"192.168.1.24     0x1         0x2         not-a-mac             *        br-lan",
+		"192.168.1.25     0x1         0x6         AA:BB:CC:00:00:25     *        br-lan",
+		"192.168.1.26     0x1",
+	)
+
+	leases, err := parseProcARP(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "192.168.1.20=AA:BB:CC:00:00:20 192.168.1.25=AA:BB:CC:00:00:25"
+	if got := leaseSummary(leases); got != want {
+		t.Errorf("leases\n got %s\nwant %s", got, want)
+	}
+
+	if _, err := parseProcARP(filepath.Join(t.TempDir(), "missing")); err == nil {
+		t.Error("expected an error for a missing file")
+	}
+}
+
+func TestNeighborLease(t *testing.T) {
+	mac, _ := net.ParseMAC("aa:bb:cc:00:00:01")
+	tests := []struct {
+		ip  string
+		mac net.HardwareAddr
+		ok  bool
+	}{
+		{"192.168.1.1", mac, true},
+		{"2001:db8::1", mac, true},
+		{"fe80::1", mac, false},
+		{"ff02::1", mac, false},
+		{"127.0.0.1", mac, false},
+		{"0.0.0.0", mac, false},
+		{"192.168.1.1", net.HardwareAddr{0xff, 0xff, 0xff, 0xff, 0xff, 0xff}, false},
+		{"192.168.1.1", net.HardwareAddr{1, 2, 3, 4, 5, 6, 7, 8}, false},
+	}
+	for _, tt := range tests {
+		lease, ok := neighborLease(net.ParseIP(tt.ip), tt.mac)
+		if ok != tt.ok {
+			t.Errorf("%s %s: ok %v, want %v", tt.ip, tt.mac, ok, tt.ok)
+		}
+		if ok && (lease.IP != tt.ip || lease.MAC != "AA:BB:CC:00:00:01") {
+			t.Errorf("%s: lease %+v", tt.ip, lease)
+		}
+	}
+}
@@ -0,0 +1,113 @@
+package dhcp
+
+import (
+	"bufio"
+	"encoding/hex"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// === odhcpd ===
+// OpenWrt's DHCPv4/DHCPv6 server keeps its leases as comments of the hosts
+// file it writes for dnsmasq:
+//   # iface duid iaid hostname valid-until assigned prefixlen addr/len...
+// DHCPv4 leases carry the MAC in place of the DUID and "ipv4" as IAID.
+// DHCPv6 leases only name a MAC when the DUID is link-layer based.
+// valid-until is a Unix time, -1 for a lease that never expires and 0 for
+// one that already did.
+
+type OdhcpdSource struct {
+	path string
+}
+
+func (o *OdhcpdSource) Name() string { return "odhcpd" }
+func (o *OdhcpdSource) Path() string { return o.path }
+
+func (o *OdhcpdSource) Detect() bool {
+	_, err := os.Stat(o.path)
+	return err == nil
+}
+
+func (o *OdhcpdSource) Parse() ([]Lease, error) {
+	file, err := os.Open(o.path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	now := time.Now()
+	var leases []Lease
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 9 || fields[0] != "#" {
+			continue
+		}
+
+		validUntil, err := strconv.ParseInt(fields[5], 10, 64)
+		if err != nil || validUntil == 0 || (validUntil > 0 && time.Unix(validUntil, 0).Before(now)) {
+			continue
+		}
+		expires := time.Unix(0, 0)
+		if validUntil > 0 {
+			expires = time.Unix(validUntil, 0)
+		}
+
+		var mac string
+		if fields[3] == "ipv4" {
+			mac = macFromHex(fields[2])
+		} else {
+			mac = macFromDUID(fields[2])
+		}
+		if mac == "" {
+			continue
+		}
+
+		hostname := fields[4]
+		if hostname == "-" {
+			hostname = ""
+		}
+
+		for _, addr := range fields[8:] {
+			ip, _, _ := strings.Cut(addr, "/")
+			if net.ParseIP(ip) == nil {
+				continue
+			}
+			leases = append(leases, Lease{
+				MAC:      mac,
+				IP:       ip,
+				Hostname: hostname,
+				Expires:  expires,
+			})
+		}
+	}
+
+	return leases, scanner.Err()
+}
+
+func macFromHex(s string) string {
+	b, err := hex.DecodeString(s)
+	if err != nil || len(b) != 6 {
+		return ""
+	}
+	return strings.ToUpper(net.HardwareAddr(b).String())
+}
+
+// macFromDUID returns the MAC of a DUID-LLT or DUID-LL with hardware type
+// Ethernet (RFC 8415 §11), other DUIDs do not name one.
+func macFromDUID(s string) string {
+	b, err := hex.DecodeString(strings.ReplaceAll(s, ":", ""))
+	if err != nil || len(b) < 4 || b[2] != 0 || b[3] != 1 {
+		return ""
+	}
+	switch {
+	case b[0] == 0 && b[1] == 1 && len(b) == 14:
+		return strings.ToUpper(net.HardwareAddr(b[8:]).String())
+	case b[0] == 0 && b[1] == 3 && len(b) == 10:
+		return strings.ToUpper(net.HardwareAddr(b[4:]).String())
+	}
+	return ""
+}
@@ -0,0 +1,71 @@
+package dhcp
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestOdhcpdSource(t *testing.T) {
+	now := time.Now().Unix()
+	path := writeLeaseFile(t, "odhcpd",
+		"# br-lan d8c4978a9f7e ipv4 phone "+fmt.Sprint(now+3600)+" 5 32 192.168.1.100/32",
+		"192.168.1.100 phone",
+		// DUID-LLT, two addresses
+		"# br-lan 00010001278f5a5cd8c4978a9f7f 3bd0c1a0 laptop "+fmt.Sprint(now+3600)+" 200 128 fd00::1a2/128 2001:db8::1a2/128",
+		// never expires, no hostname
+		"# br-lan 00030001d8c4978a9f80 1 - -1 200 128 fd00::1a3/128",
+		// expired, and 0 for a lease odhcpd already let go
+		"# br-lan d8c4978a9f81 ipv4 old "+fmt.Sprint(now-10)+" 5 32 192.168.1.101/32",
+		"# br-lan d8c4978a9f82 ipv4 gone 0 5 32 192.168.1.102/32",
+		// enterprise DUID and a malformed MAC
+		"# br-lan 000200000009abcd 1 printer "+fmt.Sprint(now+3600)+" 200 128 fd00::1a4/128",
+		"# br-lan d8c4978a9f ipv4 short "+fmt.Sprint(now+3600)+" 5 32 192.168.1.103/32",
+		// too few fields and a bad valid-until
+		"# br-lan d8c4978a9f83 ipv4 x "+fmt.Sprint(now+3600)+" 5 32",
+		"# br-lan d8c4978a9f84 ipv4 x soon 5 32 192.168.1.104/32",
+	)
+
+	leases, err := (&OdhcpdSource{path: path}).Parse()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "192.168.1.100=D8:C4:97:8A:9F:7E(phone) fd00::1a2=D8:C4:97:8A:9F:7F(laptop) 2001:db8::1a2=D8:C4:97:8A:9F:7F(laptop) fd00::1a3=D8:C4:97:8A:9F:80"
+	if got := leaseSummary(leases); got != want {
+		t.Errorf("leases\n got %s\nwant %s", got, want)
+	}
+	if !leases[0].Expires.Equal(time.Unix(now+3600, 0)) {
+		t.Errorf("expiry %v", leases[0].Expires)
+	}
+	if !leases[3].Expires.Equal(time.Unix(0, 0)) {
+		t.Errorf("lease without expiry has %v", leases[3].Expires)
+	}
+}
+
+func TestMacFromDUID(t *testing.T) {
+	tests := []struct {
+		duid string
+		mac  string
+	}{
+		{"00010001278f5a5cd8c4978a9f7e", "D8:C4:97:8A:9F:7E"},
+		{"00:01:00:01:27:8f:5a:5c:d8:c4:97:8a:9f:7e", "D8:C4:97:8A:9F:7E"},
+		{"00030001d8c4978a9f7e", "D8:C4:97:8A:9F:7E"},
+		{"00:03:00:01:D8:C4:97:8A:9F:7E", "D8:C4:97:8A:9F:7E"},
+		// hardware type other than Ethernet
+		{"00030006d8c4978a9f7e", ""},
+		// DUID-EN and DUID-UUID
+		{"000200000009abcdef", ""},
+		{"00040123456789abcdef0123456789abcdef", ""},
+		// wrong lengths
+		{"00010001278f5a5cd8c4978a9f", ""},
+		{"00030001d8c4978a9f7e00", ""},
+		{"0003", ""},
+		{"", ""},
+		{"zz030001d8c4978a9f7e", ""},
+	}
+	for _, tt := range tests {
+		if got := macFromDUID(tt.duid); got != tt.mac {
+			t.Errorf("macFromDUID(%q) = %q, want %q", tt.duid, got, tt.mac)
+		}
+	}
+}
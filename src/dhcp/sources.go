@@ -8,7 +8,8 @@ import (
 	"time"
 )
 
-// Registry of all known sources
+// Registry of all known sources, in order of precedence. Every present
+// source is used and their leases merged.
 var AllSources = []LeaseSource{
 	&DnsmasqSource{path: "/var/lib/misc/dnsmasq.leases"},
 	&DnsmasqSource{path: "/tmp/dhcp.leases"},
@@ -20,6 +21,12 @@ var AllSources = []LeaseSource{
 	&DnsmasqSource{path: "/tmp/dhcp.leases"},
 	// Merlin/Asus
 	&DnsmasqSource{path: "/var/lib/misc/dnsmasq.leases"},
+	// OpenWrt DHCPv6 and odhcpd-only DHCPv4
+	&OdhcpdSource{path: "/tmp/hosts/odhcpd"},
+	&KeaSource{path: "/var/lib/kea/kea-leases4.csv"},
+	&KeaSource{path: "/var/lib/kea/kea-leases6.csv"},
+	// Devices without a lease, last so lease hostnames win
+	&NeighborSource{procPath: "/proc/net/arp"},
 }
 
 // === Dnsmasq ===
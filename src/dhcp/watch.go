@@ -0,0 +1,74 @@
+package dhcp
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// Lease files are rewritten in place (dnsmasq), or replaced by a rename
+// (odhcpd, Kea's LFC), so their directories are watched for both.
+const watchMask = unix.IN_MODIFY | unix.IN_CLOSE_WRITE | unix.IN_CREATE |
+	unix.IN_MOVED_TO | unix.IN_DELETE
+
+// watchFiles calls changed whenever one of paths is written, created,
+// replaced or removed, until ctx is done.
+func watchFiles(ctx context.Context, paths []string, changed func()) error {
+	fd, err := unix.InotifyInit1(unix.IN_CLOEXEC | unix.IN_NONBLOCK)
+	if err != nil {
+		return err
+	}
+	// Non-blocking, so reads park in the runtime poller and Close ends them
+	f := os.NewFile(uintptr(fd), "inotify")
+
+	names := make(map[int32]map[string]bool)
+	dirs := make(map[string]int32)
+	for _, p := range paths {
+		dir, name := filepath.Split(filepath.Clean(p))
+		wd, ok := dirs[dir]
+		if !ok {
+			w, err := unix.InotifyAddWatch(fd, dir, watchMask)
+			if err != nil {
+				f.Close()
+				return err
+			}
+			wd = int32(w)
+			dirs[dir] = wd
+			names[wd] = make(map[string]bool)
+		}
+		names[wd][name] = true
+	}
+
+	go func() {
+		<-ctx.Done()
+		f.Close()
+	}()
+
+	go func() {
+		buf := make([]byte, 64*(unix.SizeofInotifyEvent+unix.NAME_MAX+1))
+		for {
+			n, err := f.Read(buf)
+			if err != nil {
+				return
+			}
+			hit := false
+			for off := 0; off+unix.SizeofInotifyEvent <= n; {
+				ev := (*unix.InotifyEvent)(unsafe.Pointer(&buf[off]))
+				nameBytes := buf[off+unix.SizeofInotifyEvent : min(off+unix.SizeofInotifyEvent+int(ev.Len), n)]
+				off += unix.SizeofInotifyEvent + int(ev.Len)
+
+				if names[ev.Wd][strings.TrimRight(string(nameBytes), "\x00")] {
+					hit = true
+				}
+			}
+			if hit {
+				changed()
+			}
+		}
+	}()
+	return nil
+}
@@ -0,0 +1,541 @@
+package discovery
+
+import (
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/daniellavrushin/b4/config"
+	"github.com/daniellavrushin/b4/log"
+	"github.com/daniellavrushin/b4/nfq"
+)
+
+const (
+	// MaxBatchDomains caps a batch run, every preset is fetched once per domain
+	MaxBatchDomains = 24
+
+	// batchRefineFamilies is how many of the best phase 1 families get their
+	// phase 2 variants tested, batchRefineLimit caps the variants per family
+	batchRefineFamilies = 2
+	batchRefineLimit    = 12
+)
+
+// BatchDiscoverySuite tests every preset against a group of domains at once
+// and looks for the single set that unblocks most of them.
+type BatchDiscoverySuite struct {
+	*CheckSuite
+
+	pool            *nfq.Pool
+	cfg             *config.Config
+	members         []*DiscoverySuite
+	presets         map[string]ConfigPreset
+	order           []string
+	skipDNS         bool
+	validationTries int
+}
+
+type BatchPresetScore struct {
+	PresetName string         `json:"preset_name"`
+	Family     StrategyFamily `json:"family,omitempty"`
+	Unblocked  int            `json:"unblocked"`
+	TotalSpeed float64        `json:"total_speed"`
+	Domains    []string       `json:"domains"`
+}
+
+type BatchException struct {
+	Domain     string            `json:"domain"`
+	PresetName string            `json:"preset_name"`
+	Speed      float64           `json:"speed"`
+	Set        *config.SetConfig `json:"set"`
+}
+
+// BatchReport is the consolidated outcome of a batch run: one recommended set
+// covering as many domains as possible and per-domain exceptions for the rest.
+type BatchReport struct {
+	Ranking        []BatchPresetScore `json:"ranking"`
+	Recommended    *BatchPresetScore  `json:"recommended,omitempty"`
+	RecommendedSet *config.SetConfig  `json:"recommended_set,omitempty"`
+	Exceptions     []BatchException   `json:"exceptions"`
+	NoBypass       []string           `json:"no_bypass"`
+	Unresolved     []string           `json:"unresolved"`
+}
+
+// NewBatchDiscoverySuite prepares a batch run. label names the group (a
+// geosite category or the first domain) and becomes the recommended set name.
+func NewBatchDiscoverySuite(label string, inputs []string, pool *nfq.Pool, skipDNS bool, validationTries int) *BatchDiscoverySuite {
+	if validationTries < 1 {
+		validationTries = 1
+	}
+
+	bs := &BatchDiscoverySuite{
+		CheckSuite:      NewCheckSuite(label),
+		pool:            pool,
+		presets:         make(map[string]ConfigPreset),
+		skipDNS:         skipDNS,
+		validationTries: validationTries,
+	}
+	bs.Domain = label
+	bs.CheckURL = ""
+
+	seen := make(map[string]bool)
+	for _, input := range inputs {
+		if strings.TrimSpace(input) == "" {
+			continue
+		}
+		ds := NewDiscoverySuite(input, pool, skipDNS, nil, validationTries)
+		if seen[ds.Domain] {
+			continue
+		}
+		if len(bs.members) == MaxBatchDomains {
+			log.Warnf("Batch discovery: limited to %d domains, skipping the rest", MaxBatchDomains)
+			break
+		}
+		seen[ds.Domain] = true
+		bs.members = append(bs.members, ds)
+		bs.Domains = append(bs.Domains, ds.Domain)
+	}
+
+	return bs
+}
+
+func (bs *BatchDiscoverySuite) RunDiscovery() {
+	sandboxMu.Lock()
+	defer sandboxMu.Unlock()
+	log.SetDiscoveryActive(true)
+
+	log.DiscoveryLogf("═══════════════════════════════════════")
+	log.DiscoveryLogf("Starting batch discovery for %s (%d domains)", bs.Domain, len(bs.members))
+	log.DiscoveryLogf("═══════════════════════════════════════")
+
+	suitesMu.Lock()
+	activeSuites[bs.Id] = bs.CheckSuite
+	suitesMu.Unlock()
+
+	defer func() {
+		log.SetDiscoveryActive(false)
+		bs.EndTime = time.Now()
+	}()
+
+	bs.setStatus(CheckStatusRunning)
+
+	phase1Presets := GetPhase1Presets()
+	bs.CheckSuite.mu.Lock()
+	bs.TotalChecks = len(phase1Presets) * len(bs.members)
+	bs.DomainDiscoveryResults = make(map[string]*DomainDiscoveryResult, len(bs.members))
+	for _, m := range bs.members {
+		bs.DomainDiscoveryResults[m.Domain] = m.domainResult
+	}
+	bs.CheckSuite.mu.Unlock()
+
+	bs.cfg = bs.pool.GetFirstWorkerConfig()
+	if bs.cfg == nil {
+		log.Errorf("Failed to get original configuration")
+		bs.setStatus(CheckStatusFailed)
+		return
+	}
+
+	for _, m := range bs.members {
+		// Each member gets its own copy of the main set, DNS bypass is per domain
+		mainSet := *bs.cfg.MainSet
+		cfg := *bs.cfg
+		cfg.MainSet = &mainSet
+		m.cfg = &cfg
+	}
+
+	if bs.skipDNS {
+		log.DiscoveryLogf("Skipping DNS discovery (user requested)")
+	} else {
+		bs.setPhase(PhaseDNS)
+		for _, m := range bs.members {
+			if bs.canceled() {
+				break
+			}
+			dnsResult := m.runDNSDiscovery()
+			m.domainResult.DNSResult = dnsResult
+			if dnsResult == nil {
+				continue
+			}
+			if len(dnsResult.ExpectedIPs) > 0 {
+				m.dnsResult = dnsResult
+			}
+			if dnsResult.IsPoisoned && dnsResult.hasWorkingConfig() {
+				m.applyDNSConfig(dnsResult)
+			}
+		}
+	}
+
+	bs.setPhase(PhaseStrategy)
+	log.DiscoveryLogf("Phase 1: Testing %d strategy families against %d domains", len(phase1Presets), len(bs.members))
+	for _, preset := range phase1Presets {
+		if bs.canceled() {
+			break
+		}
+		bs.testPreset(preset)
+	}
+
+	if !bs.canceled() {
+		bs.setPhase(PhaseOptimize)
+		bs.runRefinement()
+	}
+
+	bs.restoreConfig()
+	bs.finalize()
+	bs.logSummary()
+}
+
+// runRefinement tests the phase 2 variants of the families that unblocked
+// the most domains in phase 1.
+func (bs *BatchDiscoverySuite) runRefinement() {
+	bs.CheckSuite.mu.RLock()
+	ranking := rankBatchPresets(bs.order, bs.presets, bs.domainResults(), bs.noBypassDomains())
+	bs.CheckSuite.mu.RUnlock()
+
+	var families []StrategyFamily
+	for _, score := range ranking {
+		if score.Unblocked == 0 || len(families) == batchRefineFamilies {
+			break
+		}
+		if score.Family == "" || score.Family == FamilyNone || containsFamily(families, score.Family) {
+			continue
+		}
+		families = append(families, score.Family)
+	}
+
+	for _, family := range families {
+		var presets []ConfigPreset
+		for _, preset := range GetPhase2Presets(family) {
+			if _, tested := bs.presets[preset.Name]; tested {
+				continue
+			}
+			presets = append(presets, preset)
+			if len(presets) == batchRefineLimit {
+				break
+			}
+		}
+
+		log.DiscoveryLogf("Phase 2: Testing %d %s variants", len(presets), family)
+
+		bs.CheckSuite.mu.Lock()
+		bs.TotalChecks += len(presets) * len(bs.members)
+		bs.CheckSuite.mu.Unlock()
+
+		for _, preset := range presets {
+			if bs.canceled() {
+				return
+			}
+			bs.testPreset(preset)
+		}
+	}
+}
+
+// testPreset installs one probe config covering all domains and fetches each
+// of them through it.
+func (bs *BatchDiscoverySuite) testPreset(preset ConfigPreset) {
+	log.DiscoveryLogf("  Testing '%s'...", preset.Name)
+
+	bs.presets[preset.Name] = preset
+	bs.order = append(bs.order, preset.Name)
+
+	testConfig := bs.buildTestConfig(preset, bs.members)
+	if err := bs.pool.SetProbeConfig(testConfig); err != nil {
+		log.DiscoveryLogf("    → FAILED (config error: %v)", err)
+		for _, m := range bs.members {
+			bs.storeResult(m, preset, CheckResult{Domain: m.Domain, Status: CheckStatusFailed, Error: err.Error()})
+		}
+		return
+	}
+
+	time.Sleep(time.Duration(bs.cfg.System.Checker.ConfigPropagateMs) * time.Millisecond)
+
+	unblocked := 0
+	for _, m := range bs.members {
+		if bs.canceled() {
+			return
+		}
+		result, _ := m.validate(nil)
+		bs.storeResult(m, preset, result)
+		if result.Status == CheckStatusComplete {
+			unblocked++
+		}
+	}
+
+	log.DiscoveryLogf("    → %d/%d domains OK", unblocked, len(bs.members))
+}
+
+// buildTestConfig merges the per-domain test configs of members into one set
+func (bs *BatchDiscoverySuite) buildTestConfig(preset ConfigPreset, members []*DiscoverySuite) *config.Config {
+	var merged *config.Config
+
+	for _, m := range members {
+		testConfig := m.buildTestConfig(preset)
+		if merged == nil {
+			merged = testConfig
+			continue
+		}
+
+		set, from := merged.MainSet, testConfig.MainSet
+		set.Targets.SNIDomains = appendUnique(set.Targets.SNIDomains, from.Targets.SNIDomains...)
+		set.Targets.DomainsToMatch = appendUnique(set.Targets.DomainsToMatch, from.Targets.DomainsToMatch...)
+		set.Targets.IPs = appendUnique(set.Targets.IPs, from.Targets.IPs...)
+		set.Targets.IpsToMatch = appendUnique(set.Targets.IpsToMatch, from.Targets.IpsToMatch...)
+		set.Targets.GeoSiteCategories = appendUnique(set.Targets.GeoSiteCategories, from.Targets.GeoSiteCategories...)
+		set.Targets.GeoIpCategories = appendUnique(set.Targets.GeoIpCategories, from.Targets.GeoIpCategories...)
+		if !set.DNS.Enabled && from.DNS.Enabled {
+			set.DNS = from.DNS
+		}
+	}
+
+	return merged
+}
+
+func (bs *BatchDiscoverySuite) storeResult(m *DiscoverySuite, preset ConfigPreset, result CheckResult) {
+	bs.CheckSuite.mu.Lock()
+	defer bs.CheckSuite.mu.Unlock()
+
+	bs.CompletedChecks++
+	switch result.Status {
+	case CheckStatusComplete:
+		bs.SuccessfulChecks++
+	case CheckStatusFailed:
+		bs.FailedChecks++
+	}
+
+	dr := m.domainResult
+	dr.Results[preset.Name] = &DomainPresetResult{
+		PresetName: preset.Name,
+		Family:     preset.Family,
+		Phase:      preset.Phase,
+		Status:     result.Status,
+		Duration:   result.Duration,
+		Speed:      result.Speed,
+		BytesRead:  result.BytesRead,
+		Error:      result.Error,
+		StatusCode: result.StatusCode,
+	}
+
+	if preset.Name == "no-bypass" {
+		if result.Status == CheckStatusComplete {
+			dr.BaselineSpeed = result.Speed
+		}
+		return
+	}
+
+	if result.Status == CheckStatusComplete && result.Speed > dr.BestSpeed {
+		dr.BestPreset = preset.Name
+		dr.BestSpeed = result.Speed
+		dr.BestSuccess = true
+		if dr.BaselineSpeed > 0 {
+			dr.Improvement = ((result.Speed - dr.BaselineSpeed) / dr.BaselineSpeed) * 100
+		}
+	}
+}
+
+func (bs *BatchDiscoverySuite) domainResults() map[string]*DomainDiscoveryResult {
+	results := make(map[string]*DomainDiscoveryResult, len(bs.members))
+	for _, m := range bs.members {
+		results[m.Domain] = m.domainResult
+	}
+	return results
+}
+
+// noBypassDomains returns the domains that load without any bypass, they
+// don't count towards a preset's score.
+func (bs *BatchDiscoverySuite) noBypassDomains() []string {
+	var domains []string
+	for _, m := range bs.members {
+		if r, ok := m.domainResult.Results["no-bypass"]; ok && r.Status == CheckStatusComplete {
+			domains = append(domains, m.Domain)
+		}
+	}
+	return domains
+}
+
+// buildReport ranks the presets and picks the recommended set. Domains the
+// recommended preset doesn't unblock fall back to their own fastest preset.
+func (bs *BatchDiscoverySuite) buildReport() *BatchReport {
+	noBypass := bs.noBypassDomains()
+	report := &BatchReport{
+		Ranking:    rankBatchPresets(bs.order, bs.presets, bs.domainResults(), noBypass),
+		Exceptions: []BatchException{},
+		NoBypass:   append([]string{}, noBypass...),
+		Unresolved: []string{},
+	}
+
+	covered := make(map[string]bool)
+	for _, domain := range noBypass {
+		covered[domain] = true
+	}
+
+	var recommended []*DiscoverySuite
+	if len(report.Ranking) > 0 && report.Ranking[0].Unblocked > 0 {
+		best := report.Ranking[0]
+		report.Recommended = &best
+
+		for _, domain := range best.Domains {
+			covered[domain] = true
+		}
+		for _, m := range bs.members {
+			if containsString(best.Domains, m.Domain) {
+				recommended = append(recommended, m)
+			}
+		}
+
+		set := bs.buildTestConfig(bs.presets[best.PresetName], recommended).MainSet
+		set.Id = ""
+		set.Name = bs.Domain
+		report.RecommendedSet = set
+	}
+
+	for _, m := range bs.members {
+		if covered[m.Domain] {
+			continue
+		}
+
+		dr := m.domainResult
+		if !dr.BestSuccess {
+			report.Unresolved = append(report.Unresolved, m.Domain)
+			continue
+		}
+
+		set := m.buildTestConfig(bs.presets[dr.BestPreset]).MainSet
+		set.Id = ""
+		set.Name = m.Domain
+		report.Exceptions = append(report.Exceptions, BatchException{
+			Domain:     m.Domain,
+			PresetName: dr.BestPreset,
+			Speed:      dr.BestSpeed,
+			Set:        set,
+		})
+	}
+
+	return report
+}
+
+// rankBatchPresets orders presets by how many domains needing a bypass they
+// unblock, then by aggregate speed. Ties keep the test order.
+func rankBatchPresets(order []string, presets map[string]ConfigPreset, results map[string]*DomainDiscoveryResult, noBypass []string) []BatchPresetScore {
+	domains := make([]string, 0, len(results))
+	for domain := range results {
+		if !containsString(noBypass, domain) {
+			domains = append(domains, domain)
+		}
+	}
+	sort.Strings(domains)
+
+	ranking := make([]BatchPresetScore, 0, len(order))
+	for _, name := range order {
+		if name == "no-bypass" {
+			continue
+		}
+
+		score := BatchPresetScore{PresetName: name, Family: presets[name].Family, Domains: []string{}}
+		for _, domain := range domains {
+			r, ok := results[domain].Results[name]
+			if !ok || r.Status != CheckStatusComplete {
+				continue
+			}
+			score.Unblocked++
+			score.TotalSpeed += r.Speed
+			score.Domains = append(score.Domains, domain)
+		}
+		ranking = append(ranking, score)
+	}
+
+	sort.SliceStable(ranking, func(i, j int) bool {
+		if ranking[i].Unblocked != ranking[j].Unblocked {
+			return ranking[i].Unblocked > ranking[j].Unblocked
+		}
+		return ranking[i].TotalSpeed > ranking[j].TotalSpeed
+	})
+
+	return ranking
+}
+
+func (bs *BatchDiscoverySuite) canceled() bool {
+	select {
+	case <-bs.cancel:
+		return true
+	default:
+		return false
+	}
+}
+
+func (bs *BatchDiscoverySuite) setStatus(status CheckStatus) {
+	bs.CheckSuite.mu.Lock()
+	bs.Status = status
+	bs.CheckSuite.mu.Unlock()
+}
+
+func (bs *BatchDiscoverySuite) setPhase(phase DiscoveryPhase) {
+	bs.CheckSuite.mu.Lock()
+	bs.CurrentPhase = phase
+	bs.CheckSuite.mu.Unlock()
+}
+
+func (bs *BatchDiscoverySuite) restoreConfig() {
+	log.DiscoveryLogf("Clearing discovery sandbox")
+	bs.pool.ClearProbeConfig()
+}
+
+func (bs *BatchDiscoverySuite) finalize() {
+	bs.CheckSuite.mu.Lock()
+	bs.BatchReport = bs.buildReport()
+	if bs.Status != CheckStatusCanceled {
+		bs.Status = CheckStatusComplete
+	}
+	bs.CheckSuite.mu.Unlock()
+
+	go func() {
+		time.Sleep(30 * time.Second)
+		suitesMu.Lock()
+		delete(activeSuites, bs.Id)
+		suitesMu.Unlock()
+	}()
+}
+
+func (bs *BatchDiscoverySuite) logSummary() {
+	bs.CheckSuite.mu.RLock()
+	defer bs.CheckSuite.mu.RUnlock()
+
+	report := bs.BatchReport
+	duration := time.Since(bs.StartTime)
+
+	log.DiscoveryLogf("═══════════════════════════════════════")
+	if report.Recommended != nil {
+		log.DiscoveryLogf("✓ Batch discovery complete: %s", bs.Domain)
+		log.DiscoveryLogf("  Best config: %s (%d/%d domains, %.2f KB/s total)",
+			report.Recommended.PresetName, report.Recommended.Unblocked,
+			len(bs.members)-len(report.NoBypass), report.Recommended.TotalSpeed/1024)
+	} else {
+		log.DiscoveryLogf("✗ Batch discovery complete: no working config found")
+	}
+	if len(report.NoBypass) > 0 {
+		log.DiscoveryLogf("  No bypass needed: %s", strings.Join(report.NoBypass, ", "))
+	}
+	for _, e := range report.Exceptions {
+		log.DiscoveryLogf("  Exception: %s → %s", e.Domain, e.PresetName)
+	}
+	if len(report.Unresolved) > 0 {
+		log.DiscoveryLogf("  Unresolved: %s", strings.Join(report.Unresolved, ", "))
+	}
+	log.DiscoveryLogf("  Tested %d configurations in %v", len(bs.order), duration.Round(time.Second))
+	log.DiscoveryLogf("═══════════════════════════════════════")
+}
+
+func appendUnique(dst []string, values ...string) []string {
+	for _, v := range values {
+		if !containsString(dst, v) {
+			dst = append(dst, v)
+		}
+	}
+	return dst
+}
+
+func containsString(values []string, target string) bool {
+	for _, v := range values {
+		if v == target {
+			return true
+		}
+	}
+	return false
+}
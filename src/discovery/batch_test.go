@@ -0,0 +1,124 @@
+package discovery
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/daniellavrushin/b4/config"
+)
+
+// batchFixture builds a finished batch run. speeds maps a preset to the
+// domains it unblocked and their speed, domains missing failed.
+func batchFixture(t *testing.T, domains []string, order []string, speeds map[string]map[string]float64) *BatchDiscoverySuite {
+	t.Helper()
+	cfg := config.NewConfig()
+	bs := NewBatchDiscoverySuite("group", domains, nil, true, 1)
+	bs.order = order
+	families := []StrategyFamily{FamilyTCPFrag, FamilyTLSRec, FamilyOOB, FamilyFakeSNI, FamilyDesync}
+	for i, name := range order {
+		bs.presets[name] = ConfigPreset{Name: name, Family: families[i%len(families)], Config: config.NewSetConfig()}
+	}
+	for _, m := range bs.members {
+		m.cfg = &cfg
+		for _, name := range order {
+			result := CheckResult{Domain: m.Domain, Status: CheckStatusFailed}
+			if speed, ok := speeds[name][m.Domain]; ok {
+				result.Status, result.Speed = CheckStatusComplete, speed
+			}
+			bs.storeResult(m, bs.presets[name], result)
+		}
+	}
+	return bs
+}
+
+func rankingSummary(ranking []BatchPresetScore) string {
+	parts := make([]string, len(ranking))
+	for i, s := range ranking {
+		parts[i] = s.PresetName + ":" + strings.Join(s.Domains, ",")
+	}
+	return strings.Join(parts, " ")
+}
+
+func TestRankBatchPresets(t *testing.T) {
+	bs := batchFixture(t,
+		[]string{"a.test", "b.test", "c.test", "d.test", "e.test"},
+		[]string{"no-bypass", "p1", "p2", "p3", "p4", "p5"},
+		map[string]map[string]float64{
+			"no-bypass": {"e.test": 500},
+			// e.test loads anyway, it must not lift p1 above p2
+			"p1": {"a.test": 100, "b.test": 100, "e.test": 1000},
+			"p2": {"a.test": 50, "b.test": 60, "d.test": 70},
+			// same count and speed as p1, tested later
+			"p3": {"a.test": 100, "b.test": 100},
+			// unblocks as many as p2 but slower
+			"p4": {"a.test": 10, "b.test": 10, "c.test": 10},
+			"p5": {"c.test": 40, "d.test": 90},
+		})
+
+	ranking := rankBatchPresets(bs.order, bs.presets, bs.domainResults(), bs.noBypassDomains())
+	want := "p2:a.test,b.test,d.test p4:a.test,b.test,c.test p1:a.test,b.test p3:a.test,b.test p5:c.test,d.test"
+	if got := rankingSummary(ranking); got != want {
+		t.Errorf("ranking\n got %s\nwant %s", got, want)
+	}
+	if ranking[0].Unblocked != 3 || ranking[0].TotalSpeed != 180 || ranking[0].Family != FamilyOOB {
+		t.Errorf("best score %+v", ranking[0])
+	}
+	if ranking[2].TotalSpeed != 200 {
+		t.Errorf("no-bypass domain counted in the speed: %v", ranking[2].TotalSpeed)
+	}
+}
+
+func TestBuildBatchReport(t *testing.T) {
+	bs := batchFixture(t,
+		[]string{"a.test", "b.test", "c.test", "d.test", "e.test", "f.test"},
+		[]string{"no-bypass", "p1", "p2", "p3"},
+		map[string]map[string]float64{
+			"no-bypass": {"e.test": 500},
+			"p1":        {"a.test": 100, "b.test": 100, "c.test": 10},
+			"p2":        {"c.test": 40, "d.test": 90, "e.test": 900},
+			"p3":        {"d.test": 50},
+		})
+
+	report := bs.buildReport()
+	if report.Recommended == nil || report.Recommended.PresetName != "p1" {
+		t.Fatalf("recommended %+v", report.Recommended)
+	}
+	set := report.RecommendedSet
+	if set == nil || set.Name != "group" || set.Id != "" {
+		t.Fatalf("recommended set %+v", set)
+	}
+	if got := strings.Join(set.Targets.SNIDomains, ","); got != "a.test,b.test,c.test" {
+		t.Errorf("recommended set targets %s", got)
+	}
+
+	// d.test is left to its fastest preset, e.test needs none, f.test
+	// found nothing
+	if len(report.Exceptions) != 1 {
+		t.Fatalf("exceptions %+v", report.Exceptions)
+	}
+	e := report.Exceptions[0]
+	if e.Domain != "d.test" || e.PresetName != "p2" || e.Speed != 90 {
+		t.Errorf("exception %s -> %s at %.0f", e.Domain, e.PresetName, e.Speed)
+	}
+	if e.Set == nil || e.Set.Name != "d.test" || strings.Join(e.Set.Targets.SNIDomains, ",") != "d.test" {
+		t.Errorf("exception set %+v", e.Set)
+	}
+	if strings.Join(report.NoBypass, ",") != "e.test" || strings.Join(report.Unresolved, ",") != "f.test" {
+		t.Errorf("no bypass %v, unresolved %v", report.NoBypass, report.Unresolved)
+	}
+}
+
+func TestBuildBatchReportNothingWorks(t *testing.T) {
+	bs := batchFixture(t,
+		[]string{"a.test", "b.test"},
+		[]string{"no-bypass", "p1"},
+		map[string]map[string]float64{"no-bypass": {"b.test": 100}})
+
+	report := bs.buildReport()
+	if report.Recommended != nil || report.RecommendedSet != nil {
+		t.Errorf("recommended %+v", report.Recommended)
+	}
+	if len(report.Exceptions) != 0 || strings.Join(report.Unresolved, ",") != "a.test" {
+		t.Errorf("exceptions %v, unresolved %v", report.Exceptions, report.Unresolved)
+	}
+}
@@ -73,6 +73,8 @@ func parseDiscoveryInput(input string) (domain string, testURL string) {
 }
 
 func (ds *DiscoverySuite) RunDiscovery() {
+	sandboxMu.Lock()
+	defer sandboxMu.Unlock()
 	log.SetDiscoveryActive(true)
 
 	log.DiscoveryLogf("═══════════════════════════════════════")
@@ -538,7 +540,7 @@ func (ds *DiscoverySuite) testPresetInternal(preset ConfigPreset) CheckResult {
 
 	testConfig := ds.buildTestConfig(preset)
 
-	if err := ds.pool.UpdateConfig(testConfig); err != nil {
+	if err := ds.pool.SetProbeConfig(testConfig); err != nil {
 		log.DiscoveryLogf("    → FAILED (config error: %v)", err)
 		return CheckResult{
 			Domain: ds.Domain,
@@ -549,13 +551,34 @@ func (ds *DiscoverySuite) testPresetInternal(preset ConfigPreset) CheckResult {
 
 	time.Sleep(time.Duration(ds.cfg.System.Checker.ConfigPropagateMs) * time.Millisecond)
 
-	// Run validation tries
+	result, successCount := ds.validate(testConfig.MainSet)
+
+	// Consider the preset valid only if all tries succeeded
+	if successCount == ds.validationTries {
+		if ds.validationTries > 1 {
+			log.DiscoveryLogf("    → OK (%.2f KB/s, %d bytes) - %d/%d tries succeeded",
+				result.Speed/1024, result.BytesRead, successCount, ds.validationTries)
+		} else {
+			log.DiscoveryLogf("    → OK (%.2f KB/s, %d bytes)", result.Speed/1024, result.BytesRead)
+		}
+	} else if ds.validationTries > 1 {
+		log.DiscoveryLogf("    → FAILED (%d/%d tries succeeded)", successCount, ds.validationTries)
+	} else {
+		log.DiscoveryLogf("    → FAILED (%s)", result.Error)
+	}
+	return result
+}
+
+// validate fetches the check URL validationTries times with the probe
+// config already in place. The result only counts as complete when every
+// try succeeded.
+func (ds *DiscoverySuite) validate(set *config.SetConfig) (CheckResult, int) {
 	successCount := 0
 	var lastResult CheckResult
 
 	for i := 0; i < ds.validationTries; i++ {
 		result := ds.fetchWithTimeout(time.Duration(ds.cfg.System.Checker.DiscoveryTimeoutSec) * time.Second)
-		result.Set = testConfig.MainSet
+		result.Set = set
 		lastResult = result
 
 		if result.Status == CheckStatusComplete {
@@ -568,25 +591,11 @@ func (ds *DiscoverySuite) testPresetInternal(preset ConfigPreset) CheckResult {
 		}
 	}
 
-	// Consider the preset valid only if all tries succeeded
-	if successCount == ds.validationTries {
-		if ds.validationTries > 1 {
-			log.DiscoveryLogf("    → OK (%.2f KB/s, %d bytes) - %d/%d tries succeeded",
-				lastResult.Speed/1024, lastResult.BytesRead, successCount, ds.validationTries)
-		} else {
-			log.DiscoveryLogf("    → OK (%.2f KB/s, %d bytes)", lastResult.Speed/1024, lastResult.BytesRead)
-		}
-		return lastResult
-	} else {
-		if ds.validationTries > 1 {
-			log.DiscoveryLogf("    → FAILED (%d/%d tries succeeded)", successCount, ds.validationTries)
-			lastResult.Status = CheckStatusFailed
-			lastResult.Error = fmt.Sprintf("validation failed: %d/%d tries succeeded", successCount, ds.validationTries)
-		} else {
-			log.DiscoveryLogf("    → FAILED (%s)", lastResult.Error)
-		}
-		return lastResult
+	if successCount != ds.validationTries && ds.validationTries > 1 {
+		lastResult.Status = CheckStatusFailed
+		lastResult.Error = fmt.Sprintf("validation failed: %d/%d tries succeeded", successCount, ds.validationTries)
 	}
+	return lastResult, successCount
 }
 
 func (ds *DiscoverySuite) testPreset(preset ConfigPreset) CheckResult {
@@ -683,16 +692,10 @@ func (ds *DiscoverySuite) fetchWithTimeoutUsingIP(timeout time.Duration, ip stri
 			}
 			directAddr := net.JoinHostPort(ip, port)
 			log.Tracef("DNS bypass: connecting to %s instead of %s", directAddr, addr)
-			return (&net.Dialer{
-				Timeout:   timeout / 2,
-				KeepAlive: timeout,
-			}).DialContext(ctx, network, directAddr)
+			return newProbeDialer(ds.cfg, timeout/2, timeout).DialContext(ctx, network, directAddr)
 		}
 	} else {
-		transport.DialContext = (&net.Dialer{
-			Timeout:   timeout / 2,
-			KeepAlive: timeout,
-		}).DialContext
+		transport.DialContext = newProbeDialer(ds.cfg, timeout/2, timeout).DialContext
 	}
 
 	client := &http.Client{
@@ -996,10 +999,8 @@ func (ds *DiscoverySuite) finalize() {
 }
 
 func (ds *DiscoverySuite) restoreConfig() {
-	log.DiscoveryLogf("Restoring original configuration")
-	if err := ds.pool.UpdateConfig(ds.cfg); err != nil {
-		log.DiscoveryLogf("Failed to restore original configuration: %v", err)
-	}
+	log.DiscoveryLogf("Clearing discovery sandbox")
+	ds.pool.ClearProbeConfig()
 }
 
 func (ds *DiscoverySuite) logDiscoverySummary() {
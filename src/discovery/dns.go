@@ -448,18 +448,25 @@ func (p *DNSProber) testDNSWithFragment(server string, expectedIP string) DNSPro
 		ExpectedIP: expectedIP,
 	}
 
-	// Apply DNS config to pool temporarily
+	// Apply DNS config to probe traffic only
 	testCfg := p.buildDNSTestConfig(server, true)
-	if err := p.pool.UpdateConfig(testCfg); err != nil {
+	if err := p.pool.SetProbeConfig(testCfg); err != nil {
 		return result
 	}
-	defer p.pool.UpdateConfig(p.cfg) // Restore
+	defer p.pool.ClearProbeConfig()
 
 	time.Sleep(time.Duration(p.cfg.System.Checker.ConfigPropagateMs) * time.Millisecond)
 
-	// Now DNS queries should be fragmented via NFQ
+	// Marked DNS queries should now be redirected and fragmented via NFQ
+	resolver := &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			return newProbeDialer(p.cfg, p.timeout, 0).DialContext(ctx, network, address)
+		},
+	}
+
 	start := time.Now()
-	ips, err := net.LookupIP(p.domain)
+	ips, err := resolver.LookupIP(context.Background(), "ip", p.domain)
 	result.Latency = time.Since(start)
 
 	if err != nil || len(ips) == 0 {
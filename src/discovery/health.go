@@ -0,0 +1,421 @@
+package discovery
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/daniellavrushin/b4/config"
+	"github.com/daniellavrushin/b4/log"
+	"github.com/daniellavrushin/b4/metrics"
+	"github.com/daniellavrushin/b4/nfq"
+	"github.com/daniellavrushin/b4/sni/domainrule"
+)
+
+const (
+	healthTick        = time.Minute
+	healthHistorySize = 48
+
+	// healthDegradedRate is the success rate, in percent, under which a set
+	// that passed its last check still counts as degraded
+	healthDegradedRate = 80
+)
+
+type HealthStatus string
+
+const (
+	HealthUnknown  HealthStatus = "unknown"
+	HealthOK       HealthStatus = "healthy"
+	HealthDegraded HealthStatus = "degraded"
+	HealthFailing  HealthStatus = "failing"
+)
+
+type HealthSample struct {
+	Time    time.Time     `json:"time"`
+	Success bool          `json:"success"`
+	Latency time.Duration `json:"latency"`
+	Speed   float64       `json:"speed"`
+	Error   string        `json:"error,omitempty"`
+}
+
+// HealthProposal is a replacement strategy found by discovery after a set
+// started failing. It is only applied after review.
+type HealthProposal struct {
+	PresetName string            `json:"preset_name"`
+	Domains    []string          `json:"domains"`
+	Set        *config.SetConfig `json:"set"`
+	Time       time.Time         `json:"time"`
+}
+
+type SetHealth struct {
+	SetId               string          `json:"set_id"`
+	SetName             string          `json:"set_name"`
+	URL                 string          `json:"url"`
+	Status              HealthStatus    `json:"status"`
+	SuccessRate         float64         `json:"success_rate"`
+	AvgLatency          time.Duration   `json:"avg_latency"`
+	ConsecutiveFailures int             `json:"consecutive_failures"`
+	LastCheck           time.Time       `json:"last_check,omitzero"`
+	NextCheck           time.Time       `json:"next_check,omitzero"`
+	History             []HealthSample  `json:"history"`
+	DiscoveryId         string          `json:"discovery_id,omitempty"`
+	Proposal            *HealthProposal `json:"proposal,omitempty"`
+}
+
+type healthMonitor struct {
+	mu   sync.Mutex
+	pool *nfq.Pool
+	sets map[string]*SetHealth
+	stop chan struct{}
+}
+
+var health = &healthMonitor{sets: make(map[string]*SetHealth)}
+
+// sandboxMu is held by whoever installs probe configs in the pool: a running
+// discovery or a health check.
+var sandboxMu sync.Mutex
+
+var errSandboxBusy = errors.New("discovery is running, try again when it is done")
+
+// StartHealthChecks periodically fetches the probe URL of every set with
+// health checks enabled, through a probe sandbox holding only that set.
+func StartHealthChecks(pool *nfq.Pool) {
+	health.mu.Lock()
+	if health.stop != nil {
+		health.mu.Unlock()
+		return
+	}
+	stop := make(chan struct{})
+	health.stop = stop
+	health.pool = pool
+	health.mu.Unlock()
+
+	go func() {
+		ticker := time.NewTicker(healthTick)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+			}
+			health.checkDue()
+		}
+	}()
+}
+
+// StopHealthChecks stops the checks started by StartHealthChecks.
+func StopHealthChecks() {
+	health.mu.Lock()
+	defer health.mu.Unlock()
+	if health.stop != nil {
+		close(health.stop)
+		health.stop = nil
+	}
+}
+
+// GetSetHealth returns the health of every checked set, ordered by name.
+func GetSetHealth() []SetHealth {
+	health.mu.Lock()
+	defer health.mu.Unlock()
+
+	result := make([]SetHealth, 0, len(health.sets))
+	for _, h := range health.sets {
+		result = append(result, h.snapshot())
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].SetName < result[j].SetName })
+	return result
+}
+
+// RunHealthCheck checks a set right away instead of waiting for its turn.
+func RunHealthCheck(setId string) (SetHealth, error) {
+	health.mu.Lock()
+	pool := health.pool
+	health.mu.Unlock()
+
+	if pool == nil {
+		return SetHealth{}, fmt.Errorf("health checks are not running")
+	}
+
+	cfg := pool.GetFirstWorkerConfig()
+	if cfg == nil {
+		return SetHealth{}, fmt.Errorf("configuration not available")
+	}
+	for _, set := range cfg.Sets {
+		if set.Id == setId {
+			if !set.Enabled || !set.Health.Enabled {
+				return SetHealth{}, fmt.Errorf("health checks are disabled for set '%s'", set.Name)
+			}
+			return health.check(cfg, set)
+		}
+	}
+	return SetHealth{}, fmt.Errorf("set not found")
+}
+
+// GetHealthProposal returns the replacement discovery proposed for a set.
+func GetHealthProposal(setId string) (*HealthProposal, bool) {
+	health.mu.Lock()
+	defer health.mu.Unlock()
+	h, ok := health.sets[setId]
+	if !ok || h.Proposal == nil {
+		return nil, false
+	}
+	return h.Proposal, true
+}
+
+// DismissHealthProposal drops the proposal of a set, once applied or rejected.
+func DismissHealthProposal(setId string) {
+	health.mu.Lock()
+	defer health.mu.Unlock()
+	if h, ok := health.sets[setId]; ok {
+		h.Proposal = nil
+	}
+}
+
+// checkDue runs the checks whose interval has passed and forgets sets that
+// were removed or had their health checks disabled.
+func (hm *healthMonitor) checkDue() {
+	cfg := hm.pool.GetFirstWorkerConfig()
+	if cfg == nil {
+		return
+	}
+
+	now := time.Now()
+	seen := make(map[string]bool)
+	var due []*config.SetConfig
+
+	hm.mu.Lock()
+	for _, set := range cfg.Sets {
+		if !set.Enabled || !set.Health.Enabled {
+			continue
+		}
+		seen[set.Id] = true
+		h := hm.get(set)
+		if h.NextCheck.IsZero() || !now.Before(h.NextCheck) {
+			due = append(due, set)
+		}
+	}
+	for id := range hm.sets {
+		if !seen[id] {
+			delete(hm.sets, id)
+		}
+	}
+	hm.mu.Unlock()
+
+	for _, set := range due {
+		// The rest waits for the next tick when discovery holds the sandbox
+		if _, err := hm.check(cfg, set); err != nil {
+			return
+		}
+	}
+}
+
+// check fetches the probe URL of set through a sandbox holding only that set.
+func (hm *healthMonitor) check(cfg *config.Config, set *config.SetConfig) (SetHealth, error) {
+	if !sandboxMu.TryLock() {
+		return SetHealth{}, errSandboxBusy
+	}
+	domain, checkURL := parseDiscoveryInput(set.HealthProbeURL())
+	ds := &DiscoverySuite{
+		CheckSuite: &CheckSuite{Domain: domain, CheckURL: checkURL},
+		cfg:        cfg,
+	}
+	result := CheckResult{Status: CheckStatusFailed}
+	if err := hm.pool.SetProbeConfig(healthProbeConfig(cfg, set)); err != nil {
+		result.Error = err.Error()
+	} else {
+		result = ds.fetchWithTimeoutUsingIP(time.Duration(cfg.System.Checker.DiscoveryTimeoutSec)*time.Second, "")
+		hm.pool.ClearProbeConfig()
+	}
+	sandboxMu.Unlock()
+
+	sample := HealthSample{
+		Time:    time.Now(),
+		Success: result.Status == CheckStatusComplete,
+		Latency: result.Duration,
+		Speed:   result.Speed,
+		Error:   result.Error,
+	}
+
+	hm.mu.Lock()
+	h := hm.get(set)
+	prev := h.Status
+	h.record(sample, set.Health.FailureThreshold)
+	h.NextCheck = sample.Time.Add(set.Health.Interval())
+	discover := h.needsDiscovery(prev, set)
+	snapshot := h.snapshot()
+	hm.mu.Unlock()
+
+	log.Tracef("Health check of set '%s' (%s): %s", set.Name, checkURL, snapshot.Status)
+	notifyHealthChange(snapshot, prev)
+
+	if discover {
+		hm.discover(cfg, set)
+	}
+	return snapshot, nil
+}
+
+// healthProbeConfig holds set alone, enabled and without device or schedule
+// limits: probes come from the router itself, outside any device list, and
+// a check has to test the strategy whether or not the set is active now.
+func healthProbeConfig(cfg *config.Config, set *config.SetConfig) *config.Config {
+	s := *set
+	s.Enabled = true
+	s.Schedule.Enabled = false
+	s.Targets.Devices = nil
+	return &config.Config{
+		ConfigPath: cfg.ConfigPath,
+		Queue:      cfg.Queue,
+		System:     cfg.System,
+		MainSet:    &s,
+		Sets:       []*config.SetConfig{&s},
+	}
+}
+
+// get returns the health record of set, creating it when missing. The
+// caller holds hm.mu.
+func (hm *healthMonitor) get(set *config.SetConfig) *SetHealth {
+	h, ok := hm.sets[set.Id]
+	if !ok {
+		h = &SetHealth{SetId: set.Id, Status: HealthUnknown, History: []HealthSample{}}
+		hm.sets[set.Id] = h
+	}
+	h.SetName = set.Name
+	h.URL = set.HealthProbeURL()
+	return h
+}
+
+// discover looks for a replacement strategy for the domains of a failing
+// set and keeps the result as a proposal.
+func (hm *healthMonitor) discover(cfg *config.Config, set *config.SetConfig) {
+	if log.IsDiscoveryActive() {
+		log.Infof("Discovery already running, not searching a replacement for set '%s'", set.Name)
+		return
+	}
+
+	inputs := []string{set.HealthProbeURL()}
+	for _, target := range set.Targets.SNIDomains {
+		if host, ok := domainrule.Host(target); ok {
+			inputs = append(inputs, host)
+		}
+	}
+
+	suite := NewBatchDiscoverySuite(set.Name, inputs, hm.pool, false, cfg.System.Checker.ValidationTries)
+
+	hm.mu.Lock()
+	hm.get(set).DiscoveryId = suite.Id
+	hm.mu.Unlock()
+
+	log.Infof("Set '%s' is failing, starting discovery for %d domains", set.Name, len(suite.Domains))
+
+	go func() {
+		suite.RunDiscovery()
+
+		suite.CheckSuite.mu.RLock()
+		report := suite.BatchReport
+		suite.CheckSuite.mu.RUnlock()
+
+		hm.mu.Lock()
+		defer hm.mu.Unlock()
+
+		h, ok := hm.sets[set.Id]
+		if !ok {
+			return
+		}
+		h.DiscoveryId = ""
+		if report == nil || report.Recommended == nil {
+			metrics.GetMetricsCollector().RecordEvent("warning",
+				fmt.Sprintf("Discovery found no replacement for failing set '%s'", set.Name))
+			return
+		}
+
+		h.Proposal = &HealthProposal{
+			PresetName: report.Recommended.PresetName,
+			Domains:    report.Recommended.Domains,
+			Set:        report.RecommendedSet,
+			Time:       time.Now(),
+		}
+		metrics.GetMetricsCollector().RecordEvent("info",
+			fmt.Sprintf("Discovery proposes '%s' for set '%s'", report.Recommended.PresetName, set.Name))
+	}()
+}
+
+// record adds a sample and updates the status, success rate and latency.
+func (h *SetHealth) record(s HealthSample, threshold int) {
+	h.History = append(h.History, s)
+	if len(h.History) > healthHistorySize {
+		h.History = append([]HealthSample{}, h.History[len(h.History)-healthHistorySize:]...)
+	}
+	h.LastCheck = s.Time
+
+	successes := 0
+	var latency time.Duration
+	for _, sample := range h.History {
+		if sample.Success {
+			successes++
+			latency += sample.Latency
+		}
+	}
+	h.SuccessRate = float64(successes) * 100 / float64(len(h.History))
+	h.AvgLatency = 0
+	if successes > 0 {
+		h.AvgLatency = latency / time.Duration(successes)
+	}
+
+	switch {
+	case !s.Success:
+		h.ConsecutiveFailures++
+		if h.ConsecutiveFailures >= threshold {
+			h.Status = HealthFailing
+		} else {
+			h.Status = HealthDegraded
+		}
+	case h.SuccessRate < healthDegradedRate:
+		h.ConsecutiveFailures = 0
+		h.Status = HealthDegraded
+	default:
+		h.ConsecutiveFailures = 0
+		h.Status = HealthOK
+	}
+}
+
+// needsDiscovery reports whether the last check turned the set failing and
+// a replacement should be searched for.
+func (h *SetHealth) needsDiscovery(prev HealthStatus, set *config.SetConfig) bool {
+	return h.Status == HealthFailing && prev != HealthFailing &&
+		set.Health.AutoDiscover && h.Proposal == nil && h.DiscoveryId == ""
+}
+
+func (h *SetHealth) snapshot() SetHealth {
+	s := *h
+	s.History = append([]HealthSample{}, h.History...)
+	return s
+}
+
+func notifyHealthChange(h SetHealth, prev HealthStatus) {
+	if h.Status == prev {
+		return
+	}
+	m := metrics.GetMetricsCollector()
+	last := h.History[len(h.History)-1]
+
+	switch h.Status {
+	case HealthFailing:
+		log.Warnf("Set '%s' failed %d health checks in a row: %s", h.SetName, h.ConsecutiveFailures, last.Error)
+		m.RecordEvent("error", fmt.Sprintf("Set '%s' is failing health checks: %s", h.SetName, last.Error))
+	case HealthDegraded:
+		if prev == HealthFailing {
+			return
+		}
+		log.Warnf("Set '%s' health degraded (%.0f%% success)", h.SetName, h.SuccessRate)
+		m.RecordEvent("warning", fmt.Sprintf("Set '%s' health degraded (%.0f%% success)", h.SetName, h.SuccessRate))
+	case HealthOK:
+		if prev == HealthUnknown {
+			return
+		}
+		log.Infof("Set '%s' passes health checks again", h.SetName)
+		m.RecordEvent("info", fmt.Sprintf("Set '%s' recovered", h.SetName))
+	}
+}
@@ -0,0 +1,149 @@
+package discovery
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/daniellavrushin/b4/config"
+	"github.com/daniellavrushin/b4/metrics"
+)
+
+func healthSample(success bool, latency time.Duration) HealthSample {
+	return HealthSample{Time: time.Now(), Success: success, Latency: latency, Error: "timeout"}
+}
+
+func TestSetHealthRecord(t *testing.T) {
+	h := &SetHealth{Status: HealthUnknown}
+
+	h.record(healthSample(true, 100*time.Millisecond), 3)
+	if h.Status != HealthOK || h.SuccessRate != 100 || h.AvgLatency != 100*time.Millisecond {
+		t.Fatalf("after one success: %+v", h)
+	}
+
+	for i, want := range []HealthStatus{HealthDegraded, HealthDegraded, HealthFailing, HealthFailing} {
+		h.record(healthSample(false, 0), 3)
+		if h.Status != want || h.ConsecutiveFailures != i+1 {
+			t.Errorf("failure %d: status %s with %d failures, want %s", i+1, h.Status, h.ConsecutiveFailures, want)
+		}
+	}
+	if h.AvgLatency != 100*time.Millisecond {
+		t.Errorf("failures should not count in latency, got %v", h.AvgLatency)
+	}
+
+	// A pass resets the streak but the history still holds 4 failures of 6
+	h.record(healthSample(true, 300*time.Millisecond), 3)
+	if h.Status != HealthDegraded || h.ConsecutiveFailures != 0 {
+		t.Errorf("pass with a poor rate: status %s with %d failures", h.Status, h.ConsecutiveFailures)
+	}
+	if h.AvgLatency != 200*time.Millisecond {
+		t.Errorf("average latency %v, want 200ms", h.AvgLatency)
+	}
+
+	for i := 0; i < healthHistorySize; i++ {
+		h.record(healthSample(true, time.Millisecond), 3)
+	}
+	if h.Status != HealthOK || h.SuccessRate != 100 {
+		t.Errorf("failures should age out of the history: %s at %.0f%%", h.Status, h.SuccessRate)
+	}
+	if len(h.History) != healthHistorySize {
+		t.Errorf("history holds %d samples, want %d", len(h.History), healthHistorySize)
+	}
+
+	single := &SetHealth{}
+	single.record(healthSample(false, 0), 1)
+	if single.Status != HealthFailing {
+		t.Errorf("threshold 1: status %s, want failing", single.Status)
+	}
+}
+
+func TestNotifyHealthChange(t *testing.T) {
+	m := metrics.GetMetricsCollector()
+
+	tests := []struct {
+		prev, status HealthStatus
+		level, text  string
+	}{
+		{HealthUnknown, HealthOK, "", ""},
+		{HealthOK, HealthOK, "", ""},
+		{HealthOK, HealthDegraded, "warning", "health degraded"},
+		{HealthDegraded, HealthFailing, "error", "is failing"},
+		{HealthFailing, HealthFailing, "", ""},
+		{HealthFailing, HealthDegraded, "", ""},
+		{HealthDegraded, HealthOK, "info", "recovered"},
+		{HealthFailing, HealthOK, "info", "recovered"},
+	}
+	for _, tt := range tests {
+		m.ResetStats()
+
+		h := SetHealth{SetName: "youtube", Status: tt.status, History: []HealthSample{healthSample(tt.status == HealthOK, 0)}}
+		notifyHealthChange(h, tt.prev)
+
+		events := m.GetSnapshot().RecentEvents
+		if tt.level == "" {
+			if len(events) != 0 {
+				t.Errorf("%s -> %s: unexpected event %+v", tt.prev, tt.status, events[0])
+			}
+			continue
+		}
+		if len(events) != 1 {
+			t.Errorf("%s -> %s: expected one event, got %d", tt.prev, tt.status, len(events))
+			continue
+		}
+		if events[0].Level != tt.level || !strings.Contains(events[0].Message, tt.text) {
+			t.Errorf("%s -> %s: event %s %q, want %s containing %q",
+				tt.prev, tt.status, events[0].Level, events[0].Message, tt.level, tt.text)
+		}
+	}
+}
+
+func TestNeedsDiscovery(t *testing.T) {
+	set := config.NewSetConfig()
+	set.Health.AutoDiscover = true
+
+	failing := &SetHealth{Status: HealthFailing}
+	if !failing.needsDiscovery(HealthDegraded, &set) {
+		t.Error("a set that just started failing should trigger discovery")
+	}
+	if failing.needsDiscovery(HealthFailing, &set) {
+		t.Error("a set that was already failing should not trigger discovery again")
+	}
+	if (&SetHealth{Status: HealthDegraded}).needsDiscovery(HealthOK, &set) {
+		t.Error("a degraded set should not trigger discovery")
+	}
+	if (&SetHealth{Status: HealthFailing, DiscoveryId: "running"}).needsDiscovery(HealthDegraded, &set) {
+		t.Error("discovery already running for the set")
+	}
+	if (&SetHealth{Status: HealthFailing, Proposal: &HealthProposal{}}).needsDiscovery(HealthDegraded, &set) {
+		t.Error("a pending proposal should not be replaced")
+	}
+
+	set.Health.AutoDiscover = false
+	if failing.needsDiscovery(HealthDegraded, &set) {
+		t.Error("auto discovery is disabled")
+	}
+}
+
+func TestHealthProbeConfig(t *testing.T) {
+	cfg := config.NewConfig()
+	set := config.NewSetConfig()
+	set.Enabled = false
+	set.Targets.Devices = []string{"aa:bb:cc:dd:ee:ff"}
+	set.Targets.DomainsToMatch = []string{"example.com"}
+	set.Schedule.Enabled = true
+
+	probe := healthProbeConfig(&cfg, &set)
+	if len(probe.Sets) != 1 || probe.MainSet != probe.Sets[0] {
+		t.Fatalf("expected the set alone, got %d sets", len(probe.Sets))
+	}
+	s := probe.Sets[0]
+	if !s.Enabled || s.Schedule.Enabled || len(s.Targets.Devices) != 0 {
+		t.Errorf("probe set keeps limits: enabled=%v schedule=%v devices=%v", s.Enabled, s.Schedule.Enabled, s.Targets.Devices)
+	}
+	if len(s.Targets.DomainsToMatch) != 1 {
+		t.Error("probe set lost its targets")
+	}
+	if set.Enabled || !set.Schedule.Enabled || len(set.Targets.Devices) != 1 {
+		t.Error("live set was modified")
+	}
+}
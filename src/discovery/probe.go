@@ -0,0 +1,28 @@
+package discovery
+
+import (
+	"net"
+	"syscall"
+	"time"
+
+	"github.com/daniellavrushin/b4/config"
+)
+
+// newProbeDialer returns a dialer whose sockets carry the discovery probe
+// mark, so the queue workers apply the candidate config to them only.
+func newProbeDialer(cfg *config.Config, timeout, keepAlive time.Duration) *net.Dialer {
+	mark := int(cfg.System.Checker.ProbeMark)
+	return &net.Dialer{
+		Timeout:   timeout,
+		KeepAlive: keepAlive,
+		Control: func(network, address string, c syscall.RawConn) error {
+			var opErr error
+			if err := c.Control(func(fd uintptr) {
+				opErr = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_MARK, mark)
+			}); err != nil {
+				return err
+			}
+			return opErr
+		},
+	}
+}
@@ -79,6 +79,8 @@ type CheckSuite struct {
 	CheckURL               string                            `json:"check_url"`
 	Domain                 string                            `json:"domain"`
 	CurrentPhase           DiscoveryPhase                    `json:"current_phase,omitempty"`
+	Domains                []string                          `json:"domains,omitempty"`
+	BatchReport            *BatchReport                      `json:"batch_report,omitempty"`
 	mu                     sync.RWMutex                      `json:"-"`
 	cancel                 chan struct{}                     `json:"-"`
 }
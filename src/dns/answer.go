@@ -0,0 +1,207 @@
+package dns
+
+import (
+	"encoding/binary"
+	"net"
+	"strings"
+	"time"
+)
+
+const (
+	typeA     = 1
+	typeCNAME = 5
+	typeAAAA  = 28
+	typeSVCB  = 64
+	typeHTTPS = 65
+
+	svcParamIPv4Hint = 4
+	svcParamIPv6Hint = 6
+)
+
+// Answer is an address a DNS response resolves its question to.
+type Answer struct {
+	IP  net.IP
+	TTL time.Duration
+}
+
+// record is a resource record of a DNS message, rdata is payload[rdata:end].
+type record struct {
+	name    string
+	typ     uint16
+	ttl     time.Duration
+	ttlOff  int
+	rdata   int
+	end     int
+	section int // 0 answer, 1 authority, 2 additional
+}
+
+// parseMessage returns the question name of a message with a single
+// question, where the question ends and the records that could be parsed.
+func parseMessage(payload []byte) (string, int, []record, bool) {
+	if len(payload) < 12 || binary.BigEndian.Uint16(payload[4:6]) != 1 {
+		return "", 0, nil, false
+	}
+	question, pos, ok := readName(payload, 12)
+	if !ok || pos+4 > len(payload) {
+		return "", 0, nil, false
+	}
+	pos += 4 // QTYPE, QCLASS
+	qEnd := pos
+
+	var records []record
+	for section := 0; section < 3; section++ {
+		count := int(binary.BigEndian.Uint16(payload[6+2*section : 8+2*section]))
+		for i := 0; i < count; i++ {
+			name, p, ok := readName(payload, pos)
+			if !ok || p+10 > len(payload) {
+				return question, qEnd, records, true
+			}
+			rdlen := int(binary.BigEndian.Uint16(payload[p+8 : p+10]))
+			if p+10+rdlen > len(payload) {
+				return question, qEnd, records, true
+			}
+			records = append(records, record{
+				name:    name,
+				typ:     binary.BigEndian.Uint16(payload[p : p+2]),
+				ttl:     time.Duration(binary.BigEndian.Uint32(payload[p+4:p+8])) * time.Second,
+				ttlOff:  p + 4,
+				rdata:   p + 10,
+				end:     p + 10 + rdlen,
+				section: section,
+			})
+			pos = p + 10 + rdlen
+		}
+	}
+	return question, qEnd, records, true
+}
+
+// ParseAnswers returns the question name of a DNS response and the
+// addresses it resolves to: A and AAAA records of the name or of the names
+// its CNAME chain leads to, plus the ipv4hint and ipv6hint parameters of
+// HTTPS and SVCB records.
+func ParseAnswers(payload []byte) (string, []Answer, bool) {
+	if len(payload) < 12 || payload[2]&0x80 == 0 || payload[3]&0x0f != 0 {
+		return "", nil, false
+	}
+	question, _, all, ok := parseMessage(payload)
+	if !ok {
+		return "", nil, false
+	}
+	records := all[:0:0]
+	for _, r := range all {
+		if r.section == 0 {
+			records = append(records, r)
+		}
+	}
+	if len(records) == 0 {
+		return "", nil, false
+	}
+
+	// Follow the CNAME chain, records may come in any order
+	names := map[string]bool{question: true}
+	for changed := true; changed; {
+		changed = false
+		for _, r := range records {
+			if r.typ != typeCNAME || !names[r.name] {
+				continue
+			}
+			if target, _, ok := readName(payload, r.rdata); ok && !names[target] {
+				names[target] = true
+				changed = true
+			}
+		}
+	}
+
+	var answers []Answer
+	for _, r := range records {
+		if !names[r.name] {
+			continue
+		}
+		rdata := payload[r.rdata:r.end]
+		switch r.typ {
+		case typeA:
+			if len(rdata) == net.IPv4len {
+				answers = append(answers, Answer{IP: net.IP(append([]byte(nil), rdata...)), TTL: r.ttl})
+			}
+		case typeAAAA:
+			if len(rdata) == net.IPv6len {
+				answers = append(answers, Answer{IP: net.IP(append([]byte(nil), rdata...)), TTL: r.ttl})
+			}
+		case typeHTTPS, typeSVCB:
+			for _, ip := range svcHints(payload, r.rdata, r.end) {
+				answers = append(answers, Answer{IP: ip, TTL: r.ttl})
+			}
+		}
+	}
+
+	return question, answers, true
+}
+
+// svcHints returns the addresses of the ipv4hint and ipv6hint parameters of
+// the HTTPS or SVCB record data at payload[start:end].
+func svcHints(payload []byte, start, end int) []net.IP {
+	if start+2 > end {
+		return nil
+	}
+	_, pos, ok := readName(payload[:end], start+2) // priority, target name
+	if !ok {
+		return nil
+	}
+
+	var ips []net.IP
+	for pos+4 <= end {
+		key := binary.BigEndian.Uint16(payload[pos : pos+2])
+		vlen := int(binary.BigEndian.Uint16(payload[pos+2 : pos+4]))
+		pos += 4
+		if pos+vlen > end {
+			break
+		}
+		value := payload[pos : pos+vlen]
+		switch key {
+		case svcParamIPv4Hint:
+			for i := 0; i+net.IPv4len <= len(value); i += net.IPv4len {
+				ips = append(ips, net.IP(append([]byte(nil), value[i:i+net.IPv4len]...)))
+			}
+		case svcParamIPv6Hint:
+			for i := 0; i+net.IPv6len <= len(value); i += net.IPv6len {
+				ips = append(ips, net.IP(append([]byte(nil), value[i:i+net.IPv6len]...)))
+			}
+		}
+		pos += vlen
+	}
+	return ips
+}
+
+// readName decodes the possibly compressed name at pos and returns it in
+// lower case together with the position after it.
+func readName(payload []byte, pos int) (string, int, bool) {
+	var labels []string
+	end := -1
+	for jumps := 0; ; {
+		if pos >= len(payload) {
+			return "", 0, false
+		}
+		l := int(payload[pos])
+		switch {
+		case l == 0:
+			if end < 0 {
+				end = pos + 1
+			}
+			return strings.ToLower(strings.Join(labels, ".")), end, true
+		case l&0xc0 == 0xc0:
+			if pos+2 > len(payload) || jumps > 16 {
+				return "", 0, false
+			}
+			if end < 0 {
+				end = pos + 2
+			}
+			pos = int(binary.BigEndian.Uint16(payload[pos:pos+2]) & 0x3fff)
+			jumps++
+		case l > 63 || pos+1+l > len(payload):
+			return "", 0, false
+		default:
+			labels = append(labels, string(payload[pos+1:pos+1+l]))
+			pos += 1 + l
+		}
+	}
+}
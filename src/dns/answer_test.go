@@ -0,0 +1,315 @@
+package dns
+
+import (
+	"encoding/binary"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testMsg builds a DNS response with a single question.
+type testMsg struct {
+	b []byte
+}
+
+func encodeName(name string) []byte {
+	var b []byte
+	for _, label := range strings.Split(strings.TrimSuffix(name, "."), ".") {
+		if label == "" {
+			continue
+		}
+		b = append(b, byte(len(label)))
+		b = append(b, label...)
+	}
+	return append(b, 0)
+}
+
+func newTestResponse(question string, qtype uint16) *testMsg {
+	m := &testMsg{b: []byte{0x12, 0x34, 0x81, 0x80, 0, 1, 0, 0, 0, 0, 0, 0}}
+	m.b = append(m.b, encodeName(question)...)
+	m.b = binary.BigEndian.AppendUint16(m.b, qtype)
+	m.b = binary.BigEndian.AppendUint16(m.b, 1)
+	return m
+}
+
+// rr appends a record to section 0, 1 or 2 with its owner name given as
+// wire bytes, so tests can write compression pointers.
+func (m *testMsg) rr(section int, owner []byte, typ uint16, ttl uint32, rdata []byte) *testMsg {
+	m.b = append(m.b, owner...)
+	m.b = binary.BigEndian.AppendUint16(m.b, typ)
+	m.b = binary.BigEndian.AppendUint16(m.b, 1)
+	m.b = binary.BigEndian.AppendUint32(m.b, ttl)
+	m.b = binary.BigEndian.AppendUint16(m.b, uint16(len(rdata)))
+	m.b = append(m.b, rdata...)
+	count := m.b[6+2*section : 8+2*section]
+	binary.BigEndian.PutUint16(count, binary.BigEndian.Uint16(count)+1)
+	return m
+}
+
+func (m *testMsg) answer(owner string, typ uint16, ttl uint32, rdata []byte) *testMsg {
+	return m.rr(0, encodeName(owner), typ, ttl, rdata)
+}
+
+// questionPtr points at the question name.
+var questionPtr = []byte{0xc0, 12}
+
+func answerIPs(answers []Answer) []string {
+	ips := make([]string, len(answers))
+	for i, a := range answers {
+		ips[i] = a.IP.String()
+	}
+	return ips
+}
+
+func checkAnswers(t *testing.T, payload []byte, wantName string, want ...string) {
+	t.Helper()
+	name, answers, ok := ParseAnswers(payload)
+	if !ok {
+		t.Fatal("response not parsed")
+	}
+	if name != wantName {
+		t.Errorf("question %q, want %q", name, wantName)
+	}
+	if got := strings.Join(answerIPs(answers), " "); got != strings.Join(want, " ") {
+		t.Errorf("answers [%s], want [%s]", got, strings.Join(want, " "))
+	}
+}
+
+func TestParseAnswersDirect(t *testing.T) {
+	m := newTestResponse("WWW.Example.com", typeA).
+		rr(0, questionPtr, typeA, 300, []byte{192, 0, 2, 1}).
+		answer("www.example.com", typeAAAA, 60, net.ParseIP("2001:db8::1")).
+		answer("www.example.com", typeA, 60, []byte{192, 0, 2}). // bad length
+		answer("other.example.com", typeA, 60, []byte{192, 0, 2, 9})
+	checkAnswers(t, m.b, "www.example.com", "192.0.2.1", "2001:db8::1")
+
+	_, answers, _ := ParseAnswers(m.b)
+	if answers[0].TTL != 300*time.Second || answers[1].TTL != time.Minute {
+		t.Errorf("ttls %v %v", answers[0].TTL, answers[1].TTL)
+	}
+}
+
+func TestParseAnswersCNAMEChain(t *testing.T) {
+	// Chain www -> edge -> cdn, with the records in every order
+	records := []func(m *testMsg){
+		func(m *testMsg) { m.answer("cdn.example.net", typeA, 60, []byte{198, 51, 100, 7}) },
+		func(m *testMsg) { m.answer("edge.example.net", typeCNAME, 60, encodeName("CDN.example.net")) },
+		func(m *testMsg) { m.rr(0, questionPtr, typeCNAME, 60, encodeName("edge.example.net")) },
+	}
+	orders := [][]int{{0, 1, 2}, {0, 2, 1}, {1, 0, 2}, {1, 2, 0}, {2, 0, 1}, {2, 1, 0}}
+	for _, order := range orders {
+		m := newTestResponse("www.example.com", typeA)
+		for _, i := range order {
+			records[i](m)
+		}
+		m.answer("unrelated.example.net", typeA, 60, []byte{203, 0, 113, 1})
+		checkAnswers(t, m.b, "www.example.com", "198.51.100.7")
+	}
+}
+
+func TestParseAnswersCNAMELoop(t *testing.T) {
+	m := newTestResponse("a.example.com", typeA).
+		answer("a.example.com", typeCNAME, 60, encodeName("b.example.com")).
+		answer("b.example.com", typeCNAME, 60, encodeName("a.example.com")).
+		answer("b.example.com", typeA, 60, []byte{192, 0, 2, 2})
+	checkAnswers(t, m.b, "a.example.com", "192.0.2.2")
+}
+
+func TestParseAnswersOnlyAnswerSection(t *testing.T) {
+	m := newTestResponse("example.com", typeA).
+		answer("example.com", typeA, 60, []byte{192, 0, 2, 1}).
+		rr(1, questionPtr, typeA, 60, []byte{192, 0, 2, 2}).
+		rr(2, questionPtr, typeA, 60, []byte{192, 0, 2, 3})
+	checkAnswers(t, m.b, "example.com", "192.0.2.1")
+
+	auth := newTestResponse("example.com", typeA).rr(1, questionPtr, typeA, 60, []byte{192, 0, 2, 2})
+	if _, _, ok := ParseAnswers(auth.b); ok {
+		t.Error("response without answers parsed")
+	}
+}
+
+func TestParseAnswersRejects(t *testing.T) {
+	ok := newTestResponse("example.com", typeA).answer("example.com", typeA, 60, []byte{192, 0, 2, 1}).b
+
+	query := append([]byte(nil), ok...)
+	query[2] &^= 0x80
+	nxdomain := append([]byte(nil), ok...)
+	nxdomain[3] |= 3
+	twoQuestions := append([]byte(nil), ok...)
+	twoQuestions[5] = 2
+
+	for name, payload := range map[string][]byte{
+		"short":         ok[:11],
+		"query":         query,
+		"nxdomain":      nxdomain,
+		"two questions": twoQuestions,
+		"no qtype":      ok[:12+len(encodeName("example.com"))+2],
+	} {
+		if _, _, parsed := ParseAnswers(payload); parsed {
+			t.Errorf("%s: parsed", name)
+		}
+	}
+}
+
+func TestParseAnswersTruncated(t *testing.T) {
+	m := newTestResponse("example.com", typeA).
+		answer("example.com", typeA, 60, []byte{192, 0, 2, 1}).
+		answer("example.com", typeA, 60, []byte{192, 0, 2, 2})
+	full := len(m.b)
+
+	// Cutting into the second record keeps the first
+	for cut := full - 1; cut > full-4-10-len(encodeName("example.com")); cut-- {
+		checkAnswers(t, m.b[:cut], "example.com", "192.0.2.1")
+	}
+
+	// A count larger than the records present
+	m.b[7] = 5
+	checkAnswers(t, m.b, "example.com", "192.0.2.1", "192.0.2.2")
+}
+
+func TestParseAnswersCompressionLoop(t *testing.T) {
+	m := newTestResponse("example.com", typeA)
+	// Owner name pointing at itself
+	self := len(m.b)
+	m.rr(0, []byte{0xc0 | byte(self>>8), byte(self)}, typeA, 60, []byte{192, 0, 2, 1})
+	if _, answers, _ := ParseAnswers(m.b); len(answers) != 0 {
+		t.Errorf("record with a looping name matched: %v", answerIPs(answers))
+	}
+
+	// CNAME target pointing at itself, the chain ends there
+	m = newTestResponse("example.com", typeA)
+	rdata := len(m.b) + 2 + 10
+	m.rr(0, questionPtr, typeCNAME, 60, []byte{0xc0 | byte(rdata>>8), byte(rdata)}).
+		rr(0, questionPtr, typeA, 60, []byte{192, 0, 2, 1})
+	checkAnswers(t, m.b, "example.com", "192.0.2.1")
+}
+
+func TestReadName(t *testing.T) {
+	payload := make([]byte, 12)
+	payload = append(payload, encodeName("www.Example.com")...) // 12..28
+	payload = append(payload, 3, 'a', 'p', 'i', 0xc0, 16)       // api + pointer to example.com
+	payload = append(payload, 0xc0, 29)                         // 35: pointer to api.example.com
+	payload = append(payload, 0xc0, 37)                         // 37: pointer to itself
+	payload = append(payload, 0xc0, 41, 0xc0, 39)               // 39, 41: pointers to each other
+	payload = append(payload, 5, 'a', 'b')                      // 43: label past the end
+
+	tests := []struct {
+		pos  int
+		name string
+		end  int
+		ok   bool
+	}{
+		{12, "www.example.com", 29, true},
+		{16, "example.com", 29, true},
+		{29, "api.example.com", 35, true},
+		{33, "example.com", 35, true},
+		{35, "api.example.com", 37, true},
+		{37, "", 0, false},
+		{39, "", 0, false},
+		{41, "", 0, false},
+		{43, "", 0, false},
+		{len(payload), "", 0, false},
+	}
+	for _, tt := range tests {
+		name, end, ok := readName(payload, tt.pos)
+		if name != tt.name || end != tt.end || ok != tt.ok {
+			t.Errorf("readName at %d = %q %d %v, want %q %d %v", tt.pos, name, end, ok, tt.name, tt.end, tt.ok)
+		}
+	}
+
+	// A long chain of valid pointers is cut off as well
+	chain := make([]byte, 12)
+	chain = append(chain, 0)
+	for i := 0; i < 20; i++ {
+		prev := len(chain) - 1
+		if i > 0 {
+			prev = len(chain) - 2
+		}
+		chain = append(chain, 0xc0|byte(prev>>8), byte(prev))
+	}
+	if _, _, ok := readName(chain, len(chain)-2); ok {
+		t.Error("pointer chain longer than the jump limit accepted")
+	}
+	if name, _, ok := readName(chain, 12+1+2*3); !ok || name != "" {
+		t.Errorf("short pointer chain to the root: %q %v", name, ok)
+	}
+}
+
+// svcbRdata builds HTTPS or SVCB record data with the given parameters.
+func svcbRdata(target string, params ...[]byte) []byte {
+	b := []byte{0, 1}
+	b = append(b, encodeName(target)...)
+	for _, p := range params {
+		b = append(b, p...)
+	}
+	return b
+}
+
+func svcParam(key uint16, value []byte) []byte {
+	b := binary.BigEndian.AppendUint16(nil, key)
+	b = binary.BigEndian.AppendUint16(b, uint16(len(value)))
+	return append(b, value...)
+}
+
+func TestParseAnswersHTTPSHints(t *testing.T) {
+	v4 := []byte{192, 0, 2, 10, 192, 0, 2, 11}
+	v6 := net.ParseIP("2001:db8::10").To16()
+
+	m := newTestResponse("example.com", typeHTTPS).
+		rr(0, questionPtr, typeHTTPS, 120, svcbRdata(".",
+			svcParam(1, []byte{2, 'h', '2'}), // alpn
+			svcParam(svcParamIPv4Hint, v4),
+			svcParam(svcParamIPv6Hint, v6)))
+	checkAnswers(t, m.b, "example.com", "192.0.2.10", "192.0.2.11", "2001:db8::10")
+
+	// SVCB with a target name, odd hint lengths and a parameter running
+	// past the record
+	m = newTestResponse("_dns.example.com", typeSVCB).
+		rr(0, questionPtr, typeSVCB, 120, svcbRdata("dns.example.com",
+			svcParam(svcParamIPv4Hint, []byte{192, 0, 2, 20, 192, 0}),
+			svcParam(svcParamIPv6Hint, v6[:10]),
+			append(binary.BigEndian.AppendUint16(nil, svcParamIPv4Hint), 0, 8, 192, 0, 2, 21)))
+	checkAnswers(t, m.b, "_dns.example.com", "192.0.2.20")
+}
+
+func TestSvcHints(t *testing.T) {
+	rdata := svcbRdata(".", svcParam(svcParamIPv4Hint, []byte{192, 0, 2, 1}))
+	payload := append(make([]byte, 12), rdata...)
+	if ips := svcHints(payload, 12, len(payload)); len(ips) != 1 || ips[0].String() != "192.0.2.1" {
+		t.Errorf("hints %v", ips)
+	}
+	// The record ends inside the target name
+	if ips := svcHints(payload, 12, 14); ips != nil {
+		t.Errorf("hints from a truncated record: %v", ips)
+	}
+	if ips := svcHints(payload, 12, 13); ips != nil {
+		t.Errorf("hints from a record without a target: %v", ips)
+	}
+	// A parameter header cut short
+	if ips := svcHints(payload, 12, len(payload)-5); ips != nil {
+		t.Errorf("hints from a truncated parameter: %v", ips)
+	}
+}
+
+func FuzzParseAnswers(f *testing.F) {
+	f.Add(newTestResponse("example.com", typeA).answer("example.com", typeA, 60, []byte{192, 0, 2, 1}).b)
+	f.Add(newTestResponse("www.example.com", typeA).
+		rr(0, questionPtr, typeCNAME, 60, encodeName("cdn.example.net")).
+		answer("cdn.example.net", typeAAAA, 60, net.ParseIP("2001:db8::1")).b)
+	f.Add(newTestResponse("example.com", typeHTTPS).
+		rr(0, questionPtr, typeHTTPS, 60, svcbRdata(".", svcParam(svcParamIPv4Hint, []byte{192, 0, 2, 1}))).b)
+	f.Add(append(newTestResponse("example.com", typeA).b, 0xc0, 29, 0, 1))
+
+	f.Fuzz(func(t *testing.T, payload []byte) {
+		_, answers, ok := ParseAnswers(payload)
+		if !ok && answers != nil {
+			t.Fatal("answers returned for an unparsed response")
+		}
+		for _, a := range answers {
+			if len(a.IP) != net.IPv4len && len(a.IP) != net.IPv6len {
+				t.Fatalf("address of %d bytes", len(a.IP))
+			}
+		}
+	})
+}
@@ -0,0 +1,326 @@
+package dns
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	forwardTimeout   = 5 * time.Second
+	forwardCacheSize = 4096
+	negativeCacheTTL = 30 * time.Second
+	maxCacheTTL      = time.Hour
+
+	typeOPT = 41
+
+	// UDP reply sizes without and with EDNS, RFC 1035 and the DNS flag day
+	maxUDPReply     = 512
+	maxUDPReplyEDNS = 1232
+)
+
+type cachedReply struct {
+	msg     []byte
+	stored  time.Time
+	expires time.Time
+}
+
+// Forwarder resolves queries over DNS-over-HTTPS or DNS-over-TLS and keeps
+// the replies until their records expire.
+type Forwarder struct {
+	mu    sync.Mutex
+	cache map[string]*cachedReply
+	dot   map[string]*dotConn
+	http  *http.Client
+	now   func() time.Time
+	// rootCAs verifies DoT servers, nil for the system roots
+	rootCAs *x509.CertPool
+}
+
+var DefaultForwarder = NewForwarder()
+
+func NewForwarder() *Forwarder {
+	return &Forwarder{
+		cache: make(map[string]*cachedReply),
+		dot:   make(map[string]*dotConn),
+		http:  &http.Client{Timeout: forwardTimeout},
+		now:   time.Now,
+	}
+}
+
+// Resolve answers query, a DNS message in wire format, using upstream:
+// an https:// URL for DoH or tls://host[:port] for DoT. The reply carries
+// the ID of the query.
+func (f *Forwarder) Resolve(ctx context.Context, upstream string, query []byte) ([]byte, error) {
+	if len(query) < 12 {
+		return nil, errors.New("query too short")
+	}
+	key, ok := cacheKey(upstream, query)
+	if !ok {
+		return nil, errors.New("malformed query")
+	}
+	if reply := f.cached(key, query); reply != nil {
+		return reply, nil
+	}
+
+	// DoH clients use ID 0 so answers can be shared between queries
+	msg := append([]byte(nil), query...)
+	msg[0], msg[1] = 0, 0
+
+	var reply []byte
+	var err error
+	switch {
+	case strings.HasPrefix(upstream, "https://"):
+		reply, err = f.exchangeDoH(ctx, upstream, msg)
+	case strings.HasPrefix(upstream, "tls://"):
+		var u *url.URL
+		if u, err = url.Parse(upstream); err == nil {
+			reply, err = f.exchangeDoT(ctx, u.Host, msg)
+		}
+	default:
+		err = fmt.Errorf("unsupported upstream %q", upstream)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(reply) < 12 || reply[2]&0x80 == 0 {
+		return nil, errors.New("invalid reply from upstream")
+	}
+
+	f.store(key, reply)
+	reply = append([]byte(nil), reply...)
+	copy(reply[0:2], query[0:2])
+	return reply, nil
+}
+
+func cacheKey(upstream string, query []byte) (string, bool) {
+	name, qEnd, _, ok := parseMessage(query)
+	if !ok {
+		return "", false
+	}
+	// QTYPE and QCLASS
+	return upstream + "|" + name + "|" + string(query[qEnd-4:qEnd]), true
+}
+
+// cached returns a copy of the cached reply for key with the ID of query and
+// the TTLs reduced by the time it spent in the cache.
+func (f *Forwarder) cached(key string, query []byte) []byte {
+	now := f.now()
+
+	f.mu.Lock()
+	c, ok := f.cache[key]
+	if ok && now.After(c.expires) {
+		delete(f.cache, key)
+		ok = false
+	}
+	f.mu.Unlock()
+	if !ok {
+		return nil
+	}
+
+	reply := append([]byte(nil), c.msg...)
+	copy(reply[0:2], query[0:2])
+
+	age := uint32(now.Sub(c.stored) / time.Second)
+	if _, _, records, ok := parseMessage(reply); ok {
+		for _, r := range records {
+			if r.typ == typeOPT {
+				continue
+			}
+			ttl := binary.BigEndian.Uint32(reply[r.ttlOff:])
+			binary.BigEndian.PutUint32(reply[r.ttlOff:], ttl-min(ttl, age))
+		}
+	}
+	return reply
+}
+
+func (f *Forwarder) store(key string, reply []byte) {
+	_, _, records, ok := parseMessage(reply)
+	if !ok || reply[3]&0x0f == 2 { // never cache SERVFAIL
+		return
+	}
+
+	ttl := time.Duration(-1)
+	for _, r := range records {
+		if r.typ != typeOPT && (ttl < 0 || r.ttl < ttl) {
+			ttl = r.ttl
+		}
+	}
+	switch {
+	case ttl < 0:
+		ttl = negativeCacheTTL
+	case ttl == 0:
+		return
+	}
+	ttl = min(ttl, maxCacheTTL)
+
+	now := f.now()
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if len(f.cache) >= forwardCacheSize {
+		for k, c := range f.cache {
+			if now.After(c.expires) {
+				delete(f.cache, k)
+			}
+		}
+		// Still full, make room for the newest answer
+		for k := range f.cache {
+			if len(f.cache) < forwardCacheSize {
+				break
+			}
+			delete(f.cache, k)
+		}
+	}
+	f.cache[key] = &cachedReply{msg: reply, stored: now, expires: now.Add(ttl)}
+}
+
+func (f *Forwarder) exchangeDoH(ctx context.Context, endpoint string, msg []byte) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, "POST", endpoint, bytes.NewReader(msg))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/dns-message")
+	req.Header.Set("Accept", "application/dns-message")
+
+	resp, err := f.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("DoH %s: %s", endpoint, resp.Status)
+	}
+	return io.ReadAll(io.LimitReader(resp.Body, 65535))
+}
+
+func (f *Forwarder) exchangeDoT(ctx context.Context, server string, msg []byte) ([]byte, error) {
+	if _, _, err := net.SplitHostPort(server); err != nil {
+		server = net.JoinHostPort(strings.Trim(server, "[]"), "853")
+	}
+
+	f.mu.Lock()
+	c, ok := f.dot[server]
+	if !ok {
+		c = &dotConn{server: server, rootCAs: f.rootCAs}
+		f.dot[server] = c
+	}
+	f.mu.Unlock()
+
+	return c.exchange(ctx, msg)
+}
+
+// dotConn is a DoT connection reused for consecutive queries.
+type dotConn struct {
+	mu      sync.Mutex
+	server  string
+	rootCAs *x509.CertPool
+	conn    *tls.Conn
+}
+
+func (c *dotConn) exchange(ctx context.Context, msg []byte) ([]byte, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// A kept connection may have been closed by the server, retry once
+	for attempt := 0; ; attempt++ {
+		reused := c.conn != nil
+		if !reused {
+			if err := c.dial(ctx); err != nil {
+				return nil, err
+			}
+		}
+		reply, err := c.roundTrip(ctx, msg)
+		if err == nil {
+			return reply, nil
+		}
+		c.conn.Close()
+		c.conn = nil
+		if !reused || attempt > 0 {
+			return nil, err
+		}
+	}
+}
+
+func (c *dotConn) dial(ctx context.Context) error {
+	host, _, _ := net.SplitHostPort(c.server)
+	d := &tls.Dialer{
+		NetDialer: &net.Dialer{Timeout: forwardTimeout},
+		Config:    &tls.Config{ServerName: host, RootCAs: c.rootCAs, MinVersion: tls.VersionTLS12},
+	}
+	conn, err := d.DialContext(ctx, "tcp", c.server)
+	if err != nil {
+		return err
+	}
+	c.conn = conn.(*tls.Conn)
+	return nil
+}
+
+func (c *dotConn) roundTrip(ctx context.Context, msg []byte) ([]byte, error) {
+	deadline := time.Now().Add(forwardTimeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	_ = c.conn.SetDeadline(deadline)
+
+	if err := writeTCPMessage(c.conn, msg); err != nil {
+		return nil, err
+	}
+	return readTCPMessage(c.conn)
+}
+
+// FitUDP returns reply as it may be sent over UDP in answer to query. A
+// reply larger than the client accepts is cut down to its question with
+// the TC bit set, so the client retries over TCP.
+func FitUDP(query, reply []byte) []byte {
+	limit := maxUDPReply
+	if _, _, records, ok := parseMessage(query); ok {
+		for _, r := range records {
+			if r.typ == typeOPT {
+				limit = maxUDPReplyEDNS
+			}
+		}
+	}
+	if len(reply) <= limit {
+		return reply
+	}
+
+	qEnd := 12
+	if _, end, _, ok := parseMessage(reply); ok {
+		qEnd = end
+	}
+	out := append([]byte(nil), reply[:qEnd]...)
+	out[2] |= 0x02 // TC
+	if qEnd == 12 {
+		clear(out[4:6])
+	}
+	clear(out[6:12])
+	return out
+}
+
+// ServFail returns a SERVFAIL reply to query.
+func ServFail(query []byte) []byte {
+	qEnd := 12
+	if _, end, _, ok := parseMessage(query); ok {
+		qEnd = end
+	}
+	out := append([]byte(nil), query[:qEnd]...)
+	out[2] = 0x80 | out[2]&0x79 // QR, keep opcode and RD
+	out[3] = 0x80 | 2           // RA, SERVFAIL
+	if qEnd == 12 {
+		clear(out[4:6])
+	}
+	clear(out[6:12])
+	return out
+}
@@ -0,0 +1,380 @@
+package dns
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func newTestQuery(name string, qtype uint16, id uint16) []byte {
+	m := newTestResponse(name, qtype)
+	binary.BigEndian.PutUint16(m.b[0:2], id)
+	m.b[2], m.b[3] = 0x01, 0 // RD
+	return m.b
+}
+
+// testReply answers query with rcode and an A record for every address.
+func testReply(query []byte, rcode byte, ttl uint32, addrs ...string) []byte {
+	_, qEnd, _, _ := parseMessage(query)
+	m := &testMsg{b: append([]byte(nil), query[:qEnd]...)}
+	m.b[2] |= 0x80
+	m.b[3] = 0x80 | rcode
+	clear(m.b[6:12])
+	for _, a := range addrs {
+		m.rr(0, questionPtr, typeA, ttl, net.ParseIP(a).To4())
+	}
+	return m.b
+}
+
+func replyTTL(t *testing.T, reply []byte) uint32 {
+	t.Helper()
+	_, _, records, ok := parseMessage(reply)
+	if !ok || len(records) == 0 {
+		t.Fatal("reply without records")
+	}
+	return binary.BigEndian.Uint32(reply[records[0].ttlOff:])
+}
+
+type testClock struct{ t time.Time }
+
+func (c *testClock) now() time.Time          { return c.t }
+func (c *testClock) advance(d time.Duration) { c.t = c.t.Add(d) }
+
+// newDoHForwarder starts a DoH server answering with answer and returns a
+// forwarder with a manual clock, the server URL and the request counter.
+func newDoHForwarder(t *testing.T, answer func(query []byte) []byte) (*Forwarder, *testClock, string, *atomic.Int32) {
+	t.Helper()
+	var requests atomic.Int32
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		query, _ := io.ReadAll(r.Body)
+		if r.Method != http.MethodPost || r.Header.Get("Content-Type") != "application/dns-message" {
+			t.Errorf("unexpected request %s %s", r.Method, r.Header.Get("Content-Type"))
+		}
+		if len(query) < 12 || query[0] != 0 || query[1] != 0 {
+			t.Errorf("DoH query should carry ID 0: % x", query[:min(len(query), 2)])
+		}
+		reply := answer(query)
+		if reply == nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/dns-message")
+		_, _ = w.Write(reply)
+	}))
+	t.Cleanup(srv.Close)
+
+	clock := &testClock{t: time.Unix(1700000000, 0)}
+	f := NewForwarder()
+	f.http = srv.Client()
+	f.now = clock.now
+	return f, clock, srv.URL + "/dns-query", &requests
+}
+
+func TestForwarderCacheAging(t *testing.T) {
+	f, clock, upstream, requests := newDoHForwarder(t, func(q []byte) []byte {
+		return testReply(q, 0, 300, "192.0.2.1")
+	})
+	ctx := context.Background()
+
+	reply, err := f.Resolve(ctx, upstream, newTestQuery("example.com", typeA, 0x1111))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if binary.BigEndian.Uint16(reply) != 0x1111 || replyTTL(t, reply) != 300 {
+		t.Errorf("first reply: id %#x ttl %d", binary.BigEndian.Uint16(reply), replyTTL(t, reply))
+	}
+
+	clock.advance(100 * time.Second)
+	reply, err = f.Resolve(ctx, upstream, newTestQuery("EXAMPLE.com", typeA, 0x2222))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if requests.Load() != 1 {
+		t.Errorf("cached reply not used, %d requests", requests.Load())
+	}
+	if binary.BigEndian.Uint16(reply) != 0x2222 {
+		t.Errorf("cached reply has id %#x, want the query's", binary.BigEndian.Uint16(reply))
+	}
+	if ttl := replyTTL(t, reply); ttl != 200 {
+		t.Errorf("cached ttl %d, want 200", ttl)
+	}
+
+	// Another type or upstream is a different entry
+	if _, err := f.Resolve(ctx, upstream, newTestQuery("example.com", typeAAAA, 1)); err != nil {
+		t.Fatal(err)
+	}
+	if requests.Load() != 2 {
+		t.Errorf("AAAA answered from the A entry")
+	}
+
+	clock.advance(201 * time.Second)
+	if _, err := f.Resolve(ctx, upstream, newTestQuery("example.com", typeA, 3)); err != nil {
+		t.Fatal(err)
+	}
+	if requests.Load() != 3 {
+		t.Errorf("expired reply served from the cache")
+	}
+}
+
+func TestForwarderNegativeCaching(t *testing.T) {
+	rcode := byte(3) // NXDOMAIN
+	f, clock, upstream, requests := newDoHForwarder(t, func(q []byte) []byte {
+		return testReply(q, rcode, 0)
+	})
+	ctx := context.Background()
+	resolve := func() {
+		t.Helper()
+		reply, err := f.Resolve(ctx, upstream, newTestQuery("missing.example", typeA, 7))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if reply[3]&0x0f != rcode {
+			t.Errorf("rcode %d, want %d", reply[3]&0x0f, rcode)
+		}
+	}
+
+	resolve()
+	clock.advance(negativeCacheTTL - time.Second)
+	resolve()
+	if requests.Load() != 1 {
+		t.Errorf("negative reply not cached, %d requests", requests.Load())
+	}
+	clock.advance(2 * time.Second)
+	resolve()
+	if requests.Load() != 2 {
+		t.Errorf("negative reply kept past %v", negativeCacheTTL)
+	}
+
+	// SERVFAIL is never cached
+	rcode = 2
+	clock.advance(time.Hour)
+	resolve()
+	resolve()
+	if requests.Load() != 4 {
+		t.Errorf("SERVFAIL cached, %d requests", requests.Load())
+	}
+}
+
+func TestForwarderZeroTTLNotCached(t *testing.T) {
+	f, _, upstream, requests := newDoHForwarder(t, func(q []byte) []byte {
+		return testReply(q, 0, 0, "192.0.2.1")
+	})
+	for i := 0; i < 2; i++ {
+		if _, err := f.Resolve(context.Background(), upstream, newTestQuery("example.com", typeA, 1)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if requests.Load() != 2 {
+		t.Errorf("zero TTL reply cached")
+	}
+}
+
+func TestForwarderErrors(t *testing.T) {
+	f, _, upstream, _ := newDoHForwarder(t, func(q []byte) []byte {
+		if q[len(q)-3] == byte(typeAAAA) {
+			return q // not a response
+		}
+		return nil
+	})
+	ctx := context.Background()
+
+	if _, err := f.Resolve(ctx, upstream, newTestQuery("example.com", typeA, 1)); err == nil {
+		t.Error("expected an error for HTTP 500")
+	}
+	if _, err := f.Resolve(ctx, upstream, newTestQuery("example.com", typeAAAA, 1)); err == nil {
+		t.Error("expected an error for a reply without QR")
+	}
+	if _, err := f.Resolve(ctx, "udp://192.0.2.1", newTestQuery("example.com", typeA, 1)); err == nil {
+		t.Error("expected an error for an unsupported upstream")
+	}
+	if _, err := f.Resolve(ctx, upstream, []byte{1, 2, 3}); err == nil {
+		t.Error("expected an error for a short query")
+	}
+}
+
+// dotServer answers DoT queries on a local TLS listener. With closeAfter
+// set every connection is closed after its first answer.
+type dotServer struct {
+	addr     string
+	pool     *x509.CertPool
+	accepted atomic.Int32
+	queries  atomic.Int32
+}
+
+func startDoTServer(t *testing.T, closeAfter bool) *dotServer {
+	t.Helper()
+	// Borrow the test certificate, valid for 127.0.0.1
+	cert := httptest.NewUnstartedServer(nil)
+	cert.StartTLS()
+	cert.Close()
+
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: cert.TLS.Certificates})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &dotServer{addr: ln.Addr().String(), pool: x509.NewCertPool()}
+	s.pool.AddCert(cert.Certificate())
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var conns []net.Conn
+	t.Cleanup(func() {
+		ln.Close()
+		mu.Lock()
+		for _, c := range conns {
+			c.Close()
+		}
+		mu.Unlock()
+		wg.Wait()
+	})
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			s.accepted.Add(1)
+			mu.Lock()
+			conns = append(conns, conn)
+			mu.Unlock()
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				defer conn.Close()
+				for {
+					query, err := readTCPMessage(conn)
+					if err != nil {
+						return
+					}
+					s.queries.Add(1)
+					if err := writeTCPMessage(conn, testReply(query, 0, 60, "192.0.2.53")); err != nil || closeAfter {
+						return
+					}
+				}
+			}()
+		}
+	}()
+	return s
+}
+
+func TestForwarderDoTReusesConnection(t *testing.T) {
+	s := startDoTServer(t, false)
+	f := NewForwarder()
+	f.rootCAs = s.pool
+	upstream := "tls://" + s.addr
+
+	for _, name := range []string{"a.example", "b.example", "c.example"} {
+		reply, err := f.Resolve(context.Background(), upstream, newTestQuery(name, typeA, 9))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, answers, _ := ParseAnswers(reply); got != name || len(answers) != 1 || binary.BigEndian.Uint16(reply) != 9 {
+			t.Errorf("%s: reply for %q with %d answers", name, got, len(answers))
+		}
+	}
+	if s.accepted.Load() != 1 || s.queries.Load() != 3 {
+		t.Errorf("%d connections for %d queries, want one", s.accepted.Load(), s.queries.Load())
+	}
+}
+
+func TestForwarderDoTReconnects(t *testing.T) {
+	s := startDoTServer(t, true)
+	f := NewForwarder()
+	f.rootCAs = s.pool
+	upstream := "tls://" + s.addr
+
+	for _, name := range []string{"a.example", "b.example"} {
+		if _, err := f.Resolve(context.Background(), upstream, newTestQuery(name, typeA, 1)); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+	}
+	if s.accepted.Load() != 2 {
+		t.Errorf("%d connections, want a new one after the server closed the first", s.accepted.Load())
+	}
+}
+
+func TestForwarderDoTRejectsUnknownCertificate(t *testing.T) {
+	s := startDoTServer(t, false)
+	if _, err := NewForwarder().Resolve(context.Background(), "tls://"+s.addr, newTestQuery("a.example", typeA, 1)); err == nil {
+		t.Error("expected a certificate error")
+	}
+}
+
+func TestFitUDP(t *testing.T) {
+	query := newTestQuery("example.com", typeA, 5)
+	reply := func(records int) []byte {
+		addrs := make([]string, records)
+		for i := range addrs {
+			addrs[i] = "192.0.2.1"
+		}
+		return testReply(query, 0, 60, addrs...)
+	}
+	_, qEnd, _, _ := parseMessage(query)
+
+	small := reply(4)
+	if out := FitUDP(query, small); len(out) != len(small) {
+		t.Errorf("small reply changed to %d bytes", len(out))
+	}
+
+	large := reply(40) // 16 bytes a record, over 512
+	out := FitUDP(query, large)
+	if len(out) != qEnd || out[2]&0x02 == 0 {
+		t.Fatalf("large reply: %d bytes, TC %v", len(out), out[2]&0x02 != 0)
+	}
+	if binary.BigEndian.Uint16(out[4:6]) != 1 || binary.BigEndian.Uint16(out[6:8]) != 0 {
+		t.Errorf("truncated reply counts % x", out[4:12])
+	}
+	if name, _, _, _ := parseMessage(out); name != "example.com" {
+		t.Errorf("truncated reply lost its question: %q", name)
+	}
+	if large[2]&0x02 != 0 {
+		t.Error("original reply modified")
+	}
+
+	// EDNS raises the limit
+	edns := (&testMsg{b: append([]byte(nil), query...)}).rr(2, []byte{0}, typeOPT, 0, nil).b
+	if out := FitUDP(edns, large); len(out) != len(large) {
+		t.Errorf("reply within the EDNS limit truncated to %d bytes", len(out))
+	}
+	if out := FitUDP(edns, reply(100)); len(out) != qEnd {
+		t.Errorf("reply over the EDNS limit: %d bytes", len(out))
+	}
+}
+
+func TestServFail(t *testing.T) {
+	query := (&testMsg{b: newTestQuery("example.com", typeA, 0xabcd)}).rr(2, []byte{0}, typeOPT, 0, nil).b
+	out := ServFail(query)
+
+	_, qEnd, _, _ := parseMessage(query)
+	if len(out) != qEnd {
+		t.Errorf("reply of %d bytes, want the question only (%d)", len(out), qEnd)
+	}
+	if binary.BigEndian.Uint16(out) != 0xabcd {
+		t.Errorf("id %#x", binary.BigEndian.Uint16(out))
+	}
+	if out[2] != 0x81 || out[3] != 0x82 {
+		t.Errorf("flags %02x %02x, want QR+RD and RA+SERVFAIL", out[2], out[3])
+	}
+	if binary.BigEndian.Uint16(out[4:6]) != 1 || binary.BigEndian.Uint16(out[10:12]) != 0 {
+		t.Errorf("counts % x", out[4:12])
+	}
+
+	// A query without a readable question gets a header only
+	bad := []byte{0, 1, 0x01, 0, 0, 1, 0, 0, 0, 0, 0, 0, 0xc0}
+	out = ServFail(bad)
+	if len(out) != 12 || out[3]&0x0f != 2 || binary.BigEndian.Uint16(out[4:6]) != 0 {
+		t.Errorf("malformed query: % x", out)
+	}
+}
@@ -1,47 +1,137 @@
 package dns
 
 import (
-	"fmt"
 	"net"
+	"net/netip"
 	"sync"
 	"time"
 )
 
+const (
+	// dnsNATTimeout is how long a redirected query waits for its reply
+	dnsNATTimeout = 10 * time.Second
+	// dnsNATMaxEntries bounds the table when queries go unanswered faster
+	// than they expire
+	dnsNATMaxEntries = 8192
+)
+
+// Flow is the 5-tuple of a redirected query as seen on the reply path:
+// the client that asked and the server the query was redirected to.
+type Flow struct {
+	Proto      uint8
+	Client     net.IP
+	ClientPort uint16
+	Server     net.IP
+	ServerPort uint16
+}
+
+type dnsNATKey struct {
+	proto      uint8
+	client     netip.Addr
+	clientPort uint16
+	server     netip.Addr
+	serverPort uint16
+	txid       uint16
+}
+
 type dnsNATEntry struct {
 	originalDst net.IP
 	timestamp   time.Time
 }
 
 var (
-	dnsNATTable = make(map[string]dnsNATEntry)
-	dnsNATMu    sync.RWMutex
+	dnsNATTable   = make(map[dnsNATKey]dnsNATEntry)
+	dnsNATMu      sync.Mutex
+	dnsNATExpired uint64
+	dnsNATEvicted uint64
 )
 
-func dnsNATKey(ip net.IP, port uint16) string {
-	return fmt.Sprintf("%s:%d", ip.String(), port)
+// DnsNATCleanup drops the redirected queries whose reply never came. The
+// queue pool runs it periodically.
+func DnsNATCleanup() {
+	dnsNATMu.Lock()
+	dnsNATExpire(time.Now())
+	dnsNATMu.Unlock()
+}
+
+func newDnsNATKey(f Flow, txid uint16) dnsNATKey {
+	client, _ := netip.AddrFromSlice(f.Client)
+	server, _ := netip.AddrFromSlice(f.Server)
+	return dnsNATKey{
+		proto:      f.Proto,
+		client:     client.Unmap(),
+		clientPort: f.ClientPort,
+		server:     server.Unmap(),
+		serverPort: f.ServerPort,
+		txid:       txid,
+	}
+}
+
+// dnsNATExpire drops the entries older than dnsNATTimeout, the caller holds
+// dnsNATMu.
+func dnsNATExpire(now time.Time) {
+	for k, e := range dnsNATTable {
+		if now.Sub(e.timestamp) > dnsNATTimeout {
+			delete(dnsNATTable, k)
+			dnsNATExpired++
+		}
+	}
 }
 
-func DnsNATSet(clientIP net.IP, clientPort uint16, originalDst net.IP) {
+// DnsNATSet remembers the original destination of a query with transaction
+// ID txid redirected along f, so its reply can be made to come from there.
+func DnsNATSet(f Flow, txid uint16, originalDst net.IP) {
+	now := time.Now()
+	key := newDnsNATKey(f, txid)
+
 	dnsNATMu.Lock()
-	dnsNATTable[dnsNATKey(clientIP, clientPort)] = dnsNATEntry{
-		originalDst: originalDst,
-		timestamp:   time.Now(),
+	defer dnsNATMu.Unlock()
+	if _, ok := dnsNATTable[key]; !ok && len(dnsNATTable) >= dnsNATMaxEntries {
+		dnsNATExpire(now)
+		// Still full, drop the oldest query
+		if len(dnsNATTable) >= dnsNATMaxEntries {
+			var oldest dnsNATKey
+			var oldestAt time.Time
+			for k, e := range dnsNATTable {
+				if oldestAt.IsZero() || e.timestamp.Before(oldestAt) {
+					oldest, oldestAt = k, e.timestamp
+				}
+			}
+			delete(dnsNATTable, oldest)
+			dnsNATEvicted++
+		}
 	}
-	dnsNATMu.Unlock()
+	dnsNATTable[key] = dnsNATEntry{originalDst: originalDst, timestamp: now}
 }
 
-func DnsNATGet(clientIP net.IP, clientPort uint16) (net.IP, bool) {
-	dnsNATMu.RLock()
-	entry, ok := dnsNATTable[dnsNATKey(clientIP, clientPort)]
-	dnsNATMu.RUnlock()
-	if !ok || time.Since(entry.timestamp) > 10*time.Second {
+// DnsNATGet returns the original destination of the query a reply along f
+// with transaction ID txid answers.
+func DnsNATGet(f Flow, txid uint16) (net.IP, bool) {
+	dnsNATMu.Lock()
+	entry, ok := dnsNATTable[newDnsNATKey(f, txid)]
+	dnsNATMu.Unlock()
+	if !ok || time.Since(entry.timestamp) > dnsNATTimeout {
 		return nil, false
 	}
 	return entry.originalDst, true
 }
 
-func DnsNATDelete(clientIP net.IP, clientPort uint16) {
+func DnsNATDelete(f Flow, txid uint16) {
 	dnsNATMu.Lock()
-	delete(dnsNATTable, dnsNATKey(clientIP, clientPort))
+	delete(dnsNATTable, newDnsNATKey(f, txid))
 	dnsNATMu.Unlock()
 }
+
+// DnsNATStats returns the size of the table and how many entries timed out
+// or were evicted to stay within its limit.
+func DnsNATStats() map[string]interface{} {
+	dnsNATMu.Lock()
+	defer dnsNATMu.Unlock()
+	return map[string]interface{}{
+		"size":    len(dnsNATTable),
+		"limit":   dnsNATMaxEntries,
+		"timeout": dnsNATTimeout.String(),
+		"expired": dnsNATExpired,
+		"evicted": dnsNATEvicted,
+	}
+}
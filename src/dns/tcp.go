@@ -0,0 +1,77 @@
+package dns
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"syscall"
+	"time"
+)
+
+// ParseTCPQuery returns the DNS message of a TCP segment payload holding
+// exactly one length-prefixed message (RFC 1035 §4.2.2). Queries split
+// across segments or pipelined in one are not handled.
+func ParseTCPQuery(payload []byte) ([]byte, bool) {
+	if len(payload) < 2+12 {
+		return nil, false
+	}
+	msgLen := int(binary.BigEndian.Uint16(payload))
+	if msgLen != len(payload)-2 {
+		return nil, false
+	}
+	return payload[2:], true
+}
+
+// ExchangeTCP sends query to server, a host:port, over plain DNS-over-TCP.
+// The socket carries mark, so the query is not queued back to b4.
+func ExchangeTCP(ctx context.Context, server string, mark int, query []byte) ([]byte, error) {
+	d := &net.Dialer{
+		Timeout: forwardTimeout,
+		Control: func(network, address string, c syscall.RawConn) error {
+			var opErr error
+			if err := c.Control(func(fd uintptr) {
+				opErr = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_MARK, mark)
+			}); err != nil {
+				return err
+			}
+			return opErr
+		},
+	}
+	conn, err := d.DialContext(ctx, "tcp", server)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	deadline := time.Now().Add(forwardTimeout)
+	if dl, ok := ctx.Deadline(); ok && dl.Before(deadline) {
+		deadline = dl
+	}
+	_ = conn.SetDeadline(deadline)
+
+	if err := writeTCPMessage(conn, query); err != nil {
+		return nil, err
+	}
+	return readTCPMessage(conn)
+}
+
+func writeTCPMessage(w io.Writer, msg []byte) error {
+	out := make([]byte, 2+len(msg))
+	binary.BigEndian.PutUint16(out, uint16(len(msg)))
+	copy(out[2:], msg)
+	_, err := w.Write(out)
+	return err
+}
+
+func readTCPMessage(r io.Reader) ([]byte, error) {
+	var lenBuf [2]byte
+	if _, err := io.ReadFull(r, lenBuf[:]); err != nil {
+		return nil, err
+	}
+	msg := make([]byte, binary.BigEndian.Uint16(lenBuf[:]))
+	if _, err := io.ReadFull(r, msg); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
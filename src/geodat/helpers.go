@@ -71,14 +71,17 @@ func LoadIpsFromCategories(geodataPath string, categories []string) ([]string, e
 	return allIps, nil
 }
 
+// extractDomainValue returns a geosite rule in the target syntax: plain
+// for domain rules, prefixed with "keyword:", "full:" or "regexp:" for the
+// others, so the matcher keeps their meaning.
 func extractDomainValue(d *v2data.Domain) string {
 	switch d.Type {
 	case v2data.Domain_Plain:
-		return d.Value
+		return "keyword:" + d.Value
 	case v2data.Domain_Regex:
 		return "regexp:" + d.Value
 	case v2data.Domain_Full:
-		return d.Value
+		return "full:" + d.Value
 	case v2data.Domain_Domain:
 		return d.Value
 	default:
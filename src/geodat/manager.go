@@ -29,6 +29,9 @@ type GeodataManager struct {
 
 	categoryIps       map[string][]string // category -> IPs (cached)
 	categoryIpsCounts map[string]int      // category -> IP count (fast lookup)
+
+	files       map[GeodataType]*fileState // update state per file
+	stopUpdater chan struct{}
 }
 
 // NewGeodataManager creates a new geodata manager instance
@@ -40,6 +43,7 @@ func NewGeodataManager(geositePath, geoipPath string) *GeodataManager {
 		categoryDomainsCounts: make(map[string]int),
 		categoryIps:           make(map[string][]string),
 		categoryIpsCounts:     make(map[string]int),
+		files:                 make(map[GeodataType]*fileState),
 	}
 }
 
@@ -58,6 +62,7 @@ func (gm *GeodataManager) UpdatePaths(geositePath, geoipPath string) {
 		gm.categoryDomainsCounts = make(map[string]int)
 		gm.categoryIps = make(map[string][]string)
 		gm.categoryIpsCounts = make(map[string]int)
+		gm.files = make(map[GeodataType]*fileState)
 		log.Infof("Geodata paths updated, cache cleared")
 	}
 }
@@ -0,0 +1,477 @@
+package geodat
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/daniellavrushin/b4/log"
+	"github.com/urlesistiana/v2dat/v2data"
+	"golang.org/x/sys/unix"
+	"google.golang.org/protobuf/proto"
+)
+
+const (
+	updaterTick       = time.Minute
+	updateRetryAfter  = 30 * time.Minute
+	downloadTimeout   = 10 * time.Minute
+	checksumSizeLimit = 64 * 1024
+	maxEntrySize      = 256 << 20
+)
+
+var downloadClient = &http.Client{Timeout: downloadTimeout}
+
+// UpdateSettings say where the geodata files are downloaded from and how
+// often they are checked for updates.
+type UpdateSettings struct {
+	Enabled            bool
+	Interval           time.Duration
+	GeoSiteURL         string
+	GeoSiteChecksumURL string // empty to try the URL with a .sha256sum suffix
+	GeoIpURL           string
+	GeoIpChecksumURL   string
+}
+
+// FileStatus describes a geodata file and its last update.
+type FileStatus struct {
+	Type       string    `json:"type"`
+	Path       string    `json:"path"`
+	URL        string    `json:"url"`
+	Exists     bool      `json:"exists"`
+	Size       int64     `json:"size"`
+	Modified   time.Time `json:"last_modified,omitzero"`
+	SHA256     string    `json:"sha256,omitempty"`
+	Categories int       `json:"categories"`
+	LastCheck  time.Time `json:"last_check,omitzero"`
+	LastUpdate time.Time `json:"last_update,omitzero"`
+	NextCheck  time.Time `json:"next_check,omitzero"`
+	Error      string    `json:"error,omitempty"`
+}
+
+func (t GeodataType) String() string {
+	if t == GEOIP {
+		return "geoip"
+	}
+	return "geosite"
+}
+
+// fileState is what the updater remembers about one file. The checksum and
+// category count belong to the file with the recorded size and time.
+type fileState struct {
+	lastCheck  time.Time
+	lastUpdate time.Time
+	nextCheck  time.Time
+	err        string
+
+	modTime    time.Time
+	size       int64
+	sha256     string
+	categories int
+}
+
+// Download fetches a geodata file to dest through a temp file, and swaps it
+// in only after the checksum matches and every entry parses. The checksum
+// is read from checksumURL, or from url with a .sha256sum suffix when that
+// exists. Nothing is downloaded when the published checksum matches the
+// current file.
+func Download(url, checksumURL string, dest string, t GeodataType) (size int64, updated bool, err error) {
+	expected, err := fetchChecksum(url, checksumURL)
+	if err != nil {
+		return 0, false, err
+	}
+	if expected != "" {
+		if sum, err := fileSHA256(dest); err == nil && sum == expected {
+			if info, err := os.Stat(dest); err == nil {
+				size = info.Size()
+			}
+			return size, false, nil
+		}
+	}
+
+	resp, err := downloadClient.Get(url)
+	if err != nil {
+		return 0, false, fmt.Errorf("failed to fetch %s: %v", url, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return 0, false, fmt.Errorf("remote server returned %s for %s", resp.Status, url)
+	}
+
+	dir := filepath.Dir(dest)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return 0, false, fmt.Errorf("failed to create directory %s: %v", dir, err)
+	}
+	if resp.ContentLength > 0 {
+		if err := checkDiskSpace(dir, resp.ContentLength); err != nil {
+			return 0, false, err
+		}
+	}
+
+	tmpFile, err := os.CreateTemp(dir, ".geodat-download-*.tmp")
+	if err != nil {
+		return 0, false, fmt.Errorf("failed to create temp file in %s: %v", dir, err)
+	}
+	tmpPath := tmpFile.Name()
+	defer os.Remove(tmpPath)
+
+	hash := sha256.New()
+	size, err = io.Copy(io.MultiWriter(tmpFile, hash), resp.Body)
+	if err != nil {
+		tmpFile.Close()
+		return 0, false, fmt.Errorf("failed to write data to disk (%d bytes written): %v", size, err)
+	}
+	if err := tmpFile.Sync(); err != nil {
+		tmpFile.Close()
+		return 0, false, fmt.Errorf("failed to flush data to disk: %v", err)
+	}
+	if err := tmpFile.Close(); err != nil {
+		return 0, false, fmt.Errorf("failed to finalize file write: %v", err)
+	}
+
+	sum := hex.EncodeToString(hash.Sum(nil))
+	if expected != "" && sum != expected {
+		return 0, false, fmt.Errorf("checksum mismatch for %s: got %s, want %s", url, sum, expected)
+	}
+	if _, err := Validate(tmpPath, t); err != nil {
+		return 0, false, fmt.Errorf("downloaded %s is not a valid %s file: %v", url, t, err)
+	}
+	if old, err := fileSHA256(dest); err == nil && old == sum {
+		return size, false, nil
+	}
+
+	if err := os.Rename(tmpPath, dest); err != nil {
+		return 0, false, fmt.Errorf("failed to move downloaded file to %s: %v", dest, err)
+	}
+	return size, true, nil
+}
+
+// fetchChecksum returns the published sha256 of url, or "" when there is
+// none. A checksum URL that was set explicitly has to work.
+func fetchChecksum(url, checksumURL string) (string, error) {
+	explicit := checksumURL != ""
+	if !explicit {
+		checksumURL = url + ".sha256sum"
+	}
+
+	resp, err := downloadClient.Get(checksumURL)
+	if err != nil {
+		if explicit {
+			return "", fmt.Errorf("failed to fetch checksum %s: %v", checksumURL, err)
+		}
+		return "", nil
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		if explicit {
+			return "", fmt.Errorf("remote server returned %s for %s", resp.Status, checksumURL)
+		}
+		log.Tracef("No checksum published for %s", url)
+		return "", nil
+	}
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, checksumSizeLimit))
+	if err != nil {
+		return "", fmt.Errorf("failed to read checksum %s: %v", checksumURL, err)
+	}
+	// "<hex>" or sha256sum output, "<hex>  <file name>"
+	fields := strings.Fields(string(data))
+	if len(fields) > 0 {
+		if b, err := hex.DecodeString(fields[0]); err == nil && len(b) == sha256.Size {
+			return strings.ToLower(fields[0]), nil
+		}
+	}
+	if explicit {
+		return "", fmt.Errorf("no sha256 checksum in %s", checksumURL)
+	}
+	return "", nil
+}
+
+func fileSHA256(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// Validate parses every entry of a geodata file and returns the number of
+// categories. It fails on truncated files, files of the other type and
+// files without any rules. Entries of the other type decode without error
+// but leave the fields empty, so only rules with a value are counted.
+func Validate(path string, t GeodataType) (int, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	categories, rules := 0, 0
+	r := bufio.NewReaderSize(f, 32*1024)
+	for {
+		b, err := r.ReadByte()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return 0, err
+		}
+		if b != 0x0A {
+			return 0, fmt.Errorf("unexpected wire tag %02X", b)
+		}
+		l, err := binary.ReadUvarint(r)
+		if err != nil {
+			return 0, fmt.Errorf("failed to read varint: %w", err)
+		}
+		if l > maxEntrySize {
+			return 0, fmt.Errorf("entry of %d bytes is too large", l)
+		}
+		msg := make([]byte, l)
+		if _, err := io.ReadFull(r, msg); err != nil {
+			return 0, err
+		}
+		tag, err := readCountryCode(msg)
+		if err != nil {
+			return 0, err
+		}
+
+		if t == GEOIP {
+			var geo v2data.GeoIP
+			if err := proto.Unmarshal(msg, &geo); err != nil {
+				return 0, fmt.Errorf("category %s: %w", tag, err)
+			}
+			for _, cidr := range geo.GetCidr() {
+				if bits := 8 * len(cidr.GetIp()); (bits == 32 || bits == 128) && int(cidr.GetPrefix()) <= bits {
+					rules++
+				}
+			}
+		} else {
+			var site v2data.GeoSite
+			if err := proto.Unmarshal(msg, &site); err != nil {
+				return 0, fmt.Errorf("category %s: %w", tag, err)
+			}
+			for _, d := range site.GetDomain() {
+				if d.GetValue() != "" {
+					rules++
+				}
+			}
+		}
+		categories++
+	}
+
+	if rules == 0 {
+		return 0, fmt.Errorf("no %s rules found", t)
+	}
+	return categories, nil
+}
+
+func checkDiskSpace(dir string, needed int64) error {
+	var stat unix.Statfs_t
+	if err := unix.Statfs(dir, &stat); err != nil {
+		return fmt.Errorf("failed to check disk space on %s: %v", dir, err)
+	}
+	available := int64(stat.Bavail) * int64(stat.Bsize)
+	if available < needed {
+		availMB := float64(available) / (1024 * 1024)
+		neededMB := float64(needed) / (1024 * 1024)
+		return fmt.Errorf("not enough disk space in %s: %.1f MB available, need %.1f MB", dir, availMB, neededMB)
+	}
+	return nil
+}
+
+// StartUpdater checks the geodata files against their URLs every interval.
+// After a file was replaced the cache is cleared and onUpdate is called, so
+// the caller can rebuild the targets of its sets.
+func (gm *GeodataManager) StartUpdater(settings func() UpdateSettings, onUpdate func()) {
+	gm.mu.Lock()
+	if gm.stopUpdater != nil {
+		gm.mu.Unlock()
+		return
+	}
+	stop := make(chan struct{})
+	gm.stopUpdater = stop
+	gm.mu.Unlock()
+
+	go func() {
+		ticker := time.NewTicker(updaterTick)
+		defer ticker.Stop()
+		for {
+			s := settings()
+			if s.Enabled && gm.checkUpdates(s) && onUpdate != nil {
+				onUpdate()
+			}
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// StopUpdater stops the checks started by StartUpdater.
+func (gm *GeodataManager) StopUpdater() {
+	gm.mu.Lock()
+	defer gm.mu.Unlock()
+	if gm.stopUpdater != nil {
+		close(gm.stopUpdater)
+		gm.stopUpdater = nil
+	}
+}
+
+// checkUpdates updates the files that are due and reports whether any of
+// them was replaced.
+func (gm *GeodataManager) checkUpdates(s UpdateSettings) bool {
+	interval := s.Interval
+	if interval <= 0 {
+		interval = 24 * time.Hour
+	}
+
+	gm.mu.RLock()
+	files := []struct {
+		t                GeodataType
+		path, url, check string
+	}{
+		{GEOSITE, gm.geositePath, s.GeoSiteURL, s.GeoSiteChecksumURL},
+		{GEOIP, gm.geoipPath, s.GeoIpURL, s.GeoIpChecksumURL},
+	}
+	gm.mu.RUnlock()
+
+	updated := false
+	for _, f := range files {
+		if f.path == "" || f.url == "" {
+			continue
+		}
+		st := gm.state(f.t)
+		now := time.Now()
+
+		gm.mu.Lock()
+		if st.nextCheck.IsZero() {
+			// First run: a file younger than the interval is current
+			st.nextCheck = now
+			if info, err := os.Stat(f.path); err == nil {
+				st.nextCheck = info.ModTime().Add(interval)
+			}
+		}
+		due := !now.Before(st.nextCheck)
+		gm.mu.Unlock()
+		if !due {
+			continue
+		}
+
+		size, changed, err := Download(f.url, f.check, f.path, f.t)
+
+		gm.mu.Lock()
+		st.lastCheck = now
+		st.nextCheck = now.Add(interval)
+		if err != nil {
+			st.err = err.Error()
+			st.nextCheck = now.Add(min(interval, updateRetryAfter))
+		} else {
+			st.err = ""
+			if changed {
+				st.lastUpdate = time.Now()
+			}
+		}
+		gm.mu.Unlock()
+
+		switch {
+		case err != nil:
+			log.Errorf("Geodata %s update failed: %v", f.t, err)
+		case changed:
+			log.Infof("Geodata %s updated from %s (%d bytes)", f.t, f.url, size)
+			updated = true
+		default:
+			log.Tracef("Geodata %s is up to date", f.t)
+		}
+	}
+
+	if updated {
+		gm.ClearCache()
+	}
+	return updated
+}
+
+func (gm *GeodataManager) state(t GeodataType) *fileState {
+	gm.mu.Lock()
+	defer gm.mu.Unlock()
+	st, ok := gm.files[t]
+	if !ok {
+		st = &fileState{}
+		gm.files[t] = st
+	}
+	return st
+}
+
+// GetStatus reports both geodata files. Checksums and category counts are
+// computed once per file version.
+func (gm *GeodataManager) GetStatus(s UpdateSettings) []FileStatus {
+	gm.mu.RLock()
+	paths := map[GeodataType]string{GEOSITE: gm.geositePath, GEOIP: gm.geoipPath}
+	gm.mu.RUnlock()
+	urls := map[GeodataType]string{GEOSITE: s.GeoSiteURL, GEOIP: s.GeoIpURL}
+
+	out := make([]FileStatus, 0, 2)
+	for _, t := range []GeodataType{GEOSITE, GEOIP} {
+		out = append(out, gm.fileStatus(t, paths[t], urls[t], s))
+	}
+	return out
+}
+
+func (gm *GeodataManager) fileStatus(t GeodataType, path, url string, s UpdateSettings) FileStatus {
+	fs := FileStatus{Type: t.String(), Path: path, URL: url}
+	st := gm.state(t)
+	autoUpdate := s.Enabled && url != "" && path != ""
+
+	gm.mu.RLock()
+	fs.LastCheck, fs.LastUpdate, fs.Error = st.lastCheck, st.lastUpdate, st.err
+	if autoUpdate {
+		fs.NextCheck = st.nextCheck
+	}
+	gm.mu.RUnlock()
+
+	if path == "" {
+		return fs
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return fs
+	}
+	fs.Exists, fs.Size, fs.Modified = true, info.Size(), info.ModTime()
+	if autoUpdate && fs.NextCheck.IsZero() {
+		// Not checked yet, the updater goes by the file age
+		fs.NextCheck = info.ModTime().Add(s.Interval)
+	}
+
+	gm.mu.RLock()
+	known := st.modTime.Equal(info.ModTime()) && st.size == info.Size()
+	sum, categories := st.sha256, st.categories
+	gm.mu.RUnlock()
+
+	if !known {
+		sum, _ = fileSHA256(path)
+		categories, err = Validate(path, t)
+		if err != nil && fs.Error == "" {
+			fs.Error = err.Error()
+		}
+		gm.mu.Lock()
+		st.modTime, st.size, st.sha256, st.categories = info.ModTime(), info.Size(), sum, categories
+		gm.mu.Unlock()
+	}
+	fs.SHA256, fs.Categories = sum, categories
+	return fs
+}
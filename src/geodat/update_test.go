@@ -0,0 +1,238 @@
+package geodat
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/urlesistiana/v2dat/v2data"
+	"google.golang.org/protobuf/proto"
+)
+
+func testGeoSite(t *testing.T) []byte {
+	t.Helper()
+	data, err := proto.Marshal(&v2data.GeoSiteList{Entry: []*v2data.GeoSite{
+		{CountryCode: "YOUTUBE", Domain: []*v2data.Domain{
+			{Type: v2data.Domain_Domain, Value: "youtube.com"},
+			{Type: v2data.Domain_Full, Value: "www.youtube.com"},
+		}},
+		{CountryCode: "GOOGLE", Domain: []*v2data.Domain{{Type: v2data.Domain_Plain, Value: "google"}}},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func testGeoIP(t *testing.T) []byte {
+	t.Helper()
+	data, err := proto.Marshal(&v2data.GeoIPList{Entry: []*v2data.GeoIP{
+		{CountryCode: "PRIVATE", Cidr: []*v2data.CIDR{
+			{Ip: []byte{10, 0, 0, 0}, Prefix: 8},
+			{Ip: []byte{192, 168, 0, 0}, Prefix: 16},
+		}},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func writeTemp(t *testing.T, data []byte) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "file.dat")
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func TestValidate(t *testing.T) {
+	site, ip := testGeoSite(t), testGeoIP(t)
+
+	if n, err := Validate(writeTemp(t, site), GEOSITE); err != nil || n != 2 {
+		t.Errorf("geosite: %d categories, %v", n, err)
+	}
+	if n, err := Validate(writeTemp(t, ip), GEOIP); err != nil || n != 1 {
+		t.Errorf("geoip: %d categories, %v", n, err)
+	}
+
+	bad := map[string]struct {
+		data []byte
+		t    GeodataType
+	}{
+		"truncated":          {site[:len(site)-3], GEOSITE},
+		"cut in the header":  {site[:1], GEOSITE},
+		"geoip as geosite":   {ip, GEOSITE},
+		"geosite as geoip":   {site, GEOIP},
+		"empty":              {nil, GEOSITE},
+		"not protobuf":       {[]byte("<html>not found</html>"), GEOSITE},
+		"category no domain": {mustMarshal(t, &v2data.GeoSiteList{Entry: []*v2data.GeoSite{{CountryCode: "EMPTY"}}}), GEOSITE},
+	}
+	for name, tt := range bad {
+		if _, err := Validate(writeTemp(t, tt.data), tt.t); err == nil {
+			t.Errorf("%s: no error", name)
+		}
+	}
+}
+
+func mustMarshal(t *testing.T, m proto.Message) []byte {
+	t.Helper()
+	data, err := proto.Marshal(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+// geodataServer serves one file and its checksum sidecar. A nil checksum
+// answers 404.
+type geodataServer struct {
+	mu       sync.Mutex
+	data     []byte
+	checksum []byte
+	status   int
+	fetches  int
+}
+
+func (s *geodataServer) set(data []byte, checksum string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.data = data
+	s.checksum = nil
+	if checksum != "" {
+		s.checksum = []byte(checksum + "  geosite.dat\n")
+	}
+}
+
+func (s *geodataServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch r.URL.Path {
+	case "/geosite.dat":
+		s.fetches++
+		if s.status != 0 {
+			w.WriteHeader(s.status)
+			return
+		}
+		_, _ = w.Write(s.data)
+	case "/geosite.dat.sha256sum":
+		if s.checksum == nil {
+			http.NotFound(w, r)
+			return
+		}
+		_, _ = w.Write(s.checksum)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func TestDownload(t *testing.T) {
+	site := testGeoSite(t)
+	gs := &geodataServer{}
+	srv := httptest.NewServer(gs)
+	defer srv.Close()
+	url := srv.URL + "/geosite.dat"
+
+	dir := t.TempDir()
+	dest := filepath.Join(dir, "geosite.dat")
+	current := func() []byte {
+		data, _ := os.ReadFile(dest)
+		return data
+	}
+
+	gs.set(site, sha256Hex(site))
+	size, updated, err := Download(url, "", dest, GEOSITE)
+	if err != nil || !updated || size != int64(len(site)) || string(current()) != string(site) {
+		t.Fatalf("first download: size %d, updated %v, %v", size, updated, err)
+	}
+
+	// The published checksum matches the file, nothing is fetched
+	size, updated, err = Download(url, "", dest, GEOSITE)
+	if err != nil || updated || size != int64(len(site)) || gs.fetches != 1 {
+		t.Errorf("unchanged file: size %d, updated %v, %d fetches, %v", size, updated, gs.fetches, err)
+	}
+
+	// Without a checksum the same content is fetched but not swapped in
+	gs.set(site, "")
+	if _, updated, err := Download(url, "", dest, GEOSITE); err != nil || updated {
+		t.Errorf("same content: updated %v, %v", updated, err)
+	}
+
+	failures := map[string]func(){
+		"checksum mismatch": func() {
+			newer := append([]byte(nil), site...)
+			newer[len(newer)-1] ^= 1
+			gs.set(newer, sha256Hex(site[:10]))
+		},
+		"truncated file": func() { gs.set(site[:len(site)-5], "") },
+		"truncated file with its checksum": func() {
+			gs.set(site[:len(site)-5], sha256Hex(site[:len(site)-5]))
+		},
+		"wrong type":   func() { gs.set(testGeoIP(t), "") },
+		"server error": func() { gs.status = http.StatusInternalServerError },
+	}
+	for name, setup := range failures {
+		setup()
+		if _, updated, err := Download(url, "", dest, GEOSITE); err == nil || updated {
+			t.Errorf("%s: updated %v, %v", name, updated, err)
+		}
+		gs.status = 0
+		if string(current()) != string(site) {
+			t.Fatalf("%s: the current file was replaced", name)
+		}
+	}
+
+	entries, _ := os.ReadDir(dir)
+	if len(entries) != 1 {
+		t.Errorf("temp files left behind: %d entries", len(entries))
+	}
+}
+
+func TestFetchChecksum(t *testing.T) {
+	sum := sha256Hex([]byte("geodata"))
+	mux := http.NewServeMux()
+	mux.HandleFunc("/plain.sha256sum", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(strings.ToUpper(sum) + "\n"))
+	})
+	mux.HandleFunc("/file.sha256sum", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(sum + "  geosite.dat\n"))
+	})
+	mux.HandleFunc("/garbage.sha256sum", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("<html>moved</html>"))
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	tests := []struct {
+		name, url, checksumURL string
+		want                   string
+		fails                  bool
+	}{
+		{"sidecar lowercased", srv.URL + "/plain", "", sum, false},
+		{"sha256sum output", srv.URL + "/file", "", sum, false},
+		{"explicit URL", srv.URL + "/data", srv.URL + "/file.sha256sum", sum, false},
+		{"no sidecar", srv.URL + "/missing", "", "", false},
+		{"sidecar without a checksum", srv.URL + "/garbage", "", "", false},
+		{"explicit URL missing", srv.URL + "/data", srv.URL + "/missing.sha256sum", "", true},
+		{"explicit URL without a checksum", srv.URL + "/data", srv.URL + "/garbage.sha256sum", "", true},
+		{"explicit URL unreachable", srv.URL + "/data", "http://127.0.0.1:1/sum", "", true},
+	}
+	for _, tt := range tests {
+		got, err := fetchChecksum(tt.url, tt.checksumURL)
+		if got != tt.want || (err != nil) != tt.fails {
+			t.Errorf("%s: %q, %v", tt.name, got, err)
+		}
+	}
+}
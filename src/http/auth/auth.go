@@ -0,0 +1,306 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/daniellavrushin/b4/config"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	SessionCookie = "b4_session"
+	TokenPrefix   = "b4_"
+)
+
+// Identity describes who is making a request and what they may do.
+type Identity struct {
+	Username string `json:"username,omitempty"`
+	Token    string `json:"token,omitempty"` // token name for bearer auth
+	Scope    string `json:"scope"`
+}
+
+type session struct {
+	username string
+	expires  time.Time
+}
+
+// settings is the part of WebServerConfig the manager checks requests
+// against. It is replaced as a whole and never modified in place.
+type settings struct {
+	auth    config.AuthConfig
+	origins []string
+}
+
+// Manager authenticates requests against WebServerConfig.Auth. It keeps its
+// own copy of the settings, swapped by Update when users, tokens or origins
+// change, so requests never read the config while the API writes it.
+type Manager struct {
+	settings atomic.Pointer[settings]
+
+	mu       sync.Mutex
+	sessions map[string]session
+}
+
+type ctxKey struct{}
+
+func NewManager(cfg *config.Config) *Manager {
+	m := &Manager{
+		sessions: make(map[string]session),
+	}
+	m.Update(cfg.System.WebServer)
+	return m
+}
+
+// Update makes ws the settings checked by later requests. The manager keeps
+// a copy, ws may be changed afterwards.
+func (m *Manager) Update(ws config.WebServerConfig) {
+	m.settings.Store(&settings{
+		auth:    copyAuth(ws.Auth),
+		origins: append([]string{}, ws.AllowedOrigins...),
+	})
+}
+
+// Config returns a copy of the auth settings in use.
+func (m *Manager) Config() config.AuthConfig {
+	return copyAuth(m.settings.Load().auth)
+}
+
+func copyAuth(a config.AuthConfig) config.AuthConfig {
+	a.Users = append([]config.AuthUser{}, a.Users...)
+	a.Tokens = append([]config.AuthToken{}, a.Tokens...)
+	return a
+}
+
+func (m *Manager) Enabled() bool {
+	return m.settings.Load().auth.Enabled
+}
+
+// Login verifies the credentials and returns a new session ID.
+func (m *Manager) Login(username, password string) (string, bool) {
+	auth := m.settings.Load().auth
+
+	var hash string
+	for _, u := range auth.Users {
+		if u.Username == username {
+			hash = u.PasswordHash
+			break
+		}
+	}
+	if hash == "" || !CheckPassword(hash, password) {
+		return "", false
+	}
+
+	id := randomHex(32)
+	ttl := time.Duration(auth.SessionTTLHours) * time.Hour
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.cleanupLocked()
+	m.sessions[id] = session{username: username, expires: time.Now().Add(ttl)}
+	return id, true
+}
+
+func (m *Manager) Logout(id string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.sessions, id)
+}
+
+// DropUserSessions ends all sessions of a user, e.g. after a password change.
+func (m *Manager) DropUserSessions(username string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for id, s := range m.sessions {
+		if s.username == username {
+			delete(m.sessions, id)
+		}
+	}
+}
+
+func (m *Manager) cleanupLocked() {
+	now := time.Now()
+	for id, s := range m.sessions {
+		if now.After(s.expires) {
+			delete(m.sessions, id)
+		}
+	}
+}
+
+// Authenticate resolves the identity of r from a bearer token or a session
+// cookie.
+func (m *Manager) Authenticate(r *http.Request) (Identity, bool) {
+	if h := r.Header.Get("Authorization"); strings.HasPrefix(h, "Bearer ") {
+		return m.authenticateToken(strings.TrimSpace(strings.TrimPrefix(h, "Bearer ")))
+	}
+
+	c, err := r.Cookie(SessionCookie)
+	if err != nil || c.Value == "" {
+		return Identity{}, false
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s, ok := m.sessions[c.Value]
+	if !ok {
+		return Identity{}, false
+	}
+	if time.Now().After(s.expires) {
+		delete(m.sessions, c.Value)
+		return Identity{}, false
+	}
+	if !m.userExists(s.username) {
+		delete(m.sessions, c.Value)
+		return Identity{}, false
+	}
+	return Identity{Username: s.username, Scope: config.AuthScopeFull}, true
+}
+
+func (m *Manager) userExists(username string) bool {
+	for _, u := range m.settings.Load().auth.Users {
+		if u.Username == username {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *Manager) authenticateToken(token string) (Identity, bool) {
+	if token == "" {
+		return Identity{}, false
+	}
+	hash := HashToken(token)
+	for _, t := range m.settings.Load().auth.Tokens {
+		if subtle.ConstantTimeCompare([]byte(t.Hash), []byte(hash)) == 1 {
+			return Identity{Token: t.Name, Scope: t.Scope}, true
+		}
+	}
+	return Identity{}, false
+}
+
+// isPublic lists paths reachable without credentials. Everything outside
+// /api/ is the static UI, which has to load to show the login form, except
+// the Prometheus endpoint.
+func isPublic(path string) bool {
+	if path == "/metrics" {
+		return false
+	}
+	if !strings.HasPrefix(path, "/api/") {
+		return true
+	}
+	return path == "/api/auth/login" || path == "/api/auth/status"
+}
+
+// allows reports whether scope permits the request method.
+func allows(scope, method string) bool {
+	if scope == config.AuthScopeFull {
+		return true
+	}
+	return method == http.MethodGet || method == http.MethodHead || method == http.MethodOptions
+}
+
+// Middleware rejects unauthenticated API and WebSocket requests when auth is
+// enabled. Read-only tokens are limited to safe methods.
+func (m *Manager) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !m.Enabled() {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		id, ok := m.Authenticate(r)
+		if ok {
+			r = r.WithContext(context.WithValue(r.Context(), ctxKey{}, id))
+		}
+
+		if isPublic(r.URL.Path) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if !ok {
+			writeError(w, http.StatusUnauthorized, "authentication required")
+			return
+		}
+		if !allows(id.Scope, r.Method) {
+			writeError(w, http.StatusForbidden, "token scope does not permit this request")
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// AllowOrigin reports whether a browser page at the request's Origin may
+// call the API: the UI itself, or one of WebServerConfig.AllowedOrigins.
+// Requests without an Origin header do not come from a cross-site page.
+func (m *Manager) AllowOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	if err != nil || u.Host == "" {
+		return false
+	}
+	if strings.EqualFold(u.Host, r.Host) {
+		return true
+	}
+	origin = strings.ToLower(strings.TrimSuffix(origin, "/"))
+	for _, o := range m.settings.Load().origins {
+		if o == origin {
+			return true
+		}
+	}
+	return false
+}
+
+// FromContext returns the identity attached by Middleware.
+func FromContext(ctx context.Context) (Identity, bool) {
+	id, ok := ctx.Value(ctxKey{}).(Identity)
+	return id, ok
+}
+
+func writeError(w http.ResponseWriter, status int, message string) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	_, _ = w.Write([]byte(`{"error":"` + message + `"}`))
+}
+
+func HashPassword(password string) (string, error) {
+	b, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+func CheckPassword(hash, password string) bool {
+	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+}
+
+// NewToken returns a random bearer token and the hash to store in config.
+func NewToken() (token, hash string) {
+	token = TokenPrefix + randomHex(32)
+	return token, HashToken(token)
+}
+
+func HashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,166 @@
+package auth
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/daniellavrushin/b4/config"
+)
+
+func newTestManager(t *testing.T) (*Manager, string, string) {
+	t.Helper()
+	cfg := config.NewConfig()
+
+	hash, err := HashPassword("secret-password")
+	if err != nil {
+		t.Fatalf("HashPassword: %v", err)
+	}
+	readToken, readHash := NewToken()
+	fullToken, fullHash := NewToken()
+
+	cfg.System.WebServer.Auth = config.AuthConfig{
+		Enabled:         true,
+		SessionTTLHours: 1,
+		Users:           []config.AuthUser{{Username: "admin", PasswordHash: hash}},
+		Tokens: []config.AuthToken{
+			{Id: "1", Name: "grafana", Hash: readHash, Scope: config.AuthScopeRead},
+			{Id: "2", Name: "script", Hash: fullHash, Scope: config.AuthScopeFull},
+		},
+	}
+	return NewManager(&cfg), readToken, fullToken
+}
+
+func serve(m *Manager, req *http.Request) int {
+	h := m.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	return rec.Code
+}
+
+func TestPasswordHash(t *testing.T) {
+	hash, err := HashPassword("hunter22")
+	if err != nil {
+		t.Fatalf("HashPassword: %v", err)
+	}
+	if !CheckPassword(hash, "hunter22") {
+		t.Error("expected password to match")
+	}
+	if CheckPassword(hash, "hunter23") {
+		t.Error("expected wrong password to be rejected")
+	}
+}
+
+func TestMiddleware_Disabled(t *testing.T) {
+	m, _, _ := newTestManager(t)
+	a := m.Config()
+	a.Enabled = false
+	m.Update(config.WebServerConfig{Auth: a})
+
+	req := httptest.NewRequest(http.MethodPut, "/api/config", nil)
+	if code := serve(m, req); code != http.StatusOK {
+		t.Errorf("expected 200 with auth disabled, got %d", code)
+	}
+}
+
+func TestMiddleware_Unauthenticated(t *testing.T) {
+	m, _, _ := newTestManager(t)
+
+	for _, path := range []string{"/api/config", "/api/ws/logs", "/api/system/restart", "/metrics"} {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		if code := serve(m, req); code != http.StatusUnauthorized {
+			t.Errorf("%s: expected 401, got %d", path, code)
+		}
+	}
+
+	for _, path := range []string{"/", "/assets/index.js", "/api/auth/login", "/api/auth/status"} {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		if code := serve(m, req); code != http.StatusOK {
+			t.Errorf("%s: expected public access, got %d", path, code)
+		}
+	}
+}
+
+func TestMiddleware_Session(t *testing.T) {
+	m, _, _ := newTestManager(t)
+
+	if _, ok := m.Login("admin", "wrong"); ok {
+		t.Fatal("login with wrong password should fail")
+	}
+	sid, ok := m.Login("admin", "secret-password")
+	if !ok {
+		t.Fatal("login should succeed")
+	}
+
+	req := httptest.NewRequest(http.MethodPut, "/api/config", nil)
+	req.AddCookie(&http.Cookie{Name: SessionCookie, Value: sid})
+	if code := serve(m, req); code != http.StatusOK {
+		t.Errorf("expected 200 with session, got %d", code)
+	}
+
+	m.Logout(sid)
+	req = httptest.NewRequest(http.MethodGet, "/api/config", nil)
+	req.AddCookie(&http.Cookie{Name: SessionCookie, Value: sid})
+	if code := serve(m, req); code != http.StatusUnauthorized {
+		t.Errorf("expected 401 after logout, got %d", code)
+	}
+}
+
+func TestMiddleware_TokenScopes(t *testing.T) {
+	m, readToken, fullToken := newTestManager(t)
+
+	req := httptest.NewRequest(http.MethodGet, "/api/metrics", nil)
+	req.Header.Set("Authorization", "Bearer "+readToken)
+	if code := serve(m, req); code != http.StatusOK {
+		t.Errorf("read token GET: expected 200, got %d", code)
+	}
+
+	req = httptest.NewRequest(http.MethodPost, "/api/system/restart", nil)
+	req.Header.Set("Authorization", "Bearer "+readToken)
+	if code := serve(m, req); code != http.StatusForbidden {
+		t.Errorf("read token POST: expected 403, got %d", code)
+	}
+
+	req = httptest.NewRequest(http.MethodPost, "/api/system/restart", nil)
+	req.Header.Set("Authorization", "Bearer "+fullToken)
+	if code := serve(m, req); code != http.StatusOK {
+		t.Errorf("full token POST: expected 200, got %d", code)
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/api/config", nil)
+	req.Header.Set("Authorization", "Bearer b4_invalid")
+	if code := serve(m, req); code != http.StatusUnauthorized {
+		t.Errorf("invalid token: expected 401, got %d", code)
+	}
+}
+
+func TestAllowOrigin(t *testing.T) {
+	cfg := config.NewConfig()
+	cfg.System.WebServer.AllowedOrigins = []string{"https://dash.lan:8443"}
+	m := NewManager(&cfg)
+
+	tests := []struct {
+		origin string
+		want   bool
+	}{
+		{"", true},
+		{"http://router.lan:7000", true},
+		{"http://ROUTER.lan:7000", true},
+		{"https://dash.lan:8443", true},
+		{"https://dash.lan:8443/", true},
+		{"https://dash.lan", false},
+		{"http://evil.example", false},
+		{"null", false},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodPost, "http://router.lan:7000/api/config", nil)
+		if tt.origin != "" {
+			req.Header.Set("Origin", tt.origin)
+		}
+		if got := m.AllowOrigin(req); got != tt.want {
+			t.Errorf("AllowOrigin(%q) = %v, want %v", tt.origin, got, tt.want)
+		}
+	}
+}
@@ -2,16 +2,26 @@ package http
 
 import (
 	"net/http"
+
+	"github.com/daniellavrushin/b4/http/auth"
 )
 
-func cors(next http.Handler) http.Handler {
+// cors answers browser requests from origins the auth manager allows and
+// rejects the others, so pages on other sites cannot drive the API with
+// the user's session.
+func cors(m *auth.Manager, next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		origin := r.Header.Get("Origin")
 		if origin != "" {
+			if !m.AllowOrigin(r) {
+				http.Error(w, "origin not allowed", http.StatusForbidden)
+				return
+			}
 			w.Header().Set("Access-Control-Allow-Origin", origin)
 			w.Header().Set("Access-Control-Allow-Credentials", "true")
 			w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
 			w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
+			w.Header().Add("Vary", "Origin")
 		}
 
 		if r.Method == "OPTIONS" {
@@ -6,10 +6,13 @@ import (
 	"testing"
 
 	"github.com/daniellavrushin/b4/config"
+	"github.com/daniellavrushin/b4/http/auth"
 )
 
 func TestCors(t *testing.T) {
-	handler := cors(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	cfg := config.NewConfig()
+	cfg.System.WebServer.AllowedOrigins = []string{"http://localhost:3000"}
+	handler := cors(auth.NewManager(&cfg), http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusOK)
 	}))
 
@@ -60,6 +63,35 @@ func TestCors(t *testing.T) {
 		}
 	})
 
+	t.Run("rejects origins that are not allowed", func(t *testing.T) {
+		for _, method := range []string{http.MethodOptions, http.MethodPost} {
+			req := httptest.NewRequest(method, "/api/system/restart", nil)
+			req.Header.Set("Origin", "http://evil.example")
+			rec := httptest.NewRecorder()
+
+			handler.ServeHTTP(rec, req)
+
+			if rec.Code != http.StatusForbidden {
+				t.Errorf("%s: expected status 403, got %d", method, rec.Code)
+			}
+			if rec.Header().Get("Access-Control-Allow-Origin") != "" {
+				t.Errorf("%s: expected no CORS headers for a foreign origin", method)
+			}
+		}
+	})
+
+	t.Run("same origin is allowed", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodPost, "http://router.lan:7000/api/config", nil)
+		req.Header.Set("Origin", "http://router.lan:7000")
+		rec := httptest.NewRecorder()
+
+		handler.ServeHTTP(rec, req)
+
+		if rec.Code != http.StatusOK {
+			t.Errorf("expected status 200, got %d", rec.Code)
+		}
+	})
+
 	t.Run("OPTIONS without Origin still returns 204", func(t *testing.T) {
 		req := httptest.NewRequest(http.MethodOptions, "/test", nil)
 		rec := httptest.NewRecorder()
@@ -0,0 +1,351 @@
+package handler
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/daniellavrushin/b4/config"
+	"github.com/daniellavrushin/b4/http/auth"
+	"github.com/daniellavrushin/b4/log"
+	"github.com/google/uuid"
+)
+
+var authManager *auth.Manager
+
+// authConfigMu serializes changes to users and tokens with config saves, so
+// neither overwrites the other.
+var authConfigMu sync.Mutex
+
+var errAuthNotFound = errors.New("not found")
+
+func SetAuthManager(m *auth.Manager) {
+	authManager = m
+}
+
+func (api *API) RegisterAuthApi() {
+	api.mux.HandleFunc("/api/auth/login", api.handleLogin)
+	api.mux.HandleFunc("/api/auth/logout", api.handleLogout)
+	api.mux.HandleFunc("/api/auth/status", api.handleAuthStatus)
+	api.mux.HandleFunc("/api/auth/users", api.handleUsers)
+	api.mux.HandleFunc("/api/auth/users/{username}", api.handleUserByName)
+	api.mux.HandleFunc("/api/auth/tokens", api.handleTokens)
+	api.mux.HandleFunc("/api/auth/tokens/{id}", api.handleTokenById)
+}
+
+func (api *API) handleLogin(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if authManager == nil || !authManager.Enabled() {
+		writeJsonError(w, http.StatusBadRequest, "authentication is disabled")
+		return
+	}
+
+	var req LoginRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJsonError(w, http.StatusBadRequest, "Invalid JSON")
+		return
+	}
+
+	sid, ok := authManager.Login(req.Username, req.Password)
+	if !ok {
+		log.Warnf("Failed web login for user '%s' from %s", req.Username, r.RemoteAddr)
+		time.Sleep(500 * time.Millisecond)
+		writeJsonError(w, http.StatusUnauthorized, "invalid username or password")
+		return
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     auth.SessionCookie,
+		Value:    sid,
+		Path:     "/",
+		MaxAge:   authManager.Config().SessionTTLHours * 3600,
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteStrictMode,
+	})
+
+	log.Infof("User '%s' logged in from %s", req.Username, r.RemoteAddr)
+	sendResponse(w, AuthStatusResponse{
+		Enabled:       true,
+		Authenticated: true,
+		Username:      req.Username,
+		Scope:         config.AuthScopeFull,
+	})
+}
+
+func (api *API) handleLogout(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	if c, err := r.Cookie(auth.SessionCookie); err == nil && authManager != nil {
+		authManager.Logout(c.Value)
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     auth.SessionCookie,
+		Value:    "",
+		Path:     "/",
+		MaxAge:   -1,
+		HttpOnly: true,
+		SameSite: http.SameSiteStrictMode,
+	})
+
+	sendResponse(w, map[string]interface{}{"success": true})
+}
+
+func (api *API) handleAuthStatus(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	resp := AuthStatusResponse{Enabled: api.authConfig().Enabled}
+	if id, ok := auth.FromContext(r.Context()); ok {
+		resp.Authenticated = true
+		resp.Username = id.Username
+		resp.Token = id.Token
+		resp.Scope = id.Scope
+	}
+	sendResponse(w, resp)
+}
+
+func (api *API) handleUsers(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		authCfg := api.authConfig()
+		users := make([]UserInfo, 0, len(authCfg.Users))
+		for _, u := range authCfg.Users {
+			users = append(users, UserInfo{Username: u.Username})
+		}
+		sendResponse(w, users)
+
+	case http.MethodPost:
+		var req UserRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeJsonError(w, http.StatusBadRequest, "Invalid JSON")
+			return
+		}
+		if req.Username == "" || len(req.Password) < 8 {
+			writeJsonError(w, http.StatusBadRequest, "username is required and password must be at least 8 characters")
+			return
+		}
+
+		hash, err := auth.HashPassword(req.Password)
+		if err != nil {
+			writeJsonError(w, http.StatusInternalServerError, "failed to hash password")
+			return
+		}
+
+		updated := false
+		err = api.updateAuthConfig(func(authCfg *config.AuthConfig) error {
+			for i := range authCfg.Users {
+				if authCfg.Users[i].Username == req.Username {
+					authCfg.Users[i].PasswordHash = hash
+					updated = true
+				}
+			}
+			if !updated {
+				authCfg.Users = append(authCfg.Users, config.AuthUser{Username: req.Username, PasswordHash: hash})
+			}
+			return nil
+		})
+		if err != nil {
+			writeJsonError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		if updated && authManager != nil {
+			authManager.DropUserSessions(req.Username)
+		}
+
+		log.Infof("Web user '%s' saved", req.Username)
+		sendResponse(w, UserInfo{Username: req.Username})
+
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func (api *API) handleUserByName(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	username := r.PathValue("username")
+	err := api.updateAuthConfig(func(authCfg *config.AuthConfig) error {
+		users := authCfg.Users[:0]
+		for _, u := range authCfg.Users {
+			if u.Username != username {
+				users = append(users, u)
+			}
+		}
+		if len(users) == len(authCfg.Users) {
+			return errAuthNotFound
+		}
+		authCfg.Users = users
+		return nil
+	})
+	if errors.Is(err, errAuthNotFound) {
+		writeJsonError(w, http.StatusNotFound, "user not found")
+		return
+	}
+	if err != nil {
+		writeJsonError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if authManager != nil {
+		authManager.DropUserSessions(username)
+	}
+
+	log.Infof("Web user '%s' removed", username)
+	sendResponse(w, map[string]interface{}{"success": true})
+}
+
+func (api *API) handleTokens(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		authCfg := api.authConfig()
+		tokens := make([]TokenInfo, 0, len(authCfg.Tokens))
+		for _, t := range authCfg.Tokens {
+			tokens = append(tokens, TokenInfo{Id: t.Id, Name: t.Name, Scope: t.Scope, CreatedAt: t.CreatedAt})
+		}
+		sendResponse(w, tokens)
+
+	case http.MethodPost:
+		var req TokenRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeJsonError(w, http.StatusBadRequest, "Invalid JSON")
+			return
+		}
+		if req.Name == "" {
+			writeJsonError(w, http.StatusBadRequest, "token name is required")
+			return
+		}
+		if req.Scope != config.AuthScopeFull {
+			req.Scope = config.AuthScopeRead
+		}
+
+		token, hash := auth.NewToken()
+		t := config.AuthToken{
+			Id:        uuid.New().String(),
+			Name:      req.Name,
+			Hash:      hash,
+			Scope:     req.Scope,
+			CreatedAt: time.Now().Unix(),
+		}
+
+		err := api.updateAuthConfig(func(authCfg *config.AuthConfig) error {
+			authCfg.Tokens = append(authCfg.Tokens, t)
+			return nil
+		})
+		if err != nil {
+			writeJsonError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+
+		log.Infof("API token '%s' created (scope: %s)", t.Name, t.Scope)
+		sendResponse(w, TokenCreatedResponse{
+			TokenInfo: TokenInfo{Id: t.Id, Name: t.Name, Scope: t.Scope, CreatedAt: t.CreatedAt},
+			Token:     token,
+		})
+
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func (api *API) handleTokenById(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	id := r.PathValue("id")
+	err := api.updateAuthConfig(func(authCfg *config.AuthConfig) error {
+		tokens := authCfg.Tokens[:0]
+		for _, t := range authCfg.Tokens {
+			if t.Id != id {
+				tokens = append(tokens, t)
+			}
+		}
+		if len(tokens) == len(authCfg.Tokens) {
+			return errAuthNotFound
+		}
+		authCfg.Tokens = tokens
+		return nil
+	})
+	if errors.Is(err, errAuthNotFound) {
+		writeJsonError(w, http.StatusNotFound, "token not found")
+		return
+	}
+	if err != nil {
+		writeJsonError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	log.Infof("API token %s revoked", id)
+	sendResponse(w, map[string]interface{}{"success": true})
+}
+
+// authConfig returns a copy of the users and tokens in use.
+func (api *API) authConfig() config.AuthConfig {
+	if authManager != nil {
+		return authManager.Config()
+	}
+	authConfigMu.Lock()
+	defer authConfigMu.Unlock()
+	a := api.cfg.System.WebServer.Auth
+	a.Users = append([]config.AuthUser{}, a.Users...)
+	a.Tokens = append([]config.AuthToken{}, a.Tokens...)
+	return a
+}
+
+// updateAuthConfig applies change to a copy of the auth settings, persists
+// it and hands it to the auth manager. Unlike saveAndPushConfig it does not
+// touch the queue workers.
+func (api *API) updateAuthConfig(change func(a *config.AuthConfig) error) error {
+	authConfigMu.Lock()
+	defer authConfigMu.Unlock()
+
+	a := api.cfg.System.WebServer.Auth
+	a.Users = append([]config.AuthUser{}, a.Users...)
+	a.Tokens = append([]config.AuthToken{}, a.Tokens...)
+	if err := change(&a); err != nil {
+		return err
+	}
+	if a.Enabled && len(a.Users) == 0 {
+		return fmt.Errorf("cannot remove the last user while authentication is enabled")
+	}
+
+	api.cfg.System.WebServer.Auth = a
+	if authManager != nil {
+		authManager.Update(api.cfg.System.WebServer)
+	}
+	if err := api.cfg.SaveToFile(api.cfg.ConfigPath); err != nil {
+		return fmt.Errorf("failed to save config to file: %v", err)
+	}
+	return nil
+}
+
+// redactAuth strips password and token hashes from a config sent to clients.
+func redactAuth(a config.AuthConfig) config.AuthConfig {
+	users := make([]config.AuthUser, len(a.Users))
+	for i, u := range a.Users {
+		users[i] = config.AuthUser{Username: u.Username}
+	}
+	tokens := make([]config.AuthToken, len(a.Tokens))
+	for i, t := range a.Tokens {
+		t.Hash = ""
+		tokens[i] = t
+	}
+	a.Users = users
+	a.Tokens = tokens
+	return a
+}
@@ -0,0 +1,97 @@
+package handler
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/daniellavrushin/b4/config"
+	"github.com/daniellavrushin/b4/http/auth"
+)
+
+// Logins and token checks read the auth settings while user changes write
+// them. Run with -race.
+func TestAuthConcurrentLoginAndSave(t *testing.T) {
+	cfg := config.NewConfig()
+	cfg.ConfigPath = filepath.Join(t.TempDir(), "b4.json")
+	hash, err := auth.HashPassword("secret-password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, tokenHash := auth.NewToken()
+	cfg.System.WebServer.Auth.Enabled = true
+	cfg.System.WebServer.Auth.Users = []config.AuthUser{{Username: "admin", PasswordHash: hash}}
+	cfg.System.WebServer.Auth.Tokens = []config.AuthToken{{Id: "1", Name: "script", Hash: tokenHash, Scope: config.AuthScopeFull}}
+	if err := cfg.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	m := auth.NewManager(&cfg)
+	SetAuthManager(m)
+	defer SetAuthManager(nil)
+
+	api := &API{cfg: &cfg, mux: http.NewServeMux()}
+	api.RegisterAuthApi()
+	h := m.Middleware(api.mux)
+
+	do := func(method, path string, body interface{}, bearer bool) int {
+		var b []byte
+		if body != nil {
+			b, _ = json.Marshal(body)
+		}
+		req := httptest.NewRequest(method, path, bytes.NewReader(b))
+		if bearer {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	const n = 6
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(3)
+		go func() {
+			defer wg.Done()
+			if code := do(http.MethodPost, "/api/auth/login", LoginRequest{Username: "admin", Password: "secret-password"}, false); code != http.StatusOK {
+				t.Errorf("login: expected 200, got %d", code)
+			}
+		}()
+		go func(i int) {
+			defer wg.Done()
+			user := UserRequest{Username: fmt.Sprintf("user%d", i), Password: "another-password"}
+			if code := do(http.MethodPost, "/api/auth/users", user, true); code != http.StatusOK {
+				t.Errorf("save user: expected 200, got %d", code)
+			}
+		}(i)
+		go func() {
+			defer wg.Done()
+			if code := do(http.MethodGet, "/api/auth/tokens", nil, true); code != http.StatusOK {
+				t.Errorf("list tokens: expected 200, got %d", code)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if users := m.Config().Users; len(users) != n+1 {
+		t.Errorf("expected %d users after concurrent saves, got %d", n+1, len(users))
+	}
+
+	saved := config.NewConfig()
+	if err := saved.LoadFromFile(cfg.ConfigPath); err != nil {
+		t.Fatal(err)
+	}
+	if len(saved.System.WebServer.Auth.Users) != n+1 {
+		t.Errorf("expected %d users in the saved config, got %d", n+1, len(saved.System.WebServer.Auth.Users))
+	}
+
+	if code := do(http.MethodDelete, "/api/auth/users/nobody", nil, true); code != http.StatusNotFound {
+		t.Errorf("delete unknown user: expected 404, got %d", code)
+	}
+}
@@ -0,0 +1,40 @@
+package handler
+
+type LoginRequest struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+type AuthStatusResponse struct {
+	Enabled       bool   `json:"enabled"`
+	Authenticated bool   `json:"authenticated"`
+	Username      string `json:"username,omitempty"`
+	Token         string `json:"token,omitempty"`
+	Scope         string `json:"scope,omitempty"`
+}
+
+type UserRequest struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+type UserInfo struct {
+	Username string `json:"username"`
+}
+
+type TokenRequest struct {
+	Name  string `json:"name"`
+	Scope string `json:"scope"`
+}
+
+type TokenInfo struct {
+	Id        string `json:"id"`
+	Name      string `json:"name"`
+	Scope     string `json:"scope"`
+	CreatedAt int64  `json:"created_at"`
+}
+
+type TokenCreatedResponse struct {
+	TokenInfo
+	Token string `json:"token"` // shown once, only the hash is stored
+}
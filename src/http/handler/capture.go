@@ -8,6 +8,7 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
+	"time"
 
 	"github.com/daniellavrushin/b4/capture"
 	"github.com/daniellavrushin/b4/log"
@@ -26,6 +27,8 @@ func (api *API) RegisterCaptureApi() {
 	api.mux.HandleFunc("/api/capture/clear", api.handleClearCaptures)
 	api.mux.HandleFunc("/api/capture/download", api.handleDownloadCapture)
 	api.mux.HandleFunc("/api/capture/upload", api.handleUploadCapture)
+	api.mux.HandleFunc("/api/capture/tap", api.handleCaptureTap)
+	api.mux.HandleFunc("/api/capture/tap/download", api.handleDownloadTap)
 }
 
 func (api *API) handleGenerateCapture(w http.ResponseWriter, r *http.Request) {
@@ -345,3 +348,63 @@ func (api *API) handleUploadCapture(w http.ResponseWriter, r *http.Request) {
 		"protocol": protocol,
 	})
 }
+
+// Live pcapng tap of queued packets and the packets sent for them
+func (api *API) handleCaptureTap(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		setJsonHeader(w)
+		json.NewEncoder(w).Encode(capture.GetTapStatus())
+
+	case http.MethodPost:
+		var opts capture.TapOptions
+		if r.ContentLength != 0 {
+			if err := json.NewDecoder(r.Body).Decode(&opts); err != nil {
+				http.Error(w, "Invalid request", http.StatusBadRequest)
+				return
+			}
+		}
+
+		manager := capture.GetManager(api.cfg)
+		path := filepath.Join(manager.GetOutputPath(), fmt.Sprintf("tap-%s.pcapng", time.Now().Format("20060102-150405")))
+		if err := capture.StartTap(path, opts); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		setJsonHeader(w)
+		json.NewEncoder(w).Encode(capture.GetTapStatus())
+
+	case http.MethodDelete:
+		setJsonHeader(w)
+		json.NewEncoder(w).Encode(capture.StopTap())
+
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// Download the file of the running or last tap
+func (api *API) handleDownloadTap(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	status := capture.GetTapStatus()
+	if status.Path == "" {
+		http.Error(w, "No tap recorded", http.StatusNotFound)
+		return
+	}
+	if _, err := os.Stat(status.Path); err != nil {
+		http.Error(w, "File not found", http.StatusNotFound)
+		return
+	}
+
+	filename := filepath.Base(status.Path)
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+	w.Header().Set("Content-Type", "application/x-pcapng")
+
+	http.ServeFile(w, r, status.Path)
+	log.Tracef("Served tap file: %s", filename)
+}
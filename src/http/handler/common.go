@@ -19,8 +19,10 @@ var (
 )
 
 var (
-	globalPool        *nfq.Pool
-	tablesRefreshFunc func() error
+	globalPool            *nfq.Pool
+	globalGeodata         *geodat.GeodataManager
+	tablesRefreshFunc     func() error
+	tablesSetsRefreshFunc func() error
 )
 
 func setJsonHeader(w http.ResponseWriter) {
@@ -37,9 +39,18 @@ func SetNFQPool(pool *nfq.Pool) {
 	globalPool = pool
 }
 
+// SetGeodataManager shares the manager that keeps the geodata files up to
+// date, so the API serves from the same cache.
+func SetGeodataManager(gm *geodat.GeodataManager) {
+	globalGeodata = gm
+}
+
 func NewAPIHandler(cfg *config.Config) *API {
 	// Initialize geodata manager
-	geodataManager := geodat.NewGeodataManager(cfg.System.Geo.GeoSitePath, cfg.System.Geo.GeoIpPath)
+	geodataManager := globalGeodata
+	if geodataManager == nil {
+		geodataManager = geodat.NewGeodataManager(cfg.System.Geo.GeoSitePath, cfg.System.Geo.GeoIpPath)
+	}
 
 	// Preload geosite categories if configured
 	geositeCategories := []string{}
@@ -76,10 +87,16 @@ func NewAPIHandler(cfg *config.Config) *API {
 		}
 	}
 
+	// Share the aliases with the workers, sets can target devices by alias
+	deviceAliases := config.NewDeviceAliases(cfg.ConfigPath)
+	if globalPool != nil && globalPool.Aliases != nil {
+		deviceAliases = globalPool.Aliases
+	}
+
 	return &API{
 		cfg:            cfg,
 		geodataManager: geodataManager,
-		deviceAliases:  config.NewDeviceAliases(cfg.ConfigPath),
+		deviceAliases:  deviceAliases,
 	}
 }
 func (api *API) RegisterEndpoints(mux *http.ServeMux, cfg *config.Config) {
@@ -101,6 +118,10 @@ func (api *API) RegisterEndpoints(mux *http.ServeMux, cfg *config.Config) {
 	api.RegisterSetsApi()
 	api.RegisterDnsApi()
 	api.RegisterDevicesApi()
+	api.RegisterAuthApi()
+	api.RegisterConnectionsApi()
+	api.RegisterListsApi()
+	api.RegisterHealthApi()
 }
 
 func sendResponse(w http.ResponseWriter, response interface{}) {
@@ -114,3 +135,9 @@ func sendResponse(w http.ResponseWriter, response interface{}) {
 func SetTablesRefreshFunc(fn func() error) {
 	tablesRefreshFunc = fn
 }
+
+// SetTablesSetsRefreshFunc registers an in-place update of the firewall's
+// named sets. Backends without named sets leave it nil and get a full refresh.
+func SetTablesSetsRefreshFunc(fn func() error) {
+	tablesSetsRefreshFunc = fn
+}
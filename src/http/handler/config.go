@@ -6,10 +6,13 @@ import (
 	"fmt"
 	"net"
 	"net/http"
+	"slices"
 	"sort"
 	"strings"
 
 	"github.com/daniellavrushin/b4/config"
+	"github.com/daniellavrushin/b4/connlog"
+	"github.com/daniellavrushin/b4/lists"
 	"github.com/daniellavrushin/b4/log"
 	"github.com/daniellavrushin/b4/metrics"
 )
@@ -100,8 +103,11 @@ func (a *API) getConfig(w http.ResponseWriter) {
 	}
 	sort.Strings(ifaces)
 
+	cfgView := *a.cfg
+	cfgView.System.WebServer.Auth = redactAuth(a.authConfig())
+
 	response := ConfigResponse{
-		Config:              a.cfg,
+		Config:              &cfgView,
 		Sets:                setsWithStats,
 		AvailableInterfaces: ifaces,
 		Success:             true,
@@ -255,10 +261,13 @@ func (a *API) updateConfig(w http.ResponseWriter, r *http.Request) {
 	m.RecordEvent("info", fmt.Sprintf("Loaded %d domains and %d IPs across %d sets", allDomainsCount, allIpsCount, len(newConfig.Sets)))
 	log.Infof("Loaded %d domains and %d IPs across %d sets", allDomainsCount, allIpsCount, len(newConfig.Sets))
 
+	cfgView := newConfig
+	cfgView.System.WebServer.Auth = redactAuth(newConfig.System.WebServer.Auth)
+
 	response := ConfigResponse{
 		Success: true,
 		Message: "Configuration updated successfully",
-		Config:  &newConfig,
+		Config:  &cfgView,
 		Sets:    setsWithStats,
 	}
 
@@ -281,6 +290,8 @@ func (a *API) resetConfig(w http.ResponseWriter, r *http.Request) {
 	defaultCfg.System.Checker = a.cfg.System.Checker
 	defaultCfg.ConfigPath = a.cfg.ConfigPath
 	defaultCfg.System.WebServer.IsEnabled = a.cfg.System.WebServer.IsEnabled
+	defaultCfg.System.WebServer.Auth = a.authConfig()
+	defaultCfg.System.WebServer.AllowedOrigins = a.cfg.System.WebServer.AllowedOrigins
 
 	for _, set := range a.cfg.Sets {
 		set.ResetToDefaults()
@@ -307,6 +318,12 @@ func (a *API) resetConfig(w http.ResponseWriter, r *http.Request) {
 }
 
 func (a *API) saveAndPushConfig(newCfg *config.Config) error {
+	authConfigMu.Lock()
+	defer authConfigMu.Unlock()
+
+	// Users and tokens are managed through /api/auth only
+	newCfg.System.WebServer.Auth.Users = a.cfg.System.WebServer.Auth.Users
+	newCfg.System.WebServer.Auth.Tokens = a.cfg.System.WebServer.Auth.Tokens
 
 	if err := newCfg.Validate(); err != nil {
 		return log.Errorf("Invalid configuration: %v", err)
@@ -325,6 +342,14 @@ func (a *API) saveAndPushConfig(newCfg *config.Config) error {
 	}
 
 	*a.cfg = *newCfg
+	if authManager != nil {
+		authManager.Update(newCfg.System.WebServer)
+	}
+
+	if err := connlog.Configure(newCfg.System.Logging.Connections); err != nil {
+		log.Errorf("Failed to open connection history: %v", err)
+	}
+	lists.Check()
 
 	return nil
 }
@@ -339,15 +364,24 @@ func (a *API) PerformSoftRestart(newCfg *config.Config, oldCfg *config.Config) b
 		shouldUpdate = true
 	}
 
-	if !newCfg.System.Tables.SkipSetup && oldPorts != newPorts {
-		shouldUpdate = true
-	}
+	oldDupV4, oldDupV6 := oldCfg.CollectDuplicateIPs()
+	newDupV4, newDupV6 := newCfg.CollectDuplicateIPs()
+	setsChanged := !newCfg.System.Tables.SkipSetup && (oldPorts != newPorts ||
+		!slices.Equal(oldDupV4, newDupV4) || !slices.Equal(oldDupV6, newDupV6))
 
-	if oldCfg.MainSet.TCP.ConnBytesLimit != newCfg.MainSet.TCP.ConnBytesLimit {
+	if oldCfg.System.Tables.IPSets != newCfg.System.Tables.IPSets {
 		shouldUpdate = true
+	} else if newCfg.System.Tables.IPSets.Enabled {
+		oldTargetV4, oldTargetV6 := oldCfg.CollectTargetIPs()
+		newTargetV4, newTargetV6 := newCfg.CollectTargetIPs()
+		if !slices.Equal(oldTargetV4, newTargetV4) || !slices.Equal(oldTargetV6, newTargetV6) {
+			setsChanged = !newCfg.System.Tables.SkipSetup
+		}
 	}
 
-	if oldCfg.MainSet.UDP.ConnBytesLimit != newCfg.MainSet.UDP.ConnBytesLimit {
+	oldTCPLimit, oldUDPLimit := oldCfg.MaxConnBytesLimits()
+	newTCPLimit, newUDPLimit := newCfg.MaxConnBytesLimits()
+	if oldTCPLimit != newTCPLimit || oldUDPLimit != newUDPLimit {
 		shouldUpdate = true
 	}
 
@@ -362,11 +396,25 @@ func (a *API) PerformSoftRestart(newCfg *config.Config, oldCfg *config.Config) b
 		shouldUpdate = true
 	}
 
+	if setsChanged && oldPorts != newPorts {
+		log.Infof("UDP ports changed (%s -> %s), refreshing firewall rules", oldPorts, newPorts)
+	}
+
+	// Port and IP list changes only touch the named sets when the backend
+	// supports updating them in place
+	if !shouldUpdate && setsChanged {
+		if tablesSetsRefreshFunc != nil {
+			err := tablesSetsRefreshFunc()
+			if err == nil {
+				return true
+			}
+			log.Warnf("Failed to update firewall sets, reloading rules: %v", err)
+		}
+		shouldUpdate = true
+	}
+
 	if shouldUpdate {
 		log.Infof("Core settings changed, performing soft system restart")
-		if oldPorts != newPorts {
-			log.Infof("UDP ports changed (%s -> %s), refreshing firewall rules", oldPorts, newPorts)
-		}
 		if err := tablesRefreshFunc(); err != nil {
 			log.Errorf("Failed to refresh tables: %v", err)
 		}
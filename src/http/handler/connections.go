@@ -0,0 +1,75 @@
+package handler
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/daniellavrushin/b4/connlog"
+)
+
+func (api *API) RegisterConnectionsApi() {
+	api.mux.HandleFunc("/api/connections", api.handleConnections)
+}
+
+// Connection history, filtered by domain, device (MAC, alias or IP), set,
+// outcome and time range, newest first
+func (api *API) handleConnections(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	q := r.URL.Query()
+	f := connlog.Filter{
+		Domain:  q.Get("domain"),
+		Device:  q.Get("device"),
+		Set:     q.Get("set"),
+		Outcome: q.Get("outcome"),
+	}
+
+	var err error
+	if f.Since, err = parseQueryTime(q.Get("since")); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if f.Until, err = parseQueryTime(q.Get("until")); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if s := q.Get("limit"); s != "" {
+		if f.Limit, err = strconv.Atoi(s); err != nil || f.Limit < 0 {
+			http.Error(w, "Invalid limit", http.StatusBadRequest)
+			return
+		}
+	}
+
+	events, err := connlog.Query(f)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	setJsonHeader(w)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"enabled": connlog.Enabled(),
+		"count":   len(events),
+		"events":  events,
+	})
+}
+
+// parseQueryTime accepts RFC 3339 times and Unix seconds.
+func parseQueryTime(s string) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	if sec, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return time.Unix(sec, 0), nil
+	}
+	return time.Time{}, fmt.Errorf("invalid time %q, expected RFC 3339 or Unix seconds", s)
+}
@@ -1,6 +1,7 @@
 package handler
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
 	"net/http"
@@ -9,6 +10,7 @@ import (
 	"github.com/daniellavrushin/b4/config"
 	"github.com/daniellavrushin/b4/discovery"
 	"github.com/daniellavrushin/b4/log"
+	"github.com/daniellavrushin/b4/sni/domainrule"
 	"github.com/google/uuid"
 	"golang.org/x/net/publicsuffix"
 )
@@ -82,17 +84,22 @@ func (api *API) handleStartDiscovery(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if req.CheckURL == "" {
-		http.Error(w, "Check URL is required", http.StatusBadRequest)
-		return
-	}
-
 	// Use ValidationTries from request, or default to 1 if not provided
 	validationTries := req.ValidationTries
 	if validationTries < 1 {
 		validationTries = 1
 	}
 
+	if len(req.Domains) > 0 || req.GeositeCategory != "" {
+		api.startBatchDiscovery(w, req, validationTries)
+		return
+	}
+
+	if req.CheckURL == "" {
+		http.Error(w, "Check URL is required", http.StatusBadRequest)
+		return
+	}
+
 	suite := discovery.NewDiscoverySuite(req.CheckURL, globalPool, req.SkipDNS, req.PayloadFiles, validationTries)
 
 	phase1Count := len(discovery.GetPhase1Presets())
@@ -115,67 +122,103 @@ func (api *API) handleStartDiscovery(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(response)
 }
 
+// startBatchDiscovery tests presets against a list of domains or the domains
+// of a geosite category and reports one set covering the whole group.
+func (api *API) startBatchDiscovery(w http.ResponseWriter, req DiscoveryRequest, validationTries int) {
+	domains := req.Domains
+	label := ""
+	if len(domains) > 0 {
+		label = domains[0]
+	}
+
+	if category := strings.TrimSpace(req.GeositeCategory); category != "" {
+		rules, err := api.geodataManager.LoadGeositeCategory(category)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Failed to load geosite category: %v", err), http.StatusBadRequest)
+			return
+		}
+		// Keyword and regexp rules have no host to fetch
+		for _, rule := range rules {
+			if host, ok := domainrule.Host(rule); ok {
+				domains = append(domains, host)
+			}
+		}
+		label = category
+	}
+
+	suite := discovery.NewBatchDiscoverySuite(label, domains, globalPool, req.SkipDNS, validationTries)
+	if len(suite.Domains) == 0 {
+		http.Error(w, "At least one domain is required", http.StatusBadRequest)
+		return
+	}
+
+	phase1Count := len(discovery.GetPhase1Presets())
+
+	go func() {
+		suite.RunDiscovery()
+		log.Infof("Batch discovery complete for %s", suite.Domain)
+	}()
+
+	response := DiscoveryResponse{
+		Id:             suite.Id,
+		Domain:         suite.Domain,
+		Domains:        suite.Domains,
+		EstimatedTests: phase1Count * len(suite.Domains),
+		Message:        fmt.Sprintf("Discovery started for %d domains of %s", len(suite.Domains), suite.Domain),
+	}
+
+	setJsonHeader(w)
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(response)
+}
+
 func (api *API) handleAddPresetAsSet(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
 		w.WriteHeader(http.StatusMethodNotAllowed)
 		return
 	}
 
-	var set = config.NewSetConfig()
-
-	decoder := json.NewDecoder(r.Body)
-	if err := decoder.Decode(&set); err != nil {
+	var body json.RawMessage
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
 		log.Errorf("Failed to decode config update: %v", err)
 		http.Error(w, "Invalid JSON", http.StatusBadRequest)
 		return
 	}
 
-	set.Id = uuid.New().String()
-
-	if len(set.Targets.SNIDomains) == 0 {
-		log.Errorf("At least one SNI domain is required")
-		http.Error(w, "At least one SNI domain is required", http.StatusBadRequest)
-		return
-	}
-	if set.Name == "" {
-		set.Name = set.Targets.SNIDomains[0]
+	// A batch discovery adds its recommended set and exceptions in one call
+	items := []json.RawMessage{body}
+	if trimmed := bytes.TrimSpace(body); len(trimmed) > 0 && trimmed[0] == '[' {
+		if err := json.Unmarshal(trimmed, &items); err != nil || len(items) == 0 {
+			http.Error(w, "Invalid JSON", http.StatusBadRequest)
+			return
+		}
 	}
 
-	if len(set.Targets.SNIDomains) > 0 {
-		baseName := extractDomainName(set.Targets.SNIDomains[0])
-		if baseName != "" && api.geodataManager.IsGeositeConfigured() {
-			// Check if category already exists in the set
-			alreadyHasCategory := false
-			for _, cat := range set.Targets.GeoSiteCategories {
-				if cat == baseName {
-					alreadyHasCategory = true
-					break
-				}
-			}
+	sets := make([]*config.SetConfig, 0, len(items))
+	for _, item := range items {
+		var set = config.NewSetConfig()
+		if err := json.Unmarshal(item, &set); err != nil {
+			log.Errorf("Failed to decode config update: %v", err)
+			http.Error(w, "Invalid JSON", http.StatusBadRequest)
+			return
+		}
 
-			// Only add if not already present
-			if !alreadyHasCategory {
-				tags, err := api.geodataManager.ListCategories(api.geodataManager.GetGeositePath())
-				if err == nil {
-					for _, tag := range tags {
-						if tag == baseName {
-							set.Targets.GeoSiteCategories = append(set.Targets.GeoSiteCategories, baseName)
-							log.Infof("Auto-added geosite category '%s' for domain %s", baseName, set.Targets.SNIDomains[0])
-							break
-						}
-					}
-				}
-			}
+		if len(set.Targets.SNIDomains) == 0 {
+			log.Errorf("At least one SNI domain is required")
+			http.Error(w, "At least one SNI domain is required", http.StatusBadRequest)
+			return
 		}
+		sets = append(sets, &set)
 	}
 
-	api.loadTargetsForSetCached(&set)
-	config.ApplySetDefaults(&set)
+	for _, set := range sets {
+		api.prepareDiscoveredSet(set)
+	}
 
-	api.cfg.Sets = append([]*config.SetConfig{&set}, api.cfg.Sets...)
+	api.cfg.Sets = append(sets, api.cfg.Sets...)
 
 	if api.cfg.MainSet == nil {
-		api.cfg.MainSet = &set
+		api.cfg.MainSet = sets[0]
 	}
 
 	// Save configuration
@@ -185,14 +228,58 @@ func (api *API) handleAddPresetAsSet(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	message := fmt.Sprintf("Added '%s' configuration", sets[0].Name)
+	if len(sets) > 1 {
+		message = fmt.Sprintf("Added %d configurations", len(sets))
+	}
+
 	setJsonHeader(w)
 	w.WriteHeader(http.StatusAccepted)
 	json.NewEncoder(w).Encode(map[string]interface{}{
 		"success": true,
-		"message": fmt.Sprintf("Added '%s' configuration", set.Name),
+		"message": message,
 	})
 }
 
+// prepareDiscoveredSet gives a set from discovery a fresh id, a name and the
+// geosite category of its first domain when one exists.
+func (api *API) prepareDiscoveredSet(set *config.SetConfig) {
+	set.Id = uuid.New().String()
+
+	if set.Name == "" {
+		set.Name = set.Targets.SNIDomains[0]
+	}
+
+	baseName := extractDomainName(set.Targets.SNIDomains[0])
+	if baseName != "" && api.geodataManager.IsGeositeConfigured() {
+		// Check if category already exists in the set
+		alreadyHasCategory := false
+		for _, cat := range set.Targets.GeoSiteCategories {
+			if cat == baseName {
+				alreadyHasCategory = true
+				break
+			}
+		}
+
+		// Only add if not already present
+		if !alreadyHasCategory {
+			tags, err := api.geodataManager.ListCategories(api.geodataManager.GetGeositePath())
+			if err == nil {
+				for _, tag := range tags {
+					if tag == baseName {
+						set.Targets.GeoSiteCategories = append(set.Targets.GeoSiteCategories, baseName)
+						log.Infof("Auto-added geosite category '%s' for domain %s", baseName, set.Targets.SNIDomains[0])
+						break
+					}
+				}
+			}
+		}
+	}
+
+	api.loadTargetsForSetCached(set)
+	config.ApplySetDefaults(set)
+}
+
 func (api *API) handleFindSimilarSets(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
 		w.WriteHeader(http.StatusMethodNotAllowed)
@@ -241,6 +328,9 @@ func setsHaveSimilarConfig(a, b *config.SetConfig) bool {
 }
 
 func extractDomainName(domain string) string {
+	if kind, value := domainrule.Parse(domain); kind != domainrule.Regexp {
+		domain = value
+	}
 	domain = strings.TrimPrefix(domain, "www.")
 
 	registered, err := publicsuffix.EffectiveTLDPlusOne(domain)
@@ -0,0 +1,93 @@
+package handler
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/daniellavrushin/b4/config"
+	"github.com/daniellavrushin/b4/geodat"
+	"github.com/urlesistiana/v2dat/v2data"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestHandleStartDiscovery_Validation(t *testing.T) {
+	data, err := proto.Marshal(&v2data.GeoSiteList{Entry: []*v2data.GeoSite{
+		{CountryCode: "KEYWORDS", Domain: []*v2data.Domain{{Type: v2data.Domain_Plain, Value: "video"}}},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	geositePath := filepath.Join(t.TempDir(), "geosite.dat")
+	os.WriteFile(geositePath, data, 0644)
+
+	cfg := config.NewConfig()
+	api := &API{
+		cfg:            &cfg,
+		geodataManager: geodat.NewGeodataManager(geositePath, ""),
+	}
+	mux := http.NewServeMux()
+	api.mux = mux
+	api.RegisterDiscoveryApi()
+
+	tests := []struct {
+		name string
+		body string
+	}{
+		{"missing check URL", `{"skip_dns": true}`},
+		{"empty domain list", `{"domains": ["", " "]}`},
+		{"unknown geosite category", `{"geosite_category": "missing"}`},
+		{"category without fetchable domains", `{"geosite_category": "keywords"}`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/api/discovery/start", strings.NewReader(tt.body))
+			rec := httptest.NewRecorder()
+			mux.ServeHTTP(rec, req)
+
+			if rec.Code != http.StatusBadRequest {
+				t.Errorf("expected 400, got %d", rec.Code)
+			}
+		})
+	}
+}
+
+func TestHandleAddPresetAsSet_Validation(t *testing.T) {
+	cfg := config.NewConfig()
+	api := &API{
+		cfg:            &cfg,
+		geodataManager: geodat.NewGeodataManager("", ""),
+	}
+	mux := http.NewServeMux()
+	api.mux = mux
+	api.RegisterDiscoveryApi()
+
+	tests := []struct {
+		name string
+		body string
+	}{
+		{"invalid JSON", `not json`},
+		{"set without domains", `{"name": "empty"}`},
+		{"empty array", `[]`},
+		{"array entry without domains", `[{"name": "ok", "targets": {"sni_domains": ["example.com"]}}, {"name": "empty"}]`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/api/discovery/add", strings.NewReader(tt.body))
+			rec := httptest.NewRecorder()
+			mux.ServeHTTP(rec, req)
+
+			if rec.Code != http.StatusBadRequest {
+				t.Errorf("expected 400, got %d", rec.Code)
+			}
+			if len(cfg.Sets) != 0 {
+				t.Errorf("expected no sets added, got %d", len(cfg.Sets))
+			}
+		})
+	}
+}
@@ -5,12 +5,15 @@ type DiscoveryRequest struct {
 	SkipDNS         bool     `json:"skip_dns,omitempty"`
 	PayloadFiles    []string `json:"payload_files,omitempty"`
 	ValidationTries int      `json:"validation_tries,omitempty"`
+	Domains         []string `json:"domains,omitempty"`
+	GeositeCategory string   `json:"geosite_category,omitempty"`
 }
 
 type DiscoveryResponse struct {
-	Id             string `json:"id"`
-	Domain         string `json:"domain"`
-	CheckURL       string `json:"check_url"`
-	EstimatedTests int    `json:"estimated_tests"`
-	Message        string `json:"message"`
+	Id             string   `json:"id"`
+	Domain         string   `json:"domain"`
+	Domains        []string `json:"domains,omitempty"`
+	CheckURL       string   `json:"check_url"`
+	EstimatedTests int      `json:"estimated_tests"`
+	Message        string   `json:"message"`
 }
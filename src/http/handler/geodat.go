@@ -4,7 +4,6 @@ import (
 	_ "embed"
 	"encoding/json"
 	"fmt"
-	"io"
 	"net/http"
 	"os"
 	"path/filepath"
@@ -12,14 +11,16 @@ import (
 	"sync"
 	"time"
 
+	"github.com/daniellavrushin/b4/geodat"
 	"github.com/daniellavrushin/b4/log"
-	"golang.org/x/sys/unix"
 )
 
 type GeodatDownloadRequest struct {
-	GeositeURL      string `json:"geosite_url"`
-	GeoipURL        string `json:"geoip_url"`
-	DestinationPath string `json:"destination_path"`
+	GeositeURL         string `json:"geosite_url"`
+	GeoipURL           string `json:"geoip_url"`
+	GeositeChecksumURL string `json:"geosite_checksum_url"`
+	GeoipChecksumURL   string `json:"geoip_checksum_url"`
+	DestinationPath    string `json:"destination_path"`
 }
 
 type GeodatDownloadResponse struct {
@@ -104,7 +105,7 @@ func (api *API) handleGeodatDownload(w http.ResponseWriter, r *http.Request) {
 	if req.GeositeURL != "" {
 		geositePath := filepath.Join(req.DestinationPath, "geosite.dat")
 		var err error
-		geositeSize, err = downloadFile(req.GeositeURL, geositePath)
+		geositeSize, _, err = geodat.Download(req.GeositeURL, req.GeositeChecksumURL, geositePath, geodat.GEOSITE)
 		if err != nil {
 			msg := fmt.Sprintf("Failed to download geosite.dat: %v", err)
 			log.Errorf("geodat download: %s", msg)
@@ -113,12 +114,13 @@ func (api *API) handleGeodatDownload(w http.ResponseWriter, r *http.Request) {
 		}
 		api.cfg.System.Geo.GeoSitePath = geositePath
 		api.cfg.System.Geo.GeoSiteURL = req.GeositeURL
+		api.cfg.System.Geo.GeoSiteChecksumURL = req.GeositeChecksumURL
 	}
 
 	if req.GeoipURL != "" {
 		geoipPath := filepath.Join(req.DestinationPath, "geoip.dat")
 		var err error
-		geoipSize, err = downloadFile(req.GeoipURL, geoipPath)
+		geoipSize, _, err = geodat.Download(req.GeoipURL, req.GeoipChecksumURL, geoipPath, geodat.GEOIP)
 		if err != nil {
 			msg := fmt.Sprintf("Failed to download geoip.dat: %v", err)
 			log.Errorf("geodat download: %s", msg)
@@ -127,15 +129,10 @@ func (api *API) handleGeodatDownload(w http.ResponseWriter, r *http.Request) {
 		}
 		api.cfg.System.Geo.GeoIpPath = geoipPath
 		api.cfg.System.Geo.GeoIpURL = req.GeoipURL
+		api.cfg.System.Geo.GeoIpChecksumURL = req.GeoipChecksumURL
 	}
 
-	if err := api.saveAndPushConfig(api.cfg); err != nil {
-		msg := fmt.Sprintf("Failed to save configuration: %v", err)
-		log.Errorf("geodat download: %s", msg)
-		writeJsonError(w, http.StatusInternalServerError, msg)
-		return
-	}
-
+	// Reload the targets first, so the pool gets the new data with the config
 	api.geodataManager.UpdatePaths(api.cfg.System.Geo.GeoSitePath, api.cfg.System.Geo.GeoIpPath)
 	api.geodataManager.ClearCache()
 
@@ -144,6 +141,13 @@ func (api *API) handleGeodatDownload(w http.ResponseWriter, r *http.Request) {
 		api.loadTargetsForSetCached(set)
 	}
 
+	if err := api.saveAndPushConfig(api.cfg); err != nil {
+		msg := fmt.Sprintf("Failed to save configuration: %v", err)
+		log.Errorf("geodat download: %s", msg)
+		writeJsonError(w, http.StatusInternalServerError, msg)
+		return
+	}
+
 	parts := []string{}
 	if req.GeositeURL != "" {
 		parts = append(parts, fmt.Sprintf("geosite.dat (%d bytes)", geositeSize))
@@ -166,74 +170,6 @@ func (api *API) handleGeodatDownload(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(response)
 }
 
-func checkDiskSpace(dir string, needed int64) error {
-	var stat unix.Statfs_t
-	if err := unix.Statfs(dir, &stat); err != nil {
-		return fmt.Errorf("failed to check disk space on %s: %v", dir, err)
-	}
-	available := int64(stat.Bavail) * int64(stat.Bsize)
-	if available < needed {
-		availMB := float64(available) / (1024 * 1024)
-		neededMB := float64(needed) / (1024 * 1024)
-		return fmt.Errorf("not enough disk space in %s: %.1f MB available, need %.1f MB", dir, availMB, neededMB)
-	}
-	return nil
-}
-
-func downloadFile(url, destPath string) (int64, error) {
-	resp, err := http.Get(url)
-	if err != nil {
-		return 0, fmt.Errorf("failed to fetch %s: %v", url, err)
-	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode != http.StatusOK {
-		return 0, fmt.Errorf("remote server returned %s for %s", resp.Status, url)
-	}
-
-	dir := filepath.Dir(destPath)
-
-	if resp.ContentLength > 0 {
-		if err := checkDiskSpace(dir, resp.ContentLength); err != nil {
-			return 0, err
-		}
-	}
-
-	tmpFile, err := os.CreateTemp(dir, ".geodat-download-*.tmp")
-	if err != nil {
-		return 0, fmt.Errorf("failed to create temp file in %s: %v", dir, err)
-	}
-	tmpPath := tmpFile.Name()
-
-	cleanup := func() {
-		tmpFile.Close()
-		os.Remove(tmpPath)
-	}
-
-	size, err := io.Copy(tmpFile, resp.Body)
-	if err != nil {
-		cleanup()
-		return 0, fmt.Errorf("failed to write data to disk (%d bytes written): %v", size, err)
-	}
-
-	if err := tmpFile.Sync(); err != nil {
-		cleanup()
-		return 0, fmt.Errorf("failed to flush data to disk: %v", err)
-	}
-
-	if err := tmpFile.Close(); err != nil {
-		os.Remove(tmpPath)
-		return 0, fmt.Errorf("failed to finalize file write: %v", err)
-	}
-
-	if err := os.Rename(tmpPath, destPath); err != nil {
-		os.Remove(tmpPath)
-		return 0, fmt.Errorf("failed to move downloaded file to %s: %v", destPath, err)
-	}
-
-	return size, nil
-}
-
 func (api *API) handleFileInfo(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodGet {
 		w.WriteHeader(http.StatusMethodNotAllowed)
@@ -246,6 +182,15 @@ func (api *API) handleFileInfo(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// The configured geodata files come with their update state
+	for _, f := range api.geodataManager.GetStatus(api.cfg.GeoUpdateSettings()) {
+		if f.Path == path && f.Exists {
+			setJsonHeader(w)
+			json.NewEncoder(w).Encode(f)
+			return
+		}
+	}
+
 	info, err := os.Stat(path)
 	if err != nil {
 		if os.IsNotExist(err) {
@@ -11,6 +11,8 @@ import (
 
 	"github.com/daniellavrushin/b4/config"
 	"github.com/daniellavrushin/b4/geodat"
+	"github.com/urlesistiana/v2dat/v2data"
+	"google.golang.org/protobuf/proto"
 )
 
 func TestHandleGeodatSources(t *testing.T) {
@@ -118,6 +120,44 @@ func TestHandleFileInfo(t *testing.T) {
 		}
 	})
 
+	t.Run("geosite file reports update state", func(t *testing.T) {
+		data, err := proto.Marshal(&v2data.GeoSiteList{Entry: []*v2data.GeoSite{
+			{CountryCode: "YOUTUBE", Domain: []*v2data.Domain{{Type: v2data.Domain_Domain, Value: "youtube.com"}}},
+			{CountryCode: "GOOGLE", Domain: []*v2data.Domain{{Type: v2data.Domain_Full, Value: "google.com"}}},
+		}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		geositePath := filepath.Join(t.TempDir(), "geosite.dat")
+		os.WriteFile(geositePath, data, 0644)
+
+		cfg := config.NewConfig()
+		cfg.System.Geo.GeoSitePath = geositePath
+		cfg.System.Geo.GeoSiteURL = "https://example.com/geosite.dat"
+		api := &API{cfg: &cfg, geodataManager: geodat.NewGeodataManager(geositePath, ""), mux: http.NewServeMux()}
+		api.RegisterGeodatApi()
+
+		req := httptest.NewRequest(http.MethodGet, "/api/geodat/info?path="+geositePath, nil)
+		rec := httptest.NewRecorder()
+		api.mux.ServeHTTP(rec, req)
+
+		var resp map[string]interface{}
+		json.NewDecoder(rec.Body).Decode(&resp)
+
+		if resp["exists"] != true || resp["size"].(float64) != float64(len(data)) {
+			t.Errorf("expected file info, got %v", resp)
+		}
+		if resp["type"] != "geosite" || resp["categories"].(float64) != 2 {
+			t.Errorf("expected 2 geosite categories, got %v", resp)
+		}
+		if sum, _ := resp["sha256"].(string); len(sum) != 64 {
+			t.Errorf("expected sha256, got %v", resp["sha256"])
+		}
+		if resp["next_check"] == nil || resp["url"] != cfg.System.Geo.GeoSiteURL {
+			t.Errorf("expected auto-update state, got %v", resp)
+		}
+	})
+
 	t.Run("POST not allowed", func(t *testing.T) {
 		req := httptest.NewRequest(http.MethodPost, "/api/geodat/info?path=/tmp/test", nil)
 		rec := httptest.NewRecorder()
@@ -1,6 +1,10 @@
 package handler
 
-import "github.com/daniellavrushin/b4/config"
+import (
+	"time"
+
+	"github.com/daniellavrushin/b4/config"
+)
 
 // Response types for API endpoints
 type GeositeResponse struct {
@@ -23,6 +27,15 @@ type SetWithStats struct {
 	Stats SetStatistics `json:"stats"`
 }
 
+// SetScheduleStatus reports whether a set is currently in effect and when
+// its schedule next changes that.
+type SetScheduleStatus struct {
+	Id             string     `json:"id"`
+	Active         bool       `json:"active"`
+	Scheduled      bool       `json:"scheduled"`
+	NextTransition *time.Time `json:"next_transition,omitempty"`
+}
+
 // CategoryPreviewResponse for previewing category contents
 type CategoryPreviewResponse struct {
 	Category     string   `json:"category"`
@@ -0,0 +1,93 @@
+package handler
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/daniellavrushin/b4/discovery"
+	"github.com/daniellavrushin/b4/log"
+)
+
+func (api *API) RegisterHealthApi() {
+	api.mux.HandleFunc("/api/sets/health", api.handleSetHealth)
+	api.mux.HandleFunc("/api/sets/{id}/health/check", api.handleSetHealthCheck)
+	api.mux.HandleFunc("/api/sets/{id}/health/proposal", api.handleSetHealthProposal)
+}
+
+// Health history of every set with health checks enabled
+func (api *API) handleSetHealth(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	setJsonHeader(w)
+	json.NewEncoder(w).Encode(discovery.GetSetHealth())
+}
+
+// Check a set now instead of waiting for its interval
+func (api *API) handleSetHealthCheck(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	result, err := discovery.RunHealthCheck(r.PathValue("id"))
+	if err != nil {
+		writeJsonError(w, http.StatusConflict, err.Error())
+		return
+	}
+	sendResponse(w, result)
+}
+
+// POST applies the strategy discovery proposed for a failing set, DELETE
+// rejects it. Targets and the other settings of the set are kept.
+func (api *API) handleSetHealthProposal(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+
+	switch r.Method {
+	case http.MethodDelete:
+		discovery.DismissHealthProposal(id)
+		sendResponse(w, map[string]interface{}{"success": true})
+		return
+	case http.MethodPost:
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	proposal, ok := discovery.GetHealthProposal(id)
+	if !ok || proposal.Set == nil {
+		http.Error(w, "No proposal for this set", http.StatusNotFound)
+		return
+	}
+
+	oldConfig := api.cfg.Clone()
+
+	set := api.cfg.GetSetById(id)
+	if set == nil {
+		http.Error(w, "Set not found", http.StatusNotFound)
+		return
+	}
+
+	set.TCP = proposal.Set.TCP
+	set.UDP = proposal.Set.UDP
+	set.Fragmentation = proposal.Set.Fragmentation
+	set.Faking = proposal.Set.Faking
+
+	if err := api.saveAndPushConfig(api.cfg); err != nil {
+		log.Errorf("Failed to save config after applying health proposal: %v", err)
+		http.Error(w, "Failed to save", http.StatusInternalServerError)
+		return
+	}
+
+	if api.PerformSoftRestart(api.cfg, oldConfig) {
+		log.Infof("Soft restart completed successfully")
+	}
+
+	discovery.DismissHealthProposal(id)
+
+	log.Infof("Applied '%s' to set '%s' (id: %s)", proposal.PresetName, set.Name, id)
+	setJsonHeader(w)
+	json.NewEncoder(w).Encode(set)
+}
@@ -0,0 +1,67 @@
+package handler
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/daniellavrushin/b4/config"
+	"github.com/daniellavrushin/b4/discovery"
+)
+
+func TestHandleSetHealth(t *testing.T) {
+	cfg := config.NewConfig()
+	api := &API{cfg: &cfg}
+	mux := http.NewServeMux()
+	api.mux = mux
+	api.RegisterHealthApi()
+
+	t.Run("GET returns a list", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodGet, "/api/sets/health", nil)
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, req)
+
+		if rec.Code != http.StatusOK {
+			t.Errorf("expected 200, got %d", rec.Code)
+		}
+
+		var health []discovery.SetHealth
+		if err := json.NewDecoder(rec.Body).Decode(&health); err != nil {
+			t.Fatalf("failed to decode: %v", err)
+		}
+		if health == nil {
+			t.Error("expected an empty list, got null")
+		}
+	})
+
+	t.Run("check without running checker", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodPost, "/api/sets/some-id/health/check", nil)
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, req)
+
+		if rec.Code != http.StatusConflict {
+			t.Errorf("expected 409, got %d", rec.Code)
+		}
+	})
+
+	t.Run("apply without proposal", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodPost, "/api/sets/some-id/health/proposal", nil)
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, req)
+
+		if rec.Code != http.StatusNotFound {
+			t.Errorf("expected 404, got %d", rec.Code)
+		}
+	})
+
+	t.Run("check GET not allowed", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodGet, "/api/sets/some-id/health/check", nil)
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, req)
+
+		if rec.Code != http.StatusMethodNotAllowed {
+			t.Errorf("expected 405, got %d", rec.Code)
+		}
+	})
+}
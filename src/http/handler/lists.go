@@ -0,0 +1,38 @@
+package handler
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/daniellavrushin/b4/lists"
+)
+
+func (api *API) RegisterListsApi() {
+	api.mux.HandleFunc("/api/lists", api.handleLists)
+	api.mux.HandleFunc("/api/lists/refresh", api.handleListsRefresh)
+}
+
+// State of every list subscribed to by an enabled set
+func (api *API) handleLists(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	setJsonHeader(w)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"formats":       lists.Formats,
+		"subscriptions": lists.GetStatus(),
+	})
+}
+
+// Check every subscribed list now instead of waiting for its interval
+func (api *API) handleListsRefresh(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	lists.Refresh()
+	sendResponse(w, map[string]interface{}{"success": true})
+}
@@ -4,6 +4,7 @@ package handler
 import (
 	"encoding/json"
 	"net/http"
+	"strings"
 
 	"github.com/daniellavrushin/b4/metrics"
 )
@@ -21,6 +22,7 @@ func (api *API) RegisterMetricsApi() {
 	api.mux.HandleFunc("/api/metrics", api.getMetrics)
 	api.mux.HandleFunc("/api/metrics/summary", api.getMetricsSummary)
 	api.mux.HandleFunc("/api/metrics/reset", api.resetMetrics)
+	api.mux.HandleFunc("/metrics", api.getPrometheusMetrics)
 }
 
 func (a *API) getMetrics(w http.ResponseWriter, r *http.Request) {
@@ -72,3 +74,21 @@ func (a *API) getMetricsSummary(w http.ResponseWriter, r *http.Request) {
 	enc := json.NewEncoder(w)
 	_ = enc.Encode(summary)
 }
+
+// getPrometheusMetrics serves the collector in the Prometheus text format, or
+// in OpenMetrics format when the scraper asks for it.
+func (a *API) getPrometheusMetrics(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	openMetrics := strings.Contains(r.Header.Get("Accept"), "application/openmetrics-text")
+	if openMetrics {
+		w.Header().Set("Content-Type", metrics.OpenMetricsContentType)
+	} else {
+		w.Header().Set("Content-Type", metrics.PrometheusContentType)
+	}
+
+	_ = metrics.GetMetricsCollector().WritePrometheus(w, openMetrics)
+}
@@ -0,0 +1,96 @@
+package handler
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/daniellavrushin/b4/config"
+	"github.com/daniellavrushin/b4/metrics"
+)
+
+func TestPrometheusMetrics(t *testing.T) {
+	cfg := config.NewConfig()
+	api := &API{cfg: &cfg}
+	mux := http.NewServeMux()
+	api.mux = mux
+	api.RegisterMetricsApi()
+
+	m := metrics.GetMetricsCollector()
+	m.RecordConnection("TCP", "example.com", "10.0.0.2", "1.2.3.4", true, "", `set "a"`)
+	metrics.SetQueues(536, 2)
+	metrics.RecordQueuePacket(537)
+	metrics.RecordQueuePacket(600) // not a queue of the pool
+	metrics.RecordQueueOverflow(537)
+	metrics.RecordVerdictFailure(537)
+	metrics.RecordStrategySwitch("a", "1:disorder")
+	metrics.ObserveInjection("combo", time.Now().Add(-2*time.Millisecond))
+
+	t.Run("Prometheus text format", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, req)
+
+		if rec.Code != http.StatusOK {
+			t.Fatalf("expected 200, got %d", rec.Code)
+		}
+		if ct := rec.Header().Get("Content-Type"); ct != metrics.PrometheusContentType {
+			t.Errorf("unexpected content type %q", ct)
+		}
+
+		body := rec.Body.String()
+		for _, want := range []string{
+			"# TYPE b4_packets_total counter",
+			`b4_connections_total{set="set \"a\"",protocol="TCP"} 1`,
+			`b4_queue_packets_total{queue="536"} 0`,
+			`b4_queue_packets_total{queue="537"} 1`,
+			`b4_queue_overflows_total{queue="537"} 1`,
+			`b4_verdict_failures_total{queue="537"} 1`,
+			`b4_strategy_switches_total{set="a",variant="1:disorder"} 1`,
+			"# TYPE b4_injection_duration_seconds histogram",
+			`b4_injection_duration_seconds_bucket{strategy="combo",le="0.001"} 0`,
+			`b4_injection_duration_seconds_bucket{strategy="combo",le="+Inf"} 1`,
+			`b4_injection_duration_seconds_count{strategy="combo"} 1`,
+		} {
+			if !strings.Contains(body, want) {
+				t.Errorf("missing %q in output:\n%s", want, body)
+			}
+		}
+		if strings.Contains(body, "# EOF") {
+			t.Error("text format should not carry the OpenMetrics EOF marker")
+		}
+		if strings.Contains(body, `queue="600"`) {
+			t.Error("packets of queues outside the pool should not be counted")
+		}
+	})
+
+	t.Run("OpenMetrics format", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+		req.Header.Set("Accept", "application/openmetrics-text; version=1.0.0")
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, req)
+
+		if ct := rec.Header().Get("Content-Type"); ct != metrics.OpenMetricsContentType {
+			t.Errorf("unexpected content type %q", ct)
+		}
+		body := rec.Body.String()
+		if !strings.Contains(body, "# TYPE b4_packets counter") {
+			t.Error("OpenMetrics counter family should be named without _total")
+		}
+		if !strings.HasSuffix(body, "# EOF\n") {
+			t.Error("OpenMetrics output must end with # EOF")
+		}
+	})
+
+	t.Run("POST not allowed", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodPost, "/metrics", nil)
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, req)
+
+		if rec.Code != http.StatusMethodNotAllowed {
+			t.Errorf("expected 405, got %d", rec.Code)
+		}
+	})
+}
@@ -3,6 +3,7 @@ package handler
 import (
 	"encoding/json"
 	"net/http"
+	"time"
 
 	"github.com/daniellavrushin/b4/config"
 	"github.com/daniellavrushin/b4/log"
@@ -12,6 +13,7 @@ import (
 func (api *API) RegisterSetsApi() {
 	api.mux.HandleFunc("/api/sets", api.handleSets)
 	api.mux.HandleFunc("/api/sets/targeted-domains", api.handleTargetedDomains)
+	api.mux.HandleFunc("/api/sets/schedule", api.handleSetSchedules)
 	api.mux.HandleFunc("/api/sets/{id}", api.handleSetById)
 	api.mux.HandleFunc("/api/sets/reorder", api.handleReorderSets)
 	api.mux.HandleFunc("/api/sets/{id}/add-domain", api.handleSetDomains)
@@ -42,6 +44,33 @@ func (api *API) handleTargetedDomains(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(result)
 }
 
+// GET /api/sets/schedule
+func (api *API) handleSetSchedules(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	now := time.Now()
+	result := make([]SetScheduleStatus, 0, len(api.cfg.Sets))
+	for _, set := range api.cfg.Sets {
+		status := SetScheduleStatus{
+			Id:        set.Id,
+			Active:    set.ActiveAt(now),
+			Scheduled: set.Schedule.Enabled && len(set.Schedule.Windows) > 0,
+		}
+		if set.Enabled {
+			if next, ok := set.Schedule.NextTransition(now); ok {
+				status.NextTransition = &next
+			}
+		}
+		result = append(result, status)
+	}
+
+	setJsonHeader(w)
+	json.NewEncoder(w).Encode(result)
+}
+
 func (api *API) handleSetDomains(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
 		w.WriteHeader(http.StatusMethodNotAllowed)
@@ -311,6 +340,15 @@ func (api *API) initializeSetDefaults(set *config.SetConfig) {
 	if set.Targets.GeoIpCategories == nil {
 		set.Targets.GeoIpCategories = []string{}
 	}
+	if set.Targets.Devices == nil {
+		set.Targets.Devices = []string{}
+	}
+	if set.Schedule.Windows == nil {
+		set.Schedule.Windows = []config.ScheduleWindow{}
+	}
+	if set.Fallback.Variants == nil {
+		set.Fallback.Variants = []config.StrategyVariant{}
+	}
 	if set.TCP.Win.Values == nil {
 		set.TCP.Win.Values = []int{0, 1460, 8192, 65535}
 	}
@@ -329,6 +367,8 @@ func (api *API) loadTargetsForSetCached(set *config.SetConfig) {
 		}
 	}
 	domains = append(domains, set.Targets.SNIDomains...)
+	subDomains, subIps := api.cfg.SubscriptionTargets(set)
+	domains = append(domains, subDomains...)
 	set.Targets.DomainsToMatch = domains
 
 	for _, cat := range set.Targets.GeoIpCategories {
@@ -337,5 +377,6 @@ func (api *API) loadTargetsForSetCached(set *config.SetConfig) {
 		}
 	}
 	ips = append(ips, set.Targets.IPs...)
+	ips = append(ips, subIps...)
 	set.Targets.IpsToMatch = ips
 }
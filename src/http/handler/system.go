@@ -9,6 +9,7 @@ import (
 	"syscall"
 	"time"
 
+	"github.com/daniellavrushin/b4/dns"
 	"github.com/daniellavrushin/b4/log"
 )
 
@@ -283,5 +284,6 @@ func (api *API) handleCacheStats(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(map[string]interface{}{
 		"success": true,
 		"cache":   stats,
+		"dns_nat": dns.DnsNATStats(),
 	})
 }
@@ -10,6 +10,7 @@ import (
 	"time"
 
 	"github.com/daniellavrushin/b4/config"
+	"github.com/daniellavrushin/b4/http/auth"
 	"github.com/daniellavrushin/b4/http/handler"
 	"github.com/daniellavrushin/b4/http/ws"
 	"github.com/daniellavrushin/b4/log"
@@ -27,7 +28,11 @@ func StartServer(cfg *config.Config, pool *nfq.Pool) (*stdhttp.Server, error) {
 
 	mux := stdhttp.NewServeMux()
 
+	authManager := auth.NewManager(cfg)
+
 	handler.SetNFQPool(pool)
+	handler.SetAuthManager(authManager)
+	ws.SetOriginCheck(authManager.AllowOrigin)
 	registerWebSocketEndpoints(mux)
 
 	registerAPIEndpoints(mux, cfg)
@@ -35,7 +40,8 @@ func StartServer(cfg *config.Config, pool *nfq.Pool) (*stdhttp.Server, error) {
 	handler.RegisterSpa(mux, uiDist)
 
 	var httpHandler stdhttp.Handler = mux
-	httpHandler = cors(httpHandler)
+	httpHandler = authManager.Middleware(httpHandler)
+	httpHandler = cors(authManager, httpHandler)
 
 	bindAddr := cfg.System.WebServer.BindAddress
 	if bindAddr == "" {
@@ -63,6 +69,9 @@ func StartServer(cfg *config.Config, pool *nfq.Pool) (*stdhttp.Server, error) {
 		protocol = "https"
 	}
 	log.Infof("Starting web server on %s://%s", protocol, addr)
+	if !cfg.System.WebServer.Auth.Enabled && bindAddr != "127.0.0.1" && bindAddr != "::1" && bindAddr != "localhost" {
+		log.Warnf("Web server authentication is disabled while listening on %s", bindAddr)
+	}
 
 	metrics := handler.GetMetricsCollector()
 	metrics.RecordEvent("info", fmt.Sprintf("Web server started on %s://%s", protocol, addr))
@@ -0,0 +1,16 @@
+import { apiGet, apiPost } from "./apiClient";
+
+export interface AuthStatus {
+  enabled: boolean;
+  authenticated: boolean;
+  username?: string;
+  token?: string;
+  scope?: string;
+}
+
+export const authApi = {
+  status: () => apiGet<AuthStatus>("/api/auth/status"),
+  login: (username: string, password: string) =>
+    apiPost<AuthStatus>("/api/auth/login", { username, password }),
+  logout: () => apiPost<{ success: boolean }>("/api/auth/logout"),
+};
@@ -1,5 +1,6 @@
 import { apiDelete, apiFetch, apiPost, apiPut } from "./apiClient";
 import { B4SetConfig } from "@b4.sets";
+import { SetScheduleStatus } from "@models/config";
 
 export const setsApi = {
   getSets: () => apiFetch<B4SetConfig[]>("/api/sets"),
@@ -13,4 +14,6 @@ export const setsApi = {
   addDomainToSet: (setId: string, domain: string) =>
     apiPost<B4SetConfig>(`/api/sets/${setId}/add-domain`, { domain }),
   getTargetedDomains: () => apiFetch<string[]>("/api/sets/targeted-domains"),
+  getScheduleStatus: () =>
+    apiFetch<SetScheduleStatus[]>("/api/sets/schedule"),
 };
@@ -0,0 +1,102 @@
+import {
+  Box,
+  Button,
+  CssBaseline,
+  Paper,
+  ThemeProvider,
+  Typography,
+} from "@mui/material";
+import { useEffect, useState } from "react";
+
+import { authApi, AuthStatus } from "../../api/auth";
+import { colors, theme } from "@design";
+import { B4TextField } from "@common/B4TextField";
+import { Logo } from "@common/Logo";
+
+interface AuthGateProps {
+  children: React.ReactNode;
+}
+
+export const AuthGate = ({ children }: AuthGateProps) => {
+  const [status, setStatus] = useState<AuthStatus | null>(null);
+  const [username, setUsername] = useState("");
+  const [password, setPassword] = useState("");
+  const [error, setError] = useState<string | null>(null);
+
+  useEffect(() => {
+    authApi
+      .status()
+      .then(setStatus)
+      .catch(() => setStatus({ enabled: false, authenticated: false }));
+  }, []);
+
+  if (!status) {
+    return null;
+  }
+
+  if (!status.enabled || status.authenticated) {
+    return <>{children}</>;
+  }
+
+  const handleLogin = (e: React.FormEvent) => {
+    e.preventDefault();
+    setError(null);
+    authApi
+      .login(username, password)
+      .then(setStatus)
+      .catch(() => setError("Invalid username or password"));
+  };
+
+  return (
+    <ThemeProvider theme={theme}>
+      <CssBaseline />
+      <Box
+        sx={{
+          minHeight: "100vh",
+          display: "flex",
+          alignItems: "center",
+          justifyContent: "center",
+          bgcolor: colors.background.default,
+        }}
+      >
+        <Paper
+          component="form"
+          onSubmit={handleLogin}
+          sx={{ p: 4, width: 360 }}
+        >
+          <Box sx={{ display: "flex", justifyContent: "center", mb: 2 }}>
+            <Logo />
+          </Box>
+          <Typography variant="h6" sx={{ mb: 2 }}>
+            Sign in
+          </Typography>
+          <B4TextField
+            label="Username"
+            value={username}
+            autoComplete="username"
+            onChange={(e) => setUsername(e.target.value)}
+            sx={{ mb: 2 }}
+          />
+          <B4TextField
+            label="Password"
+            type="password"
+            value={password}
+            autoComplete="current-password"
+            onChange={(e) => setPassword(e.target.value)}
+            sx={{ mb: 2 }}
+          />
+          {error && (
+            <Typography color="error" variant="body2" sx={{ mb: 2 }}>
+              {error}
+            </Typography>
+          )}
+          <Button type="submit" variant="contained" fullWidth>
+            Sign in
+          </Button>
+        </Paper>
+      </Box>
+    </ThemeProvider>
+  );
+};
+
+export default AuthGate;
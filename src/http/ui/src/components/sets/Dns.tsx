@@ -19,6 +19,7 @@ import {
   B4Alert,
   B4Badge,
   B4Section,
+  B4Select,
   B4Switch,
   B4TextField,
 } from "@b4.elements";
@@ -42,12 +43,36 @@ interface DnsSettingsProps {
   readonly onChange: (field: string, value: string | boolean) => void;
 }
 
+const DNS_MODES = [
+  {
+    value: "redirect",
+    label: "Redirect",
+    description: "Send the plain query to another DNS server",
+  },
+  {
+    value: "forward",
+    label: "Encrypted Forward",
+    description:
+      "Answer the query from b4, resolved over DNS-over-HTTPS or DNS-over-TLS",
+  },
+];
+
+const ENCRYPTED_UPSTREAMS = [
+  { label: "Cloudflare DoH", value: "https://1.1.1.1/dns-query" },
+  { label: "Google DoH", value: "https://8.8.8.8/dns-query" },
+  { label: "Quad9 DoH", value: "https://9.9.9.9/dns-query" },
+  { label: "Cloudflare DoT", value: "tls://1.1.1.1" },
+  { label: "Google DoT", value: "tls://8.8.8.8" },
+  { label: "Quad9 DoT", value: "tls://9.9.9.9" },
+];
+
 const POPULAR_DNS = (dns as DnsEntry[]).sort((a, b) =>
   a.name.localeCompare(b.name),
 );
 
 export function DnsSettings({ config, onChange, ipv6 }: DnsSettingsProps) {
   const dns = config.dns || { enabled: false, target_dns: "" };
+  const mode = dns.mode || "redirect";
   const selectedServer = POPULAR_DNS.find((d) => d.ip === dns.target_dns);
 
   const handleServerSelect = (ip: string) => {
@@ -77,6 +102,50 @@ export function DnsSettings({ config, onChange, ipv6 }: DnsSettingsProps) {
         </Grid>
 
         {dns.enabled && (
+          <Grid size={{ xs: 12, md: 6 }}>
+            <B4Select
+              label="Mode"
+              value={mode}
+              options={DNS_MODES}
+              onChange={(e) => onChange("dns.mode", e.target.value as string)}
+              helperText={DNS_MODES.find((m) => m.value === mode)?.description}
+            />
+          </Grid>
+        )}
+
+        {dns.enabled && mode === "forward" && (
+          <>
+            <Grid size={{ xs: 12, md: 6 }}>
+              <B4TextField
+                label="Encrypted Upstream"
+                value={dns.upstream || ""}
+                onChange={(e) => onChange("dns.upstream", e.target.value)}
+                placeholder="https://1.1.1.1/dns-query or tls://1.1.1.1"
+                helperText="DoH URL or DoT server; prefer IP addresses so the upstream itself needs no DNS lookup"
+              />
+            </Grid>
+            <Grid size={{ xs: 12 }}>
+              <Stack direction="row" spacing={1} flexWrap="wrap" useFlexGap>
+                {ENCRYPTED_UPSTREAMS.map((u) => (
+                  <B4Badge
+                    key={u.value}
+                    label={u.label}
+                    variant={dns.upstream === u.value ? "filled" : "outlined"}
+                    color="secondary"
+                    onClick={() => onChange("dns.upstream", u.value)}
+                  />
+                ))}
+              </Stack>
+            </Grid>
+            <B4Alert severity="info" sx={{ m: 0 }}>
+              Matched queries never leave the router unencrypted. b4 resolves
+              them itself, caches the answers for their TTL and replies to the
+              device as if the DNS server it asked had answered.
+            </B4Alert>
+          </>
+        )}
+
+        {dns.enabled && mode === "redirect" && (
           <>
             {/* Custom IP input */}
             <Grid size={{ xs: 12, md: 6 }}>
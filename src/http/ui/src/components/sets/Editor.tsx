@@ -16,6 +16,7 @@ import {
   ImportExportIcon,
   SaveIcon,
   TcpIcon,
+  TimerIcon,
   UdpIcon,
 } from "@b4.icons";
 import ArrowBackIcon from "@mui/icons-material/ArrowBack";
@@ -27,11 +28,14 @@ import {
   B4Config,
   B4SetConfig,
   MAIN_SET_ID,
+  ScheduleWindow,
+  StrategyVariant,
   SystemConfig,
 } from "@models/config";
 
 import { DnsSettings } from "./Dns";
 import { ImportExportSettings } from "./ImportExport";
+import { ScheduleSettings } from "./Schedule";
 import { SetStats } from "./Manager";
 import { TargetSettings } from "./Target";
 import { TcpTabContainer } from "./tcp/TcpTabContainer";
@@ -90,6 +94,7 @@ export const SetEditorPage = ({
     TCP,
     UDP,
     DNS,
+    SCHEDULE,
     IMPORT_EXPORT,
   }
 
@@ -106,7 +111,16 @@ export const SetEditorPage = ({
 
   const handleChange = (
     field: string,
-    value: string | number | boolean | string[] | number[] | null | undefined,
+    value:
+      | string
+      | number
+      | boolean
+      | string[]
+      | number[]
+      | ScheduleWindow[]
+      | StrategyVariant[]
+      | null
+      | undefined,
   ) => {
     setEditedSet((prev) => {
       if (!prev) return prev;
@@ -241,6 +255,7 @@ export const SetEditorPage = ({
             <B4Tab icon={<TcpIcon />} label="TCP" inline />
             <B4Tab icon={<UdpIcon />} label="UDP" inline />
             <B4Tab icon={<DnsIcon />} label="DNS" inline />
+            <B4Tab icon={<TimerIcon />} label="Schedule" inline />
             <B4Tab icon={<ImportExportIcon />} label="Import/Export" inline />
           </B4Tabs>
         </Box>
@@ -281,6 +296,10 @@ export const SetEditorPage = ({
           />
         </TabPanel>
 
+        <TabPanel value={activeTab} index={TABS.SCHEDULE}>
+          <ScheduleSettings config={editedSet} onChange={handleChange} />
+        </TabPanel>
+
         <TabPanel value={activeTab} index={TABS.IMPORT_EXPORT}>
           <ImportExportSettings
             config={editedSet}
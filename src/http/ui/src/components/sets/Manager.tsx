@@ -11,7 +11,7 @@ import {
   TextField,
   Typography,
 } from "@mui/material";
-import { useMemo, useState } from "react";
+import { useEffect, useMemo, useState } from "react";
 import { useNavigate } from "react-router";
 
 import {
@@ -49,7 +49,8 @@ import { SetCard } from "./SetCard";
 
 import { colors, radius } from "@design";
 import { useSets } from "@hooks/useSets";
-import { B4Config, B4SetConfig } from "@models/config";
+import { setsApi } from "@api/sets";
+import { B4Config, B4SetConfig, SetScheduleStatus } from "@models/config";
 
 export interface SetStats {
   manual_domains: number;
@@ -125,6 +126,24 @@ export const SetsManager = ({ config, onRefresh }: SetsManagerProps) => {
   }>({ open: false, setA: null, setB: null });
 
   const [activeId, setActiveId] = useState<string | null>(null);
+  const [schedules, setSchedules] = useState<
+    Record<string, SetScheduleStatus>
+  >({});
+
+  useEffect(() => {
+    const loadSchedules = async () => {
+      try {
+        const status = await setsApi.getScheduleStatus();
+        setSchedules(Object.fromEntries(status.map((s) => [s.id, s])));
+      } catch (error) {
+        console.error("Failed to load set schedules:", error);
+      }
+    };
+
+    void loadSchedules();
+    const interval = setInterval(() => void loadSchedules(), 60000);
+    return () => clearInterval(interval);
+  }, [config.sets]);
 
   const setsData = config.sets || [];
   const sets = setsData.map((s) => ("set" in s ? s.set : s)) as B4SetConfig[];
@@ -350,6 +369,7 @@ export const SetsManager = ({ config, onRefresh }: SetsManagerProps) => {
                         <SetCard
                           set={set}
                           stats={stats}
+                          schedule={schedules[set.id]}
                           index={index}
                           onEdit={() => handleEditSet(set)}
                           onDuplicate={() => handleDuplicateSet(set)}
@@ -0,0 +1,171 @@
+import { Box, Grid, IconButton, Stack, Typography } from "@mui/material";
+import { ClearIcon, TimerIcon } from "@b4.icons";
+import {
+  B4Alert,
+  B4Badge,
+  B4PlusButton,
+  B4Section,
+  B4Switch,
+  B4TextField,
+} from "@b4.elements";
+import { B4SetConfig, ScheduleWindow } from "@models/config";
+import { colors, radius } from "@design";
+
+const WEEKDAYS = ["Sun", "Mon", "Tue", "Wed", "Thu", "Fri", "Sat"];
+const ALL_DAYS = 0x7f;
+
+interface ScheduleSettingsProps {
+  readonly config: B4SetConfig;
+  readonly onChange: (
+    field: string,
+    value: string | boolean | ScheduleWindow[],
+  ) => void;
+}
+
+export function ScheduleSettings({ config, onChange }: ScheduleSettingsProps) {
+  const schedule = config.schedule || {
+    enabled: false,
+    timezone: "",
+    windows: [],
+  };
+  const windows = schedule.windows ?? [];
+
+  const updateWindow = (index: number, patch: Partial<ScheduleWindow>) => {
+    onChange(
+      "schedule.windows",
+      windows.map((w, i) => (i === index ? { ...w, ...patch } : w)),
+    );
+  };
+
+  const toggleDay = (index: number, day: number) => {
+    const mask = windows[index].days || ALL_DAYS;
+    updateWindow(index, { days: (mask ^ (1 << day)) & ALL_DAYS });
+  };
+
+  const handleAddWindow = () => {
+    onChange("schedule.windows", [
+      ...windows,
+      { days: ALL_DAYS, start: "18:00", end: "23:00" },
+    ]);
+  };
+
+  const handleRemoveWindow = (index: number) => {
+    onChange(
+      "schedule.windows",
+      windows.filter((_, i) => i !== index),
+    );
+  };
+
+  return (
+    <B4Section
+      title="Schedule"
+      description="Activate this set only during selected days and hours"
+      icon={<TimerIcon />}
+    >
+      <Grid container spacing={3}>
+        <B4Alert severity="info" sx={{ m: 0 }}>
+          Outside of its windows the set is skipped as if it were disabled.
+          Windows ending at or before their start time continue into the next
+          day.
+        </B4Alert>
+
+        <Grid size={{ xs: 12, md: 6 }}>
+          <B4Switch
+            label="Enable Schedule"
+            checked={schedule.enabled}
+            onChange={(checked: boolean) =>
+              onChange("schedule.enabled", checked)
+            }
+            description="Without a schedule the set is active whenever it is enabled"
+          />
+        </Grid>
+
+        {schedule.enabled && (
+          <>
+            <Grid size={{ xs: 12, md: 6 }}>
+              <B4TextField
+                label="Timezone"
+                value={schedule.timezone}
+                onChange={(e) => onChange("schedule.timezone", e.target.value)}
+                placeholder="Europe/Moscow"
+                helperText="IANA timezone name, empty for the router's local time"
+              />
+            </Grid>
+
+            <Grid size={{ xs: 12 }}>
+              <Stack spacing={2}>
+                {windows.map((w, index) => (
+                  <Box
+                    key={index}
+                    sx={{
+                      p: 2,
+                      borderRadius: radius.sm,
+                      bgcolor: colors.background.dark,
+                      border: `1px solid ${colors.border.light}`,
+                    }}
+                  >
+                    <Stack
+                      direction={{ xs: "column", md: "row" }}
+                      spacing={2}
+                      alignItems={{ md: "center" }}
+                    >
+                      <Stack direction="row" spacing={0.5} flexWrap="wrap">
+                        {WEEKDAYS.map((label, day) => {
+                          const selected =
+                            ((w.days || ALL_DAYS) & (1 << day)) !== 0;
+                          return (
+                            <B4Badge
+                              key={label}
+                              label={label}
+                              size="small"
+                              color={selected ? "secondary" : undefined}
+                              variant={selected ? undefined : "outlined"}
+                              onClick={() => toggleDay(index, day)}
+                              sx={{ cursor: "pointer" }}
+                            />
+                          );
+                        })}
+                      </Stack>
+                      <B4TextField
+                        label="From"
+                        type="time"
+                        value={w.start}
+                        onChange={(e) =>
+                          updateWindow(index, { start: e.target.value })
+                        }
+                      />
+                      <B4TextField
+                        label="To"
+                        type="time"
+                        value={w.end}
+                        onChange={(e) =>
+                          updateWindow(index, { end: e.target.value })
+                        }
+                      />
+                      <IconButton
+                        size="small"
+                        onClick={() => handleRemoveWindow(index)}
+                      >
+                        <ClearIcon fontSize="small" />
+                      </IconButton>
+                    </Stack>
+                  </Box>
+                ))}
+
+                {windows.length === 0 && (
+                  <Typography variant="body2" color="text.secondary">
+                    No windows added, the set stays active all the time.
+                  </Typography>
+                )}
+
+                <Box>
+                  <B4PlusButton onClick={handleAddWindow} />
+                </Box>
+              </Stack>
+            </Grid>
+          </>
+        )}
+      </Grid>
+    </B4Section>
+  );
+}
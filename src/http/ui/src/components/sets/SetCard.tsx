@@ -28,16 +28,22 @@ import {
   TcpIcon,
   CheckIcon,
   CloseIcon,
+  TimerIcon,
 } from "@b4.icons";
 import MoreVertIcon from "@mui/icons-material/MoreVert";
 import { B4Badge } from "@b4.elements";
 import { colors, radius } from "@design";
-import { B4SetConfig, MAIN_SET_ID } from "@models/config";
+import {
+  B4SetConfig,
+  MAIN_SET_ID,
+  SetScheduleStatus,
+} from "@models/config";
 import { SetStats } from "./Manager";
 
 interface SetCardProps {
   set: B4SetConfig;
   stats?: SetStats;
+  schedule?: SetScheduleStatus;
   index: number;
   onEdit: () => void;
   onDuplicate: () => void;
@@ -85,6 +91,18 @@ const TargetBadge = ({ label, type }: TargetBadgeProps) => {
   );
 };
 
+const formatTransition = (status: SetScheduleStatus) => {
+  if (!status.next_transition) {
+    return status.active ? "Active" : "Inactive";
+  }
+  const at = new Date(status.next_transition).toLocaleString(undefined, {
+    weekday: "short",
+    hour: "2-digit",
+    minute: "2-digit",
+  });
+  return status.active ? `Active until ${at}` : `Inactive until ${at}`;
+};
+
 const STRATEGY_LABELS: Record<string, string> = {
   combo: "COMBO",
   hybrid: "HYBRID",
@@ -102,6 +120,7 @@ const STRATEGY_LABELS: Record<string, string> = {
 export const SetCard = ({
   set,
   stats,
+  schedule,
   index,
   onEdit,
   onDuplicate,
@@ -202,6 +221,17 @@ export const SetCard = ({
           </Tooltip>
 
           {isMain && <B4Badge label="MAIN" size="small" color="secondary" />}
+          {set.enabled && schedule?.scheduled && (
+            <Tooltip title={formatTransition(schedule)}>
+              <B4Badge
+                label={schedule.active ? "ACTIVE" : "INACTIVE"}
+                size="small"
+                icon={<TimerIcon sx={{ fontSize: 12 }} />}
+                color={schedule.active ? "secondary" : undefined}
+                variant={schedule.active ? undefined : "outlined"}
+              />
+            </Tooltip>
+          )}
         </Stack>
 
         <IconButton size="small" onClick={handleMenuOpen}>
@@ -17,6 +17,7 @@ import {
   InfoIcon,
   ClearIcon,
   IpIcon,
+  DeviceUnknowIcon,
 } from "@b4.icons";
 
 import {
@@ -77,6 +78,7 @@ export const TargetSettings = ({
   const [tabValue, setTabValue] = useState(0);
   const [newBypassDomain, setNewBypassDomain] = useState("");
   const [newBypassIP, setNewBypassIP] = useState("");
+  const [newDevice, setNewDevice] = useState("");
   const [newBypassCategory, setNewBypassCategory] = useState("");
   const [availableCategories, setAvailableCategories] = useState<string[]>([]);
   const [loadingCategories, setLoadingCategories] = useState(false);
@@ -184,6 +186,33 @@ export const TargetSettings = ({
     );
   };
 
+  const handleAddDevice = () => {
+    const value = newDevice.trim();
+    if (!value) return;
+
+    const devices = config.targets.devices ?? [];
+    const existing = new Set(devices);
+    const next = [...devices];
+
+    for (const raw of value.split(/[\s,|]+/).filter(Boolean)) {
+      const device = raw.trim();
+      if (device && !existing.has(device)) {
+        existing.add(device);
+        next.push(device);
+      }
+    }
+
+    onChange("targets.devices", next);
+    setNewDevice("");
+  };
+
+  const handleRemoveDevice = (device: string) => {
+    onChange(
+      "targets.devices",
+      (config.targets.devices ?? []).filter((d) => d !== device)
+    );
+  };
+
   const handleAddBypassGeoIPCategory = (category: string) => {
     if (category && !config.targets.geoip_categories.includes(category)) {
       onChange("targets.geoip_categories", [
@@ -282,6 +311,7 @@ export const TargetSettings = ({
             >
               <B4Tab icon={<DomainIcon />} label="Bypass Domains" inline />
               <B4Tab icon={<IpIcon />} label="Bypass IPs" inline />
+              <B4Tab icon={<DeviceUnknowIcon />} label="Devices" inline />
             </B4Tabs>
           </Box>
 
@@ -534,6 +564,47 @@ export const TargetSettings = ({
               )}
             </Grid>
           </TabPanel>
+
+          {/* Devices Tab */}
+          <TabPanel value={tabValue} index={2}>
+            <B4Alert>
+              Limit this set to traffic from specific LAN devices. Leave empty
+              to apply the set to all devices.
+            </B4Alert>
+
+            <Box>
+              <Box sx={{ display: "flex", gap: 1, alignItems: "flex-start" }}>
+                <B4TextField
+                  label="Add Device"
+                  value={newDevice}
+                  onChange={(e) => setNewDevice(e.target.value)}
+                  onKeyDown={(e) => {
+                    if (e.key === "Enter" || e.key === "Tab" || e.key === ",") {
+                      e.preventDefault();
+                      handleAddDevice();
+                    }
+                  }}
+                  helperText="MAC address, IP/CIDR or device alias"
+                  placeholder="aa:bb:cc:dd:ee:ff"
+                />
+                <B4PlusButton
+                  onClick={handleAddDevice}
+                  disabled={!newDevice}
+                />
+              </Box>
+              <Box sx={{ mt: 2 }}>
+                <B4ChipList
+                  items={config.targets.devices ?? []}
+                  getKey={(d) => d}
+                  getLabel={(d) => d}
+                  onDelete={handleRemoveDevice}
+                  emptyMessage="All devices"
+                  showEmpty
+                  maxHeight={200}
+                />
+              </Box>
+            </Box>
+          </TabPanel>
         </B4Section>
       </Stack>
 
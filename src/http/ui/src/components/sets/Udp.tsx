@@ -59,6 +59,37 @@ const UDP_FAKING_STRATEGIES = [
   { value: "checksum", label: "Checksum", description: "Corrupt UDP checksum" },
 ];
 
+const UDP_FAKE_PAYLOADS = [
+  { value: "zero", label: "Zeros", description: "Fake packets filled with zeros" },
+  {
+    value: "quic_initial",
+    label: "QUIC Initial",
+    description:
+      "Encrypted QUIC Initial with a decoy SNI, parsed by DPI like a real one",
+  },
+];
+
+const UDP_SPLIT_MODES = [
+  {
+    value: "ip",
+    label: "IP Fragments",
+    description: "Fragment the UDP datagram at the SNI",
+  },
+  {
+    value: "crypto",
+    label: "CRYPTO Frames",
+    description:
+      "Re-encrypt the Initial with its ClientHello cut into reordered CRYPTO frames",
+  },
+];
+
+const UDP_SHUFFLE_MODES = [
+  { value: "reverse", label: "Reverse Order" },
+  { value: "full", label: "Full Shuffle" },
+  { value: "middle", label: "Shuffle Middle" },
+  { value: "none", label: "Keep Order" },
+];
+
 export const UdpSettings = ({ config, main, onChange }: UdpSettingsProps) => {
   const isQuicEnabled = config.udp.filter_quic !== "disabled";
   const hasPortFilter =
@@ -166,12 +197,12 @@ export const UdpSettings = ({ config, main, onChange }: UdpSettingsProps) => {
                 value={config.udp.conn_bytes_limit}
                 onChange={(value) => onChange("udp.conn_bytes_limit", value)}
                 min={1}
-                max={main.id === config.id ? 30 : main.udp.conn_bytes_limit}
+                max={30}
                 step={1}
                 helperText={
                   main.id === config.id
-                    ? "Main set limit (changing requires service restart to take effect)"
-                    : `Max: ${main.udp.conn_bytes_limit} (limited by main set)`
+                    ? "Packets per connection handled for this set (changing requires service restart to take effect)"
+                    : `Packets per connection handled for this set (main set: ${main.udp.conn_bytes_limit})`
                 }
               />
             </Grid>
@@ -216,6 +247,34 @@ export const UdpSettings = ({ config, main, onChange }: UdpSettingsProps) => {
               />
             </Grid>
 
+            <Grid size={{ xs: 12, md: 6 }}>
+              <B4Select
+                label="Fake Payload"
+                value={config.udp.fake_payload || "zero"}
+                options={UDP_FAKE_PAYLOADS}
+                onChange={(e) =>
+                  onChange("udp.fake_payload", e.target.value as string)
+                }
+                helperText={
+                  UDP_FAKE_PAYLOADS.find(
+                    (o) => o.value === (config.udp.fake_payload || "zero")
+                  )?.description
+                }
+              />
+            </Grid>
+
+            {config.udp.fake_payload === "quic_initial" && (
+              <Grid size={{ xs: 12, md: 6 }}>
+                <B4TextField
+                  label="Decoy SNI"
+                  value={config.udp.fake_sni}
+                  onChange={(e) => onChange("udp.fake_sni", e.target.value)}
+                  placeholder="www.google.com"
+                  helperText="Domain put into the fake QUIC Initial"
+                />
+              </Grid>
+            )}
+
             <Grid size={{ xs: 12, md: 6 }}>
               <B4Slider
                 label="Fake Packet Count"
@@ -237,9 +296,58 @@ export const UdpSettings = ({ config, main, onChange }: UdpSettingsProps) => {
                 max={1500}
                 step={8}
                 valueSuffix=" bytes"
-                helperText="Size of each fake UDP packet payload"
+                helperText={
+                  config.udp.fake_payload === "quic_initial"
+                    ? "Fake QUIC Initials are padded to at least 1200 bytes"
+                    : "Size of each fake UDP packet payload"
+                }
+              />
+            </Grid>
+            <B4FormHeader label="QUIC Splitting" />
+
+            <Grid size={{ xs: 12, md: 6 }}>
+              <B4Select
+                label="Split Method"
+                value={config.udp.split_mode || "ip"}
+                options={UDP_SPLIT_MODES}
+                onChange={(e) =>
+                  onChange("udp.split_mode", e.target.value as string)
+                }
+                helperText={
+                  UDP_SPLIT_MODES.find(
+                    (o) => o.value === (config.udp.split_mode || "ip")
+                  )?.description
+                }
               />
             </Grid>
+
+            {config.udp.split_mode === "crypto" && (
+              <>
+                <Grid size={{ xs: 12, md: 6 }}>
+                  <B4Select
+                    label="Frame Order"
+                    value={config.udp.shuffle_mode}
+                    options={UDP_SHUFFLE_MODES}
+                    onChange={(e) =>
+                      onChange("udp.shuffle_mode", e.target.value as string)
+                    }
+                    helperText="How to reorder the CRYPTO frames"
+                  />
+                </Grid>
+                <Grid size={{ xs: 12, md: 6 }}>
+                  <B4Slider
+                    label="CRYPTO Frames"
+                    value={config.udp.crypto_frames}
+                    onChange={(value) => onChange("udp.crypto_frames", value)}
+                    min={2}
+                    max={16}
+                    step={1}
+                    helperText="Pieces the ClientHello is cut into, one cut is always in the SNI. All stay in the client's single Initial packet"
+                  />
+                </Grid>
+              </>
+            )}
+
             <Grid size={{ xs: 12, md: 6 }}>
               <B4RangeSlider
                 label="Segment 2 Delay"
@@ -30,7 +30,7 @@ interface TcpFakingProps {
   ) => void;
 }
 
-const FAKE_STRATEGIES = [
+export const FAKE_STRATEGIES = [
   { value: "ttl", label: "TTL" },
   { value: "randseq", label: "Random Sequence" },
   { value: "pastseq", label: "Past Sequence" },
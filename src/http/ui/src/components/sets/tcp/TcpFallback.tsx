@@ -0,0 +1,256 @@
+import { Box, Grid, IconButton, Stack, Typography } from "@mui/material";
+import {
+  B4Alert,
+  B4FormHeader,
+  B4PlusButton,
+  B4Select,
+  B4Slider,
+  B4Switch,
+} from "@b4.elements";
+import { ClearIcon } from "@b4.icons";
+import { colors, radius } from "@design";
+import { B4SetConfig, StrategyVariant } from "@models/config";
+import { fragmentationOptions } from "./TcpSplitting";
+import { FAKE_STRATEGIES } from "./TcpFaking";
+
+interface TcpFallbackProps {
+  config: B4SetConfig;
+  onChange: (
+    field: string,
+    value: string | boolean | number | StrategyVariant[],
+  ) => void;
+}
+
+const KEEP = { label: "Keep set value", value: "" };
+
+const NEW_VARIANT: StrategyVariant = {
+  strategy: "disorder",
+  sni_position: 0,
+  middle_sni: true,
+  reverse_order: false,
+  fake_sni: true,
+  fake_strategy: "",
+  fake_ttl: 0,
+};
+
+export const TcpFallback = ({ config, onChange }: TcpFallbackProps) => {
+  const fallback = config.fallback || {
+    enabled: false,
+    variants: [],
+    max_failures: 3,
+    timeout_ms: 3000,
+    ttl_minutes: 60,
+  };
+  const variants = fallback.variants ?? [];
+
+  const updateVariant = (index: number, patch: Partial<StrategyVariant>) => {
+    onChange(
+      "fallback.variants",
+      variants.map((v, i) => (i === index ? { ...v, ...patch } : v)),
+    );
+  };
+
+  const removeVariant = (index: number) => {
+    onChange(
+      "fallback.variants",
+      variants.filter((_, i) => i !== index),
+    );
+  };
+
+  return (
+    <>
+      <B4FormHeader label="Strategy Fallback" />
+      <Grid container spacing={3}>
+        <B4Alert severity="info" sx={{ m: 0 }}>
+          When a domain keeps failing with this set's strategy (RST from the
+          server or DPI, no ServerHello, retransmitted ClientHello), it is moved
+          to the next variant below. A working variant is remembered per domain.
+        </B4Alert>
+
+        <Grid size={{ xs: 12, md: 6 }}>
+          <B4Switch
+            label="Enable Fallback Chain"
+            checked={fallback.enabled}
+            onChange={(checked: boolean) =>
+              onChange("fallback.enabled", checked)
+            }
+            description="Try other strategies per domain when the current one fails"
+          />
+        </Grid>
+
+        {fallback.enabled && (
+          <>
+            <Grid size={{ xs: 12, md: 6 }}>
+              <B4Slider
+                label="Failures Before Switching"
+                value={fallback.max_failures}
+                onChange={(value: number) =>
+                  onChange("fallback.max_failures", value)
+                }
+                min={1}
+                max={10}
+                step={1}
+              />
+            </Grid>
+            <Grid size={{ xs: 12, md: 6 }}>
+              <B4Slider
+                label="ServerHello Timeout"
+                value={fallback.timeout_ms}
+                onChange={(value: number) =>
+                  onChange("fallback.timeout_ms", value)
+                }
+                min={500}
+                max={10000}
+                step={500}
+                valueSuffix=" ms"
+              />
+            </Grid>
+            <Grid size={{ xs: 12, md: 6 }}>
+              <B4Slider
+                label="Remember Variant"
+                value={fallback.ttl_minutes}
+                onChange={(value: number) =>
+                  onChange("fallback.ttl_minutes", value)
+                }
+                min={5}
+                max={1440}
+                step={5}
+                valueSuffix=" min"
+              />
+            </Grid>
+
+            <Grid size={{ xs: 12 }}>
+              <Stack spacing={2}>
+                {variants.map((v, index) => (
+                  <Box
+                    key={index}
+                    sx={{
+                      p: 2,
+                      borderRadius: radius.sm,
+                      bgcolor: colors.background.dark,
+                      border: `1px solid ${colors.border.light}`,
+                    }}
+                  >
+                    <Stack
+                      direction="row"
+                      justifyContent="space-between"
+                      alignItems="center"
+                      sx={{ mb: 1 }}
+                    >
+                      <Typography variant="subtitle2">
+                        Variant {index + 1}
+                      </Typography>
+                      <IconButton
+                        size="small"
+                        onClick={() => removeVariant(index)}
+                      >
+                        <ClearIcon fontSize="small" />
+                      </IconButton>
+                    </Stack>
+                    <Grid container spacing={2}>
+                      <Grid size={{ xs: 12, md: 6 }}>
+                        <B4Select
+                          label="Splitting Method"
+                          value={v.strategy}
+                          options={[KEEP, ...fragmentationOptions]}
+                          onChange={(e) =>
+                            updateVariant(index, {
+                              strategy: e.target
+                                .value as StrategyVariant["strategy"],
+                            })
+                          }
+                        />
+                      </Grid>
+                      <Grid size={{ xs: 12, md: 6 }}>
+                        <B4Select
+                          label="Fake Strategy"
+                          value={v.fake_strategy}
+                          options={[KEEP, ...FAKE_STRATEGIES]}
+                          onChange={(e) =>
+                            updateVariant(index, {
+                              fake_strategy: e.target
+                                .value as StrategyVariant["fake_strategy"],
+                            })
+                          }
+                        />
+                      </Grid>
+                      <Grid size={{ xs: 12, md: 4 }}>
+                        <B4Switch
+                          label="Split in SNI Middle"
+                          checked={v.middle_sni}
+                          onChange={(checked: boolean) =>
+                            updateVariant(index, { middle_sni: checked })
+                          }
+                        />
+                      </Grid>
+                      <Grid size={{ xs: 12, md: 4 }}>
+                        <B4Switch
+                          label="Reverse Order"
+                          checked={v.reverse_order}
+                          onChange={(checked: boolean) =>
+                            updateVariant(index, { reverse_order: checked })
+                          }
+                        />
+                      </Grid>
+                      <Grid size={{ xs: 12, md: 4 }}>
+                        <B4Switch
+                          label="Fake SNI"
+                          checked={v.fake_sni}
+                          onChange={(checked: boolean) =>
+                            updateVariant(index, { fake_sni: checked })
+                          }
+                        />
+                      </Grid>
+                      <Grid size={{ xs: 12, md: 6 }}>
+                        <B4Slider
+                          label="Split Position"
+                          value={v.sni_position}
+                          onChange={(value: number) =>
+                            updateVariant(index, { sni_position: value })
+                          }
+                          min={0}
+                          max={50}
+                          helperText="0 keeps the set value"
+                        />
+                      </Grid>
+                      <Grid size={{ xs: 12, md: 6 }}>
+                        <B4Slider
+                          label="Fake TTL"
+                          value={v.fake_ttl}
+                          onChange={(value: number) =>
+                            updateVariant(index, { fake_ttl: value })
+                          }
+                          min={0}
+                          max={64}
+                          helperText="0 keeps the set value"
+                        />
+                      </Grid>
+                    </Grid>
+                  </Box>
+                ))}
+
+                {variants.length === 0 && (
+                  <Typography variant="body2" color="text.secondary">
+                    No variants added, failing domains stay on the set's
+                    strategy.
+                  </Typography>
+                )}
+
+                <Box>
+                  <B4PlusButton
+                    onClick={() =>
+                      onChange("fallback.variants", [
+                        ...variants,
+                        { ...NEW_VARIANT },
+                      ])
+                    }
+                  />
+                </Box>
+              </Stack>
+            </Grid>
+          </>
+        )}
+      </Grid>
+    </>
+  );
+};
@@ -32,12 +32,12 @@ export const TcpGeneral = ({ config, main, onChange }: TcpGeneralProps) => {
               onChange("tcp.conn_bytes_limit", value)
             }
             min={1}
-            max={main.id === config.id ? 100 : main.tcp.conn_bytes_limit}
+            max={100}
             step={1}
             helperText={
               main.id === config.id
-                ? "Main set limit (changing requires service restart to take effect)"
-                : `Max: ${main.tcp.conn_bytes_limit} (limited by main set)`
+                ? "Packets per connection handled for this set (changing requires service restart to take effect)"
+                : `Packets per connection handled for this set (main set: ${main.tcp.conn_bytes_limit})`
             }
           />
         </Grid>
@@ -21,7 +21,7 @@ interface TcpSplittingProps {
   ) => void;
 }
 
-const fragmentationOptions: { label: string; value: FragmentationStrategy }[] =
+export const fragmentationOptions: { label: string; value: FragmentationStrategy }[] =
   [
     { label: "Combo", value: "combo" },
     { label: "Hybrid", value: "hybrid" },
@@ -1,18 +1,25 @@
 import { Box, Fade } from "@mui/material";
 import { useState, type ReactNode } from "react";
-import { B4SetConfig } from "@models/config";
+import { B4SetConfig, StrategyVariant } from "@models/config";
 import { B4Tabs, B4Tab, B4Section } from "@b4.elements";
-import { TcpIcon, FragIcon, FakingIcon, CoreIcon } from "@b4.icons";
+import {
+  TcpIcon,
+  FragIcon,
+  FakingIcon,
+  CoreIcon,
+  RefreshIcon,
+} from "@b4.icons";
 import { TcpGeneral } from "./TcpGeneral";
 import { TcpSplitting } from "./TcpSplitting";
 import { TcpFaking } from "./TcpFaking";
+import { TcpFallback } from "./TcpFallback";
 
 interface TcpTabContainerProps {
   config: B4SetConfig;
   main: B4SetConfig;
   onChange: (
     field: string,
-    value: string | number | boolean | string[] | number[],
+    value: string | number | boolean | string[] | number[] | StrategyVariant[],
   ) => void;
 }
 
@@ -43,6 +50,7 @@ enum TCP_TABS {
   GENERAL = 0,
   SPLITTING,
   FAKING,
+  FALLBACK,
 }
 
 export const TcpTabContainer = ({
@@ -67,6 +75,7 @@ export const TcpTabContainer = ({
         <B4Tab icon={<CoreIcon />} label="General" inline />
         <B4Tab icon={<FragIcon />} label="Splitting" inline />
         <B4Tab icon={<FakingIcon />} label="Faking" inline />
+        <B4Tab icon={<RefreshIcon />} label="Fallback" inline />
       </B4Tabs>
 
       <TabPanel value={activeTab} index={TCP_TABS.GENERAL}>
@@ -80,6 +89,10 @@ export const TcpTabContainer = ({
       <TabPanel value={activeTab} index={TCP_TABS.FAKING}>
         <TcpFaking config={config} onChange={onChange} />
       </TabPanel>
+
+      <TabPanel value={activeTab} index={TCP_TABS.FALLBACK}>
+        <TcpFallback config={config} onChange={onChange} />
+      </TabPanel>
     </B4Section>
   );
 };
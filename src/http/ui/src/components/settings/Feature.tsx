@@ -75,6 +75,34 @@ export const FeatureSettings = ({ config, onChange }: FeatureSettingsProps) => {
             )
           }
         />
+        <B4Switch
+          label="Kernel IP Sets"
+          checked={config.system.tables.ip_sets.enabled}
+          onChange={(checked: boolean) =>
+            onChange("system.tables.ip_sets.enabled", checked)
+          }
+          description="Keep target IPs and IPs learned from matched domains in nftables sets or ipsets"
+        />
+        {config.system.tables.ip_sets.enabled && (
+          <>
+            <B4Switch
+              label="Queue Only Target IPs"
+              checked={config.system.tables.ip_sets.targets_only}
+              onChange={(checked: boolean) =>
+                onChange("system.tables.ip_sets.targets_only", checked)
+              }
+              description="Traffic to other IPs never reaches B4. Every enabled set needs IP targets; domains only apply once their IPs are learned from DNS"
+            />
+            <B4Switch
+              label="Queue All Packets to Target IPs"
+              checked={config.system.tables.ip_sets.queue_all}
+              onChange={(checked: boolean) =>
+                onChange("system.tables.ip_sets.queue_all", checked)
+              }
+              description="Ignore the connbytes limit for IPs in the sets, for strategies working past the first packets"
+            />
+          </>
+        )}
         <B4FormGroup label="Network Interfaces" columns={1}>
           <Box>
             <Typography variant="body2" color="text.secondary" sx={{ mb: 1 }}>
@@ -90,6 +90,16 @@ export interface TargetsConfig {
   ip: string[];
   geosite_categories: string[];
   geoip_categories: string[];
+  devices: string[];
+  subscriptions: ListSubscription[];
+}
+
+export type ListFormat = "plain" | "dnsmasq" | "clash" | "singbox" | "adguard";
+
+export interface ListSubscription {
+  url: string;
+  format: ListFormat;
+  interval_hours: number;
 }
 
 export interface DomainStatisticsConfig {
@@ -110,12 +120,20 @@ export interface CategoryPreviewConfig {
 export type UdpMode = "drop" | "fake";
 export type UdpFilterQuicMode = "disabled" | "all" | "parse";
 export type UdpFakingStrategy = "none" | "ttl" | "checksum";
+export type UdpFakePayload = "zero" | "quic_initial";
+export type UdpSplitMode = "ip" | "crypto";
+export type UdpShuffleMode = "full" | "reverse" | "middle" | "none";
 
 export interface UdpConfig {
   mode: UdpMode;
   fake_seq_length: number;
   fake_len: number;
   faking_strategy: UdpFakingStrategy;
+  fake_payload: UdpFakePayload;
+  fake_sni: string;
+  split_mode: UdpSplitMode;
+  crypto_frames: number;
+  shuffle_mode: UdpShuffleMode;
   dport_filter: string;
   filter_quic: UdpFilterQuicMode;
   conn_bytes_limit: number;
@@ -193,10 +211,28 @@ export interface WebServerConfig {
   bind_address: string;
   tls_cert: string;
   tls_key: string;
+  auth?: AuthConfig;
+  allowed_origins?: string[];
+}
+
+export type AuthScope = "read" | "full";
+
+export interface AuthConfig {
+  enabled: boolean;
+  session_ttl_hours: number;
+  users: { username: string }[];
+  tokens: { id: string; name: string; scope: AuthScope; created_at: number }[];
 }
 export interface TableConfig {
   monitor_interval: number;
   skip_setup: false;
+  ip_sets: IPSetsConfig;
+}
+
+export interface IPSetsConfig {
+  enabled: boolean;
+  targets_only: boolean;
+  queue_all: boolean;
 }
 
 export interface GeoConfig {
@@ -204,6 +240,10 @@ export interface GeoConfig {
   ipdat_url: string;
   sitedat_path: string;
   ipdat_path: string;
+  sitedat_checksum_url: string;
+  ipdat_checksum_url: string;
+  auto_update: boolean;
+  update_interval_hours: number;
 }
 
 export interface ApiConfig {
@@ -237,6 +277,54 @@ export interface B4SetConfig {
   faking: FakingConfig;
   targets: TargetsConfig;
   dns: DNSConfig;
+  schedule: ScheduleConfig;
+  fallback: FallbackConfig;
+  health: HealthCheckConfig;
+}
+
+export interface HealthCheckConfig {
+  enabled: boolean;
+  url: string;
+  interval_minutes: number;
+  failure_threshold: number;
+  auto_discover: boolean;
+}
+
+export interface StrategyVariant {
+  strategy: FragmentationStrategy | "";
+  sni_position: number;
+  middle_sni: boolean;
+  reverse_order: boolean;
+  fake_sni: boolean;
+  fake_strategy: FakingStrategy | "";
+  fake_ttl: number;
+}
+
+export interface FallbackConfig {
+  enabled: boolean;
+  variants: StrategyVariant[];
+  max_failures: number;
+  timeout_ms: number;
+  ttl_minutes: number;
+}
+
+export interface ScheduleWindow {
+  days: number; // weekday mask, bit 0 is Sunday, 0 for every day
+  start: string;
+  end: string;
+}
+
+export interface ScheduleConfig {
+  enabled: boolean;
+  timezone: string;
+  windows: ScheduleWindow[];
+}
+
+export interface SetScheduleStatus {
+  id: string;
+  active: boolean;
+  scheduled: boolean;
+  next_transition?: string;
 }
 
 export type ComboShuffleMode = "middle" | "full" | "reverse";
@@ -257,10 +345,14 @@ export interface DisorderFragConfig {
   max_jitter_us: number;
 }
 
+export type DnsMode = "redirect" | "forward";
+
 export interface DNSConfig {
   enabled: boolean;
+  mode: DnsMode;
   target_dns: string;
   fragment_query: boolean;
+  upstream: string;
 }
 
 export interface DuplicateConfig {
@@ -34,6 +34,11 @@ export function createDefaultSet(setCount: number): B4SetConfig {
       fake_seq_length: 6,
       fake_len: 64,
       faking_strategy: "none",
+      fake_payload: "zero",
+      fake_sni: "www.google.com",
+      split_mode: "ip",
+      crypto_frames: 4,
+      shuffle_mode: "reverse",
       dport_filter: "",
       filter_quic: "disabled",
       filter_stun: true,
@@ -43,8 +48,10 @@ export function createDefaultSet(setCount: number): B4SetConfig {
     } as B4SetConfig["udp"],
     dns: {
       enabled: false,
+      mode: "redirect",
       target_dns: "",
       fragment_query: false,
+      upstream: "https://1.1.1.1/dns-query",
     } as B4SetConfig["dns"],
     fragmentation: {
       strategy: "tcp",
@@ -94,6 +101,27 @@ export function createDefaultSet(setCount: number): B4SetConfig {
       ip: [],
       geosite_categories: [],
       geoip_categories: [],
+      devices: [],
+      subscriptions: [],
     } as B4SetConfig["targets"],
+    schedule: {
+      enabled: false,
+      timezone: "",
+      windows: [],
+    } as B4SetConfig["schedule"],
+    fallback: {
+      enabled: false,
+      variants: [],
+      max_failures: 3,
+      timeout_ms: 3000,
+      ttl_minutes: 60,
+    } as B4SetConfig["fallback"],
+    health: {
+      enabled: false,
+      url: "",
+      interval_minutes: 30,
+      failure_threshold: 3,
+      auto_discover: false,
+    } as B4SetConfig["health"],
   };
 }
@@ -58,6 +58,32 @@ export interface DiscoverySuite {
   completed_checks: number;
   current_phase?: DiscoveryPhase;
   domain_discovery_results?: Record<string, DiscoveryResult>;
+  domains?: string[];
+  batch_report?: BatchReport;
+}
+
+export interface BatchPresetScore {
+  preset_name: string;
+  family?: StrategyFamily;
+  unblocked: number;
+  total_speed: number;
+  domains: string[];
+}
+
+export interface BatchException {
+  domain: string;
+  preset_name: string;
+  speed: number;
+  set: B4SetConfig;
+}
+
+export interface BatchReport {
+  ranking: BatchPresetScore[];
+  recommended?: BatchPresetScore;
+  recommended_set?: B4SetConfig;
+  exceptions: BatchException[];
+  no_bypass: string[];
+  unresolved: string[];
 }
 
 export interface DiscoveryResponse {
@@ -65,5 +91,38 @@ export interface DiscoveryResponse {
   estimated_tests: number;
   message: string;
   domain: string;
+  domains?: string[];
   check_url: string;
 }
+
+export type HealthStatus = "unknown" | "healthy" | "degraded" | "failing";
+
+export interface HealthSample {
+  time: string;
+  success: boolean;
+  latency: number;
+  speed: number;
+  error?: string;
+}
+
+export interface HealthProposal {
+  preset_name: string;
+  domains: string[];
+  set: B4SetConfig;
+  time: string;
+}
+
+export interface SetHealth {
+  set_id: string;
+  set_name: string;
+  url: string;
+  status: HealthStatus;
+  success_rate: number;
+  avg_latency: number;
+  consecutive_failures: number;
+  last_check?: string;
+  next_check?: string;
+  history: HealthSample[];
+  discovery_id?: string;
+  proposal?: HealthProposal;
+}
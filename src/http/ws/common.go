@@ -6,11 +6,15 @@ import (
 	"github.com/gorilla/websocket"
 )
 
+// Upgrader only accepts same-origin connections until SetOriginCheck
+// installs the web server's origin policy.
 var Upgrader = websocket.Upgrader{
-	CheckOrigin: func(r *http.Request) bool {
-		//TODO: Allow connections from any origin - need to handle CORS  later
-		return true
-	},
 	ReadBufferSize:  1024,
 	WriteBufferSize: 1024,
 }
+
+// SetOriginCheck sets the function deciding which page origins may open
+// WebSocket connections.
+func SetOriginCheck(check func(r *http.Request) bool) {
+	Upgrader.CheckOrigin = check
+}
@@ -2,9 +2,14 @@ package ws
 
 import (
 	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
 	"sync"
 	"testing"
 	"time"
+
+	"github.com/gorilla/websocket"
 )
 
 func TestBroadcastWriter_LineBuffering(t *testing.T) {
@@ -326,9 +331,42 @@ func TestLogHub_Concurrent(t *testing.T) {
 }
 
 func TestUpgrader_CheckOrigin(t *testing.T) {
-	// CheckOrigin should allow all origins (returns true)
-	if !Upgrader.CheckOrigin(nil) {
-		t.Error("Upgrader.CheckOrigin should return true for any request")
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if conn, err := Upgrader.Upgrade(w, r, nil); err == nil {
+			conn.Close()
+		}
+	}))
+	defer srv.Close()
+
+	dial := func(origin string) error {
+		h := http.Header{}
+		if origin != "" {
+			h.Set("Origin", origin)
+		}
+		conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), h)
+		if err == nil {
+			conn.Close()
+		}
+		return err
+	}
+
+	if err := dial(""); err != nil {
+		t.Errorf("request without origin rejected: %v", err)
+	}
+	if err := dial(srv.URL); err != nil {
+		t.Errorf("same origin rejected: %v", err)
+	}
+	if err := dial("http://evil.example"); err == nil {
+		t.Error("foreign origin accepted by default")
+	}
+
+	SetOriginCheck(func(r *http.Request) bool { return r.Header.Get("Origin") == "http://trusted.example" })
+	defer SetOriginCheck(nil)
+	if err := dial("http://trusted.example"); err != nil {
+		t.Errorf("origin allowed by the check rejected: %v", err)
+	}
+	if err := dial("http://evil.example"); err == nil {
+		t.Error("origin refused by the check accepted")
 	}
 }
 
@@ -0,0 +1,448 @@
+package lists
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/daniellavrushin/b4/log"
+)
+
+const (
+	// MaxListSize is the largest list that is downloaded
+	MaxListSize = 32 << 20
+
+	checkEvery   = time.Minute
+	retryAfter   = 10 * time.Minute
+	fetchTimeout = time.Minute
+)
+
+// Subscription is a list a set subscribes to.
+type Subscription struct {
+	// URL is an http(s) URL or a local path.
+	URL      string
+	Format   string
+	Interval time.Duration
+}
+
+// Status is the state of one subscription.
+type Status struct {
+	URL       string    `json:"url"`
+	Format    string    `json:"format"`
+	Checked   time.Time `json:"checked,omitzero"`
+	Updated   time.Time `json:"updated,omitzero"`
+	Domains   int       `json:"domains"`
+	IPs       int       `json:"ips"`
+	Error     string    `json:"error,omitempty"`
+	NextCheck time.Time `json:"next_check,omitzero"`
+}
+
+// cacheMeta is stored next to the last good copy of a remote list.
+type cacheMeta struct {
+	URL          string    `json:"url"`
+	ETag         string    `json:"etag,omitempty"`
+	LastModified string    `json:"last_modified,omitempty"`
+	Checked      time.Time `json:"checked"`
+	Updated      time.Time `json:"updated"`
+}
+
+type parsedList struct {
+	modTime time.Time
+	size    int64
+	domains []string
+	ips     []string
+}
+
+var (
+	parsedMu sync.Mutex
+	parsedBy = make(map[string]*parsedList) // by path and format
+
+	client = &http.Client{Timeout: fetchTimeout}
+)
+
+// IsRemote reports whether url is fetched over HTTP rather than read from
+// disk.
+func IsRemote(url string) bool {
+	lower := strings.ToLower(url)
+	return strings.HasPrefix(lower, "http://") || strings.HasPrefix(lower, "https://")
+}
+
+// cachePath returns where the last good copy of a remote list is kept.
+func cachePath(dir, url string) string {
+	sum := sha1.Sum([]byte(url))
+	return filepath.Join(dir, hex.EncodeToString(sum[:8])+".list")
+}
+
+// Load returns the targets of a subscription: the last good copy of a
+// remote list in dir, or the local file. Nothing is fetched, a list that
+// was never downloaded has no targets.
+func Load(dir, url, format string) (domains, ips []string) {
+	path := url
+	if IsRemote(url) {
+		path = cachePath(dir, url)
+	}
+	l, err := loadParsed(path, format)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Errorf("Failed to load list %s: %v", url, err)
+		}
+		return nil, nil
+	}
+	return l.domains, l.ips
+}
+
+// loadParsed parses the file at path, reusing the result while the file
+// is unchanged.
+func loadParsed(path, format string) (*parsedList, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	key := format + "|" + path
+
+	parsedMu.Lock()
+	l := parsedBy[key]
+	parsedMu.Unlock()
+	if l != nil && l.modTime.Equal(info.ModTime()) && l.size == info.Size() {
+		return l, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	domains, ips, err := Parse(format, data)
+	if err != nil {
+		return nil, err
+	}
+	l = &parsedList{modTime: info.ModTime(), size: info.Size(), domains: domains, ips: ips}
+
+	parsedMu.Lock()
+	parsedBy[key] = l
+	parsedMu.Unlock()
+	return l, nil
+}
+
+// Fetcher keeps subscribed lists up to date in the background.
+type Fetcher struct {
+	dir      string
+	subs     func() []Subscription
+	onChange func()
+
+	mu     sync.Mutex
+	status map[string]*Status // by URL and format
+	kick   chan struct{}
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+var (
+	fetcherMu sync.Mutex
+	fetcher   *Fetcher
+)
+
+// Start checks the lists returned by subs every minute, and calls onChange
+// after one of them changed. Remote lists are cached in dir.
+func Start(dir string, subs func() []Subscription, onChange func()) {
+	ctx, cancel := context.WithCancel(context.Background())
+	f := &Fetcher{
+		dir:      dir,
+		subs:     subs,
+		onChange: onChange,
+		status:   make(map[string]*Status),
+		kick:     make(chan struct{}, 1),
+		cancel:   cancel,
+		done:     make(chan struct{}),
+	}
+
+	fetcherMu.Lock()
+	old := fetcher
+	fetcher = f
+	fetcherMu.Unlock()
+	if old != nil {
+		old.stop()
+	}
+
+	go f.run(ctx)
+}
+
+// Stop ends the background checks.
+func Stop() {
+	fetcherMu.Lock()
+	f := fetcher
+	fetcher = nil
+	fetcherMu.Unlock()
+	if f != nil {
+		f.stop()
+	}
+}
+
+// Check checks the due lists now, so new subscriptions are fetched
+// without waiting for the next minute.
+func Check() {
+	wake(false)
+}
+
+// Refresh checks every list now, due or not.
+func Refresh() {
+	wake(true)
+}
+
+func wake(force bool) {
+	fetcherMu.Lock()
+	f := fetcher
+	fetcherMu.Unlock()
+	if f == nil {
+		return
+	}
+	if force {
+		f.mu.Lock()
+		for _, st := range f.status {
+			st.NextCheck = time.Time{}
+		}
+		f.mu.Unlock()
+	}
+	select {
+	case f.kick <- struct{}{}:
+	default:
+	}
+}
+
+// GetStatus returns the state of every subscribed list.
+func GetStatus() []Status {
+	fetcherMu.Lock()
+	f := fetcher
+	fetcherMu.Unlock()
+	out := []Status{}
+	if f == nil {
+		return out
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, sub := range f.subs() {
+		if st, ok := f.status[sub.URL+"|"+sub.Format]; ok {
+			out = append(out, *st)
+		} else {
+			out = append(out, Status{URL: sub.URL, Format: sub.Format})
+		}
+	}
+	return out
+}
+
+func (f *Fetcher) stop() {
+	f.cancel()
+	<-f.done
+}
+
+func (f *Fetcher) run(ctx context.Context) {
+	defer close(f.done)
+	ticker := time.NewTicker(checkEvery)
+	defer ticker.Stop()
+
+	for {
+		if f.checkAll(ctx) && ctx.Err() == nil && f.onChange != nil {
+			f.onChange()
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-f.kick:
+		}
+	}
+}
+
+// checkAll checks the due lists and reports whether any of them changed.
+func (f *Fetcher) checkAll(ctx context.Context) bool {
+	changed := false
+	seen := make(map[string]bool)
+	for _, sub := range f.subs() {
+		key := sub.URL + "|" + sub.Format
+		if seen[key] || ctx.Err() != nil {
+			continue
+		}
+		seen[key] = true
+
+		f.mu.Lock()
+		st, ok := f.status[key]
+		if !ok {
+			st = &Status{URL: sub.URL, Format: sub.Format}
+			f.status[key] = st
+		}
+		due := time.Now().After(st.NextCheck)
+		f.mu.Unlock()
+
+		if !due && !(!IsRemote(sub.URL) && f.localChanged(sub)) {
+			continue
+		}
+		if f.check(ctx, sub, st) {
+			changed = true
+		}
+	}
+	return changed
+}
+
+// localChanged reports whether a local list was modified since it was
+// last parsed.
+func (f *Fetcher) localChanged(sub Subscription) bool {
+	info, err := os.Stat(sub.URL)
+	if err != nil {
+		return false
+	}
+	parsedMu.Lock()
+	defer parsedMu.Unlock()
+	l := parsedBy[sub.Format+"|"+sub.URL]
+	return l == nil || !l.modTime.Equal(info.ModTime()) || l.size != info.Size()
+}
+
+// check refreshes one list and reports whether its targets changed.
+func (f *Fetcher) check(ctx context.Context, sub Subscription, st *Status) bool {
+	var updated bool
+	var err error
+	path := sub.URL
+	if IsRemote(sub.URL) {
+		path = cachePath(f.dir, sub.URL)
+		updated, err = f.fetch(ctx, sub, path)
+	} else {
+		updated = f.localChanged(sub)
+	}
+
+	now := time.Now()
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	st.Checked = now
+	st.NextCheck = now.Add(sub.Interval)
+	if err != nil {
+		st.Error = err.Error()
+		st.NextCheck = now.Add(min(sub.Interval, retryAfter))
+		log.Errorf("Failed to update list %s: %v", sub.URL, err)
+		return false
+	}
+
+	l, lerr := loadParsed(path, sub.Format)
+	if lerr != nil {
+		st.Error = lerr.Error()
+		return false
+	}
+	st.Error = ""
+	st.Domains, st.IPs = len(l.domains), len(l.ips)
+	if updated || st.Updated.IsZero() {
+		if info, err := os.Stat(path); err == nil {
+			st.Updated = info.ModTime()
+		}
+	}
+	if updated {
+		log.Infof("List %s updated: %d domains, %d IPs", sub.URL, st.Domains, st.IPs)
+	}
+	return updated
+}
+
+// fetch downloads a remote list unless the copy at path is current, and
+// reports whether the copy was replaced. A list that fails to parse or has
+// no targets does not replace the last good copy.
+func (f *Fetcher) fetch(ctx context.Context, sub Subscription, path string) (bool, error) {
+	metaPath := strings.TrimSuffix(path, ".list") + ".json"
+	var meta cacheMeta
+	if data, err := os.ReadFile(metaPath); err == nil {
+		_ = json.Unmarshal(data, &meta)
+	}
+	_, statErr := os.Stat(path)
+	haveCopy := statErr == nil && meta.URL == sub.URL
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, sub.URL, nil)
+	if err != nil {
+		return false, err
+	}
+	if haveCopy {
+		if meta.ETag != "" {
+			req.Header.Set("If-None-Match", meta.ETag)
+		}
+		if meta.LastModified != "" {
+			req.Header.Set("If-Modified-Since", meta.LastModified)
+		}
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+
+	meta.URL = sub.URL
+	meta.Checked = time.Now()
+	if resp.StatusCode == http.StatusNotModified && haveCopy {
+		return false, writeMeta(metaPath, meta)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return false, fmt.Errorf("remote server returned %s", resp.Status)
+	}
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, MaxListSize+1))
+	if err != nil {
+		return false, err
+	}
+	if len(data) > MaxListSize {
+		return false, fmt.Errorf("list is larger than %d bytes", MaxListSize)
+	}
+	domains, ips, err := Parse(sub.Format, data)
+	if err != nil {
+		return false, err
+	}
+	if len(domains)+len(ips) == 0 {
+		return false, fmt.Errorf("no %s entries found", sub.Format)
+	}
+
+	meta.ETag = resp.Header.Get("ETag")
+	meta.LastModified = resp.Header.Get("Last-Modified")
+
+	if haveCopy {
+		if old, err := os.ReadFile(path); err == nil && bytes.Equal(old, data) {
+			return false, writeMeta(metaPath, meta)
+		}
+	}
+
+	meta.Updated = meta.Checked
+	if err := os.MkdirAll(f.dir, 0755); err != nil {
+		return false, err
+	}
+	if err := writeAtomic(path, data); err != nil {
+		return false, err
+	}
+	return true, writeMeta(metaPath, meta)
+}
+
+func writeMeta(path string, meta cacheMeta) error {
+	data, _ := json.MarshalIndent(meta, "", "  ")
+	return writeAtomic(path, data)
+}
+
+func writeAtomic(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".list-*.tmp")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return nil
+}
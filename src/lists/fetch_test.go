@@ -0,0 +1,115 @@
+package lists
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func newTestFetcher(dir string) *Fetcher {
+	return &Fetcher{dir: dir, status: make(map[string]*Status)}
+}
+
+func TestFetchConditional(t *testing.T) {
+	body, etag, status := "a.com\nb.com\n", `"v1"`, http.StatusOK
+	conditional := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if status != http.StatusOK {
+			w.WriteHeader(status)
+			return
+		}
+		if r.Header.Get("If-None-Match") == etag {
+			conditional++
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", etag)
+		w.Write([]byte(body))
+	}))
+	defer srv.Close()
+
+	dir := t.TempDir()
+	f := newTestFetcher(dir)
+	sub := Subscription{URL: srv.URL + "/list.txt", Format: FormatPlain, Interval: time.Hour}
+	st := &Status{URL: sub.URL, Format: sub.Format}
+	ctx := context.Background()
+
+	if !f.check(ctx, sub, st) {
+		t.Fatal("first fetch should update the list")
+	}
+	if d, _ := Load(dir, sub.URL, sub.Format); !reflect.DeepEqual(d, []string{"a.com", "b.com"}) {
+		t.Fatalf("Load = %q", d)
+	}
+	if st.Domains != 2 || st.Error != "" || !st.NextCheck.After(time.Now().Add(50*time.Minute)) {
+		t.Fatalf("unexpected status %+v", st)
+	}
+
+	if f.check(ctx, sub, st) || conditional != 1 {
+		t.Fatalf("unchanged list should be a 304, got %d conditional requests", conditional)
+	}
+
+	// Failures keep the last good copy
+	status = http.StatusInternalServerError
+	if f.check(ctx, sub, st) || st.Error == "" {
+		t.Fatalf("server error should be recorded, got %+v", st)
+	}
+	if st.NextCheck.After(time.Now().Add(retryAfter)) {
+		t.Fatalf("failed list should be retried sooner, next check %v", st.NextCheck)
+	}
+	status, body, etag = http.StatusOK, "# nothing here\n", `"v2"`
+	if f.check(ctx, sub, st) || st.Error == "" {
+		t.Fatalf("empty list should be rejected, got %+v", st)
+	}
+	if d, _ := Load(dir, sub.URL, sub.Format); !reflect.DeepEqual(d, []string{"a.com", "b.com"}) {
+		t.Fatalf("last good copy lost, Load = %q", d)
+	}
+
+	body, etag = "c.com\n", `"v3"`
+	if !f.check(ctx, sub, st) || st.Error != "" {
+		t.Fatalf("new content should update the list, got %+v", st)
+	}
+	if d, _ := Load(dir, sub.URL, sub.Format); !reflect.DeepEqual(d, []string{"c.com"}) {
+		t.Fatalf("Load = %q", d)
+	}
+}
+
+func TestLocalList(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "local.txt")
+	if err := os.WriteFile(path, []byte("1.1.1.1\nlocal.com\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	d, ips := Load("", path, FormatPlain)
+	if !reflect.DeepEqual(d, []string{"local.com"}) || !reflect.DeepEqual(ips, []string{"1.1.1.1"}) {
+		t.Fatalf("Load = %q %q", d, ips)
+	}
+
+	f := newTestFetcher("")
+	sub := Subscription{URL: path, Format: FormatPlain, Interval: time.Hour}
+	if f.localChanged(sub) {
+		t.Fatal("unchanged local list reported as changed")
+	}
+
+	if err := os.WriteFile(path, []byte("local.com\nother.com\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if !f.localChanged(sub) {
+		t.Fatal("modified local list not detected")
+	}
+	st := &Status{}
+	if !f.check(context.Background(), sub, st) || st.Domains != 2 {
+		t.Fatalf("check = %+v", st)
+	}
+	if f.localChanged(sub) {
+		t.Fatal("local list still changed after check")
+	}
+
+	if d, _ := Load("", filepath.Join(t.TempDir(), "missing"), FormatPlain); d != nil {
+		t.Fatalf("missing list should have no targets, got %q", d)
+	}
+}
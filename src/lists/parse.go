@@ -0,0 +1,359 @@
+// Package lists fetches domain and IP lists that sets subscribe to and
+// turns them into targets. Lists may be plain text, dnsmasq configs, Clash
+// rule providers, sing-box rule sets or AdGuard filters.
+package lists
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"regexp"
+	"strings"
+)
+
+const (
+	FormatPlain   = "plain"
+	FormatDnsmasq = "dnsmasq"
+	FormatClash   = "clash"
+	FormatSingBox = "singbox"
+	FormatAdGuard = "adguard"
+)
+
+// Formats are the list formats Parse understands.
+var Formats = []string{FormatPlain, FormatDnsmasq, FormatClash, FormatSingBox, FormatAdGuard}
+
+// Parse returns the domain targets, in the rule syntax of the matcher
+// ("full:", "keyword:", "regexp:" or plain for a domain and its
+// subdomains), and the IPs or CIDRs of a list. Entries it cannot express
+// are skipped.
+func Parse(format string, data []byte) (domains, ips []string, err error) {
+	p := &parsed{seen: make(map[string]bool)}
+
+	switch format {
+	case FormatPlain, "":
+		eachLine(data, p.plainLine)
+	case FormatDnsmasq:
+		eachLine(data, p.dnsmasqLine)
+	case FormatClash:
+		p.clash(data)
+	case FormatSingBox:
+		if bytes.HasPrefix(data, srsMagic) {
+			err = p.srs(data)
+		} else {
+			err = p.singBoxJSON(data)
+		}
+	case FormatAdGuard:
+		eachLine(data, p.adguardLine)
+	default:
+		return nil, nil, fmt.Errorf("unknown list format %q", format)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	return p.domains, p.ips, nil
+}
+
+type parsed struct {
+	domains []string
+	ips     []string
+	seen    map[string]bool
+}
+
+// domain adds a domain rule, value is checked and normalized.
+func (p *parsed) domain(prefix, value string) {
+	value = strings.TrimRight(strings.ToLower(strings.TrimSpace(value)), ".")
+	if !validDomain(value) {
+		return
+	}
+	p.add(prefix + value)
+}
+
+func (p *parsed) keyword(value string) {
+	value = strings.ToLower(strings.TrimSpace(value))
+	if value != "" && !strings.ContainsAny(value, " \t") {
+		p.add("keyword:" + value)
+	}
+}
+
+func (p *parsed) regexp(pattern string) {
+	if pattern == "" {
+		return
+	}
+	if _, err := regexp.Compile(pattern); err == nil {
+		p.add("regexp:" + pattern)
+	}
+}
+
+// ip adds value if it is an IP or CIDR.
+func (p *parsed) ip(value string) bool {
+	value = strings.TrimSpace(value)
+	if _, n, err := net.ParseCIDR(value); err == nil {
+		value = n.String()
+	} else if net.ParseIP(value) == nil {
+		return false
+	}
+	if !p.seen[value] {
+		p.seen[value] = true
+		p.ips = append(p.ips, value)
+	}
+	return true
+}
+
+func (p *parsed) add(rule string) {
+	if !p.seen[rule] {
+		p.seen[rule] = true
+		p.domains = append(p.domains, rule)
+	}
+}
+
+func validDomain(d string) bool {
+	if d == "" || len(d) > 253 || d[0] == '.' || strings.Contains(d, "..") {
+		return false
+	}
+	for i := 0; i < len(d); i++ {
+		c := d[i]
+		if !(c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '-' || c == '.' || c == '_') {
+			return false
+		}
+	}
+	return true
+}
+
+func eachLine(data []byte, fn func(line string)) {
+	sc := bufio.NewScanner(bytes.NewReader(data))
+	sc.Buffer(make([]byte, 64*1024), 1024*1024)
+	for sc.Scan() {
+		if line := strings.TrimSpace(sc.Text()); line != "" {
+			fn(line)
+		}
+	}
+}
+
+// plainLine takes one entry per line: a domain, optionally with a rule
+// prefix, an IP or CIDR, or a hosts file line.
+func (p *parsed) plainLine(line string) {
+	if line[0] == '#' || strings.HasPrefix(line, "//") {
+		return
+	}
+	if i := strings.Index(line, " #"); i >= 0 {
+		line = line[:i]
+	}
+	fields := strings.Fields(line)
+	entry := fields[0]
+	switch {
+	case len(fields) > 1 && net.ParseIP(entry) != nil:
+		entry = fields[1] // hosts file
+	case len(fields) > 1:
+		return
+	case p.ip(entry):
+		return
+	}
+
+	lower := strings.ToLower(entry)
+	switch {
+	case strings.HasPrefix(lower, "regexp:"):
+		p.regexp(entry[len("regexp:"):])
+	case strings.HasPrefix(lower, "keyword:"):
+		p.keyword(entry[len("keyword:"):])
+	case strings.HasPrefix(lower, "full:"):
+		p.domain("full:", entry[len("full:"):])
+	default:
+		entry = strings.TrimPrefix(lower, "domain:")
+		entry = strings.TrimPrefix(entry, "*.")
+		p.domain("", strings.TrimPrefix(entry, "."))
+	}
+}
+
+// dnsmasqLine takes the domains of server=/a/b/addr, address=, local=,
+// ipset= and nftset= lines.
+func (p *parsed) dnsmasqLine(line string) {
+	key, value, ok := strings.Cut(line, "=")
+	if !ok {
+		return
+	}
+	switch strings.TrimSpace(key) {
+	case "server", "local", "address", "ipset", "nftset":
+	default:
+		return
+	}
+	parts := strings.Split(strings.TrimSpace(value), "/")
+	if len(parts) < 3 || parts[0] != "" {
+		return
+	}
+	for _, d := range parts[1 : len(parts)-1] {
+		d = strings.TrimPrefix(strings.TrimPrefix(d, "*"), ".")
+		p.domain("", d)
+	}
+}
+
+// clash reads a rule provider: YAML with a payload list, or the text
+// format with one entry per line. Entries are classical rules
+// ("DOMAIN-SUFFIX,example.com") or domain and ipcidr behavior entries.
+func (p *parsed) clash(data []byte) {
+	var items []string
+	inPayload, yaml := false, false
+	eachLine(data, func(line string) {
+		if line[0] == '#' {
+			return
+		}
+		if strings.HasPrefix(line, "payload:") {
+			inPayload, yaml = true, true
+			if rest := strings.TrimSpace(line[len("payload:"):]); strings.HasPrefix(rest, "[") {
+				// Flow style: payload: ['a', 'b']
+				for _, it := range strings.Split(strings.Trim(rest, "[]"), ",") {
+					items = append(items, unquote(it))
+				}
+				inPayload = false
+			}
+			return
+		}
+		if yaml {
+			if inPayload && strings.HasPrefix(line, "-") {
+				items = append(items, unquote(strings.TrimSpace(line[1:])))
+			} else if !strings.HasPrefix(line, "-") {
+				inPayload = false
+			}
+			return
+		}
+		items = append(items, line)
+	})
+
+	for _, it := range items {
+		if it == "" {
+			continue
+		}
+		if typ, rest, ok := strings.Cut(it, ","); ok {
+			value, _, _ := strings.Cut(rest, ",")
+			switch strings.ToUpper(strings.TrimSpace(typ)) {
+			case "DOMAIN":
+				p.domain("full:", value)
+			case "DOMAIN-SUFFIX":
+				p.domain("", strings.TrimPrefix(strings.TrimSpace(value), "."))
+			case "DOMAIN-KEYWORD":
+				p.keyword(value)
+			case "DOMAIN-REGEX":
+				p.regexp(strings.TrimSpace(value))
+			case "IP-CIDR", "IP-CIDR6":
+				p.ip(value)
+			}
+			continue
+		}
+		switch {
+		case p.ip(it):
+		case strings.HasPrefix(it, "+."):
+			p.domain("", it[2:])
+		case strings.HasPrefix(it, "*."):
+			// Exactly one label in front
+			if d := strings.ToLower(it[2:]); validDomain(d) {
+				p.regexp(`^[^.]+\.` + regexp.QuoteMeta(d) + `$`)
+			}
+		case strings.HasPrefix(it, "."):
+			p.domain("", it[1:])
+		default:
+			p.domain("full:", it)
+		}
+	}
+}
+
+func unquote(s string) string {
+	s = strings.TrimSpace(s)
+	if i := strings.Index(s, " #"); i >= 0 {
+		s = strings.TrimSpace(s[:i])
+	}
+	if len(s) >= 2 && (s[0] == '\'' || s[0] == '"') && s[len(s)-1] == s[0] {
+		s = s[1 : len(s)-1]
+	}
+	return s
+}
+
+// singBoxJSON reads a sing-box source rule set. Logical and inverted rules
+// are skipped.
+func (p *parsed) singBoxJSON(data []byte) error {
+	var rs struct {
+		Rules []struct {
+			Type          string      `json:"type"`
+			Invert        bool        `json:"invert"`
+			Domain        stringOrArr `json:"domain"`
+			DomainSuffix  stringOrArr `json:"domain_suffix"`
+			DomainKeyword stringOrArr `json:"domain_keyword"`
+			DomainRegex   stringOrArr `json:"domain_regex"`
+			IPCIDR        stringOrArr `json:"ip_cidr"`
+		} `json:"rules"`
+	}
+	if err := json.Unmarshal(data, &rs); err != nil {
+		return fmt.Errorf("invalid sing-box rule set: %w", err)
+	}
+	for _, r := range rs.Rules {
+		if r.Invert || (r.Type != "" && r.Type != "default") {
+			continue
+		}
+		p.singBoxRule(r.Domain, r.DomainSuffix, r.DomainKeyword, r.DomainRegex)
+		for _, c := range r.IPCIDR {
+			p.ip(c)
+		}
+	}
+	return nil
+}
+
+func (p *parsed) singBoxRule(domain, suffix, keyword, regex []string) {
+	for _, d := range domain {
+		p.domain("full:", d)
+	}
+	for _, d := range suffix {
+		p.domain("", strings.TrimPrefix(d, "."))
+	}
+	for _, k := range keyword {
+		p.keyword(k)
+	}
+	for _, r := range regex {
+		p.regexp(r)
+	}
+}
+
+type stringOrArr []string
+
+func (s *stringOrArr) UnmarshalJSON(b []byte) error {
+	var one string
+	if err := json.Unmarshal(b, &one); err == nil {
+		*s = []string{one}
+		return nil
+	}
+	var many []string
+	if err := json.Unmarshal(b, &many); err != nil {
+		return err
+	}
+	*s = many
+	return nil
+}
+
+// adguardLine takes the domain blocking rules of an AdGuard or Adblock
+// style filter: ||example.com^, /regex/, hosts lines and plain domains.
+// Exceptions and rules limited to paths or with wildcards are skipped.
+func (p *parsed) adguardLine(line string) {
+	switch {
+	case line[0] == '!' || line[0] == '#' || line[0] == '[' || strings.HasPrefix(line, "@@"):
+		return
+	case len(line) > 2 && line[0] == '/' && line[len(line)-1] == '/':
+		p.regexp(line[1 : len(line)-1])
+		return
+	}
+
+	if i := strings.IndexByte(line, '$'); i >= 0 {
+		line = line[:i]
+	}
+	if fields := strings.Fields(line); len(fields) > 1 && net.ParseIP(fields[0]) != nil {
+		p.domain("", fields[1]) // hosts file
+		return
+	}
+
+	d := strings.TrimPrefix(line, "||")
+	d = strings.TrimPrefix(d, "*.")
+	d = strings.TrimSuffix(d, "^")
+	d = strings.TrimSuffix(d, "^|")
+	if strings.ContainsAny(d, "/*|^:") {
+		return
+	}
+	p.domain("", d)
+}
@@ -0,0 +1,120 @@
+package lists
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		name    string
+		format  string
+		data    string
+		domains []string
+		ips     []string
+	}{
+		{
+			name:   "plain",
+			format: FormatPlain,
+			data: `# comment
+Example.com.
+*.wildcard.org
+full:exact.net
+keyword:tracker
+regexp:^ads\d+\.
+0.0.0.0 hosts.example # hosts file
+10.0.0.0/8
+2001:db8::1
+not a/domain
+example.com`,
+			domains: []string{"example.com", "wildcard.org", "full:exact.net", "keyword:tracker", `regexp:^ads\d+\.`, "hosts.example"},
+			ips:     []string{"10.0.0.0/8", "2001:db8::1"},
+		},
+		{
+			name:   "dnsmasq",
+			format: FormatDnsmasq,
+			data: `server=/a.com/b.org/127.0.0.1#5353
+ipset=/.c.net/list
+address=/d.io/0.0.0.0
+no-resolv
+server=8.8.8.8`,
+			domains: []string{"a.com", "b.org", "c.net", "d.io"},
+		},
+		{
+			name:   "clash classical",
+			format: FormatClash,
+			data: `payload:
+  - DOMAIN,exact.com
+  - DOMAIN-SUFFIX,suffix.com
+  - DOMAIN-KEYWORD,word
+  - IP-CIDR,1.2.3.0/24,no-resolve
+  - PROCESS-NAME,curl
+other: 1`,
+			domains: []string{"full:exact.com", "suffix.com", "keyword:word"},
+			ips:     []string{"1.2.3.0/24"},
+		},
+		{
+			name:   "clash domain behavior",
+			format: FormatClash,
+			data: `payload:
+  - '+.suffix.com'
+  - "exact.com"
+  - '*.one.com'
+  - '.dot.com'`,
+			domains: []string{"suffix.com", "full:exact.com", `regexp:^[^.]+\.one\.com$`, "dot.com"},
+		},
+		{
+			name:    "clash text",
+			format:  FormatClash,
+			data:    "+.suffix.com\n192.168.0.0/16\n",
+			domains: []string{"suffix.com"},
+			ips:     []string{"192.168.0.0/16"},
+		},
+		{
+			name:   "sing-box json",
+			format: FormatSingBox,
+			data: `{"version": 2, "rules": [
+  {"domain": "exact.com", "domain_suffix": [".suffix.com", "other.com"], "domain_keyword": ["word"], "ip_cidr": ["8.8.8.8/32"]},
+  {"domain": ["inverted.com"], "invert": true},
+  {"type": "logical", "mode": "and", "rules": []}
+]}`,
+			domains: []string{"full:exact.com", "suffix.com", "other.com", "keyword:word"},
+			ips:     []string{"8.8.8.8/32"},
+		},
+		{
+			name:   "adguard",
+			format: FormatAdGuard,
+			data: `! Title: filter
+[Adblock Plus 2.0]
+||ads.example.com^
+||third.example.org^$third-party
+@@||allowed.com^
+||path.com/banner
+/^track[0-9]+\./
+0.0.0.0 hosts.example
+plain.net`,
+			domains: []string{"ads.example.com", "third.example.org", `regexp:^track[0-9]+\.`, "hosts.example", "plain.net"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			domains, ips, err := Parse(tt.format, []byte(tt.data))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(domains, tt.domains) {
+				t.Errorf("domains = %q, want %q", domains, tt.domains)
+			}
+			if !reflect.DeepEqual(ips, tt.ips) {
+				t.Errorf("ips = %q, want %q", ips, tt.ips)
+			}
+		})
+	}
+}
+
+func TestParseUnknownFormat(t *testing.T) {
+	if _, _, err := Parse("hosts", []byte("example.com")); err == nil {
+		t.Fatal("want error for unknown format")
+	}
+}
@@ -0,0 +1,375 @@
+package lists
+
+import (
+	"bufio"
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net/netip"
+	"strings"
+)
+
+// sing-box binary rule sets (.srs): "SRS", a version byte, then a zlib
+// stream of rules. Every rule item starts with its type byte.
+var srsMagic = []byte("SRS")
+
+const (
+	srsItemQueryType uint8 = iota
+	srsItemNetwork
+	srsItemDomain
+	srsItemDomainKeyword
+	srsItemDomainRegex
+	srsItemSourceIPCIDR
+	srsItemIPCIDR
+	srsItemSourcePort
+	srsItemSourcePortRange
+	srsItemPort
+	srsItemPortRange
+	srsItemProcessName
+	srsItemProcessPath
+	srsItemPackageName
+	srsItemWIFISSID
+	srsItemWIFIBSSID
+	srsItemAdGuardDomain
+	srsItemProcessPathRegex
+	srsItemNetworkType
+	srsItemNetworkIsExpensive
+	srsItemNetworkIsConstrained
+
+	srsItemFinal uint8 = 0xff
+)
+
+// Keys of the domain matcher are stored reversed. Suffix entries carry a
+// label byte below the printable range in front of the domain.
+const srsLabelLimit = 0x20
+
+// Sizes past these are a corrupt file rather than a big list
+const (
+	srsMaxItems = 1 << 24
+	srsMaxDepth = 16
+)
+
+var errSRSAdGuard = errors.New("AdGuard rules in binary rule sets are not supported")
+
+func (p *parsed) srs(data []byte) error {
+	r := bytes.NewReader(data[len(srsMagic):])
+	version, err := r.ReadByte()
+	if err != nil {
+		return fmt.Errorf("invalid rule set: %w", err)
+	}
+	if version < 1 || version > 4 {
+		return fmt.Errorf("unsupported rule set version %d", version)
+	}
+	z, err := zlib.NewReader(r)
+	if err != nil {
+		return fmt.Errorf("invalid rule set: %w", err)
+	}
+	defer z.Close()
+
+	br := bufio.NewReader(z)
+	n, err := readCount(br)
+	if err != nil {
+		return fmt.Errorf("invalid rule set: %w", err)
+	}
+	for i := uint64(0); i < n; i++ {
+		if err := p.srsRule(br, true, 0); err != nil {
+			return fmt.Errorf("invalid rule set, rule %d: %w", i, err)
+		}
+	}
+	return nil
+}
+
+// srsRule reads one rule. Only plain, non-inverted rules at the top level
+// become targets, the others are read past.
+func (p *parsed) srsRule(r *bufio.Reader, use bool, depth int) error {
+	if depth > srsMaxDepth {
+		return errors.New("rules nested too deep")
+	}
+	typ, err := r.ReadByte()
+	if err != nil {
+		return err
+	}
+	switch typ {
+	case 0:
+		return p.srsDefaultRule(r, use)
+	case 1:
+		if _, err := r.ReadByte(); err != nil { // mode
+			return err
+		}
+		n, err := readCount(r)
+		if err != nil {
+			return err
+		}
+		for i := uint64(0); i < n; i++ {
+			if err := p.srsRule(r, false, depth+1); err != nil {
+				return err
+			}
+		}
+		_, err = r.ReadByte() // invert
+		return err
+	default:
+		return fmt.Errorf("unknown rule type %d", typ)
+	}
+}
+
+func (p *parsed) srsDefaultRule(r *bufio.Reader, use bool) error {
+	var domains, suffixes, keywords, regexes []string
+	var cidrs []netip.Prefix
+
+	for {
+		item, err := r.ReadByte()
+		if err != nil {
+			return err
+		}
+		switch item {
+		case srsItemDomain:
+			keys, err := readSuccinctKeys(r)
+			if err != nil {
+				return err
+			}
+			for _, k := range keys {
+				k = reverse(k)
+				if k[0] < srsLabelLimit {
+					suffixes = append(suffixes, strings.TrimPrefix(k[1:], "."))
+				} else {
+					domains = append(domains, k)
+				}
+			}
+		case srsItemDomainKeyword:
+			if keywords, err = readStrings(r); err != nil {
+				return err
+			}
+		case srsItemDomainRegex:
+			if regexes, err = readStrings(r); err != nil {
+				return err
+			}
+		case srsItemIPCIDR:
+			if cidrs, err = readIPSet(r); err != nil {
+				return err
+			}
+		case srsItemSourceIPCIDR:
+			if _, err = readIPSet(r); err != nil {
+				return err
+			}
+		case srsItemQueryType, srsItemSourcePort, srsItemPort:
+			if err = skipUint16s(r); err != nil {
+				return err
+			}
+		case srsItemNetwork, srsItemSourcePortRange, srsItemPortRange, srsItemProcessName,
+			srsItemProcessPath, srsItemPackageName, srsItemWIFISSID, srsItemWIFIBSSID,
+			srsItemProcessPathRegex:
+			if _, err = readStrings(r); err != nil {
+				return err
+			}
+		case srsItemNetworkType:
+			if _, err = readBytes(r); err != nil {
+				return err
+			}
+		case srsItemNetworkIsExpensive, srsItemNetworkIsConstrained:
+		case srsItemAdGuardDomain:
+			return errSRSAdGuard
+		case srsItemFinal:
+			invert, err := r.ReadByte()
+			if err != nil {
+				return err
+			}
+			if use && invert == 0 {
+				p.singBoxRule(domains, suffixes, keywords, regexes)
+				for _, c := range cidrs {
+					p.ip(c.String())
+				}
+			}
+			return nil
+		default:
+			return fmt.Errorf("unknown rule item %d", item)
+		}
+	}
+}
+
+func readCount(r *bufio.Reader) (uint64, error) {
+	n, err := binary.ReadUvarint(r)
+	if err == nil && n > srsMaxItems {
+		err = fmt.Errorf("count %d out of range", n)
+	}
+	return n, err
+}
+
+func readBytes(r *bufio.Reader) ([]byte, error) {
+	n, err := readCount(r)
+	if err != nil {
+		return nil, err
+	}
+	b := make([]byte, n)
+	_, err = io.ReadFull(r, b)
+	return b, err
+}
+
+func readStrings(r *bufio.Reader) ([]string, error) {
+	n, err := readCount(r)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]string, 0, n)
+	for i := uint64(0); i < n; i++ {
+		b, err := readBytes(r)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, string(b))
+	}
+	return out, nil
+}
+
+func skipUint16s(r *bufio.Reader) error {
+	n, err := readCount(r)
+	if err != nil {
+		return err
+	}
+	_, err = r.Discard(int(n) * 2)
+	return err
+}
+
+func readUint64s(r *bufio.Reader) ([]uint64, error) {
+	n, err := readCount(r)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]uint64, n)
+	for i := range out {
+		var b [8]byte
+		if _, err := io.ReadFull(r, b[:]); err != nil {
+			return nil, err
+		}
+		out[i] = binary.BigEndian.Uint64(b[:])
+	}
+	return out, nil
+}
+
+// readIPSet reads a version byte, a big endian range count and the from
+// and to address of every range.
+func readIPSet(r *bufio.Reader) ([]netip.Prefix, error) {
+	if v, err := r.ReadByte(); err != nil {
+		return nil, err
+	} else if v != 1 {
+		return nil, fmt.Errorf("unknown IP set version %d", v)
+	}
+	var b [8]byte
+	if _, err := io.ReadFull(r, b[:]); err != nil {
+		return nil, err
+	}
+	n := binary.BigEndian.Uint64(b[:])
+	if n > srsMaxItems {
+		return nil, fmt.Errorf("count %d out of range", n)
+	}
+
+	var out []netip.Prefix
+	for i := uint64(0); i < n; i++ {
+		fromB, err := readBytes(r)
+		if err != nil {
+			return nil, err
+		}
+		toB, err := readBytes(r)
+		if err != nil {
+			return nil, err
+		}
+		from, ok1 := netip.AddrFromSlice(fromB)
+		to, ok2 := netip.AddrFromSlice(toB)
+		if !ok1 || !ok2 || from.BitLen() != to.BitLen() || to.Less(from) {
+			return nil, errors.New("invalid IP range")
+		}
+		out = append(out, rangePrefixes(from, to)...)
+	}
+	return out, nil
+}
+
+// rangePrefixes splits the address range from-to into CIDRs.
+func rangePrefixes(from, to netip.Addr) []netip.Prefix {
+	var out []netip.Prefix
+	for {
+		bits := from.BitLen()
+		for bits > 0 {
+			p := netip.PrefixFrom(from, bits-1).Masked()
+			if p.Addr() != from || lastAddr(p).Compare(to) > 0 {
+				break
+			}
+			bits--
+		}
+		p := netip.PrefixFrom(from, bits)
+		out = append(out, p)
+		last := lastAddr(p)
+		if last.Compare(to) >= 0 {
+			return out
+		}
+		from = last.Next()
+	}
+}
+
+func lastAddr(p netip.Prefix) netip.Addr {
+	b := p.Masked().Addr().AsSlice()
+	for i := p.Bits(); i < len(b)*8; i++ {
+		b[i/8] |= 0x80 >> (i % 8)
+	}
+	a, _ := netip.AddrFromSlice(b)
+	return a
+}
+
+// readSuccinctKeys reads the succinct trie of a domain matcher: a version
+// byte, the leaf and label bitmaps and the labels. Nodes are stored in
+// breadth-first order, the label bitmap holds a 0 per child and a 1 closing
+// each node, and the leaf bitmap marks nodes that end a key.
+func readSuccinctKeys(r *bufio.Reader) ([]string, error) {
+	if v, err := r.ReadByte(); err != nil {
+		return nil, err
+	} else if v != 1 {
+		return nil, fmt.Errorf("unknown domain matcher version %d", v)
+	}
+	leaves, err := readUint64s(r)
+	if err != nil {
+		return nil, err
+	}
+	bitmap, err := readUint64s(r)
+	if err != nil {
+		return nil, err
+	}
+	labels, err := readBytes(r)
+	if err != nil {
+		return nil, err
+	}
+
+	bit := func(bm []uint64, i int) bool {
+		return i>>6 < len(bm) && bm[i>>6]&(1<<(uint(i)&63)) != 0
+	}
+
+	paths := []string{""}
+	var keys []string
+	node, label := 0, 0
+	for pos := 0; node < len(paths); pos++ {
+		if pos >= len(bitmap)*64 {
+			return nil, errors.New("truncated domain matcher")
+		}
+		if bit(bitmap, pos) {
+			if bit(leaves, node) && paths[node] != "" {
+				keys = append(keys, paths[node])
+			}
+			node++
+			continue
+		}
+		if label >= len(labels) {
+			return nil, errors.New("truncated domain matcher")
+		}
+		paths = append(paths, paths[node]+string(labels[label]))
+		label++
+	}
+	return keys, nil
+}
+
+func reverse(s string) string {
+	b := []byte(s)
+	for i, j := 0, len(b)-1; i < j; i, j = i+1, j-1 {
+		b[i], b[j] = b[j], b[i]
+	}
+	return string(b)
+}
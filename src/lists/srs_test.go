@@ -0,0 +1,168 @@
+package lists
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"net/netip"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+type srsWriter struct{ bytes.Buffer }
+
+func (w *srsWriter) uvarint(n int) {
+	w.Write(binary.AppendUvarint(nil, uint64(n)))
+}
+
+func (w *srsWriter) bytes(b []byte) {
+	w.uvarint(len(b))
+	w.Write(b)
+}
+
+func (w *srsWriter) strings(items []string) {
+	w.uvarint(len(items))
+	for _, s := range items {
+		w.bytes([]byte(s))
+	}
+}
+
+func (w *srsWriter) uint64s(v []uint64) {
+	w.uvarint(len(v))
+	for _, x := range v {
+		w.Write(binary.BigEndian.AppendUint64(nil, x))
+	}
+}
+
+// succinct writes keys as a breadth-first trie, the way the sing-box
+// domain matcher stores them.
+func (w *srsWriter) succinct(keys []string) {
+	sort.Strings(keys)
+	var leaves, bitmap []uint64
+	var labels []byte
+	set := func(bm *[]uint64, i int) {
+		for len(*bm) <= i>>6 {
+			*bm = append(*bm, 0)
+		}
+		(*bm)[i>>6] |= 1 << (uint(i) & 63)
+	}
+
+	type node struct{ keys []string }
+	queue := []node{{keys}}
+	pos := 0
+	for n := 0; n < len(queue); n++ {
+		var children []node
+		for _, k := range queue[n].keys {
+			if k == "" {
+				set(&leaves, n)
+				continue
+			}
+			if len(children) == 0 || labels[len(labels)-1] != k[0] {
+				children = append(children, node{})
+				labels = append(labels, k[0])
+				pos++
+			}
+			c := &children[len(children)-1]
+			c.keys = append(c.keys, k[1:])
+		}
+		set(&bitmap, pos)
+		pos++
+		queue = append(queue, children...)
+	}
+	w.WriteByte(1)
+	w.uint64s(leaves)
+	w.uint64s(bitmap)
+	w.bytes(labels)
+}
+
+func (w *srsWriter) ipRanges(ranges [][2]string) {
+	w.WriteByte(1)
+	w.Write(binary.BigEndian.AppendUint64(nil, uint64(len(ranges))))
+	for _, r := range ranges {
+		w.bytes(netip.MustParseAddr(r[0]).AsSlice())
+		w.bytes(netip.MustParseAddr(r[1]).AsSlice())
+	}
+}
+
+func encodeSRS(body []byte) []byte {
+	var out bytes.Buffer
+	out.Write(srsMagic)
+	out.WriteByte(3)
+	z := zlib.NewWriter(&out)
+	z.Write(body)
+	z.Close()
+	return out.Bytes()
+}
+
+func TestParseSRS(t *testing.T) {
+	var w srsWriter
+	w.uvarint(3)
+
+	// Default rule with every kind of target
+	w.WriteByte(0)
+	w.WriteByte(srsItemDomain)
+	w.succinct([]string{
+		reverse("exact.com"),
+		reverse("\x01.suffix.com"),
+		reverse("\x01.example.org"),
+		reverse("www.example.org"),
+	})
+	w.WriteByte(srsItemDomainKeyword)
+	w.strings([]string{"word"})
+	w.WriteByte(srsItemPort)
+	w.uvarint(1)
+	w.Write([]byte{0x01, 0xbb})
+	w.WriteByte(srsItemIPCIDR)
+	w.ipRanges([][2]string{{"10.0.0.0", "10.0.1.255"}, {"192.168.0.1", "192.168.0.6"}})
+	w.WriteByte(srsItemFinal)
+	w.WriteByte(0)
+
+	// Inverted rule is skipped
+	w.WriteByte(0)
+	w.WriteByte(srsItemDomainKeyword)
+	w.strings([]string{"inverted"})
+	w.WriteByte(srsItemFinal)
+	w.WriteByte(1)
+
+	// Logical rule is skipped
+	w.WriteByte(1)
+	w.WriteByte(0) // mode
+	w.uvarint(1)
+	w.WriteByte(0)
+	w.WriteByte(srsItemDomainKeyword)
+	w.strings([]string{"logical"})
+	w.WriteByte(srsItemFinal)
+	w.WriteByte(0)
+	w.WriteByte(0) // invert
+
+	domains, ips, err := Parse(FormatSingBox, encodeSRS(w.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sort.Strings(domains)
+	wantDomains := []string{"example.org", "full:exact.com", "full:www.example.org", "keyword:word", "suffix.com"}
+	if !reflect.DeepEqual(domains, wantDomains) {
+		t.Errorf("domains = %q, want %q", domains, wantDomains)
+	}
+	wantIPs := []string{"10.0.0.0/23", "192.168.0.1/32", "192.168.0.2/31", "192.168.0.4/31", "192.168.0.6/32"}
+	if !reflect.DeepEqual(ips, wantIPs) {
+		t.Errorf("ips = %q, want %q", ips, wantIPs)
+	}
+}
+
+func TestParseSRSInvalid(t *testing.T) {
+	tests := map[string][]byte{
+		"truncated":   []byte("SRS"),
+		"version":     append([]byte("SRS"), 9),
+		"not zlib":    append([]byte("SRS"), 1, 0, 1, 2),
+		"truncated z": encodeSRS([]byte{1, 0, srsItemDomain}),
+		"adguard":     encodeSRS([]byte{1, 0, srsItemAdGuardDomain}),
+	}
+	for name, data := range tests {
+		if _, _, err := Parse(FormatSingBox, data); err == nil {
+			t.Errorf("%s: want error", name)
+		}
+	}
+}
@@ -14,8 +14,12 @@ import (
 	"time"
 
 	"github.com/daniellavrushin/b4/config"
+	"github.com/daniellavrushin/b4/connlog"
+	"github.com/daniellavrushin/b4/discovery"
+	"github.com/daniellavrushin/b4/geodat"
 	b4http "github.com/daniellavrushin/b4/http"
 	"github.com/daniellavrushin/b4/http/handler"
+	"github.com/daniellavrushin/b4/lists"
 	"github.com/daniellavrushin/b4/log"
 	"github.com/daniellavrushin/b4/nfq"
 	"github.com/daniellavrushin/b4/quic"
@@ -98,6 +102,10 @@ func runB4(cmd *cobra.Command, args []string) error {
 
 	printConfigDefaults(cmd)
 
+	if err := connlog.Configure(cfg.System.Logging.Connections); err != nil {
+		log.Errorf("Failed to open connection history: %v", err)
+	}
+
 	// Initialize metrics collector early
 	metrics := handler.GetMetricsCollector()
 	metrics.RecordEvent("info", "B4 starting up")
@@ -143,6 +151,30 @@ func runB4(cmd *cobra.Command, args []string) error {
 	metrics.RecordEvent("info", fmt.Sprintf("NFQueue started with %d threads", cfg.Queue.Threads))
 	metrics.NFQueueStatus = "active"
 
+	// Keep the geodata files up to date, rebuilding the matcher on changes
+	geodata := geodat.NewGeodataManager(cfg.System.Geo.GeoSitePath, cfg.System.Geo.GeoIpPath)
+	handler.SetGeodataManager(geodata)
+	geodata.StartUpdater(func() geodat.UpdateSettings {
+		return pool.GetFirstWorkerConfig().GeoUpdateSettings()
+	}, func() {
+		metrics.RecordEvent("info", "Geodata files updated")
+		if err := pool.ReloadTargets(); err != nil {
+			log.Errorf("Failed to reload geodata targets: %v", err)
+		}
+	})
+
+	// Keep subscribed lists up to date, rebuilding the matcher on changes
+	lists.Start(cfg.ListsDir(), func() []lists.Subscription {
+		return pool.GetFirstWorkerConfig().ListSubscriptions()
+	}, func() {
+		if err := pool.ReloadTargets(); err != nil {
+			log.Errorf("Failed to reload list subscriptions: %v", err)
+		}
+	})
+
+	// Re-validate sets that have health checks enabled
+	discovery.StartHealthChecks(pool)
+
 	// Start tables monitor to handle rule restoration if system wipes them
 	var tablesMonitor *tables.Monitor
 	if !cfg.System.Tables.SkipSetup && cfg.System.Tables.MonitorInterval > 0 {
@@ -168,6 +200,10 @@ func runB4(cmd *cobra.Command, args []string) error {
 	log.Infof("Received signal: %v, shutting down gracefully", sig)
 	metrics.RecordEvent("info", fmt.Sprintf("Shutdown initiated by signal: %v", sig))
 
+	// No geodata swaps while shutting down
+	geodata.StopUpdater()
+	discovery.StopHealthChecks()
+
 	// Perform graceful shutdown with timeout
 	return gracefulShutdown(&cfg, pool, httpServer, metrics)
 }
@@ -281,6 +317,8 @@ func gracefulShutdown(cfg *config.Config, pool *nfq.Pool, httpServer *http.Serve
 		os.Exit(1)
 	}
 
+	lists.Stop()
+	connlog.Close()
 	log.CloseErrorFile()
 	log.Flush()
 	return nil
@@ -196,6 +196,7 @@ func (m *MetricsCollector) RecordConnection(protocol, domain, source, destinatio
 	if isTarget {
 		m.TargetedConnections++
 	}
+	exporter.recordConnection(hostSet, protocol)
 
 	if domain != "" {
 		m.TopDomains[domain]++
@@ -334,6 +335,8 @@ func (m *MetricsCollector) ResetStats() {
 	m.lastConnCount = 0
 	m.lastPacketCount = 0
 	m.Uptime = "0s"
+
+	exporter.reset()
 }
 
 func (m *MetricsCollector) CloseConnection() {
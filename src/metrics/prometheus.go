@@ -0,0 +1,345 @@
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Content types served by the /metrics endpoint.
+const (
+	PrometheusContentType  = "text/plain; version=0.0.4; charset=utf-8"
+	OpenMetricsContentType = "application/openmetrics-text; version=1.0.0; charset=utf-8"
+)
+
+// injectionBuckets are the upper bounds (seconds) of the injection latency
+// histogram. Most strategies finish in well under a millisecond; the upper
+// buckets catch configured segment delays and post-desync sleeps.
+var injectionBuckets = []float64{0.0001, 0.0005, 0.001, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1}
+
+type connKey struct {
+	set      string
+	protocol string
+}
+
+type switchKey struct {
+	set     string
+	variant string
+}
+
+type histogram struct {
+	counts []uint64 // per bucket, not cumulative
+	count  uint64
+	sum    float64
+}
+
+// exporterState holds the labeled series that have no place in the JSON
+// snapshot. It is kept apart from MetricsCollector so per-packet updates do
+// not contend with the dashboard lock.
+type exporterState struct {
+	mu sync.Mutex
+
+	connections     map[connKey]uint64
+	queueOverflows  map[uint16]uint64
+	verdictFailures map[uint16]uint64
+	injections      map[string]*histogram
+	switches        map[switchKey]uint64
+}
+
+var exporter = newExporterState()
+
+func newExporterState() *exporterState {
+	return &exporterState{
+		connections:     make(map[connKey]uint64),
+		queueOverflows:  make(map[uint16]uint64),
+		verdictFailures: make(map[uint16]uint64),
+		injections:      make(map[string]*histogram),
+		switches:        make(map[switchKey]uint64),
+	}
+}
+
+// queueCounters counts the packets of each queue of the pool. The queues are
+// fixed when the workers start, so every packet is counted without a lock.
+type queueCounters struct {
+	start   uint16
+	packets []atomic.Uint64
+}
+
+var queueStats atomic.Pointer[queueCounters]
+
+// SetQueues sets up the packet counters of queues start to start+n-1.
+// Packets of other queues are not counted.
+func SetQueues(start uint16, n int) {
+	queueStats.Store(&queueCounters{start: start, packets: make([]atomic.Uint64, n)})
+}
+
+// counts returns the packet count of every queue.
+func (qs *queueCounters) counts() map[uint16]uint64 {
+	out := make(map[uint16]uint64)
+	if qs == nil {
+		return out
+	}
+	for i := range qs.packets {
+		out[qs.start+uint16(i)] = qs.packets[i].Load()
+	}
+	return out
+}
+
+func (e *exporterState) recordConnection(set, protocol string) {
+	e.mu.Lock()
+	e.connections[connKey{set: set, protocol: protocol}]++
+	e.mu.Unlock()
+}
+
+// RecordQueuePacket counts a packet received on an NFQUEUE.
+func RecordQueuePacket(queue uint16) {
+	qs := queueStats.Load()
+	if qs == nil {
+		return
+	}
+	if i := int(queue) - int(qs.start); i >= 0 && i < len(qs.packets) {
+		qs.packets[i].Add(1)
+	}
+}
+
+// RecordQueueOverflow counts an ENOBUFS reported by the netlink socket of a
+// queue, i.e. the kernel dropped packets because the worker fell behind.
+func RecordQueueOverflow(queue uint16) {
+	exporter.mu.Lock()
+	exporter.queueOverflows[queue]++
+	exporter.mu.Unlock()
+}
+
+// RecordVerdictFailure counts a failed SetVerdict call on a queue.
+func RecordVerdictFailure(queue uint16) {
+	exporter.mu.Lock()
+	exporter.verdictFailures[queue]++
+	exporter.mu.Unlock()
+}
+
+// RecordStrategySwitch counts a domain of the set being moved to another
+// strategy variant after repeated failures.
+func RecordStrategySwitch(set, variant string) {
+	exporter.mu.Lock()
+	exporter.switches[switchKey{set: set, variant: variant}]++
+	exporter.mu.Unlock()
+}
+
+// ObserveInjection records how long a strategy took to inject a packet.
+// It is meant to be deferred: defer metrics.ObserveInjection(name, time.Now()).
+func ObserveInjection(strategy string, start time.Time) {
+	d := time.Since(start).Seconds()
+
+	exporter.mu.Lock()
+	defer exporter.mu.Unlock()
+
+	h := exporter.injections[strategy]
+	if h == nil {
+		h = &histogram{counts: make([]uint64, len(injectionBuckets))}
+		exporter.injections[strategy] = h
+	}
+	for i, le := range injectionBuckets {
+		if d <= le {
+			h.counts[i]++
+			break
+		}
+	}
+	h.count++
+	h.sum += d
+}
+
+func (e *exporterState) reset() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.connections = make(map[connKey]uint64)
+	if qs := queueStats.Load(); qs != nil {
+		for i := range qs.packets {
+			qs.packets[i].Store(0)
+		}
+	}
+	e.queueOverflows = make(map[uint16]uint64)
+	e.verdictFailures = make(map[uint16]uint64)
+	e.injections = make(map[string]*histogram)
+	e.switches = make(map[switchKey]uint64)
+}
+
+// WritePrometheus writes all metrics in the Prometheus text exposition
+// format, or in OpenMetrics format when openMetrics is set.
+func (m *MetricsCollector) WritePrometheus(w io.Writer, openMetrics bool) error {
+	snap := m.GetSnapshot()
+	p := &promWriter{w: bufio.NewWriter(w), openMetrics: openMetrics}
+
+	p.counter("b4_packets", "Packets processed by the queue workers.", snap.PacketsProcessed)
+	p.counter("b4_bytes", "Bytes processed by the queue workers.", snap.BytesProcessed)
+	p.counter("b4_targeted_connections", "Connections matched by a set.", snap.TargetedConnections)
+	p.gauge("b4_active_flows", "Currently tracked flows.", float64(snap.ActiveFlows))
+	p.gauge("b4_uptime_seconds", "Seconds since the collector started.", time.Since(snap.StartTime).Seconds())
+
+	p.family("b4_protocol_connections", "counter", "Connections by protocol.")
+	for _, proto := range sortedKeys(snap.ProtocolDist) {
+		p.sample("b4_protocol_connections_total", labels("protocol", proto), float64(snap.ProtocolDist[proto]))
+	}
+
+	p.family("b4_worker_packets", "counter", "Packets processed per worker, as last reported.")
+	for _, wh := range snap.WorkerStatus {
+		p.sample("b4_worker_packets_total", labels("worker", strconv.Itoa(wh.ID), "status", wh.Status), float64(wh.Processed))
+	}
+
+	exporter.mu.Lock()
+	defer exporter.mu.Unlock()
+
+	p.family("b4_connections", "counter", "Connections by matched set and protocol.")
+	conns := make([]connKey, 0, len(exporter.connections))
+	for k := range exporter.connections {
+		conns = append(conns, k)
+	}
+	sort.Slice(conns, func(i, j int) bool {
+		if conns[i].set != conns[j].set {
+			return conns[i].set < conns[j].set
+		}
+		return conns[i].protocol < conns[j].protocol
+	})
+	for _, k := range conns {
+		p.sample("b4_connections_total", labels("set", k.set, "protocol", k.protocol), float64(exporter.connections[k]))
+	}
+
+	p.queueCounter("b4_queue_packets", "Packets received per NFQUEUE.", queueStats.Load().counts())
+	p.queueCounter("b4_queue_overflows", "ENOBUFS overflows reported per NFQUEUE.", exporter.queueOverflows)
+	p.queueCounter("b4_verdict_failures", "Failed verdicts per NFQUEUE.", exporter.verdictFailures)
+
+	p.family("b4_strategy_switches", "counter", "Domains moved to another strategy variant, by set and target variant.")
+	switches := make([]switchKey, 0, len(exporter.switches))
+	for k := range exporter.switches {
+		switches = append(switches, k)
+	}
+	sort.Slice(switches, func(i, j int) bool {
+		if switches[i].set != switches[j].set {
+			return switches[i].set < switches[j].set
+		}
+		return switches[i].variant < switches[j].variant
+	})
+	for _, k := range switches {
+		p.sample("b4_strategy_switches_total", labels("set", k.set, "variant", k.variant), float64(exporter.switches[k]))
+	}
+
+	p.family("b4_injection_duration_seconds", "histogram", "Time spent injecting packets, by strategy.")
+	strategies := make([]string, 0, len(exporter.injections))
+	for s := range exporter.injections {
+		strategies = append(strategies, s)
+	}
+	sort.Strings(strategies)
+	for _, s := range strategies {
+		h := exporter.injections[s]
+		var cum uint64
+		for i, le := range injectionBuckets {
+			cum += h.counts[i]
+			p.sample("b4_injection_duration_seconds_bucket", labels("strategy", s, "le", formatFloat(le)), float64(cum))
+		}
+		p.sample("b4_injection_duration_seconds_bucket", labels("strategy", s, "le", "+Inf"), float64(h.count))
+		p.sample("b4_injection_duration_seconds_count", labels("strategy", s), float64(h.count))
+		p.sample("b4_injection_duration_seconds_sum", labels("strategy", s), h.sum)
+	}
+
+	if openMetrics {
+		p.line("# EOF")
+	}
+	return p.flush()
+}
+
+type promWriter struct {
+	w           *bufio.Writer
+	openMetrics bool
+	err         error
+}
+
+func (p *promWriter) line(format string, args ...interface{}) {
+	if p.err != nil {
+		return
+	}
+	_, p.err = fmt.Fprintf(p.w, format+"\n", args...)
+}
+
+// family writes the HELP and TYPE lines. Prometheus text format names
+// counter families with their _total suffix, OpenMetrics without it.
+func (p *promWriter) family(name, typ, help string) {
+	if typ == "counter" && !p.openMetrics {
+		name += "_total"
+	}
+	p.line("# HELP %s %s", name, help)
+	p.line("# TYPE %s %s", name, typ)
+}
+
+func (p *promWriter) sample(name, lbls string, v float64) {
+	p.line("%s%s %s", name, lbls, formatFloat(v))
+}
+
+func (p *promWriter) counter(name, help string, v uint64) {
+	p.family(name, "counter", help)
+	p.sample(name+"_total", "", float64(v))
+}
+
+func (p *promWriter) gauge(name, help string, v float64) {
+	p.family(name, "gauge", help)
+	p.sample(name, "", v)
+}
+
+func (p *promWriter) queueCounter(name, help string, values map[uint16]uint64) {
+	p.family(name, "counter", help)
+	queues := make([]int, 0, len(values))
+	for q := range values {
+		queues = append(queues, int(q))
+	}
+	sort.Ints(queues)
+	for _, q := range queues {
+		p.sample(name+"_total", labels("queue", strconv.Itoa(q)), float64(values[uint16(q)]))
+	}
+}
+
+func (p *promWriter) flush() error {
+	if p.err != nil {
+		return p.err
+	}
+	return p.w.Flush()
+}
+
+// labels formats name/value pairs as {a="x",b="y"}.
+func labels(pairs ...string) string {
+	var b strings.Builder
+	b.WriteByte('{')
+	for i := 0; i+1 < len(pairs); i += 2 {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(pairs[i])
+		b.WriteString(`="`)
+		b.WriteString(escapeLabel(pairs[i+1]))
+		b.WriteByte('"')
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeLabel(v string) string {
+	return labelEscaper.Replace(v)
+}
+
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+func sortedKeys(m map[string]uint64) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
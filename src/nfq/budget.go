@@ -0,0 +1,69 @@
+package nfq
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	flowBudgetTimeout = 120 * time.Second
+	flowBudgetMaxFlow = 65536
+)
+
+type flowCount struct {
+	packets  int
+	lastSeen time.Time
+}
+
+// flowBudgetTracker enforces per-set packet limits. The firewall queues up
+// to the highest ConnBytesLimit of all sets, so flows of sets with a lower
+// limit are passed through unchanged once they used up their own budget.
+type flowBudgetTracker struct {
+	mu    sync.Mutex
+	flows map[string]*flowCount
+}
+
+var flowBudget = &flowBudgetTracker{
+	flows: make(map[string]*flowCount),
+}
+
+// spend counts a packet of the flow and reports whether it is still within
+// limit. A non-positive limit disables the check.
+func (t *flowBudgetTracker) spend(connKey string, limit int) bool {
+	if limit <= 0 {
+		return true
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := time.Now()
+	fc, ok := t.flows[connKey]
+	if !ok {
+		if len(t.flows) >= flowBudgetMaxFlow {
+			t.cleanupLocked(now)
+			if len(t.flows) >= flowBudgetMaxFlow {
+				return true
+			}
+		}
+		fc = &flowCount{}
+		t.flows[connKey] = fc
+	}
+	fc.packets++
+	fc.lastSeen = now
+	return fc.packets <= limit
+}
+
+func (t *flowBudgetTracker) Cleanup() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.cleanupLocked(time.Now())
+}
+
+func (t *flowBudgetTracker) cleanupLocked(now time.Time) {
+	for k, v := range t.flows {
+		if now.Sub(v.lastSeen) > flowBudgetTimeout {
+			delete(t.flows, k)
+		}
+	}
+}
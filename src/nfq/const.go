@@ -10,4 +10,5 @@ const (
 	TLSHandshakeType = 0x16
 	TLSClientHello   = 0x01
 	HTTPSPort        = 443
+	HTTPPort         = 80
 )
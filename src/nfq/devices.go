@@ -0,0 +1,135 @@
+package nfq
+
+import (
+	"net"
+	"strings"
+
+	"github.com/daniellavrushin/b4/config"
+	"github.com/daniellavrushin/b4/sni"
+)
+
+// deviceProfile is a set limited to some source devices by Targets.Devices.
+// Entries are MACs, IPs/CIDRs or device alias names.
+type deviceProfile struct {
+	set     *config.SetConfig
+	macs    map[string]bool
+	aliases map[string]bool
+	nets    []*net.IPNet
+	matcher *sni.SuffixSet
+}
+
+func newDeviceProfile(set *config.SetConfig) *deviceProfile {
+	p := &deviceProfile{
+		set:     set,
+		macs:    make(map[string]bool),
+		aliases: make(map[string]bool),
+		matcher: sni.NewSuffixSet([]*config.SetConfig{set}),
+	}
+
+	for _, d := range set.Targets.Devices {
+		d = strings.TrimSpace(d)
+		if d == "" {
+			continue
+		}
+		if hw, err := net.ParseMAC(d); err == nil {
+			p.macs[strings.ToUpper(hw.String())] = true
+			continue
+		}
+		if _, ipNet, err := net.ParseCIDR(d); err == nil {
+			p.nets = append(p.nets, ipNet)
+			continue
+		}
+		if ip := net.ParseIP(d); ip != nil {
+			bits := 128
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			p.nets = append(p.nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		p.aliases[strings.ToLower(d)] = true
+	}
+	return p
+}
+
+func (p *deviceProfile) matches(ip net.IP, mac string, aliases *config.DeviceAliases) bool {
+	for _, n := range p.nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	if mac == "" {
+		return false
+	}
+	if p.macs[mac] {
+		return true
+	}
+	if len(p.aliases) > 0 && aliases != nil {
+		if alias, ok := aliases.Get(mac); ok {
+			return p.aliases[strings.ToLower(alias)]
+		}
+	}
+	return false
+}
+
+// setMatcher holds the matcher of the sets shared by all devices and one
+// matcher per device-limited set.
+type setMatcher struct {
+	shared   *sni.SuffixSet
+	all      sni.Chain
+	profiles []*deviceProfile
+	aliases  *config.DeviceAliases
+}
+
+func newSetMatcher(sets []*config.SetConfig, aliases *config.DeviceAliases) *setMatcher {
+	m := &setMatcher{aliases: aliases}
+
+	shared := make([]*config.SetConfig, 0, len(sets))
+	for _, set := range sets {
+		if !set.Enabled {
+			continue
+		}
+		if len(set.Targets.Devices) > 0 {
+			m.profiles = append(m.profiles, newDeviceProfile(set))
+			continue
+		}
+		shared = append(shared, set)
+	}
+
+	m.shared = sni.NewSuffixSet(shared)
+	m.all = sni.Chain{m.shared}
+	return m
+}
+
+// forSource returns the matchers that apply to traffic from the device with
+// the given source IP and MAC: its device-limited sets in config order, then
+// the shared sets.
+func (m *setMatcher) forSource(ip net.IP, mac string) sni.Chain {
+	var chain sni.Chain
+	for _, p := range m.profiles {
+		if p.matches(ip, mac, m.aliases) {
+			chain = append(chain, p.matcher)
+		}
+	}
+	if chain == nil {
+		return m.all
+	}
+	return append(chain, m.shared)
+}
+
+// transferLearnedIPs carries learned IPs over from the matcher of the
+// previous config, device-limited sets are paired by set ID.
+func (m *setMatcher) transferLearnedIPs(old *setMatcher) {
+	if old == nil {
+		return
+	}
+	m.shared.TransferLearnedIPs(old.shared)
+	for _, p := range m.profiles {
+		for _, op := range old.profiles {
+			if op.set.Id == p.set.Id {
+				p.matcher.TransferLearnedIPs(op.matcher)
+				break
+			}
+		}
+	}
+}
@@ -7,22 +7,28 @@ import (
 	"github.com/daniellavrushin/b4/config"
 	"github.com/daniellavrushin/b4/dns"
 	"github.com/daniellavrushin/b4/log"
+	"github.com/daniellavrushin/b4/metrics"
+	"github.com/daniellavrushin/b4/sni"
 	"github.com/daniellavrushin/b4/sock"
 	"github.com/florianl/go-nfqueue"
 )
 
-func (w *Worker) processDnsPacket(ipVersion byte, sport uint16, dport uint16, payload []byte, raw []byte, ihl int, id uint32) int {
+func (w *Worker) processDnsPacket(matcher sni.Chain, ipVersion byte, sport uint16, dport uint16, payload []byte, raw []byte, ihl int, id uint32) int {
 
 	if dport == 53 {
 		domain, ok := dns.ParseQueryDomain(payload)
 		if ok {
-			matcher := w.getMatcher()
+			if matchedSet, set := matcher.MatchSNI(domain); matchedSet && set.DNS.Enabled && set.DNS.Mode == "forward" {
+				return w.forwardDNSQuery(matcher, set, ipVersion, raw, ihl, id, domain)
+			}
+
 			if matchedSet, set := matcher.MatchSNI(domain); matchedSet && set.DNS.Enabled && set.DNS.TargetDNS != "" {
 
 				targetIP := net.ParseIP(set.DNS.TargetDNS)
 				if targetIP == nil {
 					if err := w.q.SetVerdict(id, nfqueue.NfAccept); err != nil {
 						log.Tracef("failed to set verdict on packet %d: %v", id, err)
+						metrics.RecordVerdictFailure(w.qnum)
 					}
 					return 0
 				}
@@ -32,6 +38,7 @@ func (w *Worker) processDnsPacket(ipVersion byte, sport uint16, dport uint16, pa
 					if targetDNS == nil {
 						if err := w.q.SetVerdict(id, nfqueue.NfAccept); err != nil {
 							log.Tracef("failed to set verdict on packet %d: %v", id, err)
+							metrics.RecordVerdictFailure(w.qnum)
 						}
 						return 0
 					}
@@ -39,7 +46,8 @@ func (w *Worker) processDnsPacket(ipVersion byte, sport uint16, dport uint16, pa
 					originalDst := make(net.IP, 4)
 					copy(originalDst, raw[16:20])
 
-					dns.DnsNATSet(net.IP(raw[12:16]), sport, originalDst)
+					flow := dns.Flow{Proto: 17, Client: net.IP(raw[12:16]), ClientPort: sport, Server: targetDNS, ServerPort: 53}
+					dns.DnsNATSet(flow, binary.BigEndian.Uint16(payload), originalDst)
 
 					copy(raw[16:20], targetDNS)
 					sock.FixIPv4Checksum(raw[:ihl])
@@ -51,6 +59,7 @@ func (w *Worker) processDnsPacket(ipVersion byte, sport uint16, dport uint16, pa
 					}
 					if err := w.q.SetVerdict(id, nfqueue.NfDrop); err != nil {
 						log.Tracef("failed to set drop verdict on packet %d: %v", id, err)
+						metrics.RecordVerdictFailure(w.qnum)
 					}
 					log.Infof("DNS redirect: %s -> %s (set: %s)", domain, set.DNS.TargetDNS, set.Name)
 					return 0
@@ -60,6 +69,7 @@ func (w *Worker) processDnsPacket(ipVersion byte, sport uint16, dport uint16, pa
 					if !cfg.Queue.IPv6Enabled {
 						if err := w.q.SetVerdict(id, nfqueue.NfAccept); err != nil {
 							log.Tracef("failed to set verdict on packet %d: %v", id, err)
+							metrics.RecordVerdictFailure(w.qnum)
 						}
 						return 0
 					}
@@ -68,6 +78,7 @@ func (w *Worker) processDnsPacket(ipVersion byte, sport uint16, dport uint16, pa
 					if targetDNS == nil {
 						if err := w.q.SetVerdict(id, nfqueue.NfAccept); err != nil {
 							log.Tracef("failed to set verdict on packet %d: %v", id, err)
+							metrics.RecordVerdictFailure(w.qnum)
 						}
 						return 0
 					}
@@ -75,7 +86,8 @@ func (w *Worker) processDnsPacket(ipVersion byte, sport uint16, dport uint16, pa
 					originalDst := make(net.IP, 16)
 					copy(originalDst, raw[24:40])
 
-					dns.DnsNATSet(net.IP(raw[8:24]), sport, originalDst)
+					flow := dns.Flow{Proto: 17, Client: net.IP(raw[8:24]), ClientPort: sport, Server: targetDNS, ServerPort: 53}
+					dns.DnsNATSet(flow, binary.BigEndian.Uint16(payload), originalDst)
 
 					copy(raw[24:40], targetDNS)
 					sock.FixUDPChecksumV6(raw)
@@ -86,6 +98,7 @@ func (w *Worker) processDnsPacket(ipVersion byte, sport uint16, dport uint16, pa
 					}
 					if err := w.q.SetVerdict(id, nfqueue.NfDrop); err != nil {
 						log.Tracef("failed to set drop verdict on packet %d: %v", id, err)
+						metrics.RecordVerdictFailure(w.qnum)
 					}
 					log.Infof("DNS redirect (IPv6): %s -> %s (set: %s)", domain, set.DNS.TargetDNS, set.Name)
 					return 0
@@ -95,28 +108,39 @@ func (w *Worker) processDnsPacket(ipVersion byte, sport uint16, dport uint16, pa
 	}
 
 	if sport == 53 {
+		learnFromDNSAnswer(matcher, payload)
+
+		var txid uint16
+		if len(payload) >= 2 {
+			txid = binary.BigEndian.Uint16(payload)
+		}
+
 		if ipVersion == IPv4 {
-			if originalDst, ok := dns.DnsNATGet(net.IP(raw[16:20]), dport); ok {
+			flow := dns.Flow{Proto: 17, Client: net.IP(raw[16:20]), ClientPort: dport, Server: net.IP(raw[12:16]), ServerPort: sport}
+			if originalDst, ok := dns.DnsNATGet(flow, txid); ok {
+				dns.DnsNATDelete(flow, txid)
 				copy(raw[12:16], originalDst.To4())
 				sock.FixIPv4Checksum(raw[:ihl])
 				sock.FixUDPChecksum(raw, ihl)
-				dns.DnsNATDelete(net.IP(raw[16:20]), dport)
 				_ = w.sock.SendIPv4(raw, net.IP(raw[16:20]))
 				if err := w.q.SetVerdict(id, nfqueue.NfDrop); err != nil {
 					log.Tracef("failed to set drop verdict on packet %d: %v", id, err)
+					metrics.RecordVerdictFailure(w.qnum)
 				}
 				return 0
 			}
 		} else {
 			cfg := w.getConfig()
 			if cfg.Queue.IPv6Enabled {
-				if originalDst, ok := dns.DnsNATGet(net.IP(raw[24:40]), dport); ok {
+				flow := dns.Flow{Proto: 17, Client: net.IP(raw[24:40]), ClientPort: dport, Server: net.IP(raw[8:24]), ServerPort: sport}
+				if originalDst, ok := dns.DnsNATGet(flow, txid); ok {
+					dns.DnsNATDelete(flow, txid)
 					copy(raw[8:24], originalDst.To16())
 					sock.FixUDPChecksumV6(raw)
-					dns.DnsNATDelete(net.IP(raw[24:40]), dport)
 					_ = w.sock.SendIPv6(raw, net.IP(raw[24:40]))
 					if err := w.q.SetVerdict(id, nfqueue.NfDrop); err != nil {
 						log.Tracef("failed to set drop verdict on packet %d: %v", id, err)
+						metrics.RecordVerdictFailure(w.qnum)
 					}
 					return 0
 				}
@@ -126,10 +150,29 @@ func (w *Worker) processDnsPacket(ipVersion byte, sport uint16, dport uint16, pa
 
 	if err := w.q.SetVerdict(id, nfqueue.NfAccept); err != nil {
 		log.Tracef("failed to set verdict on packet %d: %v", id, err)
+		metrics.RecordVerdictFailure(w.qnum)
 	}
 	return 0
 }
 
+// learnFromDNSAnswer registers the addresses a response resolves a set's
+// domain to, so the first packets to them match before any SNI is seen.
+func learnFromDNSAnswer(matcher sni.Chain, payload []byte) {
+	domain, answers, ok := dns.ParseAnswers(payload)
+	if !ok || len(answers) == 0 {
+		return
+	}
+	matched, set := matcher.MatchSNI(domain)
+	if !matched {
+		return
+	}
+	for _, a := range answers {
+		ttl := min(max(a.TTL, sni.MinLearnedDNSTTL), sni.MaxLearnedDNSTTL)
+		matcher.LearnIPToDomainTTL(a.IP, domain, set, ttl)
+	}
+	log.Tracef("DNS: learned %d IPs of %s (set: %s)", len(answers), domain, set.Name)
+}
+
 func (w *Worker) sendFragmentedDNSQueryV4(cfg *config.SetConfig, raw []byte, ihl int, dst net.IP) {
 	udpOffset := ihl
 	if len(raw) < ihl+8 {
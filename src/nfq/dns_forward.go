@@ -0,0 +1,118 @@
+package nfq
+
+import (
+	"context"
+	"net"
+	"time"
+
+	"github.com/daniellavrushin/b4/config"
+	"github.com/daniellavrushin/b4/dns"
+	"github.com/daniellavrushin/b4/log"
+	"github.com/daniellavrushin/b4/metrics"
+	"github.com/daniellavrushin/b4/sni"
+	"github.com/daniellavrushin/b4/sock"
+	"github.com/florianl/go-nfqueue"
+)
+
+const (
+	dnsForwardTimeout = 5 * time.Second
+	// maxDNSInFlight bounds the queries resolved at once across workers.
+	// Queries past it are dropped and the client retries.
+	maxDNSInFlight = 64
+)
+
+var dnsInFlight = make(chan struct{}, maxDNSInFlight)
+
+func acquireDNSSlot() bool {
+	select {
+	case dnsInFlight <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+func releaseDNSSlot() {
+	<-dnsInFlight
+}
+
+// forwardDNSQuery answers a query for a domain of set itself: the query is
+// dropped, resolved over DoH or DoT and the reply sent back to the client
+// from the address it queried.
+func (w *Worker) forwardDNSQuery(matcher sni.Chain, set *config.SetConfig, ipVersion byte, raw []byte, ihl int, id uint32, domain string) int {
+	if (ipVersion != IPv4 && !w.getConfig().Queue.IPv6Enabled) || len(raw) < ihl+8+12 {
+		if err := w.q.SetVerdict(id, nfqueue.NfAccept); err != nil {
+			log.Tracef("failed to set verdict on packet %d: %v", id, err)
+			metrics.RecordVerdictFailure(w.qnum)
+		}
+		return 0
+	}
+
+	pkt := make([]byte, len(raw))
+	copy(pkt, raw)
+	upstream := set.DNS.Upstream
+
+	if err := w.q.SetVerdict(id, nfqueue.NfDrop); err != nil {
+		log.Tracef("failed to set drop verdict on packet %d: %v", id, err)
+		metrics.RecordVerdictFailure(w.qnum)
+		return 0
+	}
+	if !acquireDNSSlot() {
+		log.Tracef("DNS forward: %d queries in flight, dropped query for %s", maxDNSInFlight, domain)
+		return 0
+	}
+
+	w.wg.Add(1)
+	go func() {
+		defer w.wg.Done()
+		defer releaseDNSSlot()
+
+		query := pkt[ihl+8:]
+		ctx, cancel := context.WithTimeout(context.Background(), dnsForwardTimeout)
+		defer cancel()
+
+		reply, err := dns.DefaultForwarder.Resolve(ctx, upstream, query)
+		if err != nil {
+			log.Warnf("DNS forward: %s via %s failed: %v", domain, upstream, err)
+			reply = dns.ServFail(query)
+		} else {
+			learnFromDNSAnswer(matcher, reply)
+			log.Infof("DNS forward: %s via %s (set: %s)", domain, upstream, set.Name)
+		}
+		w.sendDNSReply(ipVersion, pkt, ihl, dns.FitUDP(query, reply))
+	}()
+	return 0
+}
+
+// sendDNSReply sends reply to the client of the query packet, with the
+// addresses and ports of the query swapped.
+func (w *Worker) sendDNSReply(ipVersion byte, query []byte, ihl int, reply []byte) {
+	if ipVersion == IPv4 {
+		hdr := make([]byte, 28)
+		copy(hdr, query[:20])
+		hdr[0] = 0x45
+		copy(hdr[12:16], query[16:20])
+		copy(hdr[16:20], query[12:16])
+		copy(hdr[20:22], query[ihl+2:ihl+4])
+		copy(hdr[22:24], query[ihl:ihl+2])
+
+		out, ok := sock.BuildUDPWithPayloadV4(hdr, reply, 64)
+		if ok {
+			_ = w.sock.SendIPv4(out, net.IP(out[16:20]))
+		}
+		return
+	}
+
+	hdr := make([]byte, 48)
+	copy(hdr, query[:40])
+	hdr[6] = 17 // no extension headers in the reply
+	copy(hdr[8:24], query[24:40])
+	copy(hdr[24:40], query[8:24])
+	copy(hdr[40:42], query[ihl+2:ihl+4])
+	copy(hdr[42:44], query[ihl:ihl+2])
+
+	out, ok := sock.BuildUDPWithPayloadV6(hdr, reply, 64)
+	if ok {
+		_ = w.sock.SendIPv6(out, net.IP(out[24:40]))
+	}
+}
@@ -0,0 +1,168 @@
+package nfq
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+
+	"github.com/daniellavrushin/b4/dns"
+	"github.com/daniellavrushin/b4/log"
+	"github.com/daniellavrushin/b4/metrics"
+	"github.com/daniellavrushin/b4/sni"
+	"github.com/daniellavrushin/b4/sock"
+	"github.com/florianl/go-nfqueue"
+)
+
+// dnsTCPChunk is the most reply data put in one injected segment, small
+// enough for any path MTU DNS is used over.
+const dnsTCPChunk = 1220
+
+// processDnsTCPPacket handles a segment to TCP/53. A TCP connection cannot
+// be moved to another server once its query is seen, so a query for a
+// set's domain is answered by b4 itself: the segment is dropped, the query
+// resolved with the set's target server or upstream, and the reply injected
+// into the connection from the server the client talks to.
+func (w *Worker) processDnsTCPPacket(matcher sni.Chain, ipVersion byte, raw []byte, ihl int, datOff int, payload []byte, id uint32) int {
+	msg, ok := dns.ParseTCPQuery(payload)
+	if !ok || (ipVersion != IPv4 && !w.getConfig().Queue.IPv6Enabled) {
+		return w.acceptDNS(id)
+	}
+	domain, ok := dns.ParseQueryDomain(msg)
+	if !ok {
+		return w.acceptDNS(id)
+	}
+	matchedSet, set := matcher.MatchSNI(domain)
+	if !matchedSet || !set.DNS.Enabled {
+		return w.acceptDNS(id)
+	}
+
+	var resolve func(ctx context.Context, query []byte) ([]byte, error)
+	var via string
+	switch {
+	case set.DNS.Mode == "forward":
+		upstream := set.DNS.Upstream
+		resolve = func(ctx context.Context, query []byte) ([]byte, error) {
+			return dns.DefaultForwarder.Resolve(ctx, upstream, query)
+		}
+		via = upstream
+	case net.ParseIP(set.DNS.TargetDNS) != nil:
+		server := net.JoinHostPort(set.DNS.TargetDNS, "53")
+		mark := int(w.getConfig().Queue.Mark)
+		resolve = func(ctx context.Context, query []byte) ([]byte, error) {
+			return dns.ExchangeTCP(ctx, server, mark, query)
+		}
+		via = set.DNS.TargetDNS
+	default:
+		return w.acceptDNS(id)
+	}
+
+	pkt := make([]byte, len(raw))
+	copy(pkt, raw)
+	query := pkt[ihl+datOff+2:]
+
+	if err := w.q.SetVerdict(id, nfqueue.NfDrop); err != nil {
+		log.Tracef("failed to set drop verdict on packet %d: %v", id, err)
+		metrics.RecordVerdictFailure(w.qnum)
+		return 0
+	}
+	if !acquireDNSSlot() {
+		log.Tracef("DNS over TCP: %d queries in flight, dropped query for %s", maxDNSInFlight, domain)
+		return 0
+	}
+
+	w.wg.Add(1)
+	go func() {
+		defer w.wg.Done()
+		defer releaseDNSSlot()
+
+		ctx, cancel := context.WithTimeout(context.Background(), dnsForwardTimeout)
+		defer cancel()
+
+		reply, err := resolve(ctx, query)
+		if err != nil {
+			log.Warnf("DNS over TCP: %s via %s failed: %v", domain, via, err)
+			reply = dns.ServFail(query)
+		} else {
+			learnFromDNSAnswer(matcher, reply)
+			log.Infof("DNS over TCP: %s via %s (set: %s)", domain, via, set.Name)
+		}
+		w.sendDNSTCPReply(ipVersion, pkt, ihl, datOff, reply)
+	}()
+	return 0
+}
+
+func (w *Worker) acceptDNS(id uint32) int {
+	if err := w.q.SetVerdict(id, nfqueue.NfAccept); err != nil {
+		log.Tracef("failed to set verdict on packet %d: %v", id, err)
+		metrics.RecordVerdictFailure(w.qnum)
+	}
+	return 0
+}
+
+// sendDNSTCPReply injects reply into the connection of the query segment pkt.
+func (w *Worker) sendDNSTCPReply(ipVersion byte, pkt []byte, ihl int, datOff int, reply []byte) {
+	for _, out := range buildDNSTCPReply(ipVersion, pkt, ihl, datOff, reply) {
+		if ipVersion == IPv4 {
+			_ = w.sock.SendIPv4(out, net.IP(out[16:20]))
+		} else {
+			_ = w.sock.SendIPv6(out, net.IP(out[24:40]))
+		}
+	}
+}
+
+// buildDNSTCPReply returns the segments carrying reply, length-prefixed, as
+// if the server of the query segment pkt sent them: they start at the
+// sequence number the client acknowledged and acknowledge the query data.
+func buildDNSTCPReply(ipVersion byte, pkt []byte, ihl int, datOff int, reply []byte) [][]byte {
+	tcp := pkt[ihl:]
+	serverSeq := binary.BigEndian.Uint32(tcp[8:12])
+	ack := binary.BigEndian.Uint32(tcp[4:8]) + uint32(len(pkt)-ihl-datOff)
+
+	data := make([]byte, 2+len(reply))
+	binary.BigEndian.PutUint16(data, uint16(len(reply)))
+	copy(data[2:], reply)
+
+	var segments [][]byte
+	for off := 0; off < len(data); off += dnsTCPChunk {
+		chunk := data[off:min(off+dnsTCPChunk, len(data))]
+
+		seg := make([]byte, 20+len(chunk))
+		copy(seg[0:2], tcp[2:4])
+		copy(seg[2:4], tcp[0:2])
+		binary.BigEndian.PutUint32(seg[4:8], serverSeq+uint32(off))
+		binary.BigEndian.PutUint32(seg[8:12], ack)
+		seg[12] = 5 << 4
+		seg[13] = 0x18 // PSH, ACK
+		binary.BigEndian.PutUint16(seg[14:16], 65535)
+		copy(seg[20:], chunk)
+
+		if ipVersion == IPv4 {
+			out := make([]byte, 20+len(seg))
+			out[0] = 0x45
+			out[1] = pkt[1]
+			binary.BigEndian.PutUint16(out[2:4], uint16(len(out)))
+			out[6] = 0x40 // DF
+			out[8] = 64
+			out[9] = 6
+			copy(out[12:16], pkt[16:20])
+			copy(out[16:20], pkt[12:16])
+			copy(out[20:], seg)
+			sock.FixIPv4Checksum(out[:20])
+			sock.FixTCPChecksum(out)
+			segments = append(segments, out)
+			continue
+		}
+
+		out := make([]byte, 40+len(seg))
+		copy(out[0:4], pkt[0:4])
+		binary.BigEndian.PutUint16(out[4:6], uint16(len(seg)))
+		out[6] = 6 // no extension headers in the reply
+		out[7] = 64
+		copy(out[8:24], pkt[24:40])
+		copy(out[24:40], pkt[8:24])
+		copy(out[40:], seg)
+		sock.FixTCPChecksumV6(out)
+		segments = append(segments, out)
+	}
+	return segments
+}
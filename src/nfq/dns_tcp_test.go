@@ -0,0 +1,94 @@
+package nfq
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+
+	"github.com/daniellavrushin/b4/sock"
+)
+
+// dnsTCPQuery builds a client segment 10.0.0.2:40000 -> 1.1.1.1:53 carrying
+// a length-prefixed query.
+func dnsTCPQuery(seq, ack uint32, query []byte) []byte {
+	pkt := make([]byte, 40+2+len(query))
+	pkt[0] = 0x45
+	binary.BigEndian.PutUint16(pkt[2:4], uint16(len(pkt)))
+	pkt[8] = 64
+	pkt[9] = 6
+	copy(pkt[12:16], []byte{10, 0, 0, 2})
+	copy(pkt[16:20], []byte{1, 1, 1, 1})
+
+	tcp := pkt[20:]
+	binary.BigEndian.PutUint16(tcp[0:2], 40000)
+	binary.BigEndian.PutUint16(tcp[2:4], 53)
+	binary.BigEndian.PutUint32(tcp[4:8], seq)
+	binary.BigEndian.PutUint32(tcp[8:12], ack)
+	tcp[12] = 5 << 4
+	tcp[13] = 0x18
+	binary.BigEndian.PutUint16(tcp[20:22], uint16(len(query)))
+	copy(tcp[22:], query)
+	return pkt
+}
+
+func TestBuildDNSTCPReply(t *testing.T) {
+	query := bytes.Repeat([]byte{0xab}, 30)
+	pkt := dnsTCPQuery(1000, 5000, query)
+	reply := bytes.Repeat([]byte{0xcd}, dnsTCPChunk+100)
+
+	segments := buildDNSTCPReply(IPv4, pkt, 20, 20, reply)
+	if len(segments) != 2 {
+		t.Fatalf("expected 2 segments, got %d", len(segments))
+	}
+
+	wantAck := uint32(1000 + 2 + len(query))
+	var data []byte
+	for i, out := range segments {
+		if !bytes.Equal(out[12:16], []byte{1, 1, 1, 1}) || !bytes.Equal(out[16:20], []byte{10, 0, 0, 2}) {
+			t.Errorf("segment %d: addresses not swapped", i)
+		}
+		tcp := out[20:]
+		if sport, dport := binary.BigEndian.Uint16(tcp[0:2]), binary.BigEndian.Uint16(tcp[2:4]); sport != 53 || dport != 40000 {
+			t.Errorf("segment %d: ports %d -> %d", i, sport, dport)
+		}
+		if seq := binary.BigEndian.Uint32(tcp[4:8]); seq != 5000+uint32(len(data)) {
+			t.Errorf("segment %d: seq %d, want %d", i, seq, 5000+len(data))
+		}
+		if ack := binary.BigEndian.Uint32(tcp[8:12]); ack != wantAck {
+			t.Errorf("segment %d: ack %d, want %d", i, ack, wantAck)
+		}
+		if int(binary.BigEndian.Uint16(out[2:4])) != len(out) {
+			t.Errorf("segment %d: total length %d, want %d", i, binary.BigEndian.Uint16(out[2:4]), len(out))
+		}
+
+		check := append([]byte{}, out...)
+		sock.FixIPv4Checksum(check[:20])
+		sock.FixTCPChecksum(check)
+		if !bytes.Equal(check, out) {
+			t.Errorf("segment %d: bad checksum", i)
+		}
+		data = append(data, tcp[20:]...)
+	}
+
+	if int(binary.BigEndian.Uint16(data[:2])) != len(reply) || !bytes.Equal(data[2:], reply) {
+		t.Error("reply data not length-prefixed")
+	}
+}
+
+func TestDNSSlotsBounded(t *testing.T) {
+	for i := 0; i < maxDNSInFlight; i++ {
+		if !acquireDNSSlot() {
+			t.Fatalf("slot %d refused", i)
+		}
+	}
+	if acquireDNSSlot() {
+		t.Fatal("more queries than maxDNSInFlight in flight")
+	}
+	releaseDNSSlot()
+	if !acquireDNSSlot() {
+		t.Fatal("released slot not reused")
+	}
+	for i := 0; i < maxDNSInFlight; i++ {
+		releaseDNSSlot()
+	}
+}
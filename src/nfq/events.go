@@ -0,0 +1,137 @@
+package nfq
+
+import (
+	"net"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/daniellavrushin/b4/config"
+	"github.com/daniellavrushin/b4/connlog"
+	"github.com/daniellavrushin/b4/log"
+)
+
+const (
+	recordedFlowTimeout = 120 * time.Second
+	recordedMaxFlows    = 65536
+)
+
+type recordedFlow struct {
+	protocols []string // kinds of events written for the flow
+	lastSeen  time.Time
+}
+
+// recordedFlowTracker remembers which events of a flow went to the history
+// while the flow keeps sending packets, so each is written once.
+type recordedFlowTracker struct {
+	mu    sync.Mutex
+	flows map[string]*recordedFlow
+}
+
+var recordedFlows = &recordedFlowTracker{
+	flows: make(map[string]*recordedFlow),
+}
+
+// first reports whether no event of proto was written for the flow yet and
+// marks it written. A full table lets every event through.
+func (t *recordedFlowTracker) first(connKey, proto string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := time.Now()
+	f, ok := t.flows[connKey]
+	if !ok {
+		if len(t.flows) >= recordedMaxFlows {
+			t.cleanupLocked(now)
+			if len(t.flows) >= recordedMaxFlows {
+				return true
+			}
+		}
+		f = &recordedFlow{}
+		t.flows[connKey] = f
+	}
+	f.lastSeen = now
+	if slices.Contains(f.protocols, proto) {
+		return false
+	}
+	f.protocols = append(f.protocols, proto)
+	return true
+}
+
+func (t *recordedFlowTracker) Cleanup() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.cleanupLocked(time.Now())
+}
+
+func (t *recordedFlowTracker) cleanupLocked(now time.Time) {
+	for k, f := range t.flows {
+		if now.Sub(f.lastSeen) > recordedFlowTimeout {
+			delete(t.flows, k)
+		}
+	}
+}
+
+// connEvent starts the history event of a queued packet. It is the zero
+// Event, which recordConn ignores, when the history is off or discovery
+// runs, like the connection log lines.
+func connEvent(proto string, sets *setMatcher, mac string, src net.IP, sport uint16, dst net.IP, dport uint16, host string) connlog.Event {
+	if !connlog.Enabled() || log.IsDiscoveryActive() {
+		return connlog.Event{}
+	}
+	e := connlog.Event{
+		Protocol: proto,
+		MAC:      mac,
+		SrcIP:    src.String(),
+		SrcPort:  sport,
+		DstIP:    dst.String(),
+		DstPort:  dport,
+		Host:     host,
+	}
+	if mac != "" && sets != nil && sets.aliases != nil {
+		e.Device, _ = sets.aliases.Get(mac)
+	}
+	return e
+}
+
+// recordConn writes e with the set that handled the connection and what
+// it did. Passed connections carry no set. Only the first event of each
+// kind is written for a flow, not one per queued packet.
+func recordConn(connKey string, e connlog.Event, set *config.SetConfig, outcome string) {
+	if e.Protocol == "" || !recordedFlows.first(connKey, e.Protocol) {
+		return
+	}
+	e.Outcome = outcome
+	if set != nil && outcome != connlog.OutcomePassed {
+		e.SetID = set.Id
+		e.Set = set.Name
+		if outcome == connlog.OutcomeInjected || outcome == connlog.OutcomeDuplicated {
+			e.Strategy = describeStrategy(set, e.Protocol)
+		}
+	}
+	connlog.Record(e)
+}
+
+// describeStrategy sums up what set does to packets of proto.
+func describeStrategy(set *config.SetConfig, proto string) string {
+	var parts []string
+	switch proto {
+	case "TCP-DUP":
+		return "duplicate"
+	case "UDP":
+		parts = append(parts, "mode="+set.UDP.Mode)
+		if set.UDP.Mode == "fake" {
+			parts = append(parts, "faking="+set.UDP.FakingStrategy, "split="+set.UDP.SplitMode)
+		}
+	default:
+		parts = append(parts, "frag="+set.Fragmentation.Strategy)
+		if set.Faking.SNI {
+			parts = append(parts, "faking="+set.Faking.Strategy)
+		}
+		if proto == "TCP-SYN" && set.TCP.SynFake {
+			parts = append(parts, "synfake")
+		}
+	}
+	return strings.Join(parts, " ")
+}
@@ -0,0 +1,70 @@
+package nfq
+
+import (
+	"testing"
+	"time"
+
+	"github.com/daniellavrushin/b4/config"
+	"github.com/daniellavrushin/b4/connlog"
+)
+
+func TestRecordedFlows(t *testing.T) {
+	tr := &recordedFlowTracker{flows: make(map[string]*recordedFlow)}
+
+	if !tr.first("a", "TCP-SYN") || !tr.first("a", "TCP") {
+		t.Fatal("each kind of event should be written once")
+	}
+	if tr.first("a", "TCP") || tr.first("a", "TCP-SYN") {
+		t.Error("repeated events of a flow should be skipped")
+	}
+	if !tr.first("b", "TCP") {
+		t.Error("flows are tracked separately")
+	}
+
+	tr.flows["a"].lastSeen = time.Now().Add(-2 * recordedFlowTimeout)
+	tr.Cleanup()
+	if !tr.first("a", "TCP") {
+		t.Error("an expired flow should be written again")
+	}
+	if tr.first("b", "TCP") {
+		t.Error("an active flow should not be cleaned up")
+	}
+}
+
+func TestRecordConnOncePerFlow(t *testing.T) {
+	if err := connlog.Configure(config.ConnectionLogConfig{Enabled: true, Dir: t.TempDir(), MaxSizeMB: 1, MaxFiles: 1}); err != nil {
+		t.Fatal(err)
+	}
+	defer connlog.Close()
+
+	set := config.NewSetConfig()
+	key := "10.0.0.2:40000->192.0.2.1:443 record-once"
+	recordedFlows.mu.Lock()
+	delete(recordedFlows.flows, key)
+	delete(recordedFlows.flows, key+" other")
+	recordedFlows.mu.Unlock()
+
+	e := connlog.Event{Protocol: "UDP", SrcIP: "10.0.0.2", DstIP: "192.0.2.1", Host: "example.com"}
+	for i := 0; i < 5; i++ {
+		recordConn(key, e, &set, connlog.OutcomeInjected)
+	}
+	recordConn(key, e, &set, connlog.OutcomeOverBudget)
+	recordConn(key+" other", e, &set, connlog.OutcomeInjected)
+
+	// Wait for the writer, then a little longer for any extra event
+	var events []connlog.Event
+	for deadline := time.Now().Add(2 * time.Second); len(events) < 2 && time.Now().Before(deadline); {
+		time.Sleep(10 * time.Millisecond)
+		events, _ = connlog.Query(connlog.Filter{Limit: connlog.MaxQueryLimit})
+	}
+	time.Sleep(50 * time.Millisecond)
+	events, _ = connlog.Query(connlog.Filter{Limit: connlog.MaxQueryLimit})
+	if len(events) != 2 {
+		t.Fatalf("expected one event per flow, got %d", len(events))
+	}
+	for _, ev := range events {
+		if ev.Outcome != connlog.OutcomeInjected {
+			t.Errorf("expected the first decision of the flow, got %s", ev.Outcome)
+		}
+	}
+}
@@ -0,0 +1,274 @@
+package nfq
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/daniellavrushin/b4/config"
+	"github.com/daniellavrushin/b4/log"
+	"github.com/daniellavrushin/b4/metrics"
+)
+
+const (
+	fallbackMaxDomains = 16384
+	fallbackMaxConns   = 4096
+	fallbackMaxChains  = 256
+)
+
+// domainStrategy is the variant a domain of a set currently uses.
+type domainStrategy struct {
+	variant  int
+	failures int
+	verified bool
+	expires  time.Time
+}
+
+// pendingHello is a ClientHello waiting for the server's answer.
+type pendingHello struct {
+	key      string // set ID and domain
+	set      *config.SetConfig
+	variant  int
+	seq      uint32
+	timer    *time.Timer
+	deadline time.Time
+	failed   bool
+}
+
+// strategyTracker moves domains along the fallback chain of their set when
+// the current strategy keeps failing. A ClientHello counts as failed when it
+// is retransmitted, answered with a RST, or not answered with a ServerHello
+// within the set's timeout.
+type strategyTracker struct {
+	mu      sync.Mutex
+	domains map[string]*domainStrategy
+	conns   map[string]*pendingHello
+	chains  map[*config.SetConfig][]*config.SetConfig
+
+	// now replaces the wall clock when set. Unanswered ClientHellos then
+	// time out only through expireDue instead of timers.
+	now func() time.Time
+}
+
+var strategies = newStrategyTracker(nil)
+
+func newStrategyTracker(now func() time.Time) *strategyTracker {
+	return &strategyTracker{
+		domains: make(map[string]*domainStrategy),
+		conns:   make(map[string]*pendingHello),
+		chains:  make(map[*config.SetConfig][]*config.SetConfig),
+		now:     now,
+	}
+}
+
+func (t *strategyTracker) clock() time.Time {
+	if t.now != nil {
+		return t.now()
+	}
+	return time.Now()
+}
+
+// pick returns the set variant to use for a ClientHello of the connection
+// and starts watching the connection for the server's answer.
+func (t *strategyTracker) pick(connKey string, set *config.SetConfig, host string, seq uint32) *config.SetConfig {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := t.clock()
+	chain := t.chainLocked(set)
+
+	if p, ok := t.conns[connKey]; ok && p.set == set && p.seq == seq {
+		// The ClientHello was retransmitted, count it once per connection
+		if !p.failed {
+			p.failed = true
+			t.failLocked(p, "retransmitted ClientHello", now)
+		}
+		return chain[t.variantLocked(p.key, len(chain), now)]
+	}
+
+	key := set.Id + "|" + strings.ToLower(host)
+	variant := t.variantLocked(key, len(chain), now)
+
+	if old, ok := t.conns[connKey]; ok {
+		// A new connection on the same ports
+		old.stop()
+		delete(t.conns, connKey)
+	}
+	if len(t.conns) < fallbackMaxConns {
+		p := &pendingHello{
+			key:     key,
+			set:     set,
+			variant: variant,
+			seq:     seq,
+		}
+		if t.now == nil {
+			p.timer = time.AfterFunc(set.Fallback.Timeout(), func() { t.expire(connKey, p) })
+		} else {
+			p.deadline = now.Add(set.Fallback.Timeout())
+		}
+		t.conns[connKey] = p
+	}
+	return chain[variant]
+}
+
+// observeIncoming checks a packet from the server of a watched connection
+// for a ServerHello or a RST.
+func (t *strategyTracker) observeIncoming(connKey string, flags byte, payload []byte) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if len(t.conns) == 0 {
+		return
+	}
+	p, ok := t.conns[connKey]
+	if !ok {
+		return
+	}
+
+	switch {
+	case flags&0x04 != 0:
+		p.stop()
+		delete(t.conns, connKey)
+		if !p.failed {
+			t.failLocked(p, "RST", t.clock())
+		}
+	case isServerHello(payload):
+		p.stop()
+		delete(t.conns, connKey)
+		t.succeedLocked(p, t.clock())
+	}
+}
+
+func isServerHello(payload []byte) bool {
+	return len(payload) >= 6 && payload[0] == 0x16 && payload[5] == 0x02
+}
+
+func (t *strategyTracker) variantLocked(key string, chainLen int, now time.Time) int {
+	ds, ok := t.domains[key]
+	if !ok {
+		return 0
+	}
+	if now.After(ds.expires) || ds.variant >= chainLen {
+		delete(t.domains, key)
+		return 0
+	}
+	return ds.variant
+}
+
+func (t *strategyTracker) succeedLocked(p *pendingHello, now time.Time) {
+	ds, ok := t.domains[p.key]
+	if !ok {
+		if p.variant == 0 {
+			// The set's own strategy works, nothing to remember
+			return
+		}
+		ds = &domainStrategy{variant: p.variant}
+		t.domains[p.key] = ds
+	}
+	if ds.variant != p.variant {
+		return
+	}
+	ds.failures = 0
+	ds.expires = now.Add(p.set.Fallback.TTL())
+	if !ds.verified {
+		ds.verified = true
+		log.Infof("Strategy fallback: %s works with variant %d", p.key, p.variant)
+	}
+}
+
+func (t *strategyTracker) failLocked(p *pendingHello, reason string, now time.Time) {
+	ds, ok := t.domains[p.key]
+	if !ok {
+		if len(t.domains) >= fallbackMaxDomains {
+			return
+		}
+		ds = &domainStrategy{variant: p.variant, expires: now.Add(p.set.Fallback.TTL())}
+		t.domains[p.key] = ds
+	}
+	if ds.variant != p.variant {
+		// Already moved on by another connection
+		return
+	}
+
+	ds.failures++
+	log.Tracef("Strategy fallback: %s variant %d failed (%s, %d/%d)",
+		p.key, p.variant, reason, ds.failures, p.set.Fallback.MaxFailures)
+	if ds.failures < p.set.Fallback.MaxFailures {
+		return
+	}
+
+	chain := t.chainLocked(p.set)
+	ds.variant = (ds.variant + 1) % len(chain)
+	ds.failures = 0
+	ds.verified = false
+	ds.expires = now.Add(p.set.Fallback.TTL())
+
+	next := chain[ds.variant].Fragmentation.Strategy
+	log.Infof("Strategy fallback: moving %s to variant %d (%s) after repeated %s",
+		p.key, ds.variant, next, reason)
+	metrics.RecordStrategySwitch(p.set.Name, fmt.Sprintf("%d:%s", ds.variant, next))
+}
+
+// expire counts a ClientHello that went unanswered within the timeout of
+// its set, unless the connection was answered or replaced meanwhile.
+func (t *strategyTracker) expire(connKey string, p *pendingHello) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.conns[connKey] != p {
+		return
+	}
+	t.timeoutLocked(connKey, p, t.clock())
+}
+
+// expireDue counts the ClientHellos whose deadline is not after now. Only
+// used with a manual clock.
+func (t *strategyTracker) expireDue(now time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for k, p := range t.conns {
+		if !p.deadline.IsZero() && !now.Before(p.deadline) {
+			t.timeoutLocked(k, p, now)
+		}
+	}
+}
+
+func (t *strategyTracker) timeoutLocked(connKey string, p *pendingHello, now time.Time) {
+	delete(t.conns, connKey)
+	if !p.failed {
+		t.failLocked(p, "ServerHello timeout", now)
+	}
+}
+
+func (p *pendingHello) stop() {
+	if p.timer != nil {
+		p.timer.Stop()
+	}
+}
+
+func (t *strategyTracker) chainLocked(set *config.SetConfig) []*config.SetConfig {
+	if chain, ok := t.chains[set]; ok {
+		return chain
+	}
+	if len(t.chains) >= fallbackMaxChains {
+		// Sets of replaced configs are not referenced anymore
+		t.chains = make(map[*config.SetConfig][]*config.SetConfig)
+	}
+	chain := set.Chain()
+	t.chains[set] = chain
+	return chain
+}
+
+func (t *strategyTracker) Cleanup() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := t.clock()
+	for k, ds := range t.domains {
+		if now.After(ds.expires) {
+			delete(t.domains, k)
+		}
+	}
+}
@@ -0,0 +1,173 @@
+package nfq
+
+import (
+	"testing"
+	"time"
+
+	"github.com/daniellavrushin/b4/config"
+)
+
+var serverHello = []byte{0x16, 0x03, 0x03, 0x00, 0x40, 0x02}
+
+const tcpFlagRST = 0x04
+
+func fallbackSet() *config.SetConfig {
+	set := config.NewSetConfig()
+	set.Id = "fb"
+	set.Fragmentation.Strategy = "tcp"
+	set.Fallback.Enabled = true
+	set.Fallback.Variants = []config.StrategyVariant{{Strategy: "disorder"}, {Strategy: "oob"}}
+	set.Fallback.MaxFailures = 2
+	set.Fallback.TimeoutMs = 1000
+	set.Fallback.TTLMinutes = 10
+	return &set
+}
+
+func TestStrategyTrackerAdvance(t *testing.T) {
+	clock := &testReasmClock{t: time.Unix(1000, 0)}
+	tr := newStrategyTracker(clock.now)
+	set := fallbackSet()
+
+	strategyOf := func(s *config.SetConfig) string { return s.Fragmentation.Strategy }
+
+	if got := tr.pick("c1", set, "Example.com", 1); got != set {
+		t.Fatalf("first pick should use the set itself, got %s", strategyOf(got))
+	}
+	tr.observeIncoming("c1", tcpFlagRST, nil)
+	if got := tr.pick("c2", set, "example.com", 1); got != set {
+		t.Fatalf("one failure of %d should not move on, got %s", set.Fallback.MaxFailures, strategyOf(got))
+	}
+	tr.observeIncoming("c2", tcpFlagRST, nil)
+
+	got := tr.pick("c3", set, "example.com", 1)
+	if strategyOf(got) != "disorder" {
+		t.Fatalf("expected the first variant after %d failures, got %s", set.Fallback.MaxFailures, strategyOf(got))
+	}
+	if other := tr.pick("c4", set, "other.com", 1); other != set {
+		t.Error("domains move along the chain separately")
+	}
+
+	// A ServerHello keeps the domain on the variant that worked
+	tr.observeIncoming("c3", 0x18, serverHello)
+	if ds := tr.domains["fb|example.com"]; ds == nil || !ds.verified || ds.failures != 0 {
+		t.Fatalf("variant not verified: %+v", ds)
+	}
+	if _, ok := tr.conns["c3"]; ok {
+		t.Error("answered connection still watched")
+	}
+
+	// The last variant wraps around to the set itself
+	for _, c := range []string{"c5", "c6"} {
+		tr.pick(c, set, "example.com", 1)
+		tr.observeIncoming(c, tcpFlagRST, nil)
+	}
+	if got := tr.pick("c7", set, "example.com", 1); strategyOf(got) != "oob" {
+		t.Fatalf("expected the second variant, got %s", strategyOf(got))
+	}
+	for _, c := range []string{"c7", "c8"} {
+		tr.pick(c, set, "example.com", 1)
+		tr.observeIncoming(c, tcpFlagRST, nil)
+	}
+	if got := tr.pick("c9", set, "example.com", 1); got != set {
+		t.Fatalf("expected the chain to wrap to the set, got %s", strategyOf(got))
+	}
+
+	// The variant is forgotten after its TTL
+	tr.pick("c10", set, "example.com", 1)
+	tr.observeIncoming("c10", tcpFlagRST, nil)
+	tr.pick("c11", set, "example.com", 1)
+	tr.observeIncoming("c11", tcpFlagRST, nil)
+	clock.t = clock.t.Add(set.Fallback.TTL() + time.Second)
+	if got := tr.pick("c12", set, "example.com", 1); got != set {
+		t.Errorf("expired variant still used: %s", strategyOf(got))
+	}
+}
+
+func TestStrategyTrackerRetransmission(t *testing.T) {
+	clock := &testReasmClock{t: time.Unix(1000, 0)}
+	tr := newStrategyTracker(clock.now)
+	set := fallbackSet()
+	set.Fallback.MaxFailures = 1
+
+	tr.pick("c1", set, "example.com", 100)
+	// Retransmissions of one ClientHello count as a single failure
+	next := tr.pick("c1", set, "example.com", 100)
+	if next.Fragmentation.Strategy != "disorder" {
+		t.Fatalf("retransmitted ClientHello should move on, got %s", next.Fragmentation.Strategy)
+	}
+	tr.pick("c1", set, "example.com", 100)
+	tr.observeIncoming("c1", tcpFlagRST, nil)
+	if ds := tr.domains["fb|example.com"]; ds.variant != 1 {
+		t.Errorf("failure counted again after the retransmission: variant %d", ds.variant)
+	}
+
+	// Another sequence number on the same ports is a new connection
+	tr.pick("c2", set, "example.com", 100)
+	tr.pick("c2", set, "example.com", 5000)
+	if ds := tr.domains["fb|example.com"]; ds.variant != 1 || ds.failures != 0 {
+		t.Errorf("a new connection counted as a retransmission: %+v", ds)
+	}
+}
+
+func TestStrategyTrackerTimeout(t *testing.T) {
+	clock := &testReasmClock{t: time.Unix(1000, 0)}
+	tr := newStrategyTracker(clock.now)
+	set := fallbackSet()
+	set.Fallback.MaxFailures = 1
+
+	tr.pick("c1", set, "example.com", 1)
+	clock.t = clock.t.Add(set.Fallback.Timeout() - time.Millisecond)
+	tr.expireDue(clock.t)
+	if _, ok := tr.conns["c1"]; !ok {
+		t.Fatal("connection expired before its deadline")
+	}
+
+	clock.t = clock.t.Add(time.Millisecond)
+	tr.expireDue(clock.t)
+	if _, ok := tr.conns["c1"]; ok {
+		t.Fatal("connection not expired at its deadline")
+	}
+	if ds := tr.domains["fb|example.com"]; ds == nil || ds.variant != 1 {
+		t.Fatalf("timeout not counted as a failure: %+v", ds)
+	}
+
+	// A late ServerHello is no longer matched
+	tr.observeIncoming("c1", 0x18, serverHello)
+	if tr.domains["fb|example.com"].verified {
+		t.Error("late answer verified the variant")
+	}
+}
+
+// With the wall clock every ClientHello times out on its own, without
+// another pick or the periodic cleanup.
+func TestStrategyTrackerTimer(t *testing.T) {
+	tr := newStrategyTracker(nil)
+	set := fallbackSet()
+	set.Fallback.MaxFailures = 1
+	set.Fallback.TimeoutMs = 20
+
+	tr.pick("c1", set, "example.com", 1)
+	tr.pick("c2", set, "answered.com", 1)
+	tr.observeIncoming("c2", 0x18, serverHello)
+
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		tr.mu.Lock()
+		ds := tr.domains["fb|example.com"]
+		pending := len(tr.conns)
+		tr.mu.Unlock()
+		if ds != nil && ds.variant == 1 && pending == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("ClientHello did not time out: %+v, %d pending", ds, pending)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	if _, ok := tr.domains["fb|answered.com"]; ok {
+		t.Error("an answered ClientHello timed out")
+	}
+}
@@ -0,0 +1,97 @@
+package nfq
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/daniellavrushin/b4/config"
+	"github.com/daniellavrushin/b4/metrics"
+	"github.com/daniellavrushin/b4/sni"
+	"github.com/daniellavrushin/b4/sock"
+)
+
+// mutateHTTPRequest applies the length-preserving Host header tricks in place
+// and returns the offset inside payload where the request should be split
+// (0 if no split is wanted).
+func mutateHTTPRequest(payload []byte, cfg *config.HTTPConfig) int {
+	start, end, ok := sni.LocateHTTPHost(payload)
+	if !ok {
+		return 0
+	}
+	lineStart := bytes.LastIndexByte(payload[:start], '\n') + 1
+
+	if cfg.HostCase {
+		// "Host" -> "hOsT", value -> "eXaMpLe.CoM"
+		for i := lineStart; i < lineStart+4; i++ {
+			payload[i] = flipCase(payload[i], (i-lineStart)%2 == 1)
+		}
+		for i := start; i < end; i++ {
+			payload[i] = flipCase(payload[i], (i-start)%2 == 1)
+		}
+	}
+
+	if cfg.ExtraSpace {
+		// "GET / ...\r\nHost: x" -> "GET  / ...\r\nHost:x"
+		colon := lineStart + 4
+		methodEnd := bytes.IndexByte(payload, ' ')
+		if colon+1 < len(payload) && payload[colon+1] == ' ' && methodEnd > 0 && methodEnd < colon {
+			copy(payload[methodEnd+2:colon+2], payload[methodEnd+1:colon+1])
+			payload[methodEnd+1] = ' '
+		}
+	}
+
+	if cfg.SplitHost && end-start > 1 {
+		return start + (end-start)/2
+	}
+	return 0
+}
+
+func flipCase(b byte, upper bool) byte {
+	if upper && b >= 'a' && b <= 'z' {
+		return b - 32
+	}
+	if !upper && b >= 'A' && b <= 'Z' {
+		return b + 32
+	}
+	return b
+}
+
+func buildFakeHTTPRequest(host string) []byte {
+	return []byte(fmt.Sprintf("GET / HTTP/1.1\r\nHost: %s\r\nAccept: */*\r\n\r\n", host))
+}
+
+func (w *Worker) dropAndInjectHTTP(cfg *config.SetConfig, raw []byte, dst net.IP) {
+	defer metrics.ObserveInjection("http", time.Now())
+
+	pi, ok := ExtractPacketInfoV4(raw)
+	if !ok || pi.PayloadLen == 0 {
+		_ = w.sock.SendIPv4(raw, dst)
+		return
+	}
+
+	if cfg.HTTP.FakeRequest {
+		fake := BuildSegmentV4(raw, pi, buildFakeHTTPRequest(cfg.HTTP.FakeHost), 0, 0)
+		fake[8] = cfg.HTTP.FakeTTL
+		sock.FixIPv4Checksum(fake[:pi.IPHdrLen])
+		_ = w.sock.SendIPv4(fake, dst)
+	}
+
+	payload := make([]byte, pi.PayloadLen)
+	copy(payload, pi.Payload)
+	split := mutateHTTPRequest(payload, &cfg.HTTP)
+
+	if split <= 0 || split >= len(payload) {
+		_ = w.sock.SendIPv4(BuildSegmentV4(raw, pi, payload, 0, 0), dst)
+		return
+	}
+
+	seg1 := BuildSegmentV4(raw, pi, payload[:split], 0, 0)
+	ClearPSH(seg1, pi.IPHdrLen)
+	sock.FixTCPChecksum(seg1)
+	seg2 := BuildSegmentV4(raw, pi, payload[split:], uint32(split), 1)
+
+	delay := config.ResolveSeg2Delay(cfg.TCP.Seg2Delay, cfg.TCP.Seg2DelayMax)
+	w.SendTwoSegmentsV4(seg1, seg2, dst, delay, cfg.Fragmentation.ReverseOrder)
+}
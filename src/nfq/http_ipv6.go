@@ -0,0 +1,43 @@
+package nfq
+
+import (
+	"net"
+	"time"
+
+	"github.com/daniellavrushin/b4/config"
+	"github.com/daniellavrushin/b4/metrics"
+	"github.com/daniellavrushin/b4/sock"
+)
+
+func (w *Worker) dropAndInjectHTTPv6(cfg *config.SetConfig, raw []byte, dst net.IP) {
+	defer metrics.ObserveInjection("http", time.Now())
+
+	pi, ok := ExtractPacketInfoV6(raw)
+	if !ok || pi.PayloadLen == 0 {
+		_ = w.sock.SendIPv6(raw, dst)
+		return
+	}
+
+	if cfg.HTTP.FakeRequest {
+		fake := BuildSegmentV6(raw, pi, buildFakeHTTPRequest(cfg.HTTP.FakeHost), 0)
+		fake[7] = cfg.HTTP.FakeTTL
+		_ = w.sock.SendIPv6(fake, dst)
+	}
+
+	payload := make([]byte, pi.PayloadLen)
+	copy(payload, pi.Payload)
+	split := mutateHTTPRequest(payload, &cfg.HTTP)
+
+	if split <= 0 || split >= len(payload) {
+		_ = w.sock.SendIPv6(BuildSegmentV6(raw, pi, payload, 0), dst)
+		return
+	}
+
+	seg1 := BuildSegmentV6(raw, pi, payload[:split], 0)
+	ClearPSH(seg1, pi.IPHdrLen)
+	sock.FixTCPChecksumV6(seg1)
+	seg2 := BuildSegmentV6(raw, pi, payload[split:], uint32(split))
+
+	delay := config.ResolveSeg2Delay(cfg.TCP.Seg2Delay, cfg.TCP.Seg2DelayMax)
+	w.SendTwoSegmentsV6(seg1, seg2, dst, delay, cfg.Fragmentation.ReverseOrder)
+}
@@ -0,0 +1,99 @@
+package nfq
+
+import (
+	"testing"
+
+	"github.com/daniellavrushin/b4/config"
+)
+
+func TestMutateHTTPRequest(t *testing.T) {
+	const request = "GET /index.html HTTP/1.1\r\nUser-Agent: test\r\nHost: www.example.com\r\nAccept: */*\r\n\r\n"
+
+	tests := []struct {
+		name    string
+		request string
+		cfg     config.HTTPConfig
+		want    string
+		split   string // payload[split:] must start with this
+	}{
+		{
+			name:    "nothing enabled",
+			request: request,
+			want:    request,
+		},
+		{
+			name:    "host case",
+			request: request,
+			cfg:     config.HTTPConfig{HostCase: true},
+			want:    "GET /index.html HTTP/1.1\r\nUser-Agent: test\r\nhOsT: wWw.eXaMpLe.cOm\r\nAccept: */*\r\n\r\n",
+		},
+		{
+			name:    "host case of a lowercase header",
+			request: "GET / HTTP/1.1\r\nhost: EXAMPLE.COM\r\n\r\n",
+			cfg:     config.HTTPConfig{HostCase: true},
+			want:    "GET / HTTP/1.1\r\nhOsT: eXaMpLe.cOm\r\n\r\n",
+		},
+		{
+			name:    "extra space",
+			request: request,
+			cfg:     config.HTTPConfig{ExtraSpace: true},
+			want:    "GET  /index.html HTTP/1.1\r\nUser-Agent: test\r\nHost:www.example.com\r\nAccept: */*\r\n\r\n",
+		},
+		{
+			name:    "extra space without a space to move",
+			request: "GET / HTTP/1.1\r\nHost:\texample.com\r\n\r\n",
+			cfg:     config.HTTPConfig{ExtraSpace: true},
+			want:    "GET / HTTP/1.1\r\nHost:\texample.com\r\n\r\n",
+		},
+		{
+			name:    "split host",
+			request: request,
+			cfg:     config.HTTPConfig{SplitHost: true},
+			want:    request,
+			split:   "mple.com\r\n",
+		},
+		{
+			name:    "all of them",
+			request: request,
+			cfg:     config.HTTPConfig{HostCase: true, ExtraSpace: true, SplitHost: true},
+			want:    "GET  /index.html HTTP/1.1\r\nUser-Agent: test\r\nhOsT:wWw.eXaMpLe.cOm\r\nAccept: */*\r\n\r\n",
+			split:   "MpLe.cOm\r\n",
+		},
+		{
+			name:    "split a one letter host",
+			request: "GET / HTTP/1.1\r\nHost: x\r\n\r\n",
+			cfg:     config.HTTPConfig{SplitHost: true},
+			want:    "GET / HTTP/1.1\r\nHost: x\r\n\r\n",
+		},
+		{
+			name:    "missing Host",
+			request: "GET / HTTP/1.1\r\nAccept: */*\r\n\r\n",
+			cfg:     config.HTTPConfig{HostCase: true, ExtraSpace: true, SplitHost: true},
+			want:    "GET / HTTP/1.1\r\nAccept: */*\r\n\r\n",
+		},
+		{
+			// The first segment of a request split by the client ends
+			// before the Host line is complete
+			name:    "Host in a later segment",
+			request: "GET /index.html HTTP/1.1\r\nUser-Agent: test\r\nHost: www.exa",
+			cfg:     config.HTTPConfig{HostCase: true, ExtraSpace: true, SplitHost: true},
+			want:    "GET /index.html HTTP/1.1\r\nUser-Agent: test\r\nHost: www.exa",
+		},
+	}
+	for _, tt := range tests {
+		payload := []byte(tt.request)
+		split := mutateHTTPRequest(payload, &tt.cfg)
+		if string(payload) != tt.want {
+			t.Errorf("%s:\n got %q\nwant %q", tt.name, payload, tt.want)
+		}
+		if len(payload) != len(tt.request) {
+			t.Errorf("%s: length changed to %d", tt.name, len(payload))
+		}
+		switch {
+		case tt.split == "" && split != 0:
+			t.Errorf("%s: split at %d, want none", tt.name, split)
+		case tt.split != "" && (split <= 0 || string(payload[split:split+len(tt.split)]) != tt.split):
+			t.Errorf("%s: split at %d (%q), want before %q", tt.name, split, payload[split:], tt.split)
+		}
+	}
+}
@@ -2,19 +2,25 @@ package nfq
 
 import (
 	"encoding/binary"
+	"fmt"
 	"math/rand"
 	"net"
 	"time"
 
 	"github.com/daniellavrushin/b4/config"
 	"github.com/daniellavrushin/b4/log"
+	"github.com/daniellavrushin/b4/metrics"
 	"github.com/daniellavrushin/b4/sock"
 	"github.com/florianl/go-nfqueue"
 )
 
 var corruptionStrategies = []string{"badsum", "badseq", "badack", "all"}
 
-func (w *Worker) HandleIncoming(q *nfqueue.Nfqueue, id uint32, v byte, raw []byte, ihl int, src net.IP, dstStr string, dport uint16, srcStr string, sport uint16, payload []byte) int {
+func (w *Worker) HandleIncoming(q packetQueue, id uint32, v byte, raw []byte, ihl int, src net.IP, dstStr string, dport uint16, srcStr string, sport uint16, payload []byte) int {
+	if len(raw) > ihl+13 {
+		strategies.observeIncoming(fmt.Sprintf(connKeyFormat, dstStr, dport, srcStr, sport), raw[ihl+13], payload)
+	}
+
 	incomingSet := connState.GetSetForIncoming(dstStr, dport, srcStr, sport)
 
 	if incomingSet != nil && incomingSet.TCP.Incoming.Mode != config.ConfigOff {
@@ -63,6 +69,7 @@ func (w *Worker) HandleIncoming(q *nfqueue.Nfqueue, id uint32, v byte, raw []byt
 
 	if err := q.SetVerdict(id, nfqueue.NfAccept); err != nil {
 		log.Tracef("failed to accept incoming packet %d: %v", id, err)
+		metrics.RecordVerdictFailure(w.qnum)
 	}
 	return 0
 }
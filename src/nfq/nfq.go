@@ -13,6 +13,7 @@ import (
 
 	"github.com/daniellavrushin/b4/capture"
 	"github.com/daniellavrushin/b4/config"
+	"github.com/daniellavrushin/b4/connlog"
 	"github.com/daniellavrushin/b4/log"
 	"github.com/daniellavrushin/b4/metrics"
 	"github.com/daniellavrushin/b4/quic"
@@ -32,7 +33,7 @@ func (w *Worker) Start() error {
 	if err != nil {
 		return err
 	}
-	w.sock = s
+	w.sock = tapSender{s}
 
 	c := nfqueue.Config{
 		NfQueue:      w.qnum,
@@ -55,510 +56,696 @@ func (w *Worker) Start() error {
 		pid := os.Getpid()
 		log.Tracef("NFQ bound pid=%d queue=%d", pid, w.qnum)
 		defer w.wg.Done()
-		_ = q.RegisterWithErrorFunc(w.ctx, func(a nfqueue.Attribute) int {
-			cfg := w.getConfig()
-			set := cfg.MainSet
-
-			matcher := w.getMatcher()
-			id := *a.PacketID
-
-			if a.Mark != nil && *a.Mark == uint32(mark) {
-				if err := q.SetVerdict(id, nfqueue.NfAccept); err != nil {
-					log.Tracef("failed to set verdict on packet %d: %v", id, err)
+		_ = q.RegisterWithErrorFunc(w.ctx, w.handlePacket, func(e error) int {
+			if errors.Is(e, syscall.ENOBUFS) {
+				metrics.RecordQueueOverflow(w.qnum)
+				now := time.Now().Unix()
+				last := atomic.LoadInt64(&w.lastOverflowLog)
+				if now-last >= 5 {
+					if atomic.CompareAndSwapInt64(&w.lastOverflowLog, last, now) {
+						log.Warnf("nfq queue %d overflow - packets dropped", w.qnum)
+					}
 				}
 				return 0
 			}
-
-			if !w.matchesInterface(a) {
-				if err := q.SetVerdict(id, nfqueue.NfAccept); err != nil {
-					log.Tracef("failed to set verdict on packet %d: %v", id, err)
-				}
+			if w.ctx.Err() != nil {
 				return 0
 			}
-
-			select {
-			case <-w.ctx.Done():
+			if errors.Is(e, os.ErrClosed) || errors.Is(e, net.ErrClosed) || errors.Is(e, syscall.EBADF) {
+				return 0
+			}
+			if ne, ok := e.(net.Error); ok && ne.Timeout() {
+				return 0
+			}
+			msg := e.Error()
+			if strings.Contains(msg, "use of closed file") || strings.Contains(msg, "file descriptor") {
 				return 0
-			default:
 			}
+			log.Errorf("nfq: %v", e)
+			return 0
+		})
+	}()
 
-			atomic.AddUint64(&w.packetsProcessed, 1)
+	return nil
+}
 
-			if a.PacketID == nil || a.Payload == nil || len(*a.Payload) == 0 {
-				if a.PacketID != nil && q != nil {
-					if err := q.SetVerdict(*a.PacketID, nfqueue.NfAccept); err != nil {
-						log.Tracef("failed to set verdict on invalid packet %d: %v", *a.PacketID, err)
-					}
-				}
-				return 0
+// handlePacket is the verdict logic for one queued packet.
+func (w *Worker) handlePacket(a nfqueue.Attribute) int {
+	cfg := w.getConfig()
+	set := cfg.MainSet
+	mark := cfg.Queue.Mark
+	q := w.q
+
+	sets := w.getMatcher()
+	id := *a.PacketID
+
+	if a.Mark != nil && *a.Mark == uint32(mark) {
+		if err := q.SetVerdict(id, nfqueue.NfAccept); err != nil {
+			log.Tracef("failed to set verdict on packet %d: %v", id, err)
+			metrics.RecordVerdictFailure(w.qnum)
+		}
+		return 0
+	}
+
+	// Discovery probes are evaluated against the candidate config
+	if a.Mark != nil && *a.Mark == uint32(cfg.System.Checker.ProbeMark) {
+		if sb := w.getProbe(); sb != nil {
+			cfg = sb.cfg
+			set = cfg.MainSet
+			sets = sb.matcher
+		}
+	}
+
+	if !w.matchesInterface(a) {
+		if err := q.SetVerdict(id, nfqueue.NfAccept); err != nil {
+			log.Tracef("failed to set verdict on packet %d: %v", id, err)
+			metrics.RecordVerdictFailure(w.qnum)
+		}
+		return 0
+	}
+
+	select {
+	case <-w.ctx.Done():
+		return 0
+	default:
+	}
+
+	atomic.AddUint64(&w.packetsProcessed, 1)
+	metrics.RecordQueuePacket(w.qnum)
+
+	if a.PacketID == nil || a.Payload == nil || len(*a.Payload) == 0 {
+		if a.PacketID != nil && q != nil {
+			if err := q.SetVerdict(*a.PacketID, nfqueue.NfAccept); err != nil {
+				log.Tracef("failed to set verdict on invalid packet %d: %v", *a.PacketID, err)
+				metrics.RecordVerdictFailure(w.qnum)
 			}
-			raw := *a.Payload
+		}
+		return 0
+	}
+	raw := *a.Payload
 
-			v := raw[0] >> 4
-			if v != IPv4 && v != IPv6 {
-				if err := q.SetVerdict(id, nfqueue.NfAccept); err != nil {
-					log.Tracef("failed to set verdict on packet %d: %v", id, err)
-				}
-				return 0
+	v := raw[0] >> 4
+	if v != IPv4 && v != IPv6 {
+		if err := q.SetVerdict(id, nfqueue.NfAccept); err != nil {
+			log.Tracef("failed to set verdict on packet %d: %v", id, err)
+			metrics.RecordVerdictFailure(w.qnum)
+		}
+		return 0
+	}
+	var proto uint8
+	var src, dst net.IP
+	var ihl int
+	if v == IPv4 {
+		if len(raw) < 20 {
+			if err := q.SetVerdict(id, nfqueue.NfAccept); err != nil {
+				log.Tracef("failed to set verdict on packet %d: %v", id, err)
+				metrics.RecordVerdictFailure(w.qnum)
 			}
-			var proto uint8
-			var src, dst net.IP
-			var ihl int
-			if v == IPv4 {
-				if len(raw) < 20 {
-					if err := q.SetVerdict(id, nfqueue.NfAccept); err != nil {
-						log.Tracef("failed to set verdict on packet %d: %v", id, err)
-					}
-					return 0
-				}
-				ihl = int(raw[0]&0x0f) * 4
-				if len(raw) < ihl {
-					if err := q.SetVerdict(id, nfqueue.NfAccept); err != nil {
-						log.Tracef("failed to set verdict on packet %d: %v", id, err)
-					}
-					return 0
-				}
+			return 0
+		}
+		ihl = int(raw[0]&0x0f) * 4
+		if len(raw) < ihl {
+			if err := q.SetVerdict(id, nfqueue.NfAccept); err != nil {
+				log.Tracef("failed to set verdict on packet %d: %v", id, err)
+				metrics.RecordVerdictFailure(w.qnum)
+			}
+			return 0
+		}
 
-				fragOffset := binary.BigEndian.Uint16(raw[6:8]) & 0x1FFF
-				moreFragments := (binary.BigEndian.Uint16(raw[6:8]) & 0x2000) != 0
+		fragOffset := binary.BigEndian.Uint16(raw[6:8]) & 0x1FFF
+		moreFragments := (binary.BigEndian.Uint16(raw[6:8]) & 0x2000) != 0
 
-				if fragOffset != 0 || moreFragments {
-					if err := q.SetVerdict(id, nfqueue.NfAccept); err != nil {
-						log.Tracef("failed to accept fragmented IPv4 packet %d: %v", id, err)
-					}
-					return 0
-				}
+		if fragOffset != 0 || moreFragments {
+			if err := q.SetVerdict(id, nfqueue.NfAccept); err != nil {
+				log.Tracef("failed to accept fragmented IPv4 packet %d: %v", id, err)
+				metrics.RecordVerdictFailure(w.qnum)
+			}
+			return 0
+		}
 
-				proto = raw[9]
-				src = net.IP(raw[12:16])
-				dst = net.IP(raw[16:20])
+		proto = raw[9]
+		src = net.IP(raw[12:16])
+		dst = net.IP(raw[16:20])
 
-			} else {
-				if len(raw) < IPv6HeaderLen {
+	} else {
+		if len(raw) < IPv6HeaderLen {
+			if err := q.SetVerdict(id, nfqueue.NfAccept); err != nil {
+				log.Tracef("failed to set verdict on packet %d: %v", id, err)
+				metrics.RecordVerdictFailure(w.qnum)
+			}
+			return 0
+		}
+		ihl = IPv6HeaderLen
+		nextHeader := raw[6]
+		offset := 40
+
+		for {
+			switch nextHeader {
+			case 0, 43, 60:
+				if len(raw) < offset+2 {
 					if err := q.SetVerdict(id, nfqueue.NfAccept); err != nil {
 						log.Tracef("failed to set verdict on packet %d: %v", id, err)
+						metrics.RecordVerdictFailure(w.qnum)
 					}
 					return 0
 				}
-				ihl = IPv6HeaderLen
-				nextHeader := raw[6]
-				offset := 40
-
-				for {
-					switch nextHeader {
-					case 0, 43, 60:
-						if len(raw) < offset+2 {
-							if err := q.SetVerdict(id, nfqueue.NfAccept); err != nil {
-								log.Tracef("failed to set verdict on packet %d: %v", id, err)
-							}
-							return 0
-						}
-						nextHeader = raw[offset]
-						hdrLen := int(raw[offset+1])*8 + 8
-						offset += hdrLen
-					case 44:
-						if err := q.SetVerdict(id, nfqueue.NfAccept); err != nil {
-							log.Tracef("failed to accept fragmented IPv6 packet %d: %v", id, err)
-						}
-						return 0
-					default:
-						goto done
-					}
-				}
-			done:
-				proto = nextHeader
-				ihl = offset
-				src = net.IP(raw[8:24])
-				dst = net.IP(raw[24:40])
-			}
-
-			if src.IsLoopback() || dst.IsLoopback() {
+				nextHeader = raw[offset]
+				hdrLen := int(raw[offset+1])*8 + 8
+				offset += hdrLen
+			case 44:
 				if err := q.SetVerdict(id, nfqueue.NfAccept); err != nil {
-					log.Tracef("failed to set verdict on packet %d: %v", id, err)
+					log.Tracef("failed to accept fragmented IPv6 packet %d: %v", id, err)
+					metrics.RecordVerdictFailure(w.qnum)
 				}
 				return 0
+			default:
+				goto done
 			}
-			srcStr := src.String()
-			dstStr := dst.String()
+		}
+	done:
+		proto = nextHeader
+		ihl = offset
+		src = net.IP(raw[8:24])
+		dst = net.IP(raw[24:40])
+	}
 
-			srcMac := w.getMacByIp(srcStr)
+	if src.IsLoopback() || dst.IsLoopback() {
+		if err := q.SetVerdict(id, nfqueue.NfAccept); err != nil {
+			log.Tracef("failed to set verdict on packet %d: %v", id, err)
+			metrics.RecordVerdictFailure(w.qnum)
+		}
+		return 0
+	}
+	srcStr := src.String()
+	dstStr := dst.String()
 
-			matched, st := matcher.MatchIP(dst)
-			if matched {
-				set = st
+	srcMac := w.getMacByIp(srcStr)
+	matcher := sets.forSource(src, srcMac)
+
+	matched, st := matcher.MatchIP(dst)
+	if matched {
+		set = st
+	}
+
+	if proto == 6 && len(raw) >= ihl+TCPHeaderMinLen {
+		tcp := raw[ihl:]
+		if len(tcp) < TCPHeaderMinLen {
+			if err := q.SetVerdict(id, nfqueue.NfAccept); err != nil {
+				log.Tracef("failed to set verdict on packet %d: %v", id, err)
+				metrics.RecordVerdictFailure(w.qnum)
+			}
+			return 0
+		}
+		datOff := int((tcp[12]>>4)&0x0f) * 4
+		if len(tcp) < datOff {
+			if err := q.SetVerdict(id, nfqueue.NfAccept); err != nil {
+				log.Tracef("failed to set verdict on packet %d: %v", id, err)
+				metrics.RecordVerdictFailure(w.qnum)
 			}
+			return 0
+		}
+		payload := tcp[datOff:]
+		sport := binary.BigEndian.Uint16(tcp[0:2])
+		dport := binary.BigEndian.Uint16(tcp[2:4])
+		connKey := fmt.Sprintf(connKeyFormat, srcStr, sport, dstStr, dport)
 
-			if proto == 6 && len(raw) >= ihl+TCPHeaderMinLen {
-				tcp := raw[ihl:]
-				if len(tcp) < TCPHeaderMinLen {
-					if err := q.SetVerdict(id, nfqueue.NfAccept); err != nil {
-						log.Tracef("failed to set verdict on packet %d: %v", id, err)
-					}
-					return 0
-				}
-				datOff := int((tcp[12]>>4)&0x0f) * 4
-				if len(tcp) < datOff {
-					if err := q.SetVerdict(id, nfqueue.NfAccept); err != nil {
-						log.Tracef("failed to set verdict on packet %d: %v", id, err)
-					}
-					return 0
-				}
-				payload := tcp[datOff:]
-				sport := binary.BigEndian.Uint16(tcp[0:2])
-				dport := binary.BigEndian.Uint16(tcp[2:4])
+		if dport == 53 {
+			return w.processDnsTCPPacket(matcher, v, raw, ihl, datOff, payload, id)
+		}
 
-				if sport == HTTPSPort {
-					return w.HandleIncoming(q, id, v, raw, ihl, src, dstStr, dport, srcStr, sport, payload)
-				}
+		if sport == HTTPSPort {
+			return w.HandleIncoming(q, id, v, raw, ihl, src, dstStr, dport, srcStr, sport, payload)
+		}
 
-				// Packet duplication path: duplicate ALL outgoing TCP/443 packets
-				// without TLS/SNI parsing. Bypasses DPI evasion entirely.
-				if matched && dport == HTTPSPort && set.TCP.Duplicate.Enabled && set.TCP.Duplicate.Count > 0 {
-					log.Tracef("TCP duplicate to %s:%d (%d copies, set: %s)", dstStr, dport, set.TCP.Duplicate.Count, set.Name)
+		// Packet duplication path: duplicate ALL outgoing TCP/443 packets
+		// without TLS/SNI parsing. Bypasses DPI evasion entirely.
+		if matched && dport == HTTPSPort && set.TCP.Duplicate.Enabled && set.TCP.Duplicate.Count > 0 {
+			log.Tracef("TCP duplicate to %s:%d (%d copies, set: %s)", dstStr, dport, set.TCP.Duplicate.Count, set.Name)
 
-					m := metrics.GetMetricsCollector()
-					m.RecordConnection("TCP-DUP", "", srcStr, dstStr, true, srcMac, set.Name)
-					m.RecordPacket(uint64(len(raw)))
+			m := metrics.GetMetricsCollector()
+			m.RecordConnection("TCP-DUP", "", srcStr, dstStr, true, srcMac, set.Name)
+			m.RecordPacket(uint64(len(raw)))
+			tapOriginal(raw, "", set, "TCP-DUP")
+			recordConn(connKey, connEvent("TCP-DUP", sets, srcMac, src, sport, dst, dport, ""), set, connlog.OutcomeDuplicated)
 
-					if !log.IsDiscoveryActive() {
-						log.Infof(",TCP-DUP,,,%s:%d,%s,%s:%d,%s", srcStr, sport, set.Name, dstStr, dport, srcMac)
-					}
+			if !log.IsDiscoveryActive() {
+				log.Infof(",TCP-DUP,,,%s:%d,%s,%s:%d,%s", srcStr, sport, set.Name, dstStr, dport, srcMac)
+			}
 
-					if err := q.SetVerdict(id, nfqueue.NfDrop); err != nil {
-						log.Tracef("failed to set drop verdict on packet %d: %v", id, err)
-						return 0
-					}
+			if err := q.SetVerdict(id, nfqueue.NfDrop); err != nil {
+				log.Tracef("failed to set drop verdict on packet %d: %v", id, err)
+				metrics.RecordVerdictFailure(w.qnum)
+				return 0
+			}
 
-					for i := 0; i < set.TCP.Duplicate.Count; i++ {
-						if v == IPv4 {
-							_ = w.sock.SendIPv4(raw, dst)
-						} else {
-							_ = w.sock.SendIPv6(raw, dst)
-						}
-					}
-					return 0
+			for i := 0; i < set.TCP.Duplicate.Count; i++ {
+				if v == IPv4 {
+					_ = w.sock.SendIPv4(raw, dst)
+				} else {
+					_ = w.sock.SendIPv6(raw, dst)
 				}
+			}
+			return 0
+		}
 
-				tcpFlags := tcp[13]
-				isSyn := (tcpFlags & 0x02) != 0
-				isAck := (tcpFlags & 0x10) != 0
-				isRst := (tcpFlags & 0x04) != 0
-				if isRst && dport == HTTPSPort {
-					log.Tracef("RST received from %s:%d", dstStr, dport)
-				}
+		tcpFlags := tcp[13]
+		isSyn := (tcpFlags & 0x02) != 0
+		isAck := (tcpFlags & 0x10) != 0
+		isRst := (tcpFlags & 0x04) != 0
+		if isRst && dport == HTTPSPort {
+			log.Tracef("RST received from %s:%d", dstStr, dport)
+		}
 
-				if isSyn && !isAck && dport == HTTPSPort && matched && !set.TCP.Duplicate.Enabled {
-					log.Tracef("TCP SYN to %s:%d (set: %s)", dstStr, dport, set.Name)
+		if isSyn && !isAck && dport == HTTPSPort && matched && !set.TCP.Duplicate.Enabled {
+			log.Tracef("TCP SYN to %s:%d (set: %s)", dstStr, dport, set.Name)
 
-					metrics := metrics.GetMetricsCollector()
-					metrics.RecordConnection("TCP-SYN", "", srcStr, dstStr, true, srcMac, set.Name)
+			m := metrics.GetMetricsCollector()
+			m.RecordConnection("TCP-SYN", "", srcStr, dstStr, true, srcMac, set.Name)
+			tapOriginal(raw, "", set, "TCP-SYN")
+			recordConn(connKey, connEvent("TCP-SYN", sets, srcMac, src, sport, dst, dport, ""), set, connlog.OutcomeInjected)
 
-					if v == IPv4 {
-						modsyn := raw
+			if v == IPv4 {
+				modsyn := raw
 
-						if set.TCP.SynFake {
-							w.sendFakeSyn(set, raw, ihl, datOff)
-						}
+				if set.TCP.SynFake {
+					w.sendFakeSyn(set, raw, ihl, datOff)
+				}
 
-						if set.Fragmentation.Strategy != config.ConfigNone && set.Faking.TCPMD5 {
-							w.sendFakeSynWithMD5(set, raw, ihl, dst)
-						}
+				if set.Fragmentation.Strategy != config.ConfigNone && set.Faking.TCPMD5 {
+					w.sendFakeSynWithMD5(set, raw, ihl, dst)
+				}
 
-						_ = w.sock.SendIPv4(modsyn, dst)
-					} else {
-						if set.TCP.SynFake {
-							w.sendFakeSynV6(set, raw, ihl, datOff)
-						}
+				_ = w.sock.SendIPv4(modsyn, dst)
+			} else {
+				if set.TCP.SynFake {
+					w.sendFakeSynV6(set, raw, ihl, datOff)
+				}
 
-						if set.Fragmentation.Strategy != config.ConfigNone && set.Faking.TCPMD5 {
-							w.sendFakeSynWithMD5V6(set, raw, dst)
-						}
+				if set.Fragmentation.Strategy != config.ConfigNone && set.Faking.TCPMD5 {
+					w.sendFakeSynWithMD5V6(set, raw, dst)
+				}
 
-						_ = w.sock.SendIPv6(raw, dst)
-					}
+				_ = w.sock.SendIPv6(raw, dst)
+			}
 
+			if err := q.SetVerdict(id, nfqueue.NfDrop); err != nil {
+				log.Tracef("failed to set drop verdict on packet %d: %v", id, err)
+				metrics.RecordVerdictFailure(w.qnum)
+			}
+			return 0
+		}
+
+		host := ""
+		matchedIP := matched
+		matchedSNI := false
+		ipTarget := ""
+		sniTarget := ""
+
+		// Original segments of a reassembled ClientHello, released
+		// unchanged if the connection is not a target
+		var heldSegments [][]byte
+
+		if dport == HTTPSPort && len(payload) > 0 {
+			if w.reasm.pending(connKey) {
+				state, combined, segments := w.reasm.feed(connKey, raw, ihl, datOff)
+				switch state {
+				case reasmHeld:
 					if err := q.SetVerdict(id, nfqueue.NfDrop); err != nil {
 						log.Tracef("failed to set drop verdict on packet %d: %v", id, err)
+						metrics.RecordVerdictFailure(w.qnum)
 					}
 					return 0
+				case reasmComplete:
+					// The combined packet carries the first segment's
+					// headers and so the initial sequence number
+					raw = combined
+					tcp = raw[ihl:]
+					datOff = int((raw[ihl+12]>>4)&0x0f) * 4
+					payload = raw[ihl+datOff:]
+					heldSegments = segments
 				}
-
-				host := ""
-				matchedIP := matched
-				matchedSNI := false
-				ipTarget := ""
-				sniTarget := ""
-
-				if dport == HTTPSPort && len(payload) > 0 {
-					log.Tracef("TCP payload to %s: len=%d, first5=%x", dstStr, len(payload), payload[:min(5, len(payload))])
-					if len(payload) >= 5 && payload[0] == 0x16 {
-						log.Tracef("TLS record: type=%x ver=%x%x len=%d", payload[0], payload[1], payload[2],
-							int(payload[3])<<8|int(payload[4]))
+			} else if needsReassembly(payload) {
+				// Skip buffering when the first segment already tells us
+				// the connection is not interesting
+				partialHost, _ := sni.ParseTLSClientHelloSNI(payload)
+				skip := false
+				if partialHost != "" && !matchedIP {
+					hit, _ := matcher.MatchSNI(partialHost)
+					skip = !hit
+				}
+				if !skip && w.reasm.start(w, connKey, v, raw, ihl, datOff, dst) {
+					if err := q.SetVerdict(id, nfqueue.NfDrop); err != nil {
+						log.Tracef("failed to set drop verdict on packet %d: %v", id, err)
+						metrics.RecordVerdictFailure(w.qnum)
 					}
-					connKey := fmt.Sprintf(connKeyFormat, srcStr, sport, dstStr, dport)
-
-					host, _ = sni.ParseTLSClientHelloSNI(payload)
+					return 0
+				}
+			}
 
-					if captureManager := capture.GetManager(cfg); captureManager != nil {
-						captureManager.CapturePayload(connKey, host, "tls", payload)
-					}
+			log.Tracef("TCP payload to %s: len=%d, first5=%x", dstStr, len(payload), payload[:min(5, len(payload))])
+			if len(payload) >= 5 && payload[0] == 0x16 {
+				log.Tracef("TLS record: type=%x ver=%x%x len=%d", payload[0], payload[1], payload[2],
+					int(payload[3])<<8|int(payload[4]))
+			}
 
-					if host != "" {
-						if mSNI, stSNI := matcher.MatchSNI(host); mSNI {
-							matchedSNI = true
-							matched = true
-							set = stSNI
-							matcher.LearnIPToDomain(dst, host, stSNI)
-						}
-					}
-				}
+			host, _ = sni.ParseTLSClientHelloSNI(payload)
 
-				if matchedIP {
-					ipTarget = st.Name
-				}
-				if matchedSNI {
-					sniTarget = set.Name
-				}
+			if captureManager := capture.GetManager(cfg); captureManager != nil {
+				captureManager.CapturePayload(connKey, host, "tls", payload)
+			}
 
-				if !log.IsDiscoveryActive() {
-					log.Infof(",TCP,%s,%s,%s:%d,%s,%s:%d,%s", sniTarget, host, srcStr, sport, ipTarget, dstStr, dport, srcMac)
+			if host != "" {
+				if mSNI, stSNI := matcher.MatchSNI(host); mSNI {
+					matchedSNI = true
+					matched = true
+					set = stSNI
+					matcher.LearnIPToDomain(dst, host, stSNI)
 				}
-
-				{
-					m := metrics.GetMetricsCollector()
-					setName := ""
-					if matched {
-						setName = set.Name
-					}
-					m.RecordConnection("TCP", host, srcStr, dstStr, matched, srcMac, setName)
-					m.RecordPacket(uint64(len(raw)))
+			}
+		} else if dport == HTTPPort && len(payload) > 0 {
+			host, _ = sni.ParseHTTPHost(payload)
+			if host != "" {
+				if mSNI, stSNI := matcher.MatchSNI(host); mSNI && stSNI.HTTP.Enabled {
+					matchedSNI = true
+					matched = true
+					set = stSNI
+					matcher.LearnIPToDomain(dst, host, stSNI)
 				}
+			}
+		}
 
-				if matched {
-					if set.TCP.Incoming.Mode != config.ConfigOff {
-						connKey := fmt.Sprintf(connKeyFormat, srcStr, sport, dstStr, dport)
-						connState.RegisterOutgoing(connKey, set)
-					}
-
-					packetCopy := make([]byte, len(raw))
-					copy(packetCopy, raw)
+		if matchedIP {
+			ipTarget = st.Name
+		}
+		if matchedSNI {
+			sniTarget = set.Name
+		}
 
-					if set.TCP.DropSACK {
-						if v == 4 {
-							packetCopy = sock.StripSACKFromTCP(packetCopy)
-						} else {
-							packetCopy = sock.StripSACKFromTCPv6(packetCopy)
-						}
-					}
+		if !log.IsDiscoveryActive() {
+			log.Infof(",TCP,%s,%s,%s:%d,%s,%s:%d,%s", sniTarget, host, srcStr, sport, ipTarget, dstStr, dport, srcMac)
+		}
 
-					dstCopy := make(net.IP, len(dst))
-					copy(dstCopy, dst)
-					setCopy := set
+		{
+			m := metrics.GetMetricsCollector()
+			setName := ""
+			if matched {
+				setName = set.Name
+			}
+			m.RecordConnection("TCP", host, srcStr, dstStr, matched, srcMac, setName)
+			m.RecordPacket(uint64(len(raw)))
+		}
 
-					if err := q.SetVerdict(id, nfqueue.NfDrop); err != nil {
-						log.Tracef("failed to set drop verdict on packet %d: %v", id, err)
-						return 0
-					}
+		// Only packets a decision was taken on go to the history, bare
+		// ACKs of a target carry nothing to decide on
+		var ev connlog.Event
+		if len(payload) > 0 && (host != "" || matched) {
+			ev = connEvent("TCP", sets, srcMac, src, sport, dst, dport, host)
+		}
+		outcome := connlog.OutcomePassed
 
-					w.wg.Add(1)
-					go func(s *config.SetConfig, pkt []byte, d net.IP) {
-						defer w.wg.Done()
-						if v == 4 {
-							w.dropAndInjectTCP(s, pkt, d)
-						} else {
-							w.dropAndInjectTCPv6(s, pkt, d)
-						}
-					}(setCopy, packetCopy, dstCopy)
-					return 0
-				}
+		// Flows past their set's packet limit are passed through
+		if matched && !flowBudget.spend(connKey, set.TCP.ConnBytesLimit) {
+			matched = false
+			outcome = connlog.OutcomeOverBudget
+		}
 
+		if matched && dport == HTTPPort {
+			// Only HTTP requests of sets with HTTP evasion enabled are touched
+			if !set.HTTP.Enabled || !sni.IsHTTPRequest(payload) {
+				recordConn(connKey, ev, set, connlog.OutcomePassed)
 				if err := q.SetVerdict(id, nfqueue.NfAccept); err != nil {
 					log.Tracef("failed to set verdict on packet %d: %v", id, err)
+					metrics.RecordVerdictFailure(w.qnum)
 				}
 				return 0
 			}
 
-			if proto == 17 && len(raw) >= ihl+8 {
-				udp := raw[ihl:]
-				if len(udp) < 8 {
-					if err := q.SetVerdict(id, nfqueue.NfAccept); err != nil {
-						log.Tracef("failed to set verdict on packet %d: %v", id, err)
-					}
-					return 0
-				}
+			tapOriginal(raw, host, set, "TCP")
+			recordConn(connKey, ev, set, connlog.OutcomeInjected)
+			packetCopy := make([]byte, len(raw))
+			copy(packetCopy, raw)
+			dstCopy := make(net.IP, len(dst))
+			copy(dstCopy, dst)
 
-				payload := udp[8:]
-				sport := binary.BigEndian.Uint16(udp[0:2])
-				dport := binary.BigEndian.Uint16(udp[2:4])
-				connKey := fmt.Sprintf(connKeyFormat, srcStr, sport, dstStr, dport)
+			if err := q.SetVerdict(id, nfqueue.NfDrop); err != nil {
+				log.Tracef("failed to set drop verdict on packet %d: %v", id, err)
+				metrics.RecordVerdictFailure(w.qnum)
+				return 0
+			}
 
-				if sport == 53 || dport == 53 {
-					return w.processDnsPacket(v, sport, dport, payload, raw, ihl, id)
+			w.wg.Add(1)
+			go func(s *config.SetConfig, pkt []byte, d net.IP) {
+				defer w.wg.Done()
+				if v == IPv4 {
+					w.dropAndInjectHTTP(s, pkt, d)
+				} else {
+					w.dropAndInjectHTTPv6(s, pkt, d)
 				}
+			}(set, packetCopy, dstCopy)
+			return 0
+		}
 
-				if utils.IsPrivateIP(dst) {
-					if err := q.SetVerdict(id, nfqueue.NfAccept); err != nil {
-						log.Tracef("failed to set verdict on packet %d: %v", id, err)
-					}
-					return 0
-				}
+		if matched {
+			if dport == HTTPSPort && host != "" && set.Fallback.Enabled {
+				set = strategies.pick(connKey, set, host, binary.BigEndian.Uint32(tcp[4:8]))
+			}
 
-				matchedIP := matched
-				matchedQUIC := false
-				isSTUN := false
-				host := ""
-				ipTarget := ""
-				sniTarget := ""
+			if set.TCP.Incoming.Mode != config.ConfigOff {
+				connState.RegisterOutgoing(connKey, set)
+			}
+			tapOriginal(raw, host, set, "TCP")
+			recordConn(connKey, ev, set, connlog.OutcomeInjected)
 
-				if matchedIP {
-					ipTarget = st.Name
-				}
+			packetCopy := make([]byte, len(raw))
+			copy(packetCopy, raw)
 
-				if !matchedIP {
-					if mLearned, learnedSet, learnedDomain := matcher.MatchLearnedIP(dst); mLearned {
-						matchedIP = true
-						matched = true
-						set = learnedSet
-						host = learnedDomain
-						sniTarget = learnedSet.Name
-						ipTarget = learnedSet.Name
-					}
+			if set.TCP.DropSACK {
+				if v == 4 {
+					packetCopy = sock.StripSACKFromTCP(packetCopy)
+				} else {
+					packetCopy = sock.StripSACKFromTCPv6(packetCopy)
 				}
+			}
 
-				isSTUN = stun.IsSTUNMessage(payload)
+			dstCopy := make(net.IP, len(dst))
+			copy(dstCopy, dst)
+			setCopy := set
 
-				if host == "" {
-					if h, ok := sni.ParseQUICClientHelloSNI(payload); ok {
-						host = h
-					}
-				}
+			if err := q.SetVerdict(id, nfqueue.NfDrop); err != nil {
+				log.Tracef("failed to set drop verdict on packet %d: %v", id, err)
+				metrics.RecordVerdictFailure(w.qnum)
+				return 0
+			}
 
-				if host != "" {
-					if mSNI, sniSet := matcher.MatchSNI(host); mSNI {
-						matchedQUIC = true
-						set = sniSet
-						sniTarget = sniSet.Name
-						matcher.LearnIPToDomain(dst, host, sniSet)
-					}
+			w.wg.Add(1)
+			go func(s *config.SetConfig, pkt []byte, d net.IP) {
+				defer w.wg.Done()
+				if v == 4 {
+					w.dropAndInjectTCP(s, pkt, d)
+				} else {
+					w.dropAndInjectTCPv6(s, pkt, d)
 				}
+			}(setCopy, packetCopy, dstCopy)
+			return 0
+		}
 
-				if !matchedQUIC && matchedIP && set.UDP.FilterQUIC == "all" {
-					if quic.IsInitial(payload) {
-						matchedQUIC = true
-					}
-				}
+		recordConn(connKey, ev, set, outcome)
 
-				if captureManager := capture.GetManager(cfg); captureManager != nil {
-					captureManager.CapturePayload(connKey, host, "quic", payload)
-				}
+		if heldSegments != nil {
+			if err := q.SetVerdict(id, nfqueue.NfDrop); err != nil {
+				log.Tracef("failed to set drop verdict on packet %d: %v", id, err)
+				metrics.RecordVerdictFailure(w.qnum)
+				return 0
+			}
+			w.releaseSegments(v, heldSegments, dst)
+			return 0
+		}
 
-				shouldHandle := (matchedIP || matchedQUIC) && !(isSTUN && set.UDP.FilterSTUN)
+		if err := q.SetVerdict(id, nfqueue.NfAccept); err != nil {
+			log.Tracef("failed to set verdict on packet %d: %v", id, err)
+			metrics.RecordVerdictFailure(w.qnum)
+		}
+		return 0
+	}
 
-				matched = shouldHandle
+	if proto == 17 && len(raw) >= ihl+8 {
+		udp := raw[ihl:]
+		if len(udp) < 8 {
+			if err := q.SetVerdict(id, nfqueue.NfAccept); err != nil {
+				log.Tracef("failed to set verdict on packet %d: %v", id, err)
+				metrics.RecordVerdictFailure(w.qnum)
+			}
+			return 0
+		}
 
-				if !log.IsDiscoveryActive() {
-					log.Infof(",UDP,%s,%s,%s:%d,%s,%s:%d,%s", sniTarget, host, srcStr, sport, ipTarget, dstStr, dport, srcMac)
-				}
+		payload := udp[8:]
+		sport := binary.BigEndian.Uint16(udp[0:2])
+		dport := binary.BigEndian.Uint16(udp[2:4])
+		connKey := fmt.Sprintf(connKeyFormat, srcStr, sport, dstStr, dport)
 
-				if isSTUN && set.UDP.FilterSTUN {
-					if err := q.SetVerdict(id, nfqueue.NfAccept); err != nil {
-						log.Tracef("failed to set verdict on packet %d: %v", id, err)
-					}
-					return 0
-				}
+		if sport == 53 || dport == 53 {
+			if sport == 53 {
+				// Responses are learned for the device that asked
+				matcher = sets.forSource(dst, w.getMacByIp(dstStr))
+			}
+			return w.processDnsPacket(matcher, v, sport, dport, payload, raw, ihl, id)
+		}
 
-				if !shouldHandle {
-					m := metrics.GetMetricsCollector()
-					m.RecordConnection("UDP", host, srcStr, dstStr, false, srcMac, "")
-					m.RecordPacket(uint64(len(raw)))
-					if err := q.SetVerdict(id, nfqueue.NfAccept); err != nil {
-						log.Tracef("failed to set verdict on packet %d: %v", id, err)
-					}
-					return 0
-				}
+		if utils.IsPrivateIP(dst) {
+			if err := q.SetVerdict(id, nfqueue.NfAccept); err != nil {
+				log.Tracef("failed to set verdict on packet %d: %v", id, err)
+				metrics.RecordVerdictFailure(w.qnum)
+			}
+			return 0
+		}
 
-				metrics := metrics.GetMetricsCollector()
-				setName := ""
-				if matched {
-					setName = set.Name
-				}
-				metrics.RecordConnection("UDP", host, srcStr, dstStr, matched, srcMac, setName)
-				metrics.RecordPacket(uint64(len(raw)))
+		matchedIP := matched
+		matchedQUIC := false
+		isSTUN := false
+		host := ""
+		ipTarget := ""
+		sniTarget := ""
 
-				switch set.UDP.Mode {
-				case "drop":
-					if err := q.SetVerdict(id, nfqueue.NfDrop); err != nil {
-						log.Tracef("failed to set drop verdict on packet %d: %v", id, err)
-					}
-					return 0
+		if matchedIP {
+			ipTarget = st.Name
+		}
 
-				case "fake":
-					packetCopy := make([]byte, len(raw))
-					copy(packetCopy, raw)
-					dstCopy := make(net.IP, len(dst))
-					copy(dstCopy, dst)
-					setCopy := set
+		if !matchedIP {
+			if mLearned, learnedSet, learnedDomain := matcher.MatchLearnedIP(dst); mLearned {
+				matchedIP = true
+				matched = true
+				set = learnedSet
+				host = learnedDomain
+				sniTarget = learnedSet.Name
+				ipTarget = learnedSet.Name
+			}
+		}
 
-					if err := q.SetVerdict(id, nfqueue.NfDrop); err != nil {
-						log.Tracef("failed to set drop verdict on UDP packet %d: %v", id, err)
-						return 0
-					}
+		isSTUN = stun.IsSTUNMessage(payload)
 
-					w.wg.Add(1)
-					go func(s *config.SetConfig, pkt []byte, d net.IP) {
-						defer w.wg.Done()
-						if v == IPv4 {
-							w.dropAndInjectQUIC(s, pkt, d)
-						} else {
-							w.dropAndInjectQUICV6(s, pkt, d)
-						}
-					}(setCopy, packetCopy, dstCopy)
-					return 0
+		if host == "" {
+			if h, ok := sni.ParseQUICClientHelloSNI(payload); ok {
+				host = h
+			}
+		}
 
-				default:
-					if err := q.SetVerdict(id, nfqueue.NfAccept); err != nil {
-						log.Tracef("failed to set verdict on packet %d: %v", id, err)
-					}
-					return 0
-				}
+		if host != "" {
+			if mSNI, sniSet := matcher.MatchSNI(host); mSNI {
+				matchedQUIC = true
+				set = sniSet
+				sniTarget = sniSet.Name
+				matcher.LearnIPToDomain(dst, host, sniSet)
 			}
+		}
+
+		if !matchedQUIC && matchedIP && set.UDP.FilterQUIC == "all" {
+			if quic.IsInitial(payload) {
+				matchedQUIC = true
+			}
+		}
+
+		if captureManager := capture.GetManager(cfg); captureManager != nil {
+			captureManager.CapturePayload(connKey, host, "quic", payload)
+		}
+
+		shouldHandle := (matchedIP || matchedQUIC) && !(isSTUN && set.UDP.FilterSTUN)
+
+		matched = shouldHandle
+
+		if !log.IsDiscoveryActive() {
+			log.Infof(",UDP,%s,%s,%s:%d,%s,%s:%d,%s", sniTarget, host, srcStr, sport, ipTarget, dstStr, dport, srcMac)
+		}
 
+		if isSTUN && set.UDP.FilterSTUN {
 			if err := q.SetVerdict(id, nfqueue.NfAccept); err != nil {
 				log.Tracef("failed to set verdict on packet %d: %v", id, err)
+				metrics.RecordVerdictFailure(w.qnum)
 			}
 			return 0
-		}, func(e error) int {
-			if w.ctx.Err() != nil {
+		}
 
-				if errors.Is(e, syscall.ENOBUFS) {
-					now := time.Now().Unix()
-					last := atomic.LoadInt64(&w.lastOverflowLog)
-					if now-last >= 5 {
-						if atomic.CompareAndSwapInt64(&w.lastOverflowLog, last, now) {
-							log.Warnf("nfq queue %d overflow - packets dropped", w.qnum)
-						}
-					}
-					return 0
-				}
+		if !shouldHandle {
+			m := metrics.GetMetricsCollector()
+			m.RecordConnection("UDP", host, srcStr, dstStr, false, srcMac, "")
+			m.RecordPacket(uint64(len(raw)))
+			if host != "" {
+				recordConn(connKey, connEvent("UDP", sets, srcMac, src, sport, dst, dport, host), nil, connlog.OutcomePassed)
+			}
+			if err := q.SetVerdict(id, nfqueue.NfAccept); err != nil {
+				log.Tracef("failed to set verdict on packet %d: %v", id, err)
+				metrics.RecordVerdictFailure(w.qnum)
+			}
+			return 0
+		}
 
-				return 0
+		m := metrics.GetMetricsCollector()
+		setName := ""
+		if matched {
+			setName = set.Name
+		}
+		m.RecordConnection("UDP", host, srcStr, dstStr, matched, srcMac, setName)
+		m.RecordPacket(uint64(len(raw)))
+		tapOriginal(raw, host, set, "UDP")
+		ev := connEvent("UDP", sets, srcMac, src, sport, dst, dport, host)
+
+		if !flowBudget.spend(connKey, set.UDP.ConnBytesLimit) {
+			recordConn(connKey, ev, set, connlog.OutcomeOverBudget)
+			if err := q.SetVerdict(id, nfqueue.NfAccept); err != nil {
+				log.Tracef("failed to set verdict on packet %d: %v", id, err)
+				metrics.RecordVerdictFailure(w.qnum)
 			}
-			if errors.Is(e, os.ErrClosed) || errors.Is(e, net.ErrClosed) || errors.Is(e, syscall.EBADF) {
-				return 0
+			return 0
+		}
+
+		switch set.UDP.Mode {
+		case "drop":
+			recordConn(connKey, ev, set, connlog.OutcomeDropped)
+			if err := q.SetVerdict(id, nfqueue.NfDrop); err != nil {
+				log.Tracef("failed to set drop verdict on packet %d: %v", id, err)
+				metrics.RecordVerdictFailure(w.qnum)
 			}
-			if ne, ok := e.(net.Error); ok && ne.Timeout() {
+			return 0
+
+		case "fake":
+			recordConn(connKey, ev, set, connlog.OutcomeInjected)
+			packetCopy := make([]byte, len(raw))
+			copy(packetCopy, raw)
+			dstCopy := make(net.IP, len(dst))
+			copy(dstCopy, dst)
+			setCopy := set
+
+			if err := q.SetVerdict(id, nfqueue.NfDrop); err != nil {
+				log.Tracef("failed to set drop verdict on UDP packet %d: %v", id, err)
+				metrics.RecordVerdictFailure(w.qnum)
 				return 0
 			}
-			msg := e.Error()
-			if strings.Contains(msg, "use of closed file") || strings.Contains(msg, "file descriptor") {
-				return 0
+
+			w.wg.Add(1)
+			go func(s *config.SetConfig, pkt []byte, d net.IP) {
+				defer w.wg.Done()
+				if v == IPv4 {
+					w.dropAndInjectQUIC(s, pkt, d)
+				} else {
+					w.dropAndInjectQUICV6(s, pkt, d)
+				}
+			}(setCopy, packetCopy, dstCopy)
+			return 0
+
+		default:
+			recordConn(connKey, ev, set, connlog.OutcomePassed)
+			if err := q.SetVerdict(id, nfqueue.NfAccept); err != nil {
+				log.Tracef("failed to set verdict on packet %d: %v", id, err)
+				metrics.RecordVerdictFailure(w.qnum)
 			}
-			log.Errorf("nfq: %v", e)
 			return 0
-		})
-	}()
+		}
+	}
 
-	return nil
+	if err := q.SetVerdict(id, nfqueue.NfAccept); err != nil {
+		log.Tracef("failed to set verdict on packet %d: %v", id, err)
+		metrics.RecordVerdictFailure(w.qnum)
+	}
+	return 0
 }
 
 func (w *Worker) dropAndInjectQUIC(cfg *config.SetConfig, raw []byte, dst net.IP) {
@@ -567,9 +754,12 @@ func (w *Worker) dropAndInjectQUIC(cfg *config.SetConfig, raw []byte, dst net.IP
 	if udpCfg.Mode != "fake" {
 		return
 	}
+	defer metrics.ObserveInjection("quic", time.Now())
+
 	if udpCfg.FakeSeqLength > 0 {
+		payloadOff := min(int((raw[0]&0x0F)*4)+8, len(raw))
 		for i := 0; i < udpCfg.FakeSeqLength; i++ {
-			fake, ok := sock.BuildFakeUDPFromOriginalV4(raw, udpCfg.FakeLen, cfg.Faking.TTL)
+			fake, ok := sock.BuildUDPWithPayloadV4(raw, fakeQUICPayload(udpCfg, raw[payloadOff:]), cfg.Faking.TTL)
 			if ok {
 				if udpCfg.FakingStrategy == "checksum" {
 					ipHdrLen := int((fake[0] & 0x0F) * 4)
@@ -586,6 +776,10 @@ func (w *Worker) dropAndInjectQUIC(cfg *config.SetConfig, raw []byte, dst net.IP
 		}
 	}
 
+	if udpCfg.SplitMode == "crypto" && w.sendQUICCryptoSplitV4(udpCfg, raw, dst) {
+		return
+	}
+
 	splitPos := 24
 	ipHdrLen := int((raw[0] & 0x0F) * 4)
 	if len(raw) >= ipHdrLen+8 {
@@ -606,6 +800,7 @@ func (w *Worker) dropAndInjectQUIC(cfg *config.SetConfig, raw []byte, dst net.IP
 }
 
 func (w *Worker) dropAndInjectTCP(cfg *config.SetConfig, raw []byte, dst net.IP) {
+	defer metrics.ObserveInjection(cfg.Fragmentation.Strategy, time.Now())
 
 	if len(raw) < 40 {
 		_ = w.sock.SendIPv4(raw, dst)
@@ -937,6 +1132,9 @@ func (w *Worker) gc(cfg *config.Config) {
 			return
 		case <-t.C:
 			connState.Cleanup()
+			flowBudget.Cleanup()
+			recordedFlows.Cleanup()
+			strategies.Cleanup()
 
 			if cfg.System.WebServer.IsEnabled {
 				mtcs := metrics.GetMetricsCollector()
@@ -6,6 +6,7 @@ import (
 	"time"
 
 	"github.com/daniellavrushin/b4/config"
+	"github.com/daniellavrushin/b4/metrics"
 	"github.com/daniellavrushin/b4/quic"
 	"github.com/daniellavrushin/b4/sock"
 )
@@ -16,10 +17,12 @@ func (w *Worker) dropAndInjectQUICV6(cfg *config.SetConfig, raw []byte, dst net.
 	if cfg.UDP.Mode != "fake" {
 		return
 	}
+	defer metrics.ObserveInjection("quic", time.Now())
 
 	if cfg.UDP.FakeSeqLength > 0 {
+		payloadOff := min(40+8, len(raw))
 		for i := 0; i < cfg.UDP.FakeSeqLength; i++ {
-			fake, ok := sock.BuildFakeUDPFromOriginalV6(raw, cfg.UDP.FakeLen, cfg.Faking.TTL)
+			fake, ok := sock.BuildUDPWithPayloadV6(raw, fakeQUICPayload(&cfg.UDP, raw[payloadOff:]), cfg.Faking.TTL)
 			if ok {
 				if cfg.UDP.FakingStrategy == "checksum" {
 					ipv6HdrLen := 40
@@ -36,6 +39,10 @@ func (w *Worker) dropAndInjectQUICV6(cfg *config.SetConfig, raw []byte, dst net.
 		}
 	}
 
+	if cfg.UDP.SplitMode == "crypto" && w.sendQUICCryptoSplitV6(&cfg.UDP, raw, dst) {
+		return
+	}
+
 	// Try to locate SNI within encrypted QUIC payload
 	splitPos := 24 // fallback
 	ipv6HdrLen := 40
@@ -58,6 +65,8 @@ func (w *Worker) dropAndInjectQUICV6(cfg *config.SetConfig, raw []byte, dst net.
 
 // dropAndInjectTCPv6 handles TCP packet manipulation for IPv6
 func (w *Worker) dropAndInjectTCPv6(cfg *config.SetConfig, raw []byte, dst net.IP) {
+	defer metrics.ObserveInjection(cfg.Fragmentation.Strategy, time.Now())
+
 	if len(raw) < 60 { // IPv6 header (40) + TCP header (20 min)
 		_ = w.sock.SendIPv6(raw, dst)
 		return
@@ -7,8 +7,9 @@ import (
 
 	"github.com/daniellavrushin/b4/config"
 	"github.com/daniellavrushin/b4/dhcp"
+	"github.com/daniellavrushin/b4/dns"
 	"github.com/daniellavrushin/b4/log"
-	"github.com/daniellavrushin/b4/sni"
+	"github.com/daniellavrushin/b4/metrics"
 )
 
 func NewWorkerWithQueue(cfg *config.Config, qnum uint16) *Worker {
@@ -18,6 +19,7 @@ func NewWorkerWithQueue(cfg *config.Config, qnum uint16) *Worker {
 		qnum:   qnum,
 		ctx:    ctx,
 		cancel: cancel,
+		reasm:  helloReasm,
 	}
 
 	w.cfg.Store(cfg)
@@ -32,7 +34,10 @@ func NewPool(cfg *config.Config) *Pool {
 		threads = 1
 	}
 
-	matcher := buildMatcher(cfg)
+	metrics.SetQueues(start, threads)
+
+	aliases := config.NewDeviceAliases(cfg.ConfigPath)
+	matcher := buildMatcher(cfg, aliases)
 
 	dhcpMgr := dhcp.NewManager()
 
@@ -44,7 +49,13 @@ func NewPool(cfg *config.Config) *Pool {
 		ws = append(ws, w)
 	}
 
-	pool := &Pool{Workers: ws, Dhcp: dhcpMgr}
+	pool := &Pool{
+		Workers:  ws,
+		Dhcp:     dhcpMgr,
+		Aliases:  aliases,
+		schedule: make(chan struct{}, 1),
+		stop:     make(chan struct{}),
+	}
 
 	dhcpMgr.OnUpdate(func(ipToMAC map[string]string) {
 		for _, w := range pool.Workers {
@@ -66,9 +77,15 @@ func NewPool(cfg *config.Config) *Pool {
 		defer ticker.Stop()
 		for range ticker.C {
 			connState.Cleanup()
+			flowBudget.Cleanup()
+			recordedFlows.Cleanup()
+			strategies.Cleanup()
+			dns.DnsNATCleanup()
 		}
 	}()
 
+	go pool.runScheduler()
+
 	return pool
 }
 
@@ -85,6 +102,8 @@ func (p *Pool) Start() error {
 }
 
 func (p *Pool) Stop() {
+	p.stopOnce.Do(func() { close(p.stop) })
+
 	var wg sync.WaitGroup
 	for _, w := range p.Workers {
 		wg.Add(1)
@@ -115,49 +134,79 @@ func (w *Worker) getConfig() *config.Config {
 	return w.cfg.Load().(*config.Config)
 }
 
-func (w *Worker) getMatcher() *sni.SuffixSet {
-	return w.matcher.Load().(*sni.SuffixSet)
+func (w *Worker) getMatcher() *setMatcher {
+	return w.matcher.Load().(*setMatcher)
 }
 
 func (w *Worker) UpdateConfig(newCfg *config.Config) {
 	w.cfg.Store(newCfg)
 }
 
-func buildMatcher(cfg *config.Config) *sni.SuffixSet {
+func buildMatcher(cfg *config.Config, aliases *config.DeviceAliases) *setMatcher {
 	if len(cfg.Sets) > 0 {
-		m := sni.NewSuffixSet(cfg.Sets)
+		active := cfg.ActiveSets(time.Now())
+		m := newSetMatcher(active, aliases)
 		totalDomains := 0
 		totalIPs := 0
-		for _, set := range cfg.Sets {
+		for _, set := range active {
 			totalDomains += len(set.Targets.DomainsToMatch)
 			totalIPs += len(set.Targets.IpsToMatch)
 		}
-		log.Infof("Built matcher with %d domains and %d IPs across %d sets",
-			totalDomains, totalIPs, len(cfg.Sets))
+		log.Infof("Built matcher with %d domains and %d IPs across %d of %d sets (%d device-limited)",
+			totalDomains, totalIPs, len(active), len(cfg.Sets), len(m.profiles))
 		return m
 	}
 	log.Tracef("Built empty matcher")
-	return sni.NewSuffixSet([]*config.SetConfig{})
+	return newSetMatcher([]*config.SetConfig{}, aliases)
 }
 
 func (p *Pool) UpdateConfig(newCfg *config.Config) error {
 	p.configMu.Lock()
 	defer p.configMu.Unlock()
+	return p.updateConfigLocked(newCfg)
+}
 
-	matcher := buildMatcher(newCfg)
+func (p *Pool) updateConfigLocked(newCfg *config.Config) error {
+	matcher := buildMatcher(newCfg, p.Aliases)
 
 	if len(p.Workers) > 0 {
 		oldMatcher := p.Workers[0].getMatcher()
-		matcher.TransferLearnedIPs(oldMatcher)
+		matcher.transferLearnedIPs(oldMatcher)
 	}
 
 	for _, w := range p.Workers {
 		w.cfg.Store(newCfg)
 		w.matcher.Store(matcher)
 	}
+
+	p.kickScheduler()
 	return nil
 }
 
+// ReloadTargets rebuilds the matcher with the current content of the
+// geodata files and subscribed lists. The lock is held from reading the
+// config to storing the reloaded copy, so a config saved meanwhile is not
+// overwritten with the old one.
+func (p *Pool) ReloadTargets() error {
+	p.configMu.Lock()
+	defer p.configMu.Unlock()
+
+	cur := p.GetFirstWorkerConfig()
+	if cur == nil {
+		return nil
+	}
+	cfg := cur.Clone()
+	for _, set := range cfg.Sets {
+		if !set.Enabled {
+			continue
+		}
+		if _, _, err := cfg.GetTargetsForSet(set); err != nil {
+			return err
+		}
+	}
+	return p.updateConfigLocked(cfg)
+}
+
 func (p *Pool) GetFirstWorkerConfig() *config.Config {
 	if len(p.Workers) == 0 {
 		return nil
@@ -167,5 +216,5 @@ func (p *Pool) GetFirstWorkerConfig() *config.Config {
 
 func (w *Worker) GetCacheStats() map[string]interface{} {
 	matcher := w.getMatcher()
-	return matcher.GetCacheStats()
+	return matcher.shared.GetCacheStats()
 }
@@ -0,0 +1,56 @@
+package nfq
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/daniellavrushin/b4/config"
+)
+
+func testPool(t *testing.T, cfg *config.Config) *Pool {
+	t.Helper()
+	aliases := config.NewDeviceAliases(t.TempDir() + "/b4.json")
+	w := NewWorkerWithQueue(cfg, 0)
+	w.matcher.Store(buildMatcher(cfg, aliases))
+	return &Pool{Workers: []*Worker{w}, Aliases: aliases, schedule: make(chan struct{}, 1)}
+}
+
+// A target reload racing a config save must not put back the config it read
+// before the save.
+func TestReloadTargetsKeepsSavedConfig(t *testing.T) {
+	cfg := config.NewConfig()
+	if err := cfg.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	p := testPool(t, &cfg)
+
+	const saves = 200
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for i := 1; i <= saves; i++ {
+			next := cfg.Clone()
+			next.ConfigPath = fmt.Sprintf("save-%d", i)
+			if err := p.UpdateConfig(next); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < saves; i++ {
+			if err := p.ReloadTargets(); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+	wg.Wait()
+
+	if got := p.GetFirstWorkerConfig().ConfigPath; got != fmt.Sprintf("save-%d", saves) {
+		t.Errorf("config after reloads is %q, want the last save", got)
+	}
+}
@@ -0,0 +1,44 @@
+package nfq
+
+import (
+	"github.com/daniellavrushin/b4/config"
+	"github.com/daniellavrushin/b4/log"
+)
+
+// probeSandbox is the candidate configuration applied to discovery probe
+// traffic only. Probes are recognised by System.Checker.ProbeMark; every
+// other packet keeps using the live configuration.
+type probeSandbox struct {
+	cfg     *config.Config
+	matcher *setMatcher
+}
+
+func (w *Worker) getProbe() *probeSandbox {
+	sb, _ := w.probe.Load().(*probeSandbox)
+	return sb
+}
+
+// SetProbeConfig installs cfg as the configuration for packets carrying the
+// discovery probe mark.
+func (p *Pool) SetProbeConfig(cfg *config.Config) error {
+	p.configMu.Lock()
+	defer p.configMu.Unlock()
+
+	sb := &probeSandbox{cfg: cfg, matcher: newSetMatcher(cfg.Sets, p.Aliases)}
+	for _, w := range p.Workers {
+		w.probe.Store(sb)
+	}
+	log.Tracef("Discovery sandbox: applied '%s'", cfg.MainSet.Name)
+	return nil
+}
+
+// ClearProbeConfig removes the discovery sandbox. Probe packets seen
+// afterwards are handled with the live configuration.
+func (p *Pool) ClearProbeConfig() {
+	p.configMu.Lock()
+	defer p.configMu.Unlock()
+
+	for _, w := range p.Workers {
+		w.probe.Store((*probeSandbox)(nil))
+	}
+}
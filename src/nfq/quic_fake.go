@@ -0,0 +1,38 @@
+package nfq
+
+import (
+	"encoding/binary"
+
+	"github.com/daniellavrushin/b4/capture"
+	"github.com/daniellavrushin/b4/config"
+	"github.com/daniellavrushin/b4/log"
+	"github.com/daniellavrushin/b4/quic"
+)
+
+// fakeQUICPayload returns the UDP payload of a fake sent ahead of the QUIC
+// Initial orig. With the "quic_initial" payload it is a properly encrypted
+// Initial for the decoy SNI, so DPI that decrypts Initials parses it like a
+// real one; otherwise it is FakeLen zero bytes.
+func fakeQUICPayload(udp *config.UDPConfig, orig []byte) []byte {
+	if udp.FakePayload != "quic_initial" {
+		return make([]byte, udp.FakeLen)
+	}
+
+	hello, err := capture.GenerateTLSClientHello(udp.FakeSNI)
+	if err == nil {
+		version := uint32(quic.Version1)
+		if len(orig) >= 5 && binary.BigEndian.Uint32(orig[1:5]) == quic.Version2 {
+			version = quic.Version2
+		}
+
+		minSize := max(udp.FakeLen, quic.MinInitialSize)
+		var initial []byte
+		initial, err = quic.BuildInitial(version, quic.RandomConnID(8), quic.RandomConnID(8), hello, 0, minSize)
+		if err == nil {
+			return initial
+		}
+	}
+
+	log.Tracef("Failed to build fake QUIC Initial for %s: %v", udp.FakeSNI, err)
+	return make([]byte, udp.FakeLen)
+}
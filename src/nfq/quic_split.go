@@ -0,0 +1,91 @@
+package nfq
+
+import (
+	"math/rand"
+	"net"
+
+	"github.com/daniellavrushin/b4/config"
+	"github.com/daniellavrushin/b4/quic"
+	"github.com/daniellavrushin/b4/sock"
+	"github.com/daniellavrushin/b4/utils"
+)
+
+// quicCryptoSplit re-encrypts the client Initial in payload with its CRYPTO
+// data cut into several frames, shuffled like TCP segments. The frames stay
+// in one packet with the client's own packet number: a second Initial
+// would need a number the client never sent, and an ACK for it makes the
+// client close the connection. Packets the client coalesced after the
+// Initial follow it unchanged. It returns the UDP payload to send, or false
+// if the Initial cannot be rebuilt.
+func quicCryptoSplit(udp *config.UDPConfig, payload []byte, r *rand.Rand) ([]byte, bool) {
+	in, ok := quic.OpenInitial(payload)
+	if !ok {
+		return nil, false
+	}
+
+	total := 0
+	for _, f := range in.Frames {
+		total = max(total, f.Offset+len(f.Data))
+	}
+
+	var cuts []int
+	if sniOff, sniLen := in.SNIOffset(); sniOff >= 0 && sniLen > 0 {
+		cuts = append(cuts, sniOff+sniLen/2)
+	}
+	for i := 1; len(cuts) < udp.CryptoFrames-1 && i < udp.CryptoFrames; i++ {
+		if c := total * i / udp.CryptoFrames; len(cuts) == 0 || c != cuts[0] {
+			cuts = append(cuts, c)
+		}
+	}
+
+	frames := quic.SplitCrypto(in.Frames, cuts)
+	segments := make([]Segment, len(frames))
+	for i, f := range frames {
+		segments[i] = Segment{Data: f.Data, Seq: uint32(f.Offset)}
+	}
+	ShuffleSegments(segments, udp.ShuffleMode, r)
+	for i, s := range segments {
+		frames[i] = quic.CryptoFrame{Offset: int(s.Seq), Data: s.Data}
+	}
+
+	// Padded to the size of the original Initial, so the datagram keeps
+	// its size with the coalesced packets appended
+	packet, err := in.Seal(in.PN, frames, len(payload)-len(in.Rest))
+	if err != nil {
+		return nil, false
+	}
+	return append(packet, in.Rest...), true
+}
+
+func (w *Worker) sendQUICCryptoSplitV4(udp *config.UDPConfig, raw []byte, dst net.IP) bool {
+	ipHdrLen := int((raw[0] & 0x0F) * 4)
+	if len(raw) < ipHdrLen+8 {
+		return false
+	}
+	datagram, ok := quicCryptoSplit(udp, raw[ipHdrLen+8:], utils.NewRand())
+	if !ok {
+		return false
+	}
+	pkt, ok := sock.BuildUDPWithPayloadV4(raw, datagram, raw[8])
+	if !ok {
+		return false
+	}
+	_ = w.sock.SendIPv4(pkt, dst)
+	return true
+}
+
+func (w *Worker) sendQUICCryptoSplitV6(udp *config.UDPConfig, raw []byte, dst net.IP) bool {
+	if len(raw) < 48 {
+		return false
+	}
+	datagram, ok := quicCryptoSplit(udp, raw[48:], utils.NewRand())
+	if !ok {
+		return false
+	}
+	pkt, ok := sock.BuildUDPWithPayloadV6(raw, datagram, raw[7])
+	if !ok {
+		return false
+	}
+	_ = w.sock.SendIPv6(pkt, dst)
+	return true
+}
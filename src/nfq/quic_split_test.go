@@ -0,0 +1,64 @@
+package nfq
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+
+	"github.com/daniellavrushin/b4/capture"
+	"github.com/daniellavrushin/b4/config"
+	"github.com/daniellavrushin/b4/quic"
+)
+
+// A client Initial with packet number pn followed by a coalesced 0-RTT
+// packet
+func coalescedInitial(t *testing.T, pn uint32) (datagram, rest []byte) {
+	t.Helper()
+	hello, err := capture.GenerateTLSClientHello("split.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	initial, err := quic.BuildInitial(quic.Version1, quic.RandomConnID(8), quic.RandomConnID(5), hello, pn, quic.MinInitialSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rest = append([]byte{0xd1, 0, 0, 0, 1}, bytes.Repeat([]byte{0x5a}, 60)...)
+	return append(initial, rest...), rest
+}
+
+func TestQUICCryptoSplit(t *testing.T) {
+	for _, pn := range []uint32{0, 1, 7} {
+		payload, rest := coalescedInitial(t, pn)
+		orig, ok := quic.OpenInitial(payload)
+		if !ok {
+			t.Fatal("OpenInitial failed")
+		}
+
+		udp := config.UDPConfig{CryptoFrames: 4, ShuffleMode: "reverse"}
+		datagram, ok := quicCryptoSplit(&udp, payload, rand.New(rand.NewSource(1)))
+		if !ok {
+			t.Fatal("split failed")
+		}
+		if len(datagram) < len(payload) {
+			t.Errorf("datagram shorter than the original: %d < %d", len(datagram), len(payload))
+		}
+
+		in, ok := quic.OpenInitial(datagram)
+		if !ok {
+			t.Fatal("split Initial does not open")
+		}
+		// The server must only see packet numbers the client sent
+		if in.PN != orig.PN || in.PN != pn {
+			t.Errorf("packet number %d, want the client's %d", in.PN, pn)
+		}
+		if !bytes.Equal(in.Rest, rest) {
+			t.Errorf("expected only the coalesced 0-RTT packet after the Initial, got %d bytes", len(in.Rest))
+		}
+		if len(in.Frames) != 4 || in.Frames[0].Offset < in.Frames[len(in.Frames)-1].Offset {
+			t.Errorf("expected 4 reversed CRYPTO frames, got %d", len(in.Frames))
+		}
+		if !bytes.Equal(in.Stream(), orig.Stream()) {
+			t.Error("split Initial does not carry the ClientHello")
+		}
+	}
+}
@@ -0,0 +1,252 @@
+package nfq
+
+import (
+	"encoding/binary"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/daniellavrushin/b4/log"
+	"github.com/daniellavrushin/b4/sock"
+)
+
+const (
+	helloReassemblyTimeout = 500 * time.Millisecond
+	helloMaxRecordLen      = 5 + 16384
+	helloMaxPendingFlows   = 1024
+)
+
+type reasmState int
+
+const (
+	reasmPass     reasmState = iota // packet is not part of a pending ClientHello
+	reasmHeld                       // packet was buffered, caller must drop it
+	reasmComplete                   // record is complete, caller processes the combined packet
+)
+
+type heldHello struct {
+	worker   *Worker
+	v        byte
+	dst      net.IP
+	ihl      int
+	datOff   int
+	segments [][]byte
+	data     []byte
+	need     int
+	nextSeq  uint32
+	timer    *time.Timer
+	deadline time.Time
+}
+
+type helloReassembler struct {
+	mu    sync.Mutex
+	flows map[string]*heldHello
+
+	// now replaces the wall clock when set. Held flows then expire only
+	// through expireDue instead of timers, which lets replay follow the
+	// timestamps of the capture.
+	now func() time.Time
+}
+
+var helloReasm = newHelloReassembler(nil)
+
+func newHelloReassembler(now func() time.Time) *helloReassembler {
+	return &helloReassembler{
+		flows: make(map[string]*heldHello),
+		now:   now,
+	}
+}
+
+// clientHelloRecordLen returns the full TLS record length (header included)
+// when payload starts with a ClientHello record, or 0 otherwise.
+func clientHelloRecordLen(payload []byte) int {
+	if len(payload) < 6 || payload[0] != TLSHandshakeType || payload[5] != TLSClientHello {
+		return 0
+	}
+	return 5 + int(binary.BigEndian.Uint16(payload[3:5]))
+}
+
+// needsReassembly reports whether payload is the first segment of a
+// ClientHello that continues in later segments.
+func needsReassembly(payload []byte) bool {
+	need := clientHelloRecordLen(payload)
+	return need > len(payload) && need <= helloMaxRecordLen
+}
+
+func (r *helloReassembler) pending(key string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	_, ok := r.flows[key]
+	return ok
+}
+
+// start buffers the first segment of a split ClientHello.
+func (r *helloReassembler) start(w *Worker, key string, v byte, raw []byte, ihl, datOff int, dst net.IP) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, exists := r.flows[key]; exists || len(r.flows) >= helloMaxPendingFlows {
+		return false
+	}
+
+	payload := raw[ihl+datOff:]
+	seq := binary.BigEndian.Uint32(raw[ihl+4 : ihl+8])
+
+	h := &heldHello{
+		worker:   w,
+		v:        v,
+		dst:      append(net.IP(nil), dst...),
+		ihl:      ihl,
+		datOff:   datOff,
+		segments: [][]byte{append([]byte(nil), raw...)},
+		data:     append(make([]byte, 0, clientHelloRecordLen(payload)), payload...),
+		need:     clientHelloRecordLen(payload),
+		nextSeq:  seq + uint32(len(payload)),
+	}
+	if r.now == nil {
+		h.timer = time.AfterFunc(helloReassemblyTimeout, func() { r.expire(key, h) })
+	} else {
+		h.deadline = r.now().Add(helloReassemblyTimeout)
+	}
+	r.flows[key] = h
+
+	log.Tracef("TLS reassembly: holding %d/%d bytes for %s", len(h.data), h.need, key)
+	return true
+}
+
+// feed appends a follow-up segment to a pending ClientHello. When the record
+// is complete it returns a single packet carrying the whole payload, along
+// with the original segments so they can be released untouched if the
+// connection turns out not to be a target.
+func (r *helloReassembler) feed(key string, raw []byte, ihl, datOff int) (reasmState, []byte, [][]byte) {
+	r.mu.Lock()
+	h, ok := r.flows[key]
+	if !ok {
+		r.mu.Unlock()
+		return reasmPass, nil, nil
+	}
+
+	payload := raw[ihl+datOff:]
+	seq := binary.BigEndian.Uint32(raw[ihl+4 : ihl+8])
+
+	switch {
+	case seq == h.nextSeq:
+		h.segments = append(h.segments, append([]byte(nil), raw...))
+		h.data = append(h.data, payload...)
+		h.nextSeq += uint32(len(payload))
+	case int32(seq+uint32(len(payload))-h.nextSeq) <= 0:
+		// Retransmission of data we already hold, compared modulo 2^32 as
+		// sequence numbers wrap
+		r.mu.Unlock()
+		return reasmHeld, nil, nil
+	default:
+		// Gap in the stream - give up and let the kernel sort it out
+		delete(r.flows, key)
+		h.stop()
+		r.mu.Unlock()
+		log.Tracef("TLS reassembly: out-of-order segment for %s, releasing", key)
+		h.release()
+		return reasmPass, nil, nil
+	}
+
+	if len(h.data) < h.need {
+		r.mu.Unlock()
+		return reasmHeld, nil, nil
+	}
+
+	delete(r.flows, key)
+	h.stop()
+	r.mu.Unlock()
+
+	log.Tracef("TLS reassembly: %s complete, %d bytes in %d segments", key, len(h.data), len(h.segments))
+	return reasmComplete, h.combine(raw), h.segments
+}
+
+func (r *helloReassembler) expire(key string, h *heldHello) {
+	r.mu.Lock()
+	if cur, ok := r.flows[key]; !ok || cur != h {
+		r.mu.Unlock()
+		return
+	}
+	delete(r.flows, key)
+	r.mu.Unlock()
+
+	log.Tracef("TLS reassembly: timeout for %s, releasing %d segments", key, len(h.segments))
+	h.release()
+}
+
+// expireDue releases the flows whose deadline is not after now, oldest
+// first. Only used with a manual clock.
+func (r *helloReassembler) expireDue(now time.Time) {
+	r.mu.Lock()
+	var keys []string
+	for key, h := range r.flows {
+		if !h.deadline.IsZero() && !now.Before(h.deadline) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		di, dj := r.flows[keys[i]].deadline, r.flows[keys[j]].deadline
+		if !di.Equal(dj) {
+			return di.Before(dj)
+		}
+		return keys[i] < keys[j]
+	})
+	due := make([]*heldHello, len(keys))
+	for i, key := range keys {
+		due[i] = r.flows[key]
+		delete(r.flows, key)
+	}
+	r.mu.Unlock()
+
+	for i, h := range due {
+		log.Tracef("TLS reassembly: timeout for %s, releasing %d segments", keys[i], len(h.segments))
+		h.release()
+	}
+}
+
+func (h *heldHello) stop() {
+	if h.timer != nil {
+		h.timer.Stop()
+	}
+}
+
+func (h *heldHello) release() {
+	h.worker.releaseSegments(h.v, h.segments, h.dst)
+}
+
+// releaseSegments sends held segments exactly as they were queued.
+func (w *Worker) releaseSegments(v byte, segments [][]byte, dst net.IP) {
+	if w.ctx.Err() != nil {
+		return
+	}
+	for _, seg := range segments {
+		if v == IPv4 {
+			_ = w.sock.SendIPv4(seg, dst)
+		} else {
+			_ = w.sock.SendIPv6(seg, dst)
+		}
+	}
+}
+
+// combine builds one packet from the first segment's headers and the whole
+// buffered payload. Flags from the last segment (PSH) are carried over.
+func (h *heldHello) combine(last []byte) []byte {
+	hdrLen := h.ihl + h.datOff
+
+	pkt := make([]byte, hdrLen+len(h.data))
+	copy(pkt, h.segments[0][:hdrLen])
+	copy(pkt[hdrLen:], h.data)
+	pkt[h.ihl+13] |= last[h.ihl+13] & 0x08
+
+	if h.v == IPv4 {
+		binary.BigEndian.PutUint16(pkt[2:4], uint16(len(pkt)))
+		sock.FixIPv4Checksum(pkt[:h.ihl])
+		sock.FixTCPChecksum(pkt)
+	} else {
+		binary.BigEndian.PutUint16(pkt[4:6], uint16(len(pkt)-IPv6HeaderLen))
+		sock.FixTCPChecksumV6(pkt)
+	}
+	return pkt
+}
@@ -0,0 +1,261 @@
+package nfq
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/daniellavrushin/b4/config"
+)
+
+// sentPackets records what a worker sends instead of using raw sockets.
+type sentPackets struct {
+	mu   sync.Mutex
+	pkts [][]byte
+}
+
+func (s *sentPackets) SendIPv4(packet []byte, destIP net.IP) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.pkts = append(s.pkts, append([]byte(nil), packet...))
+	return nil
+}
+
+func (s *sentPackets) SendIPv6(packet []byte, destIP net.IP) error {
+	return s.SendIPv4(packet, destIP)
+}
+
+func (s *sentPackets) Close() {}
+
+func (s *sentPackets) count() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.pkts)
+}
+
+func testWorker(t *testing.T) (*Worker, *sentPackets) {
+	t.Helper()
+	cfg := config.NewConfig()
+	w := NewWorkerWithQueue(&cfg, 0)
+	sent := &sentPackets{}
+	w.sock = sent
+	return w, sent
+}
+
+// testClientHello returns a ClientHello record of n bytes.
+func testClientHello(n int) []byte {
+	hello := make([]byte, n)
+	hello[0], hello[1], hello[2] = TLSHandshakeType, 3, 1
+	binary.BigEndian.PutUint16(hello[3:5], uint16(n-5))
+	hello[5] = TLSClientHello
+	for i := 6; i < n; i++ {
+		hello[i] = byte(i)
+	}
+	return hello
+}
+
+// tlsSegment builds a segment 10.0.0.2:40000 -> 1.1.1.1:443 with flags
+// ACK, plus PSH when push is set.
+func tlsSegment(seq uint32, payload []byte, push bool) []byte {
+	pkt := make([]byte, 40+len(payload))
+	pkt[0] = 0x45
+	binary.BigEndian.PutUint16(pkt[2:4], uint16(len(pkt)))
+	pkt[8] = 64
+	pkt[9] = 6
+	copy(pkt[12:16], []byte{10, 0, 0, 2})
+	copy(pkt[16:20], []byte{1, 1, 1, 1})
+
+	tcp := pkt[20:]
+	binary.BigEndian.PutUint16(tcp[0:2], 40000)
+	binary.BigEndian.PutUint16(tcp[2:4], HTTPSPort)
+	binary.BigEndian.PutUint32(tcp[4:8], seq)
+	tcp[12] = 5 << 4
+	tcp[13] = 0x10
+	if push {
+		tcp[13] |= 0x08
+	}
+	copy(tcp[20:], payload)
+	return pkt
+}
+
+var testDst = net.IPv4(1, 1, 1, 1).To4()
+
+type testReasmClock struct{ t time.Time }
+
+func (c *testReasmClock) now() time.Time { return c.t }
+
+func TestNeedsReassembly(t *testing.T) {
+	hello := testClientHello(600)
+	tests := []struct {
+		name    string
+		payload []byte
+		want    bool
+	}{
+		{"first segment", hello[:300], true},
+		{"whole record", hello, false},
+		{"not a handshake", append([]byte{0x17}, hello[1:300]...), false},
+		{"not a ClientHello", append(append([]byte(nil), hello[:5]...), append([]byte{2}, hello[6:300]...)...), false},
+		{"too short to tell", hello[:5], false},
+		{"record over the limit", testClientHello(helloMaxRecordLen + 1)[:300], false},
+	}
+	for _, tt := range tests {
+		if got := needsReassembly(tt.payload); got != tt.want {
+			t.Errorf("%s: needsReassembly = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestHelloReassemblerComplete(t *testing.T) {
+	w, sent := testWorker(t)
+	clock := &testReasmClock{t: time.Unix(1000, 0)}
+	r := newHelloReassembler(clock.now)
+	const key = "flow"
+	var isn uint32 = 0xfffffe00 // sequence numbers wrap
+
+	hello := testClientHello(1200)
+	first := tlsSegment(isn, hello[:500], false)
+	if !r.start(w, key, IPv4, first, 20, 20, testDst) {
+		t.Fatal("start refused")
+	}
+	if !r.pending(key) {
+		t.Fatal("flow not pending")
+	}
+
+	state, _, _ := r.feed(key, tlsSegment(isn+500, hello[500:900], false), 20, 20)
+	if state != reasmHeld {
+		t.Fatalf("middle segment: state %d, want held", state)
+	}
+	// Retransmissions of held data are absorbed
+	state, _, _ = r.feed(key, tlsSegment(isn, hello[:500], false), 20, 20)
+	if state != reasmHeld {
+		t.Fatalf("retransmission: state %d, want held", state)
+	}
+
+	last := tlsSegment(isn+900, hello[900:], true)
+	state, combined, segments := r.feed(key, last, 20, 20)
+	if state != reasmComplete {
+		t.Fatalf("last segment: state %d, want complete", state)
+	}
+	if r.pending(key) {
+		t.Error("flow still pending after completion")
+	}
+	if len(segments) != 3 || !bytes.Equal(segments[0], first) || !bytes.Equal(segments[2], last) {
+		t.Errorf("original segments not kept: %d", len(segments))
+	}
+	if !bytes.Equal(combined[40:], hello) {
+		t.Error("combined payload differs from the record")
+	}
+	if seq := binary.BigEndian.Uint32(combined[24:28]); seq != isn {
+		t.Errorf("combined packet seq %#x, want the first segment's %#x", seq, isn)
+	}
+	if int(binary.BigEndian.Uint16(combined[2:4])) != len(combined) {
+		t.Errorf("IPv4 total length %d for %d bytes", binary.BigEndian.Uint16(combined[2:4]), len(combined))
+	}
+	if combined[33]&0x08 == 0 {
+		t.Error("PSH of the last segment not carried over")
+	}
+
+	clock.t = clock.t.Add(time.Hour)
+	r.expireDue(clock.t)
+	if sent.count() != 0 {
+		t.Errorf("completed flow released %d segments", sent.count())
+	}
+}
+
+func TestHelloReassemblerGap(t *testing.T) {
+	w, sent := testWorker(t)
+	r := newHelloReassembler((&testReasmClock{t: time.Unix(1000, 0)}).now)
+	hello := testClientHello(1200)
+
+	first := tlsSegment(100, hello[:500], false)
+	r.start(w, "flow", IPv4, first, 20, 20, testDst)
+	state, _, _ := r.feed("flow", tlsSegment(700, hello[600:], true), 20, 20)
+	if state != reasmPass {
+		t.Fatalf("segment after a gap: state %d, want pass", state)
+	}
+	if r.pending("flow") {
+		t.Error("flow still pending after a gap")
+	}
+	if sent.count() != 1 || !bytes.Equal(sent.pkts[0], first) {
+		t.Errorf("held segment not released unchanged, %d sent", sent.count())
+	}
+
+	// Segments of flows not held pass
+	if state, _, _ := r.feed("other", first, 20, 20); state != reasmPass {
+		t.Errorf("unknown flow: state %d", state)
+	}
+}
+
+func TestHelloReassemblerOverflow(t *testing.T) {
+	w, _ := testWorker(t)
+	r := newHelloReassembler((&testReasmClock{t: time.Unix(1000, 0)}).now)
+	first := tlsSegment(100, testClientHello(1200)[:500], false)
+
+	for i := 0; i < helloMaxPendingFlows; i++ {
+		if !r.start(w, fmt.Sprint("flow", i), IPv4, first, 20, 20, testDst) {
+			t.Fatalf("flow %d refused", i)
+		}
+	}
+	if r.start(w, "one too many", IPv4, first, 20, 20, testDst) {
+		t.Error("more than helloMaxPendingFlows flows held")
+	}
+	if r.start(w, "flow0", IPv4, first, 20, 20, testDst) {
+		t.Error("flow started twice")
+	}
+}
+
+func TestHelloReassemblerTimeout(t *testing.T) {
+	w, sent := testWorker(t)
+	clock := &testReasmClock{t: time.Unix(1000, 0)}
+	r := newHelloReassembler(clock.now)
+	hello := testClientHello(1200)
+
+	a := tlsSegment(100, hello[:500], false)
+	r.start(w, "b-flow", IPv4, a, 20, 20, testDst)
+	clock.t = clock.t.Add(100 * time.Millisecond)
+	b := tlsSegment(200, hello[:400], false)
+	r.start(w, "a-flow", IPv4, b, 20, 20, testDst)
+	r.feed("a-flow", tlsSegment(600, hello[400:700], false), 20, 20)
+
+	r.expireDue(time.Unix(1000, 0).Add(helloReassemblyTimeout - time.Millisecond))
+	if sent.count() != 0 || !r.pending("b-flow") {
+		t.Fatal("flow released before its timeout")
+	}
+
+	// Both due: the older flow goes first whatever its key
+	r.expireDue(clock.t.Add(helloReassemblyTimeout))
+	if sent.count() != 3 {
+		t.Fatalf("%d segments released, want 3", sent.count())
+	}
+	if !bytes.Equal(sent.pkts[0], a) || !bytes.Equal(sent.pkts[1], b) {
+		t.Error("segments released out of order")
+	}
+	if r.pending("a-flow") || r.pending("b-flow") {
+		t.Error("flows still pending after their timeout")
+	}
+	if state, _, _ := r.feed("a-flow", tlsSegment(900, hello[700:], true), 20, 20); state != reasmPass {
+		t.Errorf("segment after the timeout: state %d, want pass", state)
+	}
+}
+
+func TestHelloReassemblerTimer(t *testing.T) {
+	w, sent := testWorker(t)
+	r := newHelloReassembler(nil)
+	hello := testClientHello(1200)
+
+	r.start(w, "done", IPv4, tlsSegment(100, hello[:500], false), 20, 20, testDst)
+	r.feed("done", tlsSegment(600, hello[500:], true), 20, 20)
+	r.start(w, "stalled", IPv4, tlsSegment(100, hello[:500], false), 20, 20, testDst)
+
+	deadline := time.Now().Add(5 * helloReassemblyTimeout)
+	for r.pending("stalled") && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if r.pending("stalled") || sent.count() != 1 {
+		t.Errorf("timer released %d segments, want the stalled flow's one", sent.count())
+	}
+}
@@ -0,0 +1,165 @@
+package nfq
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/daniellavrushin/b4/config"
+	"github.com/florianl/go-nfqueue"
+)
+
+// Replayer runs recorded packets through the worker packet logic offline.
+// Verdicts and injected packets are recorded instead of reaching the
+// kernel, so strategies can be tried without root or a live queue.
+//
+// Time follows the capture: ClientHello segments held for reassembly are
+// released once a later packet is past their timeout, so the result does
+// not depend on how fast the capture is read.
+type Replayer struct {
+	w    *Worker
+	rec  *replayRecorder
+	next uint32
+	now  time.Time
+}
+
+// ReplayResult is what became of one replayed packet.
+type ReplayResult struct {
+	// Verdict is "accept", "drop", or "" when none was set.
+	Verdict string
+	// Injected is how many packets were sent on the packet's behalf.
+	Injected int
+	// Out holds the packets that left, in order: the injected ones and
+	// the original where it was accepted.
+	Out []ReplayPacket
+	// Released holds segments of earlier packets that were held for
+	// reassembly and timed out before this packet arrived.
+	Released [][]byte
+}
+
+// ReplayPacket is a packet that left during replay.
+type ReplayPacket struct {
+	Data []byte
+	// Original is set when Data is the replayed packet itself, accepted
+	// unchanged.
+	Original bool
+}
+
+func NewReplayer(cfg *config.Config) *Replayer {
+	rec := &replayRecorder{}
+	r := &Replayer{rec: rec}
+	w := NewWorkerWithQueue(cfg, uint16(cfg.Queue.StartNum))
+	w.q = replayQueue{rec}
+	w.sock = replaySender{rec}
+	w.reasm = newHelloReassembler(func() time.Time { return r.now })
+	w.matcher.Store(buildMatcher(cfg, nil))
+	w.ipToMac.Store(make(map[string]string))
+	r.w = w
+	return r
+}
+
+// Packet processes raw, an IPv4 or IPv6 packet captured at ts, as if it
+// was queued, and waits for the sends it triggered.
+func (r *Replayer) Packet(ts time.Time, raw []byte) ReplayResult {
+	released := r.advance(ts)
+
+	r.next++
+	id := r.next
+	pkt := append([]byte(nil), raw...)
+
+	r.rec.begin(pkt)
+	r.w.handlePacket(nfqueue.Attribute{PacketID: &id, Payload: &pkt})
+	r.w.wg.Wait()
+	res := r.rec.end()
+	res.Released = released
+	return res
+}
+
+// Flush releases the segments still held for reassembly at the end of the
+// capture, as their timeout would.
+func (r *Replayer) Flush() [][]byte {
+	return r.advance(r.now.Add(helloReassemblyTimeout))
+}
+
+func (r *Replayer) advance(ts time.Time) [][]byte {
+	if ts.After(r.now) {
+		r.now = ts
+	}
+	r.rec.begin(nil)
+	r.w.reasm.expireDue(r.now)
+	var released [][]byte
+	for _, p := range r.rec.end().Out {
+		released = append(released, p.Data)
+	}
+	return released
+}
+
+func (r *Replayer) Close() {
+	r.w.cancel()
+	r.w.wg.Wait()
+}
+
+type replayRecorder struct {
+	mu   sync.Mutex
+	orig []byte
+	res  ReplayResult
+}
+
+func (r *replayRecorder) begin(orig []byte) {
+	r.mu.Lock()
+	r.orig = append([]byte(nil), orig...)
+	r.res = ReplayResult{}
+	r.mu.Unlock()
+}
+
+func (r *replayRecorder) end() ReplayResult {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.res
+}
+
+func (r *replayRecorder) verdict(v int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.res.Verdict != "" {
+		return
+	}
+	if v == nfqueue.NfAccept {
+		r.res.Verdict = "accept"
+		r.res.Out = append(r.res.Out, ReplayPacket{Data: r.orig, Original: true})
+	} else {
+		r.res.Verdict = "drop"
+	}
+}
+
+func (r *replayRecorder) send(packet []byte) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.res.Injected++
+	r.res.Out = append(r.res.Out, ReplayPacket{Data: append([]byte(nil), packet...)})
+}
+
+// replayQueue stands in for the netfilter queue.
+type replayQueue struct{ rec *replayRecorder }
+
+func (q replayQueue) SetVerdict(id uint32, verdict int) error {
+	q.rec.verdict(verdict)
+	return nil
+}
+
+func (q replayQueue) Close() error { return nil }
+
+// replaySender stands in for the raw sockets.
+type replaySender struct{ rec *replayRecorder }
+
+func (s replaySender) SendIPv4(packet []byte, destIP net.IP) error {
+	s.rec.send(packet)
+	return nil
+}
+
+func (s replaySender) SendIPv6(packet []byte, destIP net.IP) error {
+	s.rec.send(packet)
+	return nil
+}
+
+func (s replaySender) Close() {}
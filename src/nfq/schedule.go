@@ -0,0 +1,69 @@
+package nfq
+
+import (
+	"strings"
+	"time"
+
+	"github.com/daniellavrushin/b4/config"
+	"github.com/daniellavrushin/b4/log"
+)
+
+// scheduleRecheck caps how long the scheduler sleeps, so wall clock jumps
+// (NTP sync after boot, manual changes) are picked up without a transition.
+const scheduleRecheck = time.Minute
+
+// runScheduler rebuilds the matcher whenever a set schedule turns a set on
+// or off.
+func (p *Pool) runScheduler() {
+	cfg := p.GetFirstWorkerConfig()
+	if cfg == nil {
+		return
+	}
+	last := activeSetKey(cfg, time.Now())
+
+	for {
+		wait := scheduleRecheck
+		if next, ok := cfg.NextScheduleTransition(time.Now()); ok {
+			if d := time.Until(next); d < wait {
+				wait = d
+			}
+		}
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-p.stop:
+			timer.Stop()
+			return
+		case <-p.schedule:
+			timer.Stop()
+		case <-timer.C:
+			if key := activeSetKey(cfg, time.Now()); key != last {
+				log.Infof("Set schedule changed, rebuilding matcher")
+				_ = p.UpdateConfig(cfg)
+			}
+		}
+
+		cfg = p.GetFirstWorkerConfig()
+		if cfg == nil {
+			return
+		}
+		last = activeSetKey(cfg, time.Now())
+	}
+}
+
+// kickScheduler makes the scheduler re-read the config after an update.
+func (p *Pool) kickScheduler() {
+	select {
+	case p.schedule <- struct{}{}:
+	default:
+	}
+}
+
+func activeSetKey(cfg *config.Config, t time.Time) string {
+	active := cfg.ActiveSets(t)
+	ids := make([]string, len(active))
+	for i, set := range active {
+		ids[i] = set.Id
+	}
+	return strings.Join(ids, ",")
+}
@@ -0,0 +1,37 @@
+package nfq
+
+import (
+	"net"
+
+	"github.com/daniellavrushin/b4/capture"
+	"github.com/daniellavrushin/b4/config"
+	"github.com/daniellavrushin/b4/sock"
+)
+
+// tapSender hands every packet the worker sends to a running packet tap
+// before it leaves.
+type tapSender struct {
+	sock.PacketSender
+}
+
+func (s tapSender) SendIPv4(packet []byte, destIP net.IP) error {
+	if capture.TapEnabled() {
+		capture.TapSent(packet)
+	}
+	return s.PacketSender.SendIPv4(packet, destIP)
+}
+
+func (s tapSender) SendIPv6(packet []byte, destIP net.IP) error {
+	if capture.TapEnabled() {
+		capture.TapSent(packet)
+	}
+	return s.PacketSender.SendIPv6(packet, destIP)
+}
+
+// tapOriginal records a queued packet handled by set, when a tap runs.
+func tapOriginal(raw []byte, host string, set *config.SetConfig, proto string) {
+	if !capture.TapEnabled() {
+		return
+	}
+	capture.TapOriginal(raw, host, set.Name, describeStrategy(set, proto))
+}
@@ -5,9 +5,9 @@ import (
 	"sync"
 	"sync/atomic"
 
+	"github.com/daniellavrushin/b4/config"
 	"github.com/daniellavrushin/b4/dhcp"
 	"github.com/daniellavrushin/b4/sock"
-	"github.com/florianl/go-nfqueue"
 )
 
 type Segment struct {
@@ -19,6 +19,10 @@ type Pool struct {
 	Workers  []*Worker
 	configMu sync.Mutex
 	Dhcp     *dhcp.Manager
+	Aliases  *config.DeviceAliases
+	schedule chan struct{} // wakes the scheduler after a config change
+	stop     chan struct{}
+	stopOnce sync.Once
 }
 
 type PacketInfo struct {
@@ -32,6 +36,13 @@ type PacketInfo struct {
 	IsIPv6       bool
 }
 
+// packetQueue takes the verdicts on queued packets, the netfilter queue or
+// a replay recorder.
+type packetQueue interface {
+	SetVerdict(id uint32, verdict int) error
+	Close() error
+}
+
 type Worker struct {
 	packetsProcessed uint64
 	lastOverflowLog  int64
@@ -39,10 +50,12 @@ type Worker struct {
 	qnum             uint16
 	ctx              context.Context
 	cancel           context.CancelFunc
-	q                *nfqueue.Nfqueue
+	q                packetQueue
 	wg               sync.WaitGroup
 	matcher          atomic.Value
-	sock             *sock.Sender
+	probe            atomic.Value // *probeSandbox, set while discovery runs
+	sock             sock.PacketSender
 	ipToMac          atomic.Value
 	connState        sync.Map
+	reasm            *helloReassembler
 }
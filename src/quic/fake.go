@@ -0,0 +1,238 @@
+package quic
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+)
+
+// Exported versions for callers building Initials.
+const (
+	Version1 = versionV1
+	Version2 = versionV2
+)
+
+// MinInitialSize is the smallest UDP payload a client Initial may have
+// (RFC 9000 §14.1). Servers and DPI boxes drop shorter ones.
+const MinInitialSize = 1200
+
+const (
+	aeadTagSize        = 16
+	hpSampleSize       = 16
+	frameTypeCrypto    = 0x06
+	extTransportParams = 0x39
+)
+
+// BuildInitial builds a client Initial packet carrying the TLS ClientHello
+// in a single CRYPTO frame. The payload is encrypted and header protected
+// with the Initial keys derived from dcid, exactly as a real client would,
+// and padded to minSize bytes. hello may be a bare handshake message or a
+// TLS record as produced by capture.GenerateTLSClientHello; a QUIC transport
+// parameters extension is added if it has none.
+func BuildInitial(version uint32, dcid, scid, hello []byte, pn uint32, minSize int) ([]byte, error) {
+	if len(dcid) > 20 || len(scid) > 20 {
+		return nil, errors.New("connection ID too long")
+	}
+
+	hs, err := clientHelloMessage(hello, scid)
+	if err != nil {
+		return nil, err
+	}
+
+	plain := appendCryptoFrame(make([]byte, 0, minSize), 0, hs)
+	return sealInitial(version, dcid, scid, nil, pn, plain, minSize)
+}
+
+func appendCryptoFrame(b []byte, off int, data []byte) []byte {
+	b = append(b, frameTypeCrypto)
+	b = appendVarint(b, uint64(off))
+	b = appendVarint(b, uint64(len(data)))
+	return append(b, data...)
+}
+
+// sealInitial wraps the frames in plain into a client Initial packet of at
+// least minSize bytes, padding with PADDING frames, and protects it with the
+// Initial keys derived from dcid.
+func sealInitial(version uint32, dcid, scid, token []byte, pn uint32, plain []byte, minSize int) ([]byte, error) {
+	hp, aead, iv, err := deriveInitial(dcid, version)
+	if err != nil {
+		return nil, err
+	}
+
+	pnLen := packetNumberLen(pn)
+
+	var typeBits byte
+	if version == versionV2 {
+		typeBits = 0x10
+	}
+
+	// Header up to the Length field, which is always encoded in 2 bytes
+	hdr := make([]byte, 0, 64+len(token))
+	hdr = append(hdr, 0xc0|typeBits|byte(pnLen-1))
+	hdr = binary.BigEndian.AppendUint32(hdr, version)
+	hdr = append(hdr, byte(len(dcid)))
+	hdr = append(hdr, dcid...)
+	hdr = append(hdr, byte(len(scid)))
+	hdr = append(hdr, scid...)
+	hdr = appendVarint(hdr, uint64(len(token)))
+	hdr = append(hdr, token...)
+
+	headerLen := len(hdr) + 2 + pnLen
+	if pad := minSize - headerLen - len(plain) - aeadTagSize; pad > 0 {
+		plain = append(plain, make([]byte, pad)...) // PADDING frames
+	}
+	// Header protection samples 16 bytes starting 4 bytes after the PN
+	if short := 4 + hpSampleSize - (pnLen + len(plain) + aeadTagSize); short > 0 {
+		plain = append(plain, make([]byte, short)...)
+	}
+
+	length := pnLen + len(plain) + aeadTagSize
+	if length > 0x3fff {
+		return nil, errors.New("payload too large for an Initial")
+	}
+	hdr = append(hdr, 0x40|byte(length>>8), byte(length))
+	pnOff := len(hdr)
+	for i := pnLen - 1; i >= 0; i-- {
+		hdr = append(hdr, byte(pn>>(8*uint(i))))
+	}
+
+	nonce := make([]byte, len(iv))
+	copy(nonce, iv)
+	for i := 0; i < 8; i++ {
+		nonce[len(nonce)-1-i] ^= byte(uint64(pn) >> (8 * uint(i)))
+	}
+
+	packet := aead.Seal(hdr, nonce, plain, hdr)
+
+	var mask [16]byte
+	hp.Encrypt(mask[:], packet[pnOff+4:pnOff+4+hpSampleSize])
+	packet[0] ^= mask[0] & 0x0f
+	for i := 0; i < pnLen; i++ {
+		packet[pnOff+i] ^= mask[1+i]
+	}
+
+	return packet, nil
+}
+
+// RandomConnID returns a random connection ID of the given length.
+func RandomConnID(n int) []byte {
+	id := make([]byte, n)
+	_, _ = rand.Read(id)
+	return id
+}
+
+func packetNumberLen(pn uint32) int {
+	switch {
+	case pn < 1<<8:
+		return 1
+	case pn < 1<<16:
+		return 2
+	case pn < 1<<24:
+		return 3
+	default:
+		return 4
+	}
+}
+
+func appendVarint(b []byte, v uint64) []byte {
+	switch {
+	case v < 1<<6:
+		return append(b, byte(v))
+	case v < 1<<14:
+		return append(b, 0x40|byte(v>>8), byte(v))
+	case v < 1<<30:
+		return append(b, 0x80|byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+	default:
+		return append(b, 0xc0|byte(v>>56), byte(v>>48), byte(v>>40), byte(v>>32),
+			byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+	}
+}
+
+// clientHelloMessage strips the TLS record header from hello and makes sure
+// the ClientHello carries QUIC transport parameters.
+func clientHelloMessage(hello, scid []byte) ([]byte, error) {
+	if len(hello) > 5 && hello[0] == 0x16 {
+		hello = hello[5:]
+	}
+	if len(hello) < 4 || hello[0] != 0x01 {
+		return nil, errors.New("not a ClientHello")
+	}
+	msgLen := int(hello[1])<<16 | int(hello[2])<<8 | int(hello[3])
+	if 4+msgLen > len(hello) {
+		return nil, errors.New("truncated ClientHello")
+	}
+	body := hello[4 : 4+msgLen]
+
+	// version, random, session ID, cipher suites, compression methods
+	off := 2 + 32
+	if len(body) < off+1 {
+		return nil, errors.New("truncated ClientHello")
+	}
+	off += 1 + int(body[off])
+	if len(body) < off+2 {
+		return nil, errors.New("truncated ClientHello")
+	}
+	off += 2 + int(binary.BigEndian.Uint16(body[off:]))
+	if len(body) < off+1 {
+		return nil, errors.New("truncated ClientHello")
+	}
+	off += 1 + int(body[off])
+	if len(body) < off+2 {
+		return nil, errors.New("truncated ClientHello")
+	}
+	extStart := off + 2
+	extEnd := extStart + int(binary.BigEndian.Uint16(body[off:]))
+	if extEnd > len(body) {
+		return nil, errors.New("truncated ClientHello")
+	}
+
+	for p := extStart; p+4 <= extEnd; {
+		typ := binary.BigEndian.Uint16(body[p:])
+		if typ == extTransportParams {
+			out := make([]byte, 4+msgLen)
+			copy(out, hello)
+			return out, nil
+		}
+		p += 4 + int(binary.BigEndian.Uint16(body[p+2:]))
+	}
+
+	params := transportParams(scid)
+	ext := make([]byte, 0, 4+len(params))
+	ext = binary.BigEndian.AppendUint16(ext, extTransportParams)
+	ext = binary.BigEndian.AppendUint16(ext, uint16(len(params)))
+	ext = append(ext, params...)
+
+	newBody := make([]byte, 0, len(body)+len(ext))
+	newBody = append(newBody, body[:extEnd]...)
+	newBody = append(newBody, ext...)
+	binary.BigEndian.PutUint16(newBody[off:], uint16(extEnd-extStart+len(ext)))
+
+	out := make([]byte, 4, 4+len(newBody))
+	out[0] = 0x01
+	out[1], out[2], out[3] = byte(len(newBody)>>16), byte(len(newBody)>>8), byte(len(newBody))
+	return append(out, newBody...), nil
+}
+
+// transportParams returns the parameters a typical browser sends.
+func transportParams(scid []byte) []byte {
+	var p []byte
+	param := func(id uint64, val []byte) {
+		p = appendVarint(p, id)
+		p = appendVarint(p, uint64(len(val)))
+		p = append(p, val...)
+	}
+	intParam := func(id, v uint64) {
+		param(id, appendVarint(nil, v))
+	}
+
+	intParam(0x01, 30000)    // max_idle_timeout
+	intParam(0x03, 1472)     // max_udp_payload_size
+	intParam(0x04, 15728640) // initial_max_data
+	intParam(0x05, 6291456)  // initial_max_stream_data_bidi_local
+	intParam(0x06, 6291456)  // initial_max_stream_data_bidi_remote
+	intParam(0x07, 6291456)  // initial_max_stream_data_uni
+	intParam(0x08, 100)      // initial_max_streams_bidi
+	intParam(0x09, 103)      // initial_max_streams_uni
+	param(0x0f, scid)        // initial_source_connection_id
+	return p
+}
@@ -0,0 +1,111 @@
+package quic
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/daniellavrushin/b4/capture"
+)
+
+func TestBuildInitialRoundTrip(t *testing.T) {
+	const decoy = "decoy.example.com"
+
+	hello, err := capture.GenerateTLSClientHello(decoy)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		name    string
+		version uint32
+		pn      uint32
+	}{
+		{"v1", Version1, 0},
+		{"v2", Version2, 0},
+		{"v1 long pn", Version1, 0x1234},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			dcid := RandomConnID(8)
+			scid := RandomConnID(8)
+
+			packet, err := BuildInitial(tc.version, dcid, scid, hello, tc.pn, MinInitialSize)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(packet) != MinInitialSize {
+				t.Errorf("expected %d bytes, got %d", MinInitialSize, len(packet))
+			}
+			if !IsInitial(packet) {
+				t.Fatal("packet not recognized as Initial")
+			}
+			if got := ParseDCID(packet); !bytes.Equal(got, dcid) {
+				t.Fatalf("DCID mismatch: %x != %x", got, dcid)
+			}
+
+			plain, ok := DecryptInitial(dcid, packet)
+			if !ok {
+				t.Fatal("DecryptInitial failed")
+			}
+
+			frames := parseCryptoFrames(plain)
+			if len(frames) != 1 || frames[0].off != 0 {
+				t.Fatalf("expected one CRYPTO frame at offset 0, got %d", len(frames))
+			}
+			if frames[0].b[0] != 0x01 {
+				t.Fatalf("CRYPTO data is not a ClientHello: %#x", frames[0].b[0])
+			}
+
+			off, n := LocateSNIOffset(packet)
+			if off < 0 {
+				t.Fatal("SNI not found")
+			}
+			hdrLen, pnLen, _ := parseHeaderLength(packet)
+			start := off - hdrLen - pnLen
+			if got := string(plain[start : start+n]); got != decoy {
+				t.Errorf("expected SNI %q, got %q", decoy, got)
+			}
+		})
+	}
+}
+
+func TestBuildInitialTransportParams(t *testing.T) {
+	hello, err := capture.GenerateTLSClientHello("example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	scid := []byte{1, 2, 3, 4}
+
+	hs, err := clientHelloMessage(hello, scid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hs[0] != 0x01 {
+		t.Fatal("record header was not stripped")
+	}
+	if !bytes.Contains(hs, transportParams(scid)) {
+		t.Error("transport parameters extension missing")
+	}
+	if off, n := locateSNIInClientHello(hs); off < 0 || string(hs[off:off+n]) != "example.com" {
+		t.Error("SNI lost while adding transport parameters")
+	}
+
+	again, err := clientHelloMessage(hs, scid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(again, hs) {
+		t.Error("transport parameters added twice")
+	}
+}
+
+func TestBuildInitialErrors(t *testing.T) {
+	if _, err := BuildInitial(Version1, make([]byte, 21), nil, []byte{0x01}, 0, MinInitialSize); err == nil {
+		t.Error("expected error for oversized DCID")
+	}
+	if _, err := BuildInitial(Version1, RandomConnID(8), nil, []byte{0x02, 0, 0, 0}, 0, MinInitialSize); err == nil {
+		t.Error("expected error for non-ClientHello data")
+	}
+	if _, err := BuildInitial(0xdeadbeef, RandomConnID(8), nil, nil, 0, MinInitialSize); err == nil {
+		t.Error("expected error for unsupported version")
+	}
+}
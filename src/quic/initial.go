@@ -48,13 +48,20 @@ func IsInitial(b []byte) bool {
 }
 
 func DecryptInitial(dcid, packet []byte) ([]byte, bool) {
+	plain, _, _, ok := decryptInitial(dcid, packet)
+	return plain, ok
+}
+
+// decryptInitial decrypts the first packet of a datagram and also returns
+// its packet number and where it ends.
+func decryptInitial(dcid, packet []byte) ([]byte, uint64, int, bool) {
 	if len(packet) < 7 || packet[0]&0x80 == 0 {
-		return nil, false
+		return nil, 0, 0, false
 	}
 	ver := binary.BigEndian.Uint32(packet[1:5])
 	hp, aead, iv, err := deriveInitial(dcid, ver)
 	if err != nil {
-		return nil, false
+		return nil, 0, 0, false
 	}
 
 	// flags+ver
@@ -62,12 +69,12 @@ func DecryptInitial(dcid, packet []byte) ([]byte, bool) {
 
 	// DCID len + DCID
 	if len(packet) < off+1 {
-		return nil, false
+		return nil, 0, 0, false
 	}
 	dlen := int(packet[off])
 	off++
 	if len(packet) < off+dlen+1 {
-		return nil, false
+		return nil, 0, 0, false
 	}
 	off += dlen
 
@@ -75,27 +82,27 @@ func DecryptInitial(dcid, packet []byte) ([]byte, bool) {
 	slen := int(packet[off])
 	off++
 	if len(packet) < off+slen {
-		return nil, false
+		return nil, 0, 0, false
 	}
 	off += slen
 
 	// Token (varint + bytes)
 	tlen, n := readVar(packet[off:])
 	if n == 0 || len(packet) < off+n+int(tlen) {
-		return nil, false
+		return nil, 0, 0, false
 	}
 	off += n + int(tlen)
 
 	// Length (varint) -> PN offset
-	_, m := readVar(packet[off:])
+	length, m := readVar(packet[off:])
 	if m == 0 {
-		return nil, false
+		return nil, 0, 0, false
 	}
 	pnOff := off + m
 
 	// HP sample (pnOff + 4)
 	if pnOff+4+16 > len(packet) {
-		return nil, false
+		return nil, 0, 0, false
 	}
 	var sample [16]byte
 	copy(sample[:], packet[pnOff+4:pnOff+4+16])
@@ -107,7 +114,7 @@ func DecryptInitial(dcid, packet []byte) ([]byte, bool) {
 	first := packet[0] ^ (mask[0] & 0x0f)
 	pnLen := int((first & 0x03) + 1)
 	if pnOff+pnLen > len(packet) {
-		return nil, false
+		return nil, 0, 0, false
 	}
 
 	// Unmasked PN bytes (don’t write back)
@@ -134,13 +141,17 @@ func DecryptInitial(dcid, packet []byte) ([]byte, bool) {
 		nonce[len(nonce)-pnLen+i] ^= pnBytes[i]
 	}
 
-	// Ciphertext (incl. tag) follows PN
-	ct := packet[pnOff+pnLen:]
+	// Ciphertext (incl. tag) follows PN up to the end of a coalesced packet
+	end := len(packet)
+	if l := pnOff + int(length); int(length) >= pnLen && l < end {
+		end = l
+	}
+	ct := packet[pnOff+pnLen : end]
 	plain, err := aead.Open(nil, nonce, ct, aad)
 	if err != nil {
-		return nil, false
+		return nil, 0, 0, false
 	}
-	return plain, true
+	return plain, pn, end, true
 }
 
 func deriveInitial(dcid []byte, version uint32) (cipher.Block, cipher.AEAD, []byte, error) {
@@ -0,0 +1,142 @@
+package quic
+
+import (
+	"encoding/binary"
+	"sort"
+)
+
+// CryptoFrame is a piece of the client's CRYPTO stream.
+type CryptoFrame struct {
+	Offset int
+	Data   []byte
+}
+
+// Initial is a decrypted client Initial packet.
+type Initial struct {
+	Version uint32
+	DCID    []byte
+	SCID    []byte
+	Token   []byte
+	PN      uint32
+	Frames  []CryptoFrame // CRYPTO frames in packet order
+	Rest    []byte        // packets coalesced after the Initial, as sent
+}
+
+// OpenInitial decrypts the client Initial packet at the start of a
+// datagram. Packets coalesced after it, such as 0-RTT, are kept in Rest
+// untouched. PADDING and PING frames are dropped; any other frame makes it
+// fail, as the packet could not be rebuilt from its CRYPTO frames alone.
+func OpenInitial(packet []byte) (*Initial, bool) {
+	if !IsInitial(packet) {
+		return nil, false
+	}
+	dcid := ParseDCID(packet)
+	if dcid == nil {
+		return nil, false
+	}
+	plain, pn, end, ok := decryptInitial(dcid, packet)
+	if !ok {
+		return nil, false
+	}
+
+	// decryptInitial has already checked the header bounds
+	off := 5 + 1 + len(dcid)
+	slen := int(packet[off])
+	off++
+	scid := packet[off : off+slen]
+	off += slen
+	tlen, n := readVar(packet[off:])
+	token := packet[off+n : off+n+int(tlen)]
+
+	in := &Initial{
+		Version: binary.BigEndian.Uint32(packet[1:5]),
+		DCID:    append([]byte(nil), dcid...),
+		SCID:    append([]byte(nil), scid...),
+		Token:   append([]byte(nil), token...),
+		PN:      uint32(pn),
+		Rest:    append([]byte(nil), packet[end:]...),
+	}
+
+	for i := 0; i < len(plain); {
+		switch plain[i] {
+		case 0x00, 0x01: // PADDING, PING
+			i++
+		case frameTypeCrypto:
+			i++
+			foff, n := readVar(plain[i:])
+			if n == 0 {
+				return nil, false
+			}
+			i += n
+			flen, n := readVar(plain[i:])
+			if n == 0 || int(flen) > len(plain)-i-n {
+				return nil, false
+			}
+			i += n
+			in.Frames = append(in.Frames, CryptoFrame{Offset: int(foff), Data: plain[i : i+int(flen)]})
+			i += int(flen)
+		default:
+			return nil, false
+		}
+	}
+	if len(in.Frames) == 0 {
+		return nil, false
+	}
+	return in, true
+}
+
+// Stream returns the CRYPTO stream carried by the packet from offset 0 up
+// to the first gap.
+func (in *Initial) Stream() []byte {
+	frames := append([]CryptoFrame(nil), in.Frames...)
+	sort.Slice(frames, func(i, j int) bool { return frames[i].Offset < frames[j].Offset })
+
+	var stream []byte
+	for _, f := range frames {
+		if f.Offset > len(stream) {
+			break
+		}
+		if end := f.Offset + len(f.Data); end > len(stream) {
+			stream = append(stream, f.Data[len(stream)-f.Offset:]...)
+		}
+	}
+	return stream
+}
+
+// SNIOffset returns the CRYPTO stream offset and length of the SNI, or
+// (-1, 0) if the packet does not carry it.
+func (in *Initial) SNIOffset() (int, int) {
+	return locateSNIInClientHello(in.Stream())
+}
+
+// Seal builds an Initial packet with the header of the original one, the
+// packet number pn and the frames in the given order, padded to minSize.
+func (in *Initial) Seal(pn uint32, frames []CryptoFrame, minSize int) ([]byte, error) {
+	var plain []byte
+	for _, f := range frames {
+		plain = appendCryptoFrame(plain, f.Offset, f.Data)
+	}
+	return sealInitial(in.Version, in.DCID, in.SCID, in.Token, pn, plain, minSize)
+}
+
+// SplitCrypto cuts frames at the given CRYPTO stream offsets. Cuts outside
+// a frame leave it whole.
+func SplitCrypto(frames []CryptoFrame, cuts []int) []CryptoFrame {
+	cuts = append([]int(nil), cuts...)
+	sort.Ints(cuts)
+
+	out := make([]CryptoFrame, 0, len(frames)+len(cuts))
+	for _, f := range frames {
+		start := 0
+		for _, c := range cuts {
+			rel := c - f.Offset
+			if rel <= start || rel >= len(f.Data) {
+				continue
+			}
+			out = append(out, CryptoFrame{Offset: f.Offset + start, Data: f.Data[start:rel]})
+			start = rel
+		}
+		out = append(out, CryptoFrame{Offset: f.Offset + start, Data: f.Data[start:]})
+	}
+	return out
+}
@@ -0,0 +1,151 @@
+package quic
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/daniellavrushin/b4/capture"
+)
+
+func buildTestInitial(t *testing.T, version uint32, domain string) []byte {
+	t.Helper()
+	hello, err := capture.GenerateTLSClientHello(domain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	packet, err := BuildInitial(version, RandomConnID(8), RandomConnID(5), hello, 0, MinInitialSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return packet
+}
+
+func reassemble(t *testing.T, dcid []byte, packets ...[]byte) []byte {
+	t.Helper()
+	var stream []byte
+	for _, p := range packets {
+		plain, ok := DecryptInitial(dcid, p)
+		if !ok {
+			t.Fatal("DecryptInitial failed")
+		}
+		for _, f := range parseCryptoFrames(plain) {
+			if end := int(f.off) + len(f.b); end > len(stream) {
+				stream = append(stream, make([]byte, end-len(stream))...)
+			}
+			copy(stream[f.off:], f.b)
+		}
+	}
+	return stream
+}
+
+func TestOpenInitial(t *testing.T) {
+	packet := buildTestInitial(t, Version1, "example.com")
+
+	in, ok := OpenInitial(packet)
+	if !ok {
+		t.Fatal("OpenInitial failed")
+	}
+	if in.Version != Version1 || !bytes.Equal(in.DCID, ParseDCID(packet)) || len(in.SCID) != 5 {
+		t.Errorf("unexpected header fields: %+v", in)
+	}
+	if len(in.Frames) != 1 || in.Frames[0].Offset != 0 {
+		t.Fatalf("expected one CRYPTO frame at offset 0, got %d", len(in.Frames))
+	}
+
+	off, n := in.SNIOffset()
+	if off < 0 || string(in.Stream()[off:off+n]) != "example.com" {
+		t.Error("SNI not found in CRYPTO stream")
+	}
+
+	if len(in.Rest) != 0 {
+		t.Errorf("a single packet has nothing coalesced, got %d bytes", len(in.Rest))
+	}
+
+	if _, ok := OpenInitial(packet[:len(packet)-1]); ok {
+		t.Error("truncated packet should not open")
+	}
+}
+
+func TestSplitCrypto(t *testing.T) {
+	frames := []CryptoFrame{
+		{Offset: 0, Data: []byte("0123456789")},
+		{Offset: 10, Data: []byte("abcdef")},
+	}
+
+	out := SplitCrypto(frames, []int{12, 5, 0, 10, 100})
+	want := []CryptoFrame{
+		{Offset: 0, Data: []byte("01234")},
+		{Offset: 5, Data: []byte("56789")},
+		{Offset: 10, Data: []byte("ab")},
+		{Offset: 12, Data: []byte("cdef")},
+	}
+	if len(out) != len(want) {
+		t.Fatalf("expected %d frames, got %d", len(want), len(out))
+	}
+	for i := range want {
+		if out[i].Offset != want[i].Offset || !bytes.Equal(out[i].Data, want[i].Data) {
+			t.Errorf("frame %d: got %d %q, want %d %q", i, out[i].Offset, out[i].Data, want[i].Offset, want[i].Data)
+		}
+	}
+}
+
+func TestSealSplitInitial(t *testing.T) {
+	for _, version := range []uint32{Version1, Version2} {
+		packet := buildTestInitial(t, version, "split.example.com")
+		in, ok := OpenInitial(packet)
+		if !ok {
+			t.Fatal("OpenInitial failed")
+		}
+		stream := in.Stream()
+		sniOff, sniLen := in.SNIOffset()
+
+		frames := SplitCrypto(in.Frames, []int{1, sniOff + sniLen/2, len(stream) - 10})
+		if len(frames) != 4 {
+			t.Fatalf("expected 4 frames, got %d", len(frames))
+		}
+		reversed := []CryptoFrame{frames[3], frames[2], frames[1], frames[0]}
+
+		// One packet with the frames out of order
+		single, err := in.Seal(in.PN, reversed, MinInitialSize)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(single) < MinInitialSize {
+			t.Errorf("packet shorter than %d bytes: %d", MinInitialSize, len(single))
+		}
+		if got := reassemble(t, in.DCID, single); !bytes.Equal(got, stream) {
+			t.Error("single packet does not carry the original CRYPTO stream")
+		}
+
+		// Two packets coalesced into one datagram, the second padded
+		first, err := in.Seal(in.PN, reversed[:2], 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		second, err := in.Seal(in.PN+16, reversed[2:], MinInitialSize-len(first))
+		if err != nil {
+			t.Fatal(err)
+		}
+		datagram := append(append([]byte(nil), first...), second...)
+
+		_, _, end, ok := decryptInitial(in.DCID, datagram)
+		if !ok || end != len(first) {
+			t.Fatalf("first coalesced packet should end at %d, got %d", len(first), end)
+		}
+		if got := reassemble(t, in.DCID, first, second); !bytes.Equal(got, stream) {
+			t.Error("coalesced packets do not carry the original CRYPTO stream")
+		}
+
+		// Only the first packet is opened, the second is kept as sent
+		head, ok := OpenInitial(datagram)
+		if !ok {
+			t.Fatal("OpenInitial failed on a coalesced datagram")
+		}
+		if !bytes.Equal(head.Rest, second) {
+			t.Errorf("coalesced packet not kept: %d bytes, want %d", len(head.Rest), len(second))
+		}
+		if len(head.Frames) != 2 || head.Frames[0].Offset != reversed[0].Offset || head.Frames[1].Offset != reversed[1].Offset {
+			t.Error("frames of the first packet differ")
+		}
+	}
+}
@@ -0,0 +1,276 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/daniellavrushin/b4/capture"
+	"github.com/daniellavrushin/b4/config"
+	"github.com/daniellavrushin/b4/log"
+	"github.com/daniellavrushin/b4/nfq"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+	"github.com/spf13/cobra"
+)
+
+var (
+	replayIn      string
+	replayOut     string
+	replaySet     string
+	replayConfig  string
+	replayVerbose string
+)
+
+var replayCmd = &cobra.Command{
+	Use:   "replay",
+	Short: "Run captured packets through a set's strategy offline",
+	Long: `Replay feeds the packets of a pcap or pcapng capture through the packet
+processing of a queue worker, with only the given set enabled. No root,
+queue or network is needed: verdicts and injected packets are recorded,
+and every packet that would leave is written to the output pcapng. Each
+output packet carries a comment with the number of the input packet it
+belongs to, its verdict, and whether it is the original or was injected.
+Reassembly timeouts follow the capture timestamps.`,
+	Args: cobra.NoArgs,
+	RunE: runReplay,
+}
+
+func init() {
+	replayCmd.Flags().StringVar(&replayIn, "pcap", "", "Capture to replay (pcap or pcapng)")
+	replayCmd.Flags().StringVar(&replayOut, "out", "", "Output pcapng of the packets that would be sent")
+	replayCmd.Flags().StringVar(&replaySet, "set", config.MAIN_SET_ID, "ID or name of the set to apply")
+	replayCmd.Flags().StringVar(&replayConfig, "config", cfg.ConfigPath, "Path to config file")
+	replayCmd.Flags().StringVar(&replayVerbose, "verbose", "error", "Set verbosity level (debug, trace, info, error, silent)")
+	_ = replayCmd.MarkFlagRequired("pcap")
+	_ = replayCmd.MarkFlagRequired("out")
+
+	rootCmd.AddCommand(replayCmd)
+}
+
+func runReplay(cmd *cobra.Command, args []string) error {
+	c := config.NewConfig()
+	c.ApplyLogLevel(replayVerbose)
+	log.Init(os.Stderr, log.Level(c.System.Logging.Level), true)
+	defer log.Flush()
+
+	if _, err := os.Stat(replayConfig); err == nil {
+		if err := c.LoadWithMigration(replayConfig); err != nil {
+			return err
+		}
+	}
+	if err := c.Validate(); err != nil {
+		return fmt.Errorf("invalid configuration: %w", err)
+	}
+
+	set, err := onlyReplaySet(&c, replaySet)
+	if err != nil {
+		return err
+	}
+
+	in, err := os.Open(replayIn)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	src, err := openCapture(in)
+	if err != nil {
+		return fmt.Errorf("%s: %w", replayIn, err)
+	}
+
+	out, err := os.Create(replayOut)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	buf := bufio.NewWriter(out)
+	w, err := capture.NewPcapNGWriter(buf)
+	if err != nil {
+		return err
+	}
+
+	r := nfq.NewReplayer(&c)
+	defer r.Close()
+
+	stats, err := replayCapture(src, r, w, os.Stdout)
+	if err != nil {
+		return fmt.Errorf("%s: %w", replayIn, err)
+	}
+	if err := buf.Flush(); err != nil {
+		return err
+	}
+
+	fmt.Printf("replayed %d of %d packets with set %q: %d dropped, %d injected\n",
+		stats.replayed, stats.total, set.Name, stats.dropped, stats.injected)
+	return nil
+}
+
+// onlyReplaySet leaves the set named or identified by name as the only
+// one in c, enabled at all times.
+func onlyReplaySet(c *config.Config, name string) (*config.SetConfig, error) {
+	var set *config.SetConfig
+	for _, s := range c.Sets {
+		if s.Id == name || s.Name == name {
+			set = s
+			break
+		}
+	}
+	if set == nil {
+		return nil, fmt.Errorf("set %q not found", name)
+	}
+	set.Enabled = true
+	set.Schedule.Enabled = false
+	c.Sets = []*config.SetConfig{set}
+	if _, _, _, err := c.LoadTargets(); err != nil {
+		return nil, fmt.Errorf("failed to load targets: %w", err)
+	}
+	return set, nil
+}
+
+type replayStats struct {
+	total, replayed, dropped, injected int
+}
+
+// replayWriter receives the packets that would leave, each with a comment
+// telling which input packet it belongs to and why it was sent.
+type replayWriter interface {
+	WritePacket(ts time.Time, data []byte, comment string) error
+}
+
+// replayCapture runs every packet of src through r, writes what would be
+// sent to out and a line per input packet to report.
+func replayCapture(src *captureReader, r *nfq.Replayer, out replayWriter, report io.Writer) (replayStats, error) {
+	var stats replayStats
+	var last time.Time
+
+	writeReleased := func(ts time.Time, released [][]byte) error {
+		if len(released) == 0 {
+			return nil
+		}
+		fmt.Fprintf(report, "%6s  released %d held segments after reassembly timeout\n", "", len(released))
+		for _, p := range released {
+			if err := out.WritePacket(ts, p, "held segment released after reassembly timeout"); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	for {
+		data, ci, err := src.read()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return stats, err
+		}
+		stats.total++
+
+		pkt, ok := ipPayload(src.linkType(ci), data)
+		if !ok {
+			fmt.Fprintf(report, "%6d  skipped (not IP)\n", stats.total)
+			continue
+		}
+		stats.replayed++
+		last = ci.Timestamp
+
+		res := r.Packet(ci.Timestamp, pkt)
+		if err := writeReleased(ci.Timestamp, res.Released); err != nil {
+			return stats, err
+		}
+		if res.Verdict == "drop" {
+			stats.dropped++
+		}
+		stats.injected += res.Injected
+		fmt.Fprintf(report, "%6d  %-6s  injected %d\n", stats.total, res.Verdict, res.Injected)
+
+		n := 0
+		for _, p := range res.Out {
+			comment := fmt.Sprintf("packet %d: verdict %s, original", stats.total, res.Verdict)
+			if !p.Original {
+				n++
+				comment = fmt.Sprintf("packet %d: verdict %s, injected %d/%d", stats.total, res.Verdict, n, res.Injected)
+			}
+			if err := out.WritePacket(ci.Timestamp, p.Data, comment); err != nil {
+				return stats, err
+			}
+		}
+	}
+
+	if err := writeReleased(last, r.Flush()); err != nil {
+		return stats, err
+	}
+	return stats, nil
+}
+
+// captureReader reads pcap and pcapng files alike. pcapng packets carry
+// the link type of the interface they were captured on.
+type captureReader struct {
+	read     func() ([]byte, gopacket.CaptureInfo, error)
+	linkType func(ci gopacket.CaptureInfo) layers.LinkType
+}
+
+func openCapture(f io.Reader) (*captureReader, error) {
+	br := bufio.NewReader(f)
+	magic, err := br.Peek(4)
+	if err != nil {
+		return nil, err
+	}
+
+	if binary.LittleEndian.Uint32(magic) == 0x0a0d0d0a {
+		r, err := pcapgo.NewNgReader(br, pcapgo.DefaultNgReaderOptions)
+		if err != nil {
+			return nil, err
+		}
+		return &captureReader{
+			read: r.ReadPacketData,
+			linkType: func(ci gopacket.CaptureInfo) layers.LinkType {
+				if iface, err := r.Interface(ci.InterfaceIndex); err == nil {
+					return iface.LinkType
+				}
+				return r.LinkType()
+			},
+		}, nil
+	}
+
+	r, err := pcapgo.NewReader(br)
+	if err != nil {
+		return nil, err
+	}
+	return &captureReader{
+		read:     r.ReadPacketData,
+		linkType: func(gopacket.CaptureInfo) layers.LinkType { return r.LinkType() },
+	}, nil
+}
+
+// ipPayload strips the link layer header of a captured frame.
+func ipPayload(lt layers.LinkType, data []byte) ([]byte, bool) {
+	var off int
+	switch lt {
+	case layers.LinkTypeRaw, layers.LinkTypeIPv4, layers.LinkTypeIPv6:
+	case layers.LinkTypeNull, layers.LinkTypeLoop:
+		off = 4
+	case layers.LinkTypeLinuxSLL:
+		off = 16
+	case layers.LinkTypeEthernet:
+		off = 14
+		for len(data) >= off && (binary.BigEndian.Uint16(data[off-2:]) == 0x8100 || binary.BigEndian.Uint16(data[off-2:]) == 0x88a8) {
+			off += 4 // VLAN tags
+		}
+	default:
+		return nil, false
+	}
+	if len(data) <= off {
+		return nil, false
+	}
+	pkt := data[off:]
+	if v := pkt[0] >> 4; v != 4 && v != 6 {
+		return nil, false
+	}
+	return pkt, true
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/daniellavrushin/b4/capture"
+	"github.com/daniellavrushin/b4/config"
+	"github.com/daniellavrushin/b4/nfq"
+	"github.com/google/gopacket/pcapgo"
+)
+
+var updateGolden = flag.Bool("update", false, "rewrite the golden files in testdata")
+
+// summaryWriter describes every written packet on one line, leaving out
+// fields that change between runs such as IP IDs and checksums.
+type summaryWriter struct {
+	buf   bytes.Buffer
+	start time.Time
+}
+
+func (s *summaryWriter) WritePacket(ts time.Time, data []byte, comment string) error {
+	if s.start.IsZero() {
+		s.start = ts
+	}
+	var ttl, flags byte
+	var hdr int
+	family := "ipv4"
+	if data[0]>>4 == 6 {
+		family, ttl, hdr = "ipv6", data[7], 40
+	} else {
+		ttl, hdr = data[8], int(data[0]&0x0f)*4
+	}
+	tcp := data[hdr:]
+	flags = tcp[13]
+	payload := len(tcp) - int(tcp[12]>>4)*4
+
+	fmt.Fprintf(&s.buf, "%4dms %s ttl=%-3d flags=%02x sport=%d seq=%d payload=%-4d  %s\n",
+		ts.Sub(s.start).Milliseconds(), family, ttl, flags,
+		binary.BigEndian.Uint16(tcp[0:2]), binary.BigEndian.Uint32(tcp[4:8]), payload, comment)
+	return nil
+}
+
+func replayFixture(t *testing.T) string {
+	t.Helper()
+
+	c := config.NewConfig()
+	if err := c.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	c.MainSet.Targets.SNIDomains = []string{"example.com"}
+	if _, err := onlyReplaySet(&c, config.MAIN_SET_ID); err != nil {
+		t.Fatal(err)
+	}
+
+	in, err := os.Open(filepath.Join("testdata", "replay", "input.pcap"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer in.Close()
+	src, err := openCapture(in)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := nfq.NewReplayer(&c)
+	defer r.Close()
+
+	var report bytes.Buffer
+	out := &summaryWriter{}
+	stats, err := replayCapture(src, r, out, &report)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.total != 7 || stats.replayed != 7 {
+		t.Errorf("replayed %d of %d packets, want 7 of 7", stats.replayed, stats.total)
+	}
+	return report.String() + "\n" + out.buf.String()
+}
+
+func TestReplayGolden(t *testing.T) {
+	got := replayFixture(t)
+	golden := filepath.Join("testdata", "replay", "output.golden")
+
+	if *updateGolden {
+		if err := os.WriteFile(golden, []byte(got), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want, err := os.ReadFile(golden)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != string(want) {
+		t.Errorf("replay output differs from %s:\n%s", golden, got)
+	}
+
+	// The held segment must not depend on how fast the capture is read
+	if again := replayFixture(t); again != got {
+		t.Errorf("second replay differs:\n%s", again)
+	}
+}
+
+func TestReplayWritesComments(t *testing.T) {
+	var buf bytes.Buffer
+	w, err := capture.NewPcapNGWriter(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pkt := []byte{0x45, 0, 0, 20, 0, 0, 0, 0, 64, 6, 0, 0, 10, 0, 0, 1, 10, 0, 0, 2}
+	if err := w.WritePacket(time.Unix(1, 0), pkt, "packet 1: verdict drop, injected 1/2"); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := pcapgo.NewNgReader(bytes.NewReader(buf.Bytes()), pcapgo.DefaultNgReaderOptions)
+	if err != nil {
+		t.Fatalf("not a pcapng file: %v", err)
+	}
+	data, _, err := r.ReadPacketData()
+	if err != nil || !bytes.Equal(data, pkt) {
+		t.Fatalf("read %x, %v", data, err)
+	}
+	if !strings.Contains(buf.String(), "packet 1: verdict drop, injected 1/2") {
+		t.Error("comment not written")
+	}
+}
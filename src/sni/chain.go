@@ -0,0 +1,64 @@
+package sni
+
+import (
+	"net"
+	"time"
+
+	"github.com/daniellavrushin/b4/config"
+)
+
+// Chain matches against several SuffixSets in order, the first hit wins.
+// It gives sets limited to some devices precedence over the shared sets
+// for traffic of those devices.
+type Chain []*SuffixSet
+
+func (c Chain) MatchIP(ip net.IP) (bool, *config.SetConfig) {
+	for _, s := range c {
+		if matched, set := s.MatchIP(ip); matched {
+			return true, set
+		}
+	}
+	return false, nil
+}
+
+func (c Chain) MatchSNI(host string) (bool, *config.SetConfig) {
+	for _, s := range c {
+		if matched, set := s.MatchSNI(host); matched {
+			return true, set
+		}
+	}
+	return false, nil
+}
+
+func (c Chain) MatchLearnedIP(ip net.IP) (bool, *config.SetConfig, string) {
+	for _, s := range c {
+		if matched, set, domain := s.MatchLearnedIP(ip); matched {
+			return true, set, domain
+		}
+	}
+	return false, nil, ""
+}
+
+// LearnIPToDomain stores the IP in the SuffixSet built from set, so it is
+// only matched again for the devices set applies to.
+func (c Chain) LearnIPToDomain(ip net.IP, domain string, set *config.SetConfig) {
+	c.LearnIPToDomainTTL(ip, domain, set, 0)
+}
+
+// LearnIPToDomainTTL is LearnIPToDomain with the TTL of the learned IP.
+func (c Chain) LearnIPToDomainTTL(ip net.IP, domain string, set *config.SetConfig, ttl time.Duration) {
+	for _, s := range c {
+		if s.Owns(set) {
+			s.LearnIPToDomainTTL(ip, domain, set, ttl)
+			return
+		}
+	}
+	if len(c) > 0 {
+		c[len(c)-1].LearnIPToDomainTTL(ip, domain, set, ttl)
+	}
+}
+
+// Owns reports whether set is one of the sets s was built from.
+func (s *SuffixSet) Owns(set *config.SetConfig) bool {
+	return s != nil && s.members[set]
+}
@@ -0,0 +1,57 @@
+// Package domainrule parses domain targets written with the v2ray and xray
+// rule prefixes. It has no dependencies so config and sni can both use it.
+package domainrule
+
+import "strings"
+
+// Kind is how a domain target is matched.
+type Kind int
+
+const (
+	// Domain matches the domain and its subdomains, "domain:" or no prefix
+	Domain Kind = iota
+	// Full matches the exact host only, "full:"
+	Full
+	// Keyword matches hosts containing the value, "keyword:"
+	Keyword
+	// Regexp matches hosts against a regular expression, "regexp:"
+	Regexp
+)
+
+var prefixes = []struct {
+	prefix string
+	kind   Kind
+}{
+	{"domain:", Domain},
+	{"full:", Full},
+	{"keyword:", Keyword},
+	{"regexp:", Regexp},
+}
+
+// Parse splits a target such as "full:www.example.com" into its kind and
+// value. Values other than regular expressions are lowercased and lose a
+// trailing dot.
+func Parse(rule string) (Kind, string) {
+	rule = strings.TrimSpace(rule)
+	kind := Domain
+	for _, p := range prefixes {
+		if len(rule) >= len(p.prefix) && strings.EqualFold(rule[:len(p.prefix)], p.prefix) {
+			kind, rule = p.kind, strings.TrimSpace(rule[len(p.prefix):])
+			break
+		}
+	}
+	if kind == Regexp {
+		return kind, rule
+	}
+	return kind, strings.TrimRight(strings.ToLower(rule), ".")
+}
+
+// Host returns the host a target names, false for keyword and regexp
+// targets which have none.
+func Host(rule string) (string, bool) {
+	kind, value := Parse(rule)
+	if (kind != Domain && kind != Full) || value == "" {
+		return "", false
+	}
+	return value, true
+}
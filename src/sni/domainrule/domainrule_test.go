@@ -0,0 +1,51 @@
+package domainrule
+
+import "testing"
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		rule  string
+		kind  Kind
+		value string
+	}{
+		{"example.com", Domain, "example.com"},
+		{"  Example.COM. ", Domain, "example.com"},
+		{"domain:example.com", Domain, "example.com"},
+		{"DOMAIN: example.com", Domain, "example.com"},
+		{"full:www.Example.com", Full, "www.example.com"},
+		{"Full:www.example.com.", Full, "www.example.com"},
+		{"keyword:Google", Keyword, "google"},
+		{"regexp:^Ads\\.", Regexp, "^Ads\\."},
+		{"regexp: .*\\.com$ ", Regexp, ".*\\.com$"},
+		{"full:", Full, ""},
+		{"ful", Domain, "ful"},
+		{"", Domain, ""},
+	}
+	for _, tt := range tests {
+		kind, value := Parse(tt.rule)
+		if kind != tt.kind || value != tt.value {
+			t.Errorf("Parse(%q) = %d %q, want %d %q", tt.rule, kind, value, tt.kind, tt.value)
+		}
+	}
+}
+
+func TestHost(t *testing.T) {
+	tests := []struct {
+		rule string
+		host string
+		ok   bool
+	}{
+		{"example.com", "example.com", true},
+		{"full:WWW.example.com", "www.example.com", true},
+		{"domain:example.com.", "example.com", true},
+		{"keyword:example", "", false},
+		{"regexp:example\\.com", "", false},
+		{"domain:", "", false},
+	}
+	for _, tt := range tests {
+		host, ok := Host(tt.rule)
+		if host != tt.host || ok != tt.ok {
+			t.Errorf("Host(%q) = %q %v, want %q %v", tt.rule, host, ok, tt.host, tt.ok)
+		}
+	}
+}
@@ -0,0 +1,91 @@
+package sni
+
+import (
+	"bytes"
+	"strings"
+)
+
+var httpMethods = [][]byte{
+	[]byte("GET "), []byte("POST "), []byte("HEAD "), []byte("PUT "),
+	[]byte("DELETE "), []byte("OPTIONS "), []byte("PATCH "), []byte("CONNECT "),
+}
+
+// IsHTTPRequest reports whether payload starts with an HTTP/1.x request line.
+func IsHTTPRequest(payload []byte) bool {
+	for _, m := range httpMethods {
+		if bytes.HasPrefix(payload, m) {
+			return true
+		}
+	}
+	return false
+}
+
+// LocateHTTPHost returns the offsets of the Host header value within an HTTP
+// request. The value excludes surrounding whitespace but keeps the port, if any.
+// Header name matching is case-insensitive; the line must be terminated.
+func LocateHTTPHost(payload []byte) (start, end int, ok bool) {
+	if !IsHTTPRequest(payload) {
+		return 0, 0, false
+	}
+
+	// Skip the request line
+	i := bytes.IndexByte(payload, '\n')
+	if i < 0 {
+		return 0, 0, false
+	}
+	i++
+
+	for i < len(payload) {
+		eol := bytes.IndexByte(payload[i:], '\n')
+		if eol < 0 {
+			return 0, 0, false
+		}
+		line := payload[i : i+eol]
+		if len(line) == 0 || (len(line) == 1 && line[0] == '\r') {
+			// End of headers
+			return 0, 0, false
+		}
+
+		if len(line) > 5 && bytes.EqualFold(line[:5], []byte("host:")) {
+			s := 5
+			for s < len(line) && (line[s] == ' ' || line[s] == '\t') {
+				s++
+			}
+			e := len(line)
+			for e > s && (line[e-1] == '\r' || line[e-1] == ' ' || line[e-1] == '\t') {
+				e--
+			}
+			if e <= s {
+				return 0, 0, false
+			}
+			return i + s, i + e, true
+		}
+
+		i += eol + 1
+	}
+	return 0, 0, false
+}
+
+// ParseHTTPHost extracts the hostname from the Host header of an HTTP
+// request. The port is stripped and the result is lowercased.
+func ParseHTTPHost(payload []byte) (string, bool) {
+	start, end, ok := LocateHTTPHost(payload)
+	if !ok {
+		return "", false
+	}
+	host := string(payload[start:end])
+
+	if strings.HasPrefix(host, "[") {
+		// IPv6 literal, not matchable by domain
+		return "", false
+	}
+	if idx := strings.LastIndexByte(host, ':'); idx >= 0 {
+		host = host[:idx]
+	}
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+
+	if !validateSNI(host) {
+		return "", false
+	}
+	return host, true
+}
@@ -0,0 +1,72 @@
+package sni
+
+import "testing"
+
+func TestLocateHTTPHost(t *testing.T) {
+	tests := []struct {
+		name    string
+		payload string
+		host    string
+	}{
+		{"plain", "GET / HTTP/1.1\r\nHost: example.com\r\n\r\n", "example.com"},
+		{"port kept", "GET / HTTP/1.1\r\nHost: example.com:8080\r\n\r\n", "example.com:8080"},
+		{"header case", "POST /x HTTP/1.1\r\nhOsT: Example.com\r\n\r\n", "Example.com"},
+		{"after other headers", "GET / HTTP/1.1\r\nUser-Agent: x\r\nHOST: example.com\r\nAccept: */*\r\n\r\n", "example.com"},
+		{"no space", "GET / HTTP/1.1\r\nHost:example.com\r\n\r\n", "example.com"},
+		{"tabs and spaces", "GET / HTTP/1.1\r\nHost: \t example.com \t\r\n\r\n", "example.com"},
+		{"bare LF", "GET / HTTP/1.0\nHost: example.com\n\n", "example.com"},
+		{"first Host wins", "GET / HTTP/1.1\r\nHost: a.example\r\nHost: b.example\r\n\r\n", "a.example"},
+
+		{"not a request", "HTTP/1.1 200 OK\r\nHost: example.com\r\n\r\n", ""},
+		{"lowercase method", "get / HTTP/1.1\r\nHost: example.com\r\n\r\n", ""},
+		{"missing Host", "GET / HTTP/1.1\r\nAccept: */*\r\n\r\n", ""},
+		{"Host after the headers", "GET / HTTP/1.1\r\nAccept: */*\r\n\r\nHost: example.com\r\n", ""},
+		{"empty value", "GET / HTTP/1.1\r\nHost: \t\r\n\r\n", ""},
+		{"prefix of another header", "GET / HTTP/1.1\r\nHostname: example.com\r\n\r\n", ""},
+		{"folded line", "GET / HTTP/1.1\r\nX-A: 1\r\n Host: example.com\r\n\r\n", ""},
+		// Split across segments: the Host line is not complete yet
+		{"request line only", "GET /index.html HTTP/1.1", ""},
+		{"cut in the headers", "GET / HTTP/1.1\r\nAccept: */*\r\nHo", ""},
+		{"cut in the value", "GET / HTTP/1.1\r\nHost: examp", ""},
+	}
+	for _, tt := range tests {
+		payload := []byte(tt.payload)
+		start, end, ok := LocateHTTPHost(payload)
+		if ok != (tt.host != "") {
+			t.Errorf("%s: ok = %v", tt.name, ok)
+			continue
+		}
+		if ok && string(payload[start:end]) != tt.host {
+			t.Errorf("%s: located %q, want %q", tt.name, payload[start:end], tt.host)
+		}
+	}
+}
+
+func TestParseHTTPHost(t *testing.T) {
+	tests := []struct {
+		host string
+		want string
+	}{
+		{"example.com", "example.com"},
+		{"WWW.Example.COM", "www.example.com"},
+		{"example.com:8080", "example.com"},
+		{"example.com.", "example.com"},
+		{"example.com.:80", "example.com"},
+		{"localhost", "localhost"},
+		{"192.0.2.1:80", "192.0.2.1"},
+		{"[2001:db8::1]:80", ""},
+		{"intranet", ""},
+		{"exa mple.com", ""},
+		{"example.com\x00", ""},
+	}
+	for _, tt := range tests {
+		got, ok := ParseHTTPHost([]byte("GET / HTTP/1.1\r\nHost: " + tt.host + "\r\n\r\n"))
+		if got != tt.want || ok != (tt.want != "") {
+			t.Errorf("Host %q: got %q %v, want %q", tt.host, got, ok, tt.want)
+		}
+	}
+
+	if _, ok := ParseHTTPHost([]byte("GET / HTTP/1.1\r\nHost: exam")); ok {
+		t.Error("host of a request cut in the Host line")
+	}
+}
@@ -0,0 +1,94 @@
+package sni
+
+// keywordMatcher finds which of many keywords occur in a host in one pass
+// (Aho-Corasick). When several do, the one added first wins.
+type keywordMatcher struct {
+	nodes []keywordNode
+}
+
+type keywordNode struct {
+	next map[byte]int32
+	fail int32
+	// best is the lowest keyword index ending here or at a fail
+	// ancestor, -1 for none
+	best int32
+}
+
+func newKeywordMatcher() *keywordMatcher {
+	return &keywordMatcher{nodes: []keywordNode{{best: -1}}}
+}
+
+// add inserts keyword with index idx. build must be called after the last
+// add.
+func (k *keywordMatcher) add(keyword string, idx int32) {
+	n := int32(0)
+	for i := 0; i < len(keyword); i++ {
+		c := keyword[i]
+		next, ok := k.nodes[n].next[c]
+		if !ok {
+			next = int32(len(k.nodes))
+			k.nodes = append(k.nodes, keywordNode{best: -1})
+			if k.nodes[n].next == nil {
+				k.nodes[n].next = make(map[byte]int32)
+			}
+			k.nodes[n].next[c] = next
+		}
+		n = next
+	}
+	if k.nodes[n].best < 0 || idx < k.nodes[n].best {
+		k.nodes[n].best = idx
+	}
+}
+
+// build links every node to the longest proper suffix of its path that is
+// also in the trie.
+func (k *keywordMatcher) build() {
+	queue := make([]int32, 0, len(k.nodes))
+	for _, child := range k.nodes[0].next {
+		queue = append(queue, child)
+	}
+	for len(queue) > 0 {
+		n := queue[0]
+		queue = queue[1:]
+		for c, child := range k.nodes[n].next {
+			f := k.nodes[n].fail
+			for f != 0 && !k.has(f, c) {
+				f = k.nodes[f].fail
+			}
+			if next, ok := k.nodes[f].next[c]; ok && next != child {
+				f = next
+			} else {
+				f = 0
+			}
+			k.nodes[child].fail = f
+			if fb := k.nodes[f].best; fb >= 0 && (k.nodes[child].best < 0 || fb < k.nodes[child].best) {
+				k.nodes[child].best = fb
+			}
+			queue = append(queue, child)
+		}
+	}
+}
+
+func (k *keywordMatcher) has(n int32, c byte) bool {
+	_, ok := k.nodes[n].next[c]
+	return ok
+}
+
+// match returns the lowest index of the keywords found in host, or -1.
+func (k *keywordMatcher) match(host string) int32 {
+	best := int32(-1)
+	n := int32(0)
+	for i := 0; i < len(host); i++ {
+		c := host[i]
+		for n != 0 && !k.has(n, c) {
+			n = k.nodes[n].fail
+		}
+		if next, ok := k.nodes[n].next[c]; ok {
+			n = next
+		}
+		if b := k.nodes[n].best; b >= 0 && (best < 0 || b < best) {
+			best = b
+		}
+	}
+	return best
+}
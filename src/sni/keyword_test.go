@@ -0,0 +1,104 @@
+package sni
+
+import (
+	"testing"
+
+	"github.com/daniellavrushin/b4/config"
+)
+
+func newTestKeywords(keywords ...string) *keywordMatcher {
+	k := newKeywordMatcher()
+	for i, kw := range keywords {
+		k.add(kw, int32(i))
+	}
+	k.build()
+	return k
+}
+
+func TestKeywordMatcher(t *testing.T) {
+	tests := []struct {
+		name     string
+		keywords []string
+		host     string
+		want     int32
+	}{
+		{"no keywords", nil, "example.com", -1},
+		{"no match", []string{"google", "yt"}, "example.com", -1},
+		{"single", []string{"google"}, "www.google.com", 0},
+		{"whole host", []string{"abc"}, "abc", 0},
+		{"fail link", []string{"ab", "bc"}, "abc", 0},
+		{"fail link only", []string{"abd", "bc"}, "abc", 1},
+		{"suffix of a longer keyword", []string{"xabc", "bc"}, "yabc", 1},
+		{"lowest index wins", []string{"video", "googlevideo"}, "r1.googlevideo.com", 0},
+		{"lowest index wins, later in host", []string{"com", "google"}, "google.com", 0},
+		{"lower index found later", []string{"cdn", "google"}, "google-cdn.net", 0},
+		{"duplicate keeps first", []string{"ads", "ads"}, "ads.example", 0},
+		{"nested", []string{"a", "aa", "aaa"}, "aaa", 0},
+		{"restart after mismatch", []string{"abab"}, "abaabab", 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := newTestKeywords(tt.keywords...).match(tt.host); got != tt.want {
+				t.Errorf("match(%q) = %d, want %d", tt.host, got, tt.want)
+			}
+		})
+	}
+}
+
+func testSet(name string, domains ...string) *config.SetConfig {
+	set := config.NewSetConfig()
+	set.Name = name
+	set.Enabled = true
+	set.Targets.DomainsToMatch = domains
+	return &set
+}
+
+func TestMatchSNIRuleKinds(t *testing.T) {
+	full := testSet("full", "full:www.example.com")
+	domain := testSet("domain", "example.com", "domain:Example.org")
+	keyword := testSet("keyword", "keyword:example", "keyword:ads")
+	regex := testSet("regexp", "regexp:^cdn[0-9]+\\.")
+	s := NewSuffixSet([]*config.SetConfig{keyword, regex, domain, full})
+
+	tests := []struct {
+		host string
+		want *config.SetConfig
+	}{
+		// full beats the suffix rule for the same host only
+		{"www.example.com", full},
+		{"WWW.EXAMPLE.COM", full},
+		{"api.www.example.com", domain},
+		{"example.com", domain},
+		{"img.example.org", domain},
+		// suffix beats keyword even though the keyword set comes first
+		{"cdn.example.com", domain},
+		{"example.net", keyword},
+		{"myads.net", keyword},
+		{"cdn12.other.net", regex},
+		{"other.net", nil},
+	}
+	for _, tt := range tests {
+		matched, set := s.MatchSNI(tt.host)
+		if matched != (tt.want != nil) || set != tt.want {
+			name := "<nil>"
+			if set != nil {
+				name = set.Name
+			}
+			t.Errorf("MatchSNI(%q) = %v %s", tt.host, matched, name)
+		}
+	}
+}
+
+func TestMatchSNIFirstSetWins(t *testing.T) {
+	a := testSet("a", "keyword:video", "example.com")
+	b := testSet("b", "keyword:googlevideo", "full:example.com")
+	s := NewSuffixSet([]*config.SetConfig{a, b})
+
+	if _, set := s.MatchSNI("r1.googlevideo.com"); set != a {
+		t.Errorf("overlapping keywords should match the first set, got %v", set)
+	}
+	// full rules are checked before suffix rules whatever the set order
+	if _, set := s.MatchSNI("example.com"); set != b {
+		t.Errorf("full rule should win, got %v", set)
+	}
+}
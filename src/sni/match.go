@@ -11,6 +11,7 @@ import (
 	"time"
 
 	"github.com/daniellavrushin/b4/config"
+	"github.com/daniellavrushin/b4/sni/domainrule"
 	"github.com/yl2chen/cidranger"
 )
 
@@ -26,11 +27,15 @@ type portRange struct {
 }
 
 type SuffixSet struct {
-	sets       map[string]*config.SetConfig
-	regexes    []*regexWithSet
-	regexCache sync.Map
-	ipRanger   cidranger.Ranger
-	portRanges []portRange
+	members     map[*config.SetConfig]bool
+	sets        map[string]*config.SetConfig // domain rules, matched by suffix
+	full        map[string]*config.SetConfig
+	keywords    *keywordMatcher
+	keywordSets []*config.SetConfig
+	regexes     []*regexWithSet
+	regexCache  sync.Map
+	ipRanger    cidranger.Ranger
+	portRanges  []portRange
 
 	ipCache      map[string]*cacheEntry
 	ipCacheLRU   *list.List
@@ -61,6 +66,7 @@ type learnedIPEntry struct {
 	domain    string
 	set       *config.SetConfig
 	learnedAt time.Time
+	ttl       time.Duration
 	element   *list.Element
 }
 
@@ -69,13 +75,38 @@ type regexWithSet struct {
 	set   *config.SetConfig
 }
 
+// LearnedIPTTL is how long a learned IP stays associated with its domain
+// after it was last seen.
+const LearnedIPTTL = 10 * time.Minute
+
+// Bounds for the TTLs of IPs learned from DNS answers. Records with very
+// short TTLs are kept long enough for the client to connect.
+const (
+	MinLearnedDNSTTL = time.Minute
+	MaxLearnedDNSTTL = 24 * time.Hour
+)
+
+// LearnFunc receives every learned IP together with how long it stays valid.
+type LearnFunc func(ip net.IP, ttl time.Duration)
+
+var learnHook atomic.Value // LearnFunc
+
+// SetLearnHook registers fn to be called whenever an IP is learned or
+// refreshed, e.g. to mirror it into a kernel set. nil removes the hook.
+func SetLearnHook(fn LearnFunc) {
+	learnHook.Store(fn)
+}
+
 func (e *ipRange) Network() net.IPNet {
 	return *e.ipNet
 }
 
 func NewSuffixSet(sets []*config.SetConfig) *SuffixSet {
 	s := &SuffixSet{
+		members:  make(map[*config.SetConfig]bool),
 		sets:     make(map[string]*config.SetConfig),
+		full:     make(map[string]*config.SetConfig),
+		keywords: newKeywordMatcher(),
 		regexes:  make([]*regexWithSet, 0),
 		ipRanger: cidranger.NewPCTrieRanger(),
 
@@ -90,39 +121,48 @@ func NewSuffixSet(sets []*config.SetConfig) *SuffixSet {
 		learnedIPCache:      make(map[string]*learnedIPEntry),
 		learnedIPCacheLRU:   list.New(),
 		learnedIPCacheLimit: 5000,
-		learnedIPTTL:        10 * time.Minute,
+		learnedIPTTL:        LearnedIPTTL,
 	}
 
 	seenRegexes := make(map[string]bool)
+	seenKeywords := make(map[string]bool)
 
 	for _, set := range sets {
 		if !set.Enabled {
 			continue
 		}
+		s.members[set] = true
 
-		for _, d := range set.Targets.DomainsToMatch {
-			d = strings.ToLower(strings.TrimSpace(d))
+		for _, rule := range set.Targets.DomainsToMatch {
+			kind, d := domainrule.Parse(rule)
 			if d == "" {
 				continue
 			}
 
-			// Handle regex patterns
-			if strings.HasPrefix(d, "regexp:") {
-				pattern := strings.TrimPrefix(d, "regexp:")
-				if seenRegexes[pattern] {
+			switch kind {
+			case domainrule.Regexp:
+				if seenRegexes[d] {
 					continue
 				}
-				if re, err := regexp.Compile(pattern); err == nil {
+				if re, err := regexp.Compile(d); err == nil {
 					s.regexes = append(s.regexes, &regexWithSet{regex: re, set: set})
-					seenRegexes[pattern] = true
+					seenRegexes[d] = true
+				}
+			case domainrule.Keyword:
+				if seenKeywords[d] {
+					continue
+				}
+				seenKeywords[d] = true
+				s.keywords.add(d, int32(len(s.keywordSets)))
+				s.keywordSets = append(s.keywordSets, set)
+			case domainrule.Full:
+				if _, exists := s.full[d]; !exists {
+					s.full[d] = set
+				}
+			default:
+				if _, exists := s.sets[d]; !exists {
+					s.sets[d] = set
 				}
-				continue
-			}
-
-			// Regular domain
-			d = strings.TrimRight(d, ".")
-			if _, exists := s.sets[d]; !exists {
-				s.sets[d] = set
 			}
 		}
 
@@ -184,6 +224,8 @@ func NewSuffixSet(sets []*config.SetConfig) *SuffixSet {
 		}
 	}
 
+	s.keywords.build()
+
 	return s
 }
 
@@ -206,13 +248,13 @@ func (s *SuffixSet) MatchUDPPort(dport uint16) (bool, *config.SetConfig) {
 }
 
 func (s *SuffixSet) MatchSNI(host string) (bool, *config.SetConfig) {
-	if s == nil || (len(s.sets) == 0 && len(s.regexes) == 0) || host == "" {
+	if s == nil || (len(s.sets) == 0 && len(s.full) == 0 && len(s.keywordSets) == 0 && len(s.regexes) == 0) || host == "" {
 		return false, nil
 	}
 
 	lower := strings.ToLower(host)
 
-	// Check exact/suffix match first (fast)
+	// Check exact, suffix and keyword matches first (fast)
 	if matched, set := s.matchDomain(lower); matched {
 		return true, set
 	}
@@ -303,7 +345,10 @@ func (s *SuffixSet) matchDomain(host string) (bool, *config.SetConfig) {
 	var matched bool
 	var matchedSet *config.SetConfig
 
-	if set, ok := s.sets[host]; ok {
+	if set, ok := s.full[host]; ok {
+		matched = true
+		matchedSet = set
+	} else if set, ok := s.sets[host]; ok {
 		matched = true
 		matchedSet = set
 	} else {
@@ -322,6 +367,13 @@ func (s *SuffixSet) matchDomain(host string) (bool, *config.SetConfig) {
 		}
 	}
 
+	if !matched && len(s.keywordSets) > 0 {
+		if idx := s.keywords.match(host); idx >= 0 {
+			matched = true
+			matchedSet = s.keywordSets[idx]
+		}
+	}
+
 	// Update cache — check if another goroutine already cached this host
 	s.domainCacheMu.Lock()
 	defer s.domainCacheMu.Unlock()
@@ -374,12 +426,25 @@ func (s *SuffixSet) matchRegex(host string) (bool, *config.SetConfig) {
 }
 
 func (s *SuffixSet) LearnIPToDomain(ip net.IP, domain string, set *config.SetConfig) {
+	s.LearnIPToDomainTTL(ip, domain, set, 0)
+}
+
+// LearnIPToDomainTTL is LearnIPToDomain for an IP that stays valid for ttl
+// instead of LearnedIPTTL, e.g. the TTL of the DNS record it came from.
+func (s *SuffixSet) LearnIPToDomainTTL(ip net.IP, domain string, set *config.SetConfig, ttl time.Duration) {
 	if s == nil || ip == nil || domain == "" || set == nil {
 		return
 	}
+	if ttl <= 0 {
+		ttl = s.learnedIPTTL
+	}
 
 	ipStr := ip.String()
 
+	if fn, _ := learnHook.Load().(LearnFunc); fn != nil {
+		fn(ip, ttl)
+	}
+
 	s.learnedIPCacheMu.Lock()
 	defer s.learnedIPCacheMu.Unlock()
 
@@ -388,6 +453,7 @@ func (s *SuffixSet) LearnIPToDomain(ip net.IP, domain string, set *config.SetCon
 		entry.domain = domain
 		entry.set = set
 		entry.learnedAt = time.Now()
+		entry.ttl = ttl
 		return
 	}
 
@@ -404,6 +470,7 @@ func (s *SuffixSet) LearnIPToDomain(ip net.IP, domain string, set *config.SetCon
 		domain:    domain,
 		set:       set,
 		learnedAt: time.Now(),
+		ttl:       ttl,
 		element:   element,
 	}
 }
@@ -431,7 +498,7 @@ func (s *SuffixSet) MatchLearnedIP(ip net.IP) (bool, *config.SetConfig, string)
 		return false, nil, ""
 	}
 
-	if time.Since(entry.learnedAt) > s.learnedIPTTL {
+	if time.Since(entry.learnedAt) > entry.ttl {
 		if currentEntry, stillExists := s.learnedIPCache[ipStr]; stillExists && currentEntry == entry {
 			delete(s.learnedIPCache, ipStr)
 			s.learnedIPCacheLRU.Remove(entry.element)
@@ -449,20 +516,18 @@ func (s *SuffixSet) TransferLearnedIPs(old *SuffixSet) {
 		return
 	}
 
-	old.learnedIPCacheMu.RLock()
-	entries := make([]struct {
+	type learned struct {
 		ip     string
 		domain string
-		set    *config.SetConfig
-	}, 0, len(old.learnedIPCache))
+		ttl    time.Duration
+	}
+
+	old.learnedIPCacheMu.RLock()
+	entries := make([]learned, 0, len(old.learnedIPCache))
 	now := time.Now()
 	for ipStr, entry := range old.learnedIPCache {
-		if now.Sub(entry.learnedAt) <= old.learnedIPTTL {
-			entries = append(entries, struct {
-				ip     string
-				domain string
-				set    *config.SetConfig
-			}{ip: ipStr, domain: entry.domain, set: entry.set})
+		if now.Sub(entry.learnedAt) <= entry.ttl {
+			entries = append(entries, learned{ip: ipStr, domain: entry.domain, ttl: entry.ttl})
 		}
 	}
 	old.learnedIPCacheMu.RUnlock()
@@ -471,7 +536,7 @@ func (s *SuffixSet) TransferLearnedIPs(old *SuffixSet) {
 		if matched, newSet := s.MatchSNI(e.domain); matched {
 			ip := net.ParseIP(e.ip)
 			if ip != nil {
-				s.LearnIPToDomain(ip, e.domain, newSet)
+				s.LearnIPToDomainTTL(ip, e.domain, newSet, e.ttl)
 			}
 		}
 	}
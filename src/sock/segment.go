@@ -0,0 +1,93 @@
+package sock
+
+import (
+	"encoding/binary"
+)
+
+// oversizeSegmentLen is the packet size used when the kernel rejects an
+// oversized TCP packet (EMSGSIZE). 1280 is the IPv6 minimum MTU and fits
+// every IPv4 link b4 is deployed on.
+const oversizeSegmentLen = 1280
+
+// SplitTCPv4 re-segments an IPv4 TCP packet so that no resulting packet is
+// larger than maxLen bytes. Sequence numbers and IP IDs are advanced per
+// segment and PSH is kept only on the last one.
+func SplitTCPv4(packet []byte, maxLen int) ([][]byte, bool) {
+	if len(packet) < 40 || packet[0]>>4 != 4 || packet[9] != 6 {
+		return nil, false
+	}
+	ipHdrLen := int((packet[0] & 0x0F) * 4)
+	if len(packet) < ipHdrLen+20 {
+		return nil, false
+	}
+	tcpHdrLen := int((packet[ipHdrLen+12] >> 4) * 4)
+	payloadStart := ipHdrLen + tcpHdrLen
+	chunk := maxLen - payloadStart
+	if payloadStart > len(packet) || chunk <= 0 || len(packet) <= maxLen {
+		return nil, false
+	}
+
+	payload := packet[payloadStart:]
+	seq0 := binary.BigEndian.Uint32(packet[ipHdrLen+4 : ipHdrLen+8])
+	id0 := binary.BigEndian.Uint16(packet[4:6])
+	psh := packet[ipHdrLen+13] & 0x08
+
+	var segs [][]byte
+	for off, i := 0, 0; off < len(payload); off, i = off+chunk, i+1 {
+		end := min(off+chunk, len(payload))
+		seg := make([]byte, payloadStart+end-off)
+		copy(seg, packet[:payloadStart])
+		copy(seg[payloadStart:], payload[off:end])
+
+		binary.BigEndian.PutUint16(seg[2:4], uint16(len(seg)))
+		binary.BigEndian.PutUint16(seg[4:6], id0+uint16(i))
+		binary.BigEndian.PutUint32(seg[ipHdrLen+4:ipHdrLen+8], seq0+uint32(off))
+		seg[ipHdrLen+13] &^= 0x08
+		if end == len(payload) {
+			seg[ipHdrLen+13] |= psh
+		}
+
+		FixIPv4Checksum(seg[:ipHdrLen])
+		FixTCPChecksum(seg)
+		segs = append(segs, seg)
+	}
+	return segs, true
+}
+
+// SplitTCPv6 is the IPv6 counterpart of SplitTCPv4. Only packets without
+// extension headers are handled.
+func SplitTCPv6(packet []byte, maxLen int) ([][]byte, bool) {
+	ipv6HdrLen := 40
+	if len(packet) < ipv6HdrLen+20 || packet[0]>>4 != 6 || packet[6] != 6 {
+		return nil, false
+	}
+	tcpHdrLen := int((packet[ipv6HdrLen+12] >> 4) * 4)
+	payloadStart := ipv6HdrLen + tcpHdrLen
+	chunk := maxLen - payloadStart
+	if payloadStart > len(packet) || chunk <= 0 || len(packet) <= maxLen {
+		return nil, false
+	}
+
+	payload := packet[payloadStart:]
+	seq0 := binary.BigEndian.Uint32(packet[ipv6HdrLen+4 : ipv6HdrLen+8])
+	psh := packet[ipv6HdrLen+13] & 0x08
+
+	var segs [][]byte
+	for off := 0; off < len(payload); off += chunk {
+		end := min(off+chunk, len(payload))
+		seg := make([]byte, payloadStart+end-off)
+		copy(seg, packet[:payloadStart])
+		copy(seg[payloadStart:], payload[off:end])
+
+		binary.BigEndian.PutUint16(seg[4:6], uint16(len(seg)-ipv6HdrLen))
+		binary.BigEndian.PutUint32(seg[ipv6HdrLen+4:ipv6HdrLen+8], seq0+uint32(off))
+		seg[ipv6HdrLen+13] &^= 0x08
+		if end == len(payload) {
+			seg[ipv6HdrLen+13] |= psh
+		}
+
+		FixTCPChecksumV6(seg)
+		segs = append(segs, seg)
+	}
+	return segs, true
+}
@@ -0,0 +1,72 @@
+package sock
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+func TestSplitTCPv4_SmallPacket(t *testing.T) {
+	pkt := buildMinimalIPv4TCPPacket(100)
+	if _, ok := SplitTCPv4(pkt, 1280); ok {
+		t.Error("packet below limit should not be split")
+	}
+}
+
+func TestSplitTCPv4_Oversize(t *testing.T) {
+	pkt := buildMinimalIPv4TCPPacket(3000)
+	segs, ok := SplitTCPv4(pkt, 1280)
+	if !ok {
+		t.Fatal("expected packet to be split")
+	}
+	if len(segs) != 3 {
+		t.Fatalf("expected 3 segments, got %d", len(segs))
+	}
+
+	var joined []byte
+	seq := uint32(1000)
+	for i, seg := range segs {
+		if len(seg) > 1280 {
+			t.Errorf("segment %d too large: %d", i, len(seg))
+		}
+		if got := int(binary.BigEndian.Uint16(seg[2:4])); got != len(seg) {
+			t.Errorf("segment %d: total length %d, want %d", i, got, len(seg))
+		}
+		if got := binary.BigEndian.Uint32(seg[24:28]); got != seq {
+			t.Errorf("segment %d: seq %d, want %d", i, got, seq)
+		}
+		psh := seg[33]&0x08 != 0
+		if psh != (i == len(segs)-1) {
+			t.Errorf("segment %d: unexpected PSH=%v", i, psh)
+		}
+		seq += uint32(len(seg) - 40)
+		joined = append(joined, seg[40:]...)
+	}
+
+	if !bytes.Equal(joined, pkt[40:]) {
+		t.Error("reassembled payload does not match original")
+	}
+}
+
+func TestSplitTCPv6_Oversize(t *testing.T) {
+	pkt := buildMinimalIPv6TCPPacket(2000)
+	segs, ok := SplitTCPv6(pkt, 1280)
+	if !ok {
+		t.Fatal("expected packet to be split")
+	}
+	if len(segs) != 2 {
+		t.Fatalf("expected 2 segments, got %d", len(segs))
+	}
+
+	var joined []byte
+	for i, seg := range segs {
+		if got := int(binary.BigEndian.Uint16(seg[4:6])); got != len(seg)-40 {
+			t.Errorf("segment %d: payload length %d, want %d", i, got, len(seg)-40)
+		}
+		joined = append(joined, seg[60:]...)
+	}
+
+	if !bytes.Equal(joined, pkt[60:]) {
+		t.Error("reassembled payload does not match original")
+	}
+}
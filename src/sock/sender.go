@@ -1,6 +1,7 @@
 package sock
 
 import (
+	"errors"
 	"net"
 	"syscall"
 
@@ -8,6 +9,14 @@ import (
 	"golang.org/x/sys/unix"
 )
 
+// PacketSender sends raw IP packets. Sender does it over raw sockets,
+// replay records them instead.
+type PacketSender interface {
+	SendIPv4(packet []byte, destIP net.IP) error
+	SendIPv6(packet []byte, destIP net.IP) error
+	Close()
+}
+
 type Sender struct {
 	fd4  int
 	fd6  int
@@ -59,7 +68,19 @@ func (s *Sender) SendIPv4(packet []byte, destIP net.IP) error {
 	log.Tracef("Sending IPv4 packet to %s, len=%d", destIP.String(), len(packet))
 	addr := syscall.SockaddrInet4{}
 	copy(addr.Addr[:], destIP.To4())
-	return syscall.Sendto(s.fd4, packet, 0, &addr)
+	err := syscall.Sendto(s.fd4, packet, 0, &addr)
+	if errors.Is(err, syscall.EMSGSIZE) {
+		// Reassembled ClientHellos can exceed the link MTU after desync
+		if segs, ok := SplitTCPv4(packet, oversizeSegmentLen); ok {
+			log.Tracef("IPv4 packet too large (%d bytes), re-segmented into %d", len(packet), len(segs))
+			for _, seg := range segs {
+				if err = syscall.Sendto(s.fd4, seg, 0, &addr); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return err
 }
 
 func (s *Sender) SendIPv6(packet []byte, destIP net.IP) error {
@@ -69,7 +90,18 @@ func (s *Sender) SendIPv6(packet []byte, destIP net.IP) error {
 	log.Tracef("Sending IPv6 packet to %s, len=%d", destIP.String(), len(packet))
 	addr := syscall.SockaddrInet6{}
 	copy(addr.Addr[:], destIP.To16())
-	return syscall.Sendto(s.fd6, packet, 0, &addr)
+	err := syscall.Sendto(s.fd6, packet, 0, &addr)
+	if errors.Is(err, syscall.EMSGSIZE) {
+		if segs, ok := SplitTCPv6(packet, oversizeSegmentLen); ok {
+			log.Tracef("IPv6 packet too large (%d bytes), re-segmented into %d", len(packet), len(segs))
+			for _, seg := range segs {
+				if err = syscall.Sendto(s.fd6, seg, 0, &addr); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return err
 }
 
 func (s *Sender) Close() {
@@ -36,6 +36,12 @@ func udpChecksumIPv4(pkt []byte) {
 }
 
 func BuildFakeUDPFromOriginalV4(orig []byte, fakeLen int, ttl uint8) ([]byte, bool) {
+	return BuildUDPWithPayloadV4(orig, make([]byte, fakeLen), ttl)
+}
+
+// BuildUDPWithPayloadV4 copies the IPv4 and UDP headers of orig around a new
+// payload and fixes lengths and checksums.
+func BuildUDPWithPayloadV4(orig, payload []byte, ttl uint8) ([]byte, bool) {
 	if len(orig) < 20 || orig[0]>>4 != 4 {
 		return nil, false
 	}
@@ -43,18 +49,17 @@ func BuildFakeUDPFromOriginalV4(orig []byte, fakeLen int, ttl uint8) ([]byte, bo
 	if len(orig) < ihl+8 {
 		return nil, false
 	}
-	out := make([]byte, 20+8+fakeLen)
+	out := make([]byte, 20+8+len(payload))
 	copy(out, orig[:20])
+	out[0] = 0x45
 	out[8] = ttl
 	id := binary.BigEndian.Uint16(out[4:6])
 	binary.BigEndian.PutUint16(out[4:6], id+1)
 	out[6], out[7] = 0, 0
-	binary.BigEndian.PutUint16(out[2:4], uint16(20+8+fakeLen))
+	binary.BigEndian.PutUint16(out[2:4], uint16(20+8+len(payload)))
 	copy(out[20:], orig[ihl:ihl+8])
-	binary.BigEndian.PutUint16(out[20+4:20+6], uint16(8+fakeLen))
-	for i := 0; i < fakeLen; i++ {
-		out[28+i] = 0
-	}
+	binary.BigEndian.PutUint16(out[20+4:20+6], uint16(8+len(payload)))
+	copy(out[28:], payload)
 	FixIPv4Checksum(out[:20])
 	udpChecksumIPv4(out)
 	return out, true
@@ -67,6 +67,31 @@ func TestBuildFakeUDPFromOriginalV4_Valid(t *testing.T) {
 	}
 }
 
+func TestBuildUDPWithPayloadV4(t *testing.T) {
+	pkt := buildMinimalIPv4UDPPacket(20)
+	payload := []byte("quic initial")
+	result, ok := BuildUDPWithPayloadV4(pkt, payload, 4)
+	if !ok {
+		t.Fatal("expected success")
+	}
+
+	if string(result[28:]) != string(payload) {
+		t.Errorf("payload not copied: %q", result[28:])
+	}
+	if got := binary.BigEndian.Uint16(result[24:26]); got != uint16(8+len(payload)) {
+		t.Errorf("UDP length: expected %d, got %d", 8+len(payload), got)
+	}
+	if binary.BigEndian.Uint16(result[20:22]) != 12345 || binary.BigEndian.Uint16(result[22:24]) != 53 {
+		t.Error("ports not preserved")
+	}
+
+	want := binary.BigEndian.Uint16(result[26:28])
+	udpChecksumIPv4(result)
+	if got := binary.BigEndian.Uint16(result[26:28]); got != want {
+		t.Errorf("bad UDP checksum: %04x, expected %04x", want, got)
+	}
+}
+
 func TestIPv4FragmentUDP_TooShort(t *testing.T) {
 	_, ok := IPv4FragmentUDP(make([]byte, 20), 8)
 	if ok {
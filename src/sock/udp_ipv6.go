@@ -53,6 +53,12 @@ func udpChecksumIPv6(pkt []byte) {
 }
 
 func BuildFakeUDPFromOriginalV6(orig []byte, fakeLen int, hopLimit uint8) ([]byte, bool) {
+	return BuildUDPWithPayloadV6(orig, make([]byte, fakeLen), hopLimit)
+}
+
+// BuildUDPWithPayloadV6 copies the IPv6 and UDP headers of orig around a new
+// payload and fixes lengths and the checksum.
+func BuildUDPWithPayloadV6(orig, payload []byte, hopLimit uint8) ([]byte, bool) {
 	if len(orig) < 48 || orig[0]>>4 != 6 {
 		return nil, false
 	}
@@ -62,7 +68,7 @@ func BuildFakeUDPFromOriginalV6(orig []byte, fakeLen int, hopLimit uint8) ([]byt
 		return nil, false
 	}
 
-	out := make([]byte, ipv6HdrLen+8+fakeLen)
+	out := make([]byte, ipv6HdrLen+8+len(payload))
 
 	// Copy IPv6 header
 	copy(out, orig[:ipv6HdrLen])
@@ -71,18 +77,15 @@ func BuildFakeUDPFromOriginalV6(orig []byte, fakeLen int, hopLimit uint8) ([]byt
 	out[7] = hopLimit
 
 	// Update payload length
-	binary.BigEndian.PutUint16(out[4:6], uint16(8+fakeLen))
+	binary.BigEndian.PutUint16(out[4:6], uint16(8+len(payload)))
 
 	// Copy UDP header
 	copy(out[ipv6HdrLen:], orig[ipv6HdrLen:ipv6HdrLen+8])
 
 	// Update UDP length
-	binary.BigEndian.PutUint16(out[ipv6HdrLen+4:ipv6HdrLen+6], uint16(8+fakeLen))
+	binary.BigEndian.PutUint16(out[ipv6HdrLen+4:ipv6HdrLen+6], uint16(8+len(payload)))
 
-	// Zero out fake payload
-	for i := 0; i < fakeLen; i++ {
-		out[ipv6HdrLen+8+i] = 0
-	}
+	copy(out[ipv6HdrLen+8:], payload)
 
 	// Calculate checksum
 	udpChecksumIPv6(out)
@@ -71,6 +71,28 @@ func TestBuildFakeUDPFromOriginalV6_Valid(t *testing.T) {
 	}
 }
 
+func TestBuildUDPWithPayloadV6(t *testing.T) {
+	pkt := buildMinimalIPv6UDPPacket(20)
+	payload := []byte("quic initial")
+	result, ok := BuildUDPWithPayloadV6(pkt, payload, 5)
+	if !ok {
+		t.Fatal("expected success")
+	}
+
+	if string(result[48:]) != string(payload) {
+		t.Errorf("payload not copied: %q", result[48:])
+	}
+	if got := binary.BigEndian.Uint16(result[4:6]); got != uint16(8+len(payload)) {
+		t.Errorf("payload length: expected %d, got %d", 8+len(payload), got)
+	}
+
+	want := binary.BigEndian.Uint16(result[46:48])
+	udpChecksumIPv6(result)
+	if got := binary.BigEndian.Uint16(result[46:48]); got != want {
+		t.Errorf("bad UDP checksum: %04x, expected %04x", want, got)
+	}
+}
+
 func TestIPv6FragmentUDP_TooShort(t *testing.T) {
 	_, ok := IPv6FragmentUDP(make([]byte, 40), 8)
 	if ok {
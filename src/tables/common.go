@@ -9,8 +9,13 @@ import (
 	"github.com/daniellavrushin/b4/config"
 	"github.com/daniellavrushin/b4/http/handler"
 	"github.com/daniellavrushin/b4/log"
+	"github.com/daniellavrushin/b4/sni"
 )
 
+// dnsTCPPacketLimit is how many packets of a TCP/53 connection are queued,
+// the handshake and the first queries
+const dnsTCPPacketLimit = 8
+
 var modulesLoaded sync.Once
 
 func AddRules(cfg *config.Config) error {
@@ -30,16 +35,39 @@ func AddRules(cfg *config.Config) error {
 
 	if backend == "nftables" {
 		nft := NewNFTablesManager(cfg)
-		return nft.Apply()
+		handler.SetTablesSetsRefreshFunc(nft.UpdateSets)
+		if err := nft.Apply(); err != nil {
+			return err
+		}
+		syncLearnedSets(cfg.System.Tables.IPSets.Enabled, nft)
+		return nil
 	}
 
+	handler.SetTablesSetsRefreshFunc(nil)
 	ipt := NewIPTablesManager(cfg)
 
-	return ipt.Apply()
+	if err := ipt.Apply(); err != nil {
+		return err
+	}
+	syncLearnedSets(ipt.ipSetsEnabled(), ipt)
+	return nil
+}
+
+// syncLearnedSets mirrors the IPs learned by the matcher into the learned
+// sets of w, which were just (re)created.
+func syncLearnedSets(enabled bool, w learnedSetWriter) {
+	if !enabled {
+		sni.SetLearnHook(nil)
+		learnedSets.stop()
+		return
+	}
+	learnedSets.start(w)
+	sni.SetLearnHook(learnedSets.learn)
 }
 
 func ClearRules(cfg *config.Config) error {
 
+	learnedSets.stop()
 	backend := detectFirewallBackend()
 
 	if backend == "nftables" {
@@ -60,6 +88,17 @@ func run(args ...string) (string, error) {
 	return out.String(), err
 }
 
+// runInput is run with input fed to stdin.
+func runInput(input string, args ...string) (string, error) {
+	var out bytes.Buffer
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Stdin = strings.NewReader(input)
+	cmd.Stdout = &out
+	cmd.Stderr = &out
+	err := cmd.Run()
+	return out.String(), err
+}
+
 func setSysctlOrProc(name, val string) {
 	_, _ = run("sh", "-c", "sysctl -w "+name+"="+val+" || echo "+val+" > /proc/sys/"+strings.ReplaceAll(name, ".", "/"))
 }
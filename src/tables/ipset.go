@@ -0,0 +1,99 @@
+package tables
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/daniellavrushin/b4/log"
+	"github.com/daniellavrushin/b4/sni"
+)
+
+// ipset names used by the iptables backend, see config.IPSetsConfig
+const (
+	ipsetTargetsV4 = "b4_targets_v4"
+	ipsetTargetsV6 = "b4_targets_v6"
+	ipsetLearnedV4 = "b4_learned_v4"
+	ipsetLearnedV6 = "b4_learned_v6"
+	ipsetMaxElem   = 1048576
+)
+
+var allIPSets = []string{ipsetTargetsV4, ipsetLearnedV4, ipsetTargetsV6, ipsetLearnedV6}
+
+// ipsetsFor returns the target and learned set names for an iptables binary.
+func ipsetsFor(ipt string) []string {
+	if ipt == "ip6tables" {
+		return []string{ipsetTargetsV6, ipsetLearnedV6}
+	}
+	return []string{ipsetTargetsV4, ipsetLearnedV4}
+}
+
+// ipSetsEnabled reports whether the iptables backend can use kernel IP sets.
+func (im *IPTablesManager) ipSetsEnabled() bool {
+	if !im.cfg.System.Tables.IPSets.Enabled {
+		return false
+	}
+	if !hasBinary("ipset") {
+		log.Warnf("IPTABLES: ipset not found, kernel IP sets disabled")
+		return false
+	}
+	return true
+}
+
+// ensureIPSets creates the sets and replaces the target sets content.
+func (im *IPTablesManager) ensureIPSets() error {
+	targetIPv4, targetIPv6 := im.cfg.CollectTargetIPs()
+	timeout := int(sni.LearnedIPTTL.Seconds())
+
+	var b strings.Builder
+	for _, fam := range []struct {
+		family, targets, learned string
+		ips                      []string
+	}{
+		{"inet", ipsetTargetsV4, ipsetLearnedV4, targetIPv4},
+		{"inet6", ipsetTargetsV6, ipsetLearnedV6, targetIPv6},
+	} {
+		fmt.Fprintf(&b, "create %s hash:net family %s maxelem %d\n", fam.targets, fam.family, ipsetMaxElem)
+		fmt.Fprintf(&b, "create %s hash:ip family %s timeout %d maxelem %d\n", fam.learned, fam.family, timeout, ipsetMaxElem)
+		fmt.Fprintf(&b, "flush %s\n", fam.targets)
+		for _, ip := range fam.ips {
+			fmt.Fprintf(&b, "add %s %s\n", fam.targets, ip)
+		}
+	}
+
+	if out, err := runInput(b.String(), "ipset", "-exist", "restore"); err != nil {
+		return fmt.Errorf("failed to create ipsets: %v: %s", err, strings.TrimSpace(out))
+	}
+	log.Tracef("IPTABLES: ipsets ready, %d IPv4 and %d IPv6 targets", len(targetIPv4), len(targetIPv6))
+	return nil
+}
+
+// destroyIPSets removes the sets once no rule references them anymore.
+func destroyIPSets() {
+	if !hasBinary("ipset") {
+		return
+	}
+	for _, name := range allIPSets {
+		_, _ = run("ipset", "destroy", name)
+	}
+}
+
+func (im *IPTablesManager) addLearnedIPs(add, refresh []learnedIP) error {
+	var b strings.Builder
+	for _, l := range append(add, refresh...) {
+		set := ipsetLearnedV6
+		if l.ip.To4() != nil {
+			set = ipsetLearnedV4
+		}
+		fmt.Fprintf(&b, "add %s %s timeout %d\n", set, l.ip, int(l.timeout.Seconds()))
+	}
+	// -exist turns adding a present element into a timeout refresh
+	if out, err := runInput(b.String(), "ipset", "-exist", "restore"); err != nil {
+		return fmt.Errorf("failed to update learned ipsets: %v: %s", err, strings.TrimSpace(out))
+	}
+	return nil
+}
+
+// ipsetMatch returns the iptables match on the set for the given direction.
+func ipsetMatch(name, dir string) []string {
+	return []string{"-m", "set", "--match-set", name, dir}
+}
@@ -233,6 +233,13 @@ func (manager *IPTablesManager) buildManifest() (Manifest, error) {
 		markAccept = "0x8000/0x8000"
 	}
 
+	// Queue enough packets for the most demanding set, per-set limits are
+	// enforced by the workers
+	tcpLimit, udpLimit := cfg.MaxConnBytesLimits()
+
+	ipSets := cfg.System.Tables.IPSets
+	useIPSets := manager.ipSetsEnabled()
+
 	var chains []Chain
 	var rules []Rule
 
@@ -240,8 +247,8 @@ func (manager *IPTablesManager) buildManifest() (Manifest, error) {
 		ch := Chain{manager: manager, IPT: ipt, Table: "mangle", Name: chainName}
 		chains = append(chains, ch)
 
-		tcpConnbytesRange := fmt.Sprintf("0:%d", cfg.MainSet.TCP.ConnBytesLimit)
-		udpConnbytesRange := fmt.Sprintf("0:%d", cfg.MainSet.UDP.ConnBytesLimit)
+		tcpConnbytesRange := fmt.Sprintf("0:%d", tcpLimit)
+		udpConnbytesRange := fmt.Sprintf("0:%d", udpLimit)
 
 		tcpSpec := append(
 			[]string{"-p", "tcp", "--dport", "443",
@@ -255,6 +262,13 @@ func (manager *IPTablesManager) buildManifest() (Manifest, error) {
 			manager.buildNFQSpec(queueNum, threads)...,
 		)
 
+		dnsTCPSpec := append(
+			[]string{"-p", "tcp", "--dport", "53",
+				"-m", "connbytes", "--connbytes-dir", "original",
+				"--connbytes-mode", "packets", "--connbytes", fmt.Sprintf("0:%d", dnsTCPPacketLimit-1)}, // inclusive, as nft's "< limit"
+			manager.buildNFQSpec(queueNum, threads)...,
+		)
+
 		dnsResponseSpec := append(
 			[]string{"-p", "udp", "--sport", "53"},
 			manager.buildNFQSpec(queueNum, threads)...,
@@ -272,10 +286,32 @@ func (manager *IPTablesManager) buildManifest() (Manifest, error) {
 			manager.buildNFQSpec(queueNum, threads)...,
 		)
 
+		// Address matches the connbytes-limited rules are repeated for,
+		// the kernel IP sets when queueing is limited to them
+		dstScopes, srcScopes := [][]string{nil}, [][]string{nil}
+		if useIPSets && ipSets.TargetsOnly {
+			dstScopes, srcScopes = nil, nil
+			for _, name := range ipsetsFor(ipt) {
+				dstScopes = append(dstScopes, ipsetMatch(name, "dst"))
+				srcScopes = append(srcScopes, ipsetMatch(name, "src"))
+			}
+		}
+
 		rules = append(rules,
 			Rule{manager: manager, IPT: ipt, Table: "mangle", Chain: "PREROUTING", Action: "I", Spec: dnsResponseSpec},
-			Rule{manager: manager, IPT: ipt, Table: "mangle", Chain: "PREROUTING", Action: "I", Spec: tcpResponseSpec},
-			Rule{manager: manager, IPT: ipt, Table: "mangle", Chain: "PREROUTING", Action: "I", Spec: synackSpec},
+		)
+		for _, scope := range srcScopes {
+			rules = append(rules,
+				Rule{manager: manager, IPT: ipt, Table: "mangle", Chain: "PREROUTING", Action: "I", Spec: scoped(scope, tcpResponseSpec)},
+				Rule{manager: manager, IPT: ipt, Table: "mangle", Chain: "PREROUTING", Action: "I", Spec: scoped(scope, synackSpec)},
+			)
+		}
+
+		// Discovery probes are handled by the sandbox config in the workers,
+		// whatever the live targets, ports and connbytes limits
+		rules = append(rules,
+			Rule{manager: manager, IPT: ipt, Table: "mangle", Chain: chainName, Action: "A",
+				Spec: manager.probeSpec(queueNum, threads)},
 		)
 
 		// Duplication rules: queue ALL TCP/443 to specific IPs (no connbytes limit).
@@ -297,11 +333,47 @@ func (manager *IPTablesManager) buildManifest() (Manifest, error) {
 			)
 		}
 
+		// Queue everything to the target and learned IPs, for strategies
+		// that work past the connbytes window
+		if useIPSets && ipSets.QueueAll {
+			for _, name := range ipsetsFor(ipt) {
+				rules = append(rules,
+					Rule{manager: manager, IPT: ipt, Table: "mangle", Chain: chainName, Action: "A",
+						Spec: scoped(ipsetMatch(name, "dst"), append([]string{"-p", "tcp", "--dport", "443"}, manager.buildNFQSpec(queueNum, threads)...))},
+				)
+				if cfg.HasHTTPSets() {
+					rules = append(rules,
+						Rule{manager: manager, IPT: ipt, Table: "mangle", Chain: chainName, Action: "A",
+							Spec: scoped(ipsetMatch(name, "dst"), append([]string{"-p", "tcp", "--dport", "80"}, manager.buildNFQSpec(queueNum, threads)...))},
+					)
+				}
+			}
+		}
+
+		for _, scope := range dstScopes {
+			rules = append(rules,
+				Rule{manager: manager, IPT: ipt, Table: "mangle", Chain: chainName, Action: "A", Spec: scoped(scope, tcpSpec)},
+			)
+		}
 		rules = append(rules,
-			Rule{manager: manager, IPT: ipt, Table: "mangle", Chain: chainName, Action: "A", Spec: tcpSpec},
 			Rule{manager: manager, IPT: ipt, Table: "mangle", Chain: chainName, Action: "A", Spec: dnsSpec},
+			Rule{manager: manager, IPT: ipt, Table: "mangle", Chain: chainName, Action: "A", Spec: dnsTCPSpec},
 		)
 
+		if cfg.HasHTTPSets() {
+			httpSpec := append(
+				[]string{"-p", "tcp", "--dport", "80",
+					"-m", "connbytes", "--connbytes-dir", "original",
+					"--connbytes-mode", "packets", "--connbytes", tcpConnbytesRange},
+				manager.buildNFQSpec(queueNum, threads)...,
+			)
+			for _, scope := range dstScopes {
+				rules = append(rules,
+					Rule{manager: manager, IPT: ipt, Table: "mangle", Chain: chainName, Action: "A", Spec: scoped(scope, httpSpec)},
+				)
+			}
+		}
+
 		udpPorts := cfg.CollectUDPPorts()
 		for i, p := range udpPorts {
 			udpPorts[i] = strings.ReplaceAll(p, "-", ":")
@@ -318,7 +390,9 @@ func (manager *IPTablesManager) buildManifest() (Manifest, error) {
 						"--connbytes-mode", "packets", "--connbytes", udpConnbytesRange),
 					manager.buildNFQSpec(queueNum, threads)...,
 				)
-				rules = append(rules, Rule{manager: manager, IPT: ipt, Table: "mangle", Chain: chainName, Action: "A", Spec: udpSpec})
+				for _, scope := range dstScopes {
+					rules = append(rules, Rule{manager: manager, IPT: ipt, Table: "mangle", Chain: chainName, Action: "A", Spec: scoped(scope, udpSpec)})
+				}
 			}
 		} else {
 			// Fallback: create individual rules for each port/range
@@ -330,7 +404,9 @@ func (manager *IPTablesManager) buildManifest() (Manifest, error) {
 						"--connbytes-mode", "packets", "--connbytes", udpConnbytesRange),
 					manager.buildNFQSpec(queueNum, threads)...,
 				)
-				rules = append(rules, Rule{manager: manager, IPT: ipt, Table: "mangle", Chain: chainName, Action: "A", Spec: udpSpec})
+				for _, scope := range dstScopes {
+					rules = append(rules, Rule{manager: manager, IPT: ipt, Table: "mangle", Chain: chainName, Action: "A", Spec: scoped(scope, udpSpec)})
+				}
 			}
 		}
 
@@ -393,6 +469,11 @@ func (ipt *IPTablesManager) Apply() error {
 	if err != nil {
 		return err
 	}
+	if ipt.ipSetsEnabled() {
+		if err := ipt.ensureIPSets(); err != nil {
+			return err
+		}
+	}
 	result := m.Apply()
 
 	if log.Level(log.CurLevel.Load()) >= log.LevelTrace {
@@ -413,6 +494,7 @@ func (ipt *IPTablesManager) Clear() error {
 	m.RemoveRules()
 	time.Sleep(30 * time.Millisecond)
 	m.RemoveChains()
+	destroyIPSets()
 	return nil
 }
 
@@ -534,6 +616,20 @@ func (ipt *IPTablesManager) clearB4JumpRules() {
 	}
 }
 
+// scoped prefixes spec with an address match, nil leaves it unrestricted.
+// probeSpec queues every packet carrying exactly the discovery probe mark.
+func (ipt *IPTablesManager) probeSpec(queueStart, threads int) []string {
+	mark := fmt.Sprintf("0x%x", ipt.cfg.System.Checker.ProbeMark)
+	return append([]string{"-m", "mark", "--mark", mark}, ipt.buildNFQSpec(queueStart, threads)...)
+}
+
+func scoped(scope, spec []string) []string {
+	if scope == nil {
+		return spec
+	}
+	return append(append([]string{}, scope...), spec...)
+}
+
 func chunkPorts(ports []string, maxSize int) [][]string {
 	if len(ports) <= maxSize {
 		return [][]string{ports}
@@ -0,0 +1,155 @@
+package tables
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/daniellavrushin/b4/log"
+)
+
+const (
+	learnedFlushInterval = time.Second
+	learnedMaxEntries    = 65536
+)
+
+type learnedIP struct {
+	ip      net.IP
+	timeout time.Duration
+}
+
+// learnedSetWriter adds learned IPs to the kernel sets of a firewall backend.
+type learnedSetWriter interface {
+	addLearnedIPs(add, refresh []learnedIP) error
+}
+
+type learnedEntry struct {
+	ip        net.IP
+	expires   time.Time // as known by the matcher
+	inKernel  time.Time // expiry of the kernel element, zero if not added
+	scheduled bool
+}
+
+// learnedSync mirrors the IPs learned by the domain matcher into the kernel
+// sets. Learning happens per packet, so updates are collected and written in
+// one batch per flush interval. An IP is only rewritten once its kernel
+// element is at least half a TTL behind the matcher.
+type learnedSync struct {
+	mu      sync.Mutex
+	writer  learnedSetWriter
+	entries map[string]*learnedEntry
+	pending []string
+	once    sync.Once
+}
+
+var learnedSets = &learnedSync{entries: make(map[string]*learnedEntry)}
+
+// start directs updates to w and replays all live entries, since the sets
+// were just recreated.
+func (l *learnedSync) start(w learnedSetWriter) {
+	l.mu.Lock()
+	l.writer = w
+	l.pending = l.pending[:0]
+	for k, e := range l.entries {
+		e.inKernel = time.Time{}
+		e.scheduled = true
+		l.pending = append(l.pending, k)
+	}
+	l.mu.Unlock()
+
+	l.once.Do(func() {
+		go l.loop()
+	})
+}
+
+// stop drops the writer. Entries are kept so a later start can replay them.
+func (l *learnedSync) stop() {
+	l.mu.Lock()
+	l.writer = nil
+	l.mu.Unlock()
+}
+
+// learn is the sni learn hook.
+func (l *learnedSync) learn(ip net.IP, ttl time.Duration) {
+	now := time.Now()
+	key := ip.String()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	e, ok := l.entries[key]
+	if !ok {
+		if len(l.entries) >= learnedMaxEntries {
+			return
+		}
+		// ip may point into a packet buffer that is reused
+		e = &learnedEntry{ip: append(net.IP(nil), ip...)}
+		l.entries[key] = e
+	}
+	e.expires = now.Add(ttl)
+
+	if !e.scheduled && e.expires.Sub(e.inKernel) > ttl/2 {
+		e.scheduled = true
+		l.pending = append(l.pending, key)
+	}
+}
+
+func (l *learnedSync) loop() {
+	ticker := time.NewTicker(learnedFlushInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		l.flush()
+	}
+}
+
+func (l *learnedSync) flush() {
+	now := time.Now()
+
+	l.mu.Lock()
+	w := l.writer
+	var add, refresh []learnedIP
+	var written []*learnedEntry
+	var expiries []time.Time
+	for _, key := range l.pending {
+		e, ok := l.entries[key]
+		if !ok {
+			continue
+		}
+		e.scheduled = false
+		timeout := e.expires.Sub(now).Round(time.Second)
+		if w == nil || timeout < time.Second {
+			continue
+		}
+		item := learnedIP{ip: e.ip, timeout: timeout}
+		if e.inKernel.After(now) {
+			refresh = append(refresh, item)
+		} else {
+			add = append(add, item)
+		}
+		written = append(written, e)
+		expiries = append(expiries, now.Add(timeout))
+	}
+	l.pending = l.pending[:0]
+
+	for k, e := range l.entries {
+		if !e.expires.After(now) && !e.scheduled {
+			delete(l.entries, k)
+		}
+	}
+	l.mu.Unlock()
+
+	if len(written) == 0 {
+		return
+	}
+
+	if err := w.addLearnedIPs(add, refresh); err != nil {
+		log.Tracef("Failed to write learned IPs: %v", err)
+		return
+	}
+
+	l.mu.Lock()
+	for i, e := range written {
+		e.inKernel = expiries[i]
+	}
+	l.mu.Unlock()
+}
@@ -142,61 +142,10 @@ func (m *Monitor) checkIPTablesRules() bool {
 }
 
 func (m *Monitor) checkNFTablesRules() bool {
-	nft := NewNFTablesManager(m.cfg)
-
-	if !nft.tableExists() {
-		log.Tracef("Monitor: nftables table missing")
-		return false
-	}
-
-	if !nft.chainExists(nftChainName) {
-		log.Tracef("Monitor: b4_chain missing")
-		return false
-	}
-
-	if m.cfg.Queue.Devices.Enabled && len(m.cfg.Queue.Devices.Mac) > 0 {
-		if !nft.chainExists("forward") {
-			log.Tracef("Monitor: forward chain missing")
-			return false
-		}
-		out, _ := nft.runNft("list", "chain", "inet", nftTableName, "forward")
-		if !strings.Contains(out, nftChainName) {
-			log.Tracef("Monitor: forward->b4_chain jump missing")
-			return false
-		}
-	} else {
-		if !nft.chainExists("postrouting") {
-			log.Tracef("Monitor: postrouting chain missing")
-			return false
-		}
-		out, _ := nft.runNft("list", "chain", "inet", nftTableName, "postrouting")
-		if !strings.Contains(out, nftChainName) {
-			log.Tracef("Monitor: postrouting->b4_chain jump missing")
-			return false
-		}
-	}
-
-	if !nft.chainExists("prerouting") {
-		log.Tracef("Monitor: prerouting chain missing")
+	if err := NewNFTablesManager(m.cfg).Verify(); err != nil {
+		log.Tracef("Monitor: nftables drift: %v", err)
 		return false
 	}
-	out, _ := nft.runNft("list", "chain", "inet", nftTableName, "prerouting")
-	if !strings.Contains(out, "sport 53") || !strings.Contains(out, "sport 443") {
-		log.Tracef("Monitor: prerouting response rules missing")
-		return false
-	}
-
-	if !nft.chainExists("output") {
-		log.Tracef("Monitor: output chain missing")
-		return false
-	}
-
-	out, _ = nft.runNft("list", "chain", "inet", nftTableName, "output")
-	if !strings.Contains(out, "accept") || !strings.Contains(out, nftChainName) {
-		log.Tracef("Monitor: output mark accept rule missing")
-		return false
-	}
-
 	return true
 }
 
@@ -1,294 +1,489 @@
 package tables
 
 import (
-	"bytes"
 	"fmt"
-	"os/exec"
+	"net"
+	"slices"
 	"strings"
-	"time"
 
 	"github.com/daniellavrushin/b4/config"
 	"github.com/daniellavrushin/b4/log"
+	"github.com/daniellavrushin/b4/sni"
+	"github.com/mdlayher/netlink"
+	"golang.org/x/sys/unix"
 )
 
 const (
 	nftTableName = "b4_mangle"
 	nftChainName = "b4_chain"
+
+	// Named sets, updated in place by UpdateSets
+	nftSetDupV4    = "dup_v4"
+	nftSetDupV6    = "dup_v6"
+	nftSetUDPPorts = "udp_ports"
+
+	// Kernel IP sets, only present with System.Tables.IPSets enabled
+	nftSetTargetsV4 = "targets_v4"
+	nftSetTargetsV6 = "targets_v6"
+	nftSetLearnedV4 = "learned_v4"
+	nftSetLearnedV6 = "learned_v6"
 )
 
-type NFTablesManager struct {
-	cfg             *config.Config
-	ipVersionFilter string
-}
+var nftIPSets = []string{nftSetTargetsV4, nftSetLearnedV4, nftSetTargetsV6, nftSetLearnedV6}
 
-func NewNFTablesManager(cfg *config.Config) *NFTablesManager {
-	return &NFTablesManager{cfg: cfg}
+// NFTablesManager programs the inet b4_mangle table over netlink. The whole
+// table is replaced in one transaction, so there is never a window with a
+// partial ruleset.
+type NFTablesManager struct {
+	cfg     *config.Config
+	nfproto uint8 // restricts queue rules to one family, 0 for both
 }
 
-func (n *NFTablesManager) runNft(args ...string) (string, error) {
-	var out bytes.Buffer
-	cmd := exec.Command("nft", args...)
-	cmd.Stdout = &out
-	cmd.Stderr = &out
-	err := cmd.Run()
-	return out.String(), err
+// nftRuleset is the desired content of the table.
+type nftRuleset struct {
+	chains []nftChain
+	sets   []*nftSet
+	rules  []*nftRule
 }
 
-func (n *NFTablesManager) tableExists() bool {
-	out, err := n.runNft("list", "tables")
-	if err != nil {
-		return false
-	}
-	return strings.Contains(out, nftTableName)
+// nftMatch is a rule prefix together with its nft syntax.
+type nftMatch struct {
+	desc  string
+	exprs []nftExpr
 }
 
-func (n *NFTablesManager) chainExists(chain string) bool {
-	_, err := n.runNft("list", "chain", "inet", nftTableName, chain)
-	return err == nil
+func NewNFTablesManager(cfg *config.Config) *NFTablesManager {
+	return &NFTablesManager{cfg: cfg}
 }
 
-func (n *NFTablesManager) createTable() error {
-	if n.tableExists() {
-		return nil
-	}
-	_, err := n.runNft("add", "table", "inet", nftTableName)
-	if err != nil {
-		return fmt.Errorf("failed to create nftables table: %w", err)
+func (n *NFTablesManager) buildNFQueueAction() string {
+	if n.cfg.Queue.Threads > 1 {
+		return fmt.Sprintf("queue num %d-%d bypass", n.cfg.Queue.StartNum, n.cfg.Queue.StartNum+n.cfg.Queue.Threads-1)
 	}
-	log.Tracef("Created nftables table: %s", nftTableName)
-	return nil
+	return fmt.Sprintf("queue num %d bypass", n.cfg.Queue.StartNum)
 }
 
-func (n *NFTablesManager) createChain(chain, hook string, priority int, policy string) error {
-	if n.chainExists(chain) {
-		return nil
+func (n *NFTablesManager) queueExprs() []nftExpr {
+	threads := n.cfg.Queue.Threads
+	if threads < 1 {
+		threads = 1
 	}
+	return []nftExpr{exprCounter(), exprQueue(uint16(n.cfg.Queue.StartNum), uint16(threads), nftQueueBypass)}
+}
 
-	var cmd []string
-	if hook != "" {
-		cmd = []string{"add", "chain", "inet", nftTableName, chain,
-			fmt.Sprintf("{ type filter hook %s priority %d ; policy %s ; }", hook, priority, policy)}
-	} else {
-		cmd = []string{"add", "chain", "inet", nftTableName, chain}
+func (rs *nftRuleset) add(chain, desc string, exprs ...[]nftExpr) {
+	r := &nftRule{chain: chain, desc: desc}
+	for _, e := range exprs {
+		r.exprs = append(r.exprs, e...)
 	}
+	rs.rules = append(rs.rules, r)
+}
 
-	_, err := n.runNft(cmd...)
-	if err != nil {
-		return fmt.Errorf("failed to create chain %s: %w", chain, err)
+func (rs *nftRuleset) set(name string) *nftSet {
+	for _, s := range rs.sets {
+		if s.name == name {
+			return s
+		}
 	}
-	log.Tracef("Created nftables chain: %s", chain)
 	return nil
 }
 
-func (n *NFTablesManager) buildNFQueueAction() string {
-	if n.cfg.Queue.Threads > 1 {
-		return fmt.Sprintf("queue num %d-%d bypass", n.cfg.Queue.StartNum, n.cfg.Queue.StartNum+n.cfg.Queue.Threads-1)
-	}
-	return fmt.Sprintf("queue num %d bypass", n.cfg.Queue.StartNum)
+// addQueueRule appends a rule ending in the queue action, limited to the
+// enabled IP family or to the addresses of scope.
+func (n *NFTablesManager) addQueueRule(rs *nftRuleset, chain string, scope nftMatch, desc string, exprs ...[]nftExpr) {
+	var filter []nftExpr
+	switch {
+	case scope.exprs != nil:
+		// A set lookup already implies the family
+		filter = scope.exprs
+		desc = scope.desc + " " + desc
+	case n.nfproto == nfprotoIPv4:
+		filter = matchNfproto(nfprotoIPv4)
+		desc = "meta nfproto ipv4 " + desc
+	case n.nfproto == nfprotoIPv6:
+		filter = matchNfproto(nfprotoIPv6)
+		desc = "meta nfproto ipv6 " + desc
+	}
+	all := append([][]nftExpr{filter}, exprs...)
+	all = append(all, n.queueExprs())
+	rs.add(chain, desc+" counter "+n.buildNFQueueAction(), all...)
 }
 
-func (n *NFTablesManager) addRule(chain string, args ...string) error {
-	cmd := append([]string{"add", "rule", "inet", nftTableName, chain}, args...)
-	log.Tracef("NFTABLES: adding rule to %s: %v", chain, args)
-	_, err := n.runNft(cmd...)
-	if err != nil {
-		return fmt.Errorf("failed to add rule to %s: %w", chain, err)
+// ipSetMatches returns a source or destination address match for every
+// kernel IP set of the ruleset.
+func (n *NFTablesManager) ipSetMatches(rs *nftRuleset, dst bool) []nftMatch {
+	dir := "saddr"
+	if dst {
+		dir = "daddr"
 	}
-	return nil
-}
 
-func (n *NFTablesManager) addFilteredRule(chain string, args ...string) error {
-	if n.ipVersionFilter != "" {
-		args = append(strings.Fields(n.ipVersionFilter), args...)
+	var matches []nftMatch
+	for _, name := range nftIPSets {
+		s := rs.set(name)
+		if s == nil {
+			continue
+		}
+		nfproto, prefix := uint8(nfprotoIPv4), "ip"
+		if s.keyType == nftTypeIPv6Addr {
+			nfproto, prefix = nfprotoIPv6, "ip6"
+		}
+		matches = append(matches, nftMatch{
+			desc:  fmt.Sprintf("%s %s @%s", prefix, dir, name),
+			exprs: matchAddrSet(nfproto, dst, s),
+		})
 	}
-	return n.addRule(chain, args...)
+	return matches
 }
 
-func (n *NFTablesManager) addQueueRule(chain string, args ...string) error {
-	args = append(args, strings.Fields(n.buildNFQueueAction())...)
-	return n.addFilteredRule(chain, args...)
+// queueScopes returns the matches the connbytes-limited queue rules are
+// repeated for: the kernel IP sets when queueing is limited to them,
+// otherwise a single unrestricted match.
+func (n *NFTablesManager) queueScopes(rs *nftRuleset, dst bool) []nftMatch {
+	if ipSets := n.cfg.System.Tables.IPSets; ipSets.Enabled && ipSets.TargetsOnly {
+		return n.ipSetMatches(rs, dst)
+	}
+	return []nftMatch{{}}
 }
 
-func (n *NFTablesManager) Apply() error {
+func (n *NFTablesManager) buildRuleset() *nftRuleset {
 	cfg := n.cfg
-	if !hasBinary("nft") {
-		return fmt.Errorf("nft binary not found")
-	}
-
-	log.Tracef("NFTABLES: adding rules")
-	loadKernelModules()
-
-	// Clear existing table to prevent rule duplication
-	if n.tableExists() {
-		n.Clear()
-	}
+	rs := &nftRuleset{}
 
-	// Set IP version filter
 	switch {
 	case cfg.Queue.IPv4Enabled && cfg.Queue.IPv6Enabled:
-		n.ipVersionFilter = ""
+		n.nfproto = 0
 	case cfg.Queue.IPv4Enabled:
-		n.ipVersionFilter = "meta nfproto ipv4"
+		n.nfproto = nfprotoIPv4
 	case cfg.Queue.IPv6Enabled:
-		n.ipVersionFilter = "meta nfproto ipv6"
+		n.nfproto = nfprotoIPv6
 	}
 
-	if err := n.createTable(); err != nil {
-		return err
-	}
+	rs.chains = append(rs.chains,
+		nftChain{name: nftChainName},
+		nftChain{name: "prerouting", hook: true, hookNum: nfInetPreRouting, priority: -150},
+		nftChain{name: "output", hook: true, hookNum: nfInetLocalOut, priority: -150},
+	)
 
-	if err := n.createChain(nftChainName, "", 0, ""); err != nil {
-		return err
-	}
-
-	if err := n.createChain("prerouting", "prerouting", -150, "accept"); err != nil {
-		return err
-	}
-
-	if err := n.createChain("output", "output", -150, "accept"); err != nil {
-		return err
+	dupIPv4, dupIPv6 := cfg.CollectDuplicateIPs()
+	rs.sets = append(rs.sets,
+		&nftSet{id: 1, name: nftSetDupV4, keyType: nftTypeIPv4Addr, keyLen: 4, elems: addrRanges(dupIPv4, false)},
+		&nftSet{id: 2, name: nftSetDupV6, keyType: nftTypeIPv6Addr, keyLen: 16, elems: addrRanges(dupIPv6, true)},
+		&nftSet{id: 3, name: nftSetUDPPorts, keyType: nftTypeInetService, keyLen: 2, elems: portRanges(cfg.CollectUDPPorts())},
+	)
+
+	ipSets := cfg.System.Tables.IPSets
+	if ipSets.Enabled {
+		targetIPv4, targetIPv6 := cfg.CollectTargetIPs()
+		if cfg.Queue.IPv4Enabled {
+			rs.sets = append(rs.sets,
+				&nftSet{id: 4, name: nftSetTargetsV4, keyType: nftTypeIPv4Addr, keyLen: 4, elems: addrRanges(targetIPv4, false)},
+				&nftSet{id: 5, name: nftSetLearnedV4, keyType: nftTypeIPv4Addr, keyLen: 4, timeout: sni.LearnedIPTTL},
+			)
+		}
+		if cfg.Queue.IPv6Enabled {
+			rs.sets = append(rs.sets,
+				&nftSet{id: 6, name: nftSetTargetsV6, keyType: nftTypeIPv6Addr, keyLen: 16, elems: addrRanges(targetIPv6, true)},
+				&nftSet{id: 7, name: nftSetLearnedV6, keyType: nftTypeIPv6Addr, keyLen: 16, timeout: sni.LearnedIPTTL},
+			)
+		}
 	}
 
-	markAccept := fmt.Sprintf("0x%x", cfg.Queue.Mark)
+	jump := []nftExpr{exprVerdict(nftJump, nftChainName)}
+	ret := []nftExpr{exprVerdict(nftReturn, "")}
 
 	if cfg.Queue.Devices.Enabled && len(cfg.Queue.Devices.Mac) > 0 {
-		if err := n.createChain("forward", "forward", -150, "accept"); err != nil {
-			return err
-		}
+		rs.chains = append(rs.chains, nftChain{name: "forward", hook: true, hookNum: nfInetForward, priority: -150})
 
-		if cfg.Queue.Devices.WhiteIsBlack {
-			for _, mac := range cfg.Queue.Devices.Mac {
-				if mac = strings.ToUpper(strings.TrimSpace(mac)); mac != "" {
-					if err := n.addRule("forward", "ether", "saddr", mac, "return"); err != nil {
-						return err
-					}
-				}
-			}
-			if err := n.addRule("forward", "jump", nftChainName); err != nil {
-				return err
+		for _, mac := range cfg.Queue.Devices.Mac {
+			mac = strings.ToUpper(strings.TrimSpace(mac))
+			hw, err := net.ParseMAC(mac)
+			if err != nil || len(hw) != 6 {
+				continue
 			}
-		} else {
-			for _, mac := range cfg.Queue.Devices.Mac {
-				if mac = strings.ToUpper(strings.TrimSpace(mac)); mac != "" {
-					if err := n.addRule("forward", "ether", "saddr", mac, "jump", nftChainName); err != nil {
-						return err
-					}
-				}
+			if cfg.Queue.Devices.WhiteIsBlack {
+				rs.add("forward", "ether saddr "+mac+" return", matchEtherSaddr(hw), ret)
+			} else {
+				rs.add("forward", "ether saddr "+mac+" jump "+nftChainName, matchEtherSaddr(hw), jump)
 			}
 		}
+		if cfg.Queue.Devices.WhiteIsBlack {
+			rs.add("forward", "jump "+nftChainName, jump)
+		}
 	} else {
+		rs.chains = append(rs.chains, nftChain{name: "postrouting", hook: true, hookNum: nfInetPostRouting, priority: -150})
+		rs.add("postrouting", "jump "+nftChainName, jump)
+	}
+
+	mark := uint32(cfg.Queue.Mark)
+	markAccept := fmt.Sprintf("0x%x", cfg.Queue.Mark)
+
+	rs.add("output", `oifname "lo" return`, matchOifname("lo"), ret)
+	rs.add("output", "meta mark "+markAccept+" accept", matchMark(mark), []nftExpr{exprVerdict(nfAccept, "")})
+	rs.add("output", "jump "+nftChainName, jump)
+
+	rs.add(nftChainName, "meta mark "+markAccept+" return", matchMark(mark), ret)
 
-		if err := n.createChain("postrouting", "postrouting", -150, "accept"); err != nil {
-			return err
+	// Discovery probes are handled by the sandbox config in the workers,
+	// whatever the live targets, ports and connbytes limits
+	probeMark := uint32(cfg.System.Checker.ProbeMark)
+	n.addQueueRule(rs, nftChainName, nftMatch{}, fmt.Sprintf("meta mark 0x%x", probeMark), matchMark(probeMark))
+
+	// Duplication rules: queue ALL TCP/443 packets to specific IPs (no connbytes limit).
+	// Must come before the generic connbytes-limited rules.
+	dport443 := matchPort(unix.IPPROTO_TCP, true, 443)
+	if cfg.Queue.IPv4Enabled {
+		rs.add(nftChainName, "ip daddr @"+nftSetDupV4+" tcp dport 443 counter "+n.buildNFQueueAction(),
+			matchAddrSet(nfprotoIPv4, true, rs.set(nftSetDupV4)), dport443, n.queueExprs())
+	}
+	if cfg.Queue.IPv6Enabled {
+		rs.add(nftChainName, "ip6 daddr @"+nftSetDupV6+" tcp dport 443 counter "+n.buildNFQueueAction(),
+			matchAddrSet(nfprotoIPv6, true, rs.set(nftSetDupV6)), dport443, n.queueExprs())
+	}
+
+	// Queue everything to the target and learned IPs, for strategies that
+	// work past the connbytes window
+	if ipSets.Enabled && ipSets.QueueAll {
+		for _, m := range n.ipSetMatches(rs, true) {
+			n.addQueueRule(rs, nftChainName, m, "tcp dport 443", dport443)
+			if cfg.HasHTTPSets() {
+				n.addQueueRule(rs, nftChainName, m, "tcp dport 80", matchPort(unix.IPPROTO_TCP, true, 80))
+			}
 		}
-		if err := n.addRule("postrouting", "jump", nftChainName); err != nil {
-			return err
+	}
+
+	// Queue enough packets for the most demanding set, per-set limits are
+	// enforced by the workers
+	maxTCP, maxUDP := cfg.MaxConnBytesLimits()
+	tcpLimit := uint64(maxTCP + 1)
+	udpLimit := uint64(maxUDP + 1)
+
+	dstScopes := n.queueScopes(rs, true)
+	srcScopes := n.queueScopes(rs, false)
+
+	for _, scope := range dstScopes {
+		n.addQueueRule(rs, nftChainName, scope, fmt.Sprintf("tcp dport 443 ct original packets < %d", tcpLimit),
+			dport443, matchOrigPacketsBelow(tcpLimit))
+
+		if cfg.HasHTTPSets() {
+			n.addQueueRule(rs, nftChainName, scope, fmt.Sprintf("tcp dport 80 ct original packets < %d", tcpLimit),
+				matchPort(unix.IPPROTO_TCP, true, 80), matchOrigPacketsBelow(tcpLimit))
 		}
 	}
 
-	if err := n.addRule("output", "oifname", `"lo"`, "return"); err != nil {
-		return err
+	// DNS is never limited to the IP sets, responses are where IPs get learned
+	n.addQueueRule(rs, nftChainName, nftMatch{}, "udp dport 53", matchPort(unix.IPPROTO_UDP, true, 53))
+	n.addQueueRule(rs, nftChainName, nftMatch{}, fmt.Sprintf("tcp dport 53 ct original packets < %d", dnsTCPPacketLimit),
+		matchPort(unix.IPPROTO_TCP, true, 53), matchOrigPacketsBelow(dnsTCPPacketLimit))
+	n.addQueueRule(rs, "prerouting", nftMatch{}, "udp sport 53", matchPort(unix.IPPROTO_UDP, false, 53))
+
+	for _, scope := range srcScopes {
+		n.addQueueRule(rs, "prerouting", scope, fmt.Sprintf("tcp sport 443 ct original packets < %d", tcpLimit),
+			matchPort(unix.IPPROTO_TCP, false, 443), matchOrigPacketsBelow(tcpLimit))
+		n.addQueueRule(rs, "prerouting", scope, "tcp sport 443 tcp flags & (syn|ack) == (syn|ack)",
+			matchPort(unix.IPPROTO_TCP, false, 443), matchTCPFlags(0x12, 0x12))
 	}
-	if err := n.addRule("output", "meta", "mark", markAccept, "accept"); err != nil {
-		return err
+
+	for _, scope := range dstScopes {
+		n.addQueueRule(rs, nftChainName, scope, fmt.Sprintf("udp dport @%s ct original packets < %d", nftSetUDPPorts, udpLimit),
+			matchPortSet(unix.IPPROTO_UDP, rs.set(nftSetUDPPorts)), matchOrigPacketsBelow(udpLimit))
+	}
+
+	return rs
+}
+
+// messages returns the batch that replaces the table with the ruleset.
+func (rs *nftRuleset) messages() []netlink.Message {
+	msgs := []netlink.Message{
+		// Create before deleting so the delete cannot fail on a missing table
+		nftTableMsg(nftMsgNewTable, nftTableName),
+		nftTableMsg(nftMsgDelTable, nftTableName),
+		nftTableMsg(nftMsgNewTable, nftTableName),
+	}
+	for _, c := range rs.chains {
+		msgs = append(msgs, nftChainMsg(nftTableName, c))
+	}
+	for _, s := range rs.sets {
+		msgs = append(msgs, nftSetMsg(nftTableName, s))
+		msgs = append(msgs, nftSetElemMsgs(nftTableName, s)...)
 	}
-	if err := n.addRule("output", "jump", nftChainName); err != nil {
+	for _, r := range rs.rules {
+		msgs = append(msgs, nftRuleMsg(nftTableName, r))
+	}
+	return msgs
+}
+
+func (n *NFTablesManager) Apply() error {
+	log.Tracef("NFTABLES: adding rules")
+	loadKernelModules()
+
+	rs := n.buildRuleset()
+	for _, r := range rs.rules {
+		log.Tracef("NFTABLES: rule in %s: %s", r.chain, r.desc)
+	}
+
+	conn, err := dialNft()
+	if err != nil {
 		return err
 	}
+	defer conn.Close()
+
+	if err := conn.commit(rs.messages()); err != nil {
+		return fmt.Errorf("failed to apply nftables ruleset: %w", err)
+	}
+	log.Tracef("NFTABLES: applied %d chains, %d sets and %d rules", len(rs.chains), len(rs.sets), len(rs.rules))
+
+	setSysctlOrProc("net.netfilter.nf_conntrack_checksum", "0")
+	setSysctlOrProc("net.netfilter.nf_conntrack_tcp_be_liberal", "1")
+
+	return nil
+}
+
+// Verify reads the table back and reports the first difference from the
+// ruleset the current config produces.
+func (n *NFTablesManager) Verify() error {
+	rs := n.buildRuleset()
 
-	if err := n.addRule(nftChainName, "meta", "mark", markAccept, "return"); err != nil {
+	conn, err := dialNft()
+	if err != nil {
 		return err
 	}
+	defer conn.Close()
 
-	// Duplication rules: queue ALL TCP/443 packets to specific IPs (no connbytes limit).
-	// Must come before the generic connbytes-limited rules.
-	dupIPv4, dupIPv6 := cfg.CollectDuplicateIPs()
-	queueAction := strings.Fields(n.buildNFQueueAction())
-	if len(dupIPv4) > 0 && cfg.Queue.IPv4Enabled {
-		var ipExpr string
-		if len(dupIPv4) == 1 {
-			ipExpr = dupIPv4[0]
-		} else {
-			ipExpr = "{ " + strings.Join(dupIPv4, ", ") + " }"
-		}
-		args := append([]string{"meta", "nfproto", "ipv4", "ip", "daddr", ipExpr, "tcp", "dport", "443", "counter"}, queueAction...)
-		if err := n.addRule(nftChainName, args...); err != nil {
-			return err
+	got, err := conn.ruleTags(nftTableName)
+	if err != nil {
+		return fmt.Errorf("failed to read nftables rules: %w", err)
+	}
+
+	want := make(map[string][]string)
+	for _, r := range rs.rules {
+		want[r.chain] = append(want[r.chain], r.tag())
+	}
+	for _, c := range rs.chains {
+		if !slices.Equal(want[c.name], got[c.name]) {
+			return fmt.Errorf("chain %s differs: expected %d rules, found %d", c.name, len(want[c.name]), len(got[c.name]))
 		}
 	}
-	if len(dupIPv6) > 0 && cfg.Queue.IPv6Enabled {
-		var ipExpr string
-		if len(dupIPv6) == 1 {
-			ipExpr = dupIPv6[0]
-		} else {
-			ipExpr = "{ " + strings.Join(dupIPv6, ", ") + " }"
+
+	for _, s := range rs.sets {
+		if s.timeout > 0 {
+			// Filled at runtime
+			continue
+		}
+		elems, err := conn.setElems(nftTableName, s.name)
+		if err != nil {
+			return fmt.Errorf("failed to read set %s: %w", s.name, err)
+		}
+		expected := make([]string, 0, len(s.elems))
+		for _, e := range s.elems {
+			expected = append(expected, e.String())
 		}
-		args := append([]string{"meta", "nfproto", "ipv6", "ip6", "daddr", ipExpr, "tcp", "dport", "443", "counter"}, queueAction...)
-		if err := n.addRule(nftChainName, args...); err != nil {
-			return err
+		slices.Sort(expected)
+		if !slices.Equal(expected, elems) {
+			return fmt.Errorf("set %s differs: expected %d elements, found %d", s.name, len(expected), len(elems))
 		}
 	}
 
-	tcpLimit := fmt.Sprintf("%d", cfg.MainSet.TCP.ConnBytesLimit+1)
-	udpLimit := fmt.Sprintf("%d", cfg.MainSet.UDP.ConnBytesLimit+1)
+	return nil
+}
 
-	if err := n.addQueueRule(nftChainName, "tcp", "dport", "443", "ct", "original", "packets", "<", tcpLimit, "counter"); err != nil {
-		return err
-	}
+// UpdateSets replaces the content of the named sets from the current config
+// without touching the rules.
+func (n *NFTablesManager) UpdateSets() error {
+	rs := n.buildRuleset()
 
-	if err := n.addQueueRule(nftChainName, "udp", "dport", "53", "counter"); err != nil {
-		return err
+	var msgs []netlink.Message
+	for _, s := range rs.sets {
+		if s.timeout > 0 {
+			continue
+		}
+		msgs = append(msgs, nftSetFlushMsg(nftTableName, s.name))
+		msgs = append(msgs, nftSetElemMsgs(nftTableName, s)...)
 	}
 
-	if err := n.addQueueRule("prerouting", "udp", "sport", "53", "counter"); err != nil {
+	conn, err := dialNft()
+	if err != nil {
 		return err
 	}
+	defer conn.Close()
 
-	if err := n.addQueueRule("prerouting", "tcp", "sport", "443", "ct", "original", "packets", "<", tcpLimit, "counter"); err != nil {
-		return err
+	if err := conn.commit(msgs); err != nil {
+		return fmt.Errorf("failed to update nftables sets: %w", err)
 	}
+	log.Tracef("NFTABLES: updated %d sets", len(rs.sets))
+	return nil
+}
 
-	if err := n.addQueueRule("prerouting", "tcp", "sport", "443", "tcp", "flags", "&", "(syn|ack)", "==", "(syn|ack)", "counter"); err != nil {
+// addLearnedIPs adds learned IPs to the learned sets. Refreshed IPs are
+// removed and added again in the same batch, older kernels keep the original
+// expiry of an element that is added twice.
+func (n *NFTablesManager) addLearnedIPs(add, refresh []learnedIP) error {
+	conn, err := dialNft()
+	if err != nil {
 		return err
 	}
+	defer conn.Close()
 
-	udpPorts := cfg.CollectUDPPorts()
-	var udpPortExpr string
-	if len(udpPorts) == 1 {
-		udpPortExpr = udpPorts[0]
-	} else {
-		udpPortExpr = "{ " + strings.Join(udpPorts, ", ") + " }"
+	refreshSets := n.learnedSets(refresh)
+	addSets := n.learnedSets(append(add, refresh...))
+
+	var msgs []netlink.Message
+	for _, s := range refreshSets {
+		msgs = append(msgs, nftSetElemDelMsgs(nftTableName, s)...)
 	}
-	if err := n.addQueueRule(nftChainName, "udp", "dport", udpPortExpr, "ct", "original", "packets", "<", udpLimit, "counter"); err != nil {
-		return err
+	for _, s := range addSets {
+		msgs = append(msgs, nftSetElemMsgs(nftTableName, s)...)
 	}
-
-	setSysctlOrProc("net.netfilter.nf_conntrack_checksum", "0")
-	setSysctlOrProc("net.netfilter.nf_conntrack_tcp_be_liberal", "1")
-
-	if log.Level(log.CurLevel.Load()) >= log.LevelTrace {
-		out, _ := n.runNft("list", "table", "inet", nftTableName)
-		log.Tracef("Current nftables rules:\n%s", out)
+	if len(msgs) == 0 {
+		return nil
 	}
 
+	err = conn.commit(msgs)
+	if err != nil && len(refresh) > 0 {
+		// An element expired in the meantime, the delete fails on it
+		msgs = msgs[:0]
+		for _, s := range addSets {
+			msgs = append(msgs, nftSetElemMsgs(nftTableName, s)...)
+		}
+		err = conn.commit(msgs)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to update nftables learned sets: %w", err)
+	}
 	return nil
 }
 
-func (n *NFTablesManager) Clear() error {
-	if !hasBinary("nft") {
-		return nil
+// learnedSets splits ips into the learned sets, dropping IPs of a disabled
+// family since their set does not exist.
+func (n *NFTablesManager) learnedSets(ips []learnedIP) []*nftSet {
+	v4 := &nftSet{name: nftSetLearnedV4}
+	v6 := &nftSet{name: nftSetLearnedV6}
+	for _, l := range ips {
+		if ip4 := l.ip.To4(); ip4 != nil {
+			if n.cfg.Queue.IPv4Enabled {
+				v4.elems = append(v4.elems, nftSetElem{key: ip4, timeout: l.timeout})
+			}
+		} else if n.cfg.Queue.IPv6Enabled {
+			v6.elems = append(v6.elems, nftSetElem{key: l.ip.To16(), timeout: l.timeout})
+		}
 	}
+	return []*nftSet{v4, v6}
+}
 
+func (n *NFTablesManager) Clear() error {
 	log.Tracef("NFTABLES: clearing rules")
 
-	if n.tableExists() {
-		if _, err := n.runNft("flush", "table", "inet", nftTableName); err != nil {
-			log.Errorf("Failed to flush nftables table: %v", err)
-		}
-		time.Sleep(30 * time.Millisecond)
-		if _, err := n.runNft("delete", "table", "inet", nftTableName); err != nil {
-			log.Errorf("Failed to delete nftables table: %v", err)
-		}
+	conn, err := dialNft()
+	if err != nil {
+		log.Errorf("Failed to clear nftables table: %v", err)
+		return nil
+	}
+	defer conn.Close()
+
+	if err := conn.commit([]netlink.Message{
+		nftTableMsg(nftMsgNewTable, nftTableName),
+		nftTableMsg(nftMsgDelTable, nftTableName),
+	}); err != nil {
+		log.Errorf("Failed to delete nftables table: %v", err)
 	}
 
 	return nil
@@ -0,0 +1,760 @@
+package tables
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/fnv"
+	"net/netip"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mdlayher/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// Minimal nf_tables netlink encoding, see include/uapi/linux/netfilter/nf_tables.h.
+// Only the objects and expressions used by the b4 ruleset are covered.
+
+const (
+	nfnlSubsysNFTables = 10
+	nfnlMsgBatchBegin  = 0x10
+	nfnlMsgBatchEnd    = 0x11
+
+	nftMsgNewTable   = 0
+	nftMsgDelTable   = 2
+	nftMsgNewChain   = 3
+	nftMsgNewRule    = 6
+	nftMsgGetRule    = 7
+	nftMsgNewSet     = 9
+	nftMsgNewSetElem = 12
+	nftMsgGetSetElem = 13
+	nftMsgDelSetElem = 14
+
+	nfprotoInet = 1
+	nfprotoIPv4 = 2
+	nfprotoIPv6 = 10
+
+	nftaTableName = 1
+
+	nftaChainTable  = 1
+	nftaChainName   = 3
+	nftaChainHook   = 4
+	nftaChainPolicy = 5
+	nftaChainType   = 7
+
+	nftaHookHooknum  = 1
+	nftaHookPriority = 2
+
+	nftaRuleTable       = 1
+	nftaRuleChain       = 2
+	nftaRuleExpressions = 4
+	nftaRuleUserdata    = 7
+
+	nftaListElem = 1
+	nftaExprName = 1
+	nftaExprData = 2
+
+	nftaDataValue   = 1
+	nftaDataVerdict = 2
+
+	nftaVerdictCode  = 1
+	nftaVerdictChain = 2
+
+	nftaSetTable   = 1
+	nftaSetName    = 2
+	nftaSetFlags   = 3
+	nftaSetKeyType = 4
+	nftaSetKeyLen  = 5
+	nftaSetID      = 10
+	nftaSetTimeout = 11
+
+	nftaSetElemListTable    = 1
+	nftaSetElemListSet      = 2
+	nftaSetElemListElements = 3
+	nftaSetElemListSetID    = 4
+
+	nftaSetElemKey     = 1
+	nftaSetElemFlags   = 3
+	nftaSetElemTimeout = 4
+
+	nftSetInterval        = 0x4
+	nftSetTimeout         = 0x10
+	nftSetElemIntervalEnd = 0x1
+
+	// nft userspace datatypes, only used for display by `nft list`
+	nftTypeIPv4Addr    = 7
+	nftTypeIPv6Addr    = 8
+	nftTypeInetService = 13
+
+	nfInetPreRouting  = 0
+	nfInetForward     = 2
+	nfInetLocalOut    = 3
+	nfInetPostRouting = 4
+
+	nfAccept  = 1
+	nftJump   = -3
+	nftReturn = -5
+
+	nftReg1 = 1
+
+	nftMetaMark    = 3
+	nftMetaOifname = 7
+	nftMetaIiftype = 8
+	nftMetaNfproto = 15
+	nftMetaL4proto = 16
+
+	nftCmpEq = 0
+	nftCmpLt = 2
+
+	nftPayloadLL        = 0
+	nftPayloadNetwork   = 1
+	nftPayloadTransport = 2
+
+	nftCtPkts         = 14
+	nftCtDirOriginal  = 0
+	nftByteorderHton  = 1
+	nftQueueBypass    = 0x1
+	nftUdataComment   = 0
+	nftElemsPerMsg    = 256
+	nftNetlinkTimeout = 5 * time.Second
+)
+
+type nftExpr struct {
+	name string
+	data []byte
+}
+
+type nftRule struct {
+	chain string
+	desc  string // nft syntax, for logs
+	exprs []nftExpr
+}
+
+type nftChain struct {
+	name     string
+	hook     bool
+	hookNum  uint32
+	priority int32
+}
+
+// nftSet is an interval set filled from the config, or, with a timeout, a
+// hash set whose elements are added at runtime and expire on their own.
+type nftSet struct {
+	id      uint32
+	name    string
+	keyType uint32
+	keyLen  uint32
+	timeout time.Duration
+	elems   []nftSetElem
+}
+
+type nftSetElem struct {
+	key     []byte
+	end     bool
+	timeout time.Duration
+}
+
+// encodeAttrs runs fn on a big endian attribute encoder. Encoding only fails
+// on oversized attributes, which the fixed-size expressions below never hit.
+func encodeAttrs(fn func(ae *netlink.AttributeEncoder)) []byte {
+	ae := netlink.NewAttributeEncoder()
+	ae.ByteOrder = binary.BigEndian
+	fn(ae)
+	b, _ := ae.Encode()
+	return b
+}
+
+func nftData(ae *netlink.AttributeEncoder, typ uint16, value []byte) {
+	ae.Nested(typ, func(nae *netlink.AttributeEncoder) error {
+		nae.Bytes(nftaDataValue, value)
+		return nil
+	})
+}
+
+func exprMeta(key uint32) nftExpr {
+	return nftExpr{"meta", encodeAttrs(func(ae *netlink.AttributeEncoder) {
+		ae.Uint32(1, nftReg1) // NFTA_META_DREG
+		ae.Uint32(2, key)     // NFTA_META_KEY
+	})}
+}
+
+func exprCmp(op uint32, value []byte) nftExpr {
+	return nftExpr{"cmp", encodeAttrs(func(ae *netlink.AttributeEncoder) {
+		ae.Uint32(1, nftReg1) // NFTA_CMP_SREG
+		ae.Uint32(2, op)      // NFTA_CMP_OP
+		nftData(ae, 3, value) // NFTA_CMP_DATA
+	})}
+}
+
+func exprPayload(base, offset, length uint32) nftExpr {
+	return nftExpr{"payload", encodeAttrs(func(ae *netlink.AttributeEncoder) {
+		ae.Uint32(1, nftReg1) // NFTA_PAYLOAD_DREG
+		ae.Uint32(2, base)    // NFTA_PAYLOAD_BASE
+		ae.Uint32(3, offset)  // NFTA_PAYLOAD_OFFSET
+		ae.Uint32(4, length)  // NFTA_PAYLOAD_LEN
+	})}
+}
+
+func exprCt(key uint32, dir uint8) nftExpr {
+	return nftExpr{"ct", encodeAttrs(func(ae *netlink.AttributeEncoder) {
+		ae.Uint32(1, nftReg1) // NFTA_CT_DREG
+		ae.Uint32(2, key)     // NFTA_CT_KEY
+		ae.Uint8(3, dir)      // NFTA_CT_DIRECTION
+	})}
+}
+
+func exprByteorder(op, length, size uint32) nftExpr {
+	return nftExpr{"byteorder", encodeAttrs(func(ae *netlink.AttributeEncoder) {
+		ae.Uint32(1, nftReg1) // NFTA_BYTEORDER_SREG
+		ae.Uint32(2, nftReg1) // NFTA_BYTEORDER_DREG
+		ae.Uint32(3, op)      // NFTA_BYTEORDER_OP
+		ae.Uint32(4, length)  // NFTA_BYTEORDER_LEN
+		ae.Uint32(5, size)    // NFTA_BYTEORDER_SIZE
+	})}
+}
+
+func exprBitwise(mask, xor []byte) nftExpr {
+	return nftExpr{"bitwise", encodeAttrs(func(ae *netlink.AttributeEncoder) {
+		ae.Uint32(1, nftReg1)           // NFTA_BITWISE_SREG
+		ae.Uint32(2, nftReg1)           // NFTA_BITWISE_DREG
+		ae.Uint32(3, uint32(len(mask))) // NFTA_BITWISE_LEN
+		nftData(ae, 4, mask)            // NFTA_BITWISE_MASK
+		nftData(ae, 5, xor)             // NFTA_BITWISE_XOR
+	})}
+}
+
+func exprLookup(set *nftSet) nftExpr {
+	return nftExpr{"lookup", encodeAttrs(func(ae *netlink.AttributeEncoder) {
+		ae.String(1, set.name) // NFTA_LOOKUP_SET
+		ae.Uint32(2, nftReg1)  // NFTA_LOOKUP_SREG
+		ae.Uint32(4, set.id)   // NFTA_LOOKUP_SET_ID
+	})}
+}
+
+func exprCounter() nftExpr {
+	return nftExpr{"counter", encodeAttrs(func(ae *netlink.AttributeEncoder) {
+		ae.Uint64(1, 0) // NFTA_COUNTER_BYTES
+		ae.Uint64(2, 0) // NFTA_COUNTER_PACKETS
+	})}
+}
+
+func exprVerdict(code int32, chain string) nftExpr {
+	return nftExpr{"immediate", encodeAttrs(func(ae *netlink.AttributeEncoder) {
+		ae.Uint32(1, 0) // NFTA_IMMEDIATE_DREG, verdict register
+		ae.Nested(2, func(data *netlink.AttributeEncoder) error {
+			data.Nested(nftaDataVerdict, func(v *netlink.AttributeEncoder) error {
+				v.Uint32(nftaVerdictCode, uint32(code))
+				if chain != "" {
+					v.String(nftaVerdictChain, chain)
+				}
+				return nil
+			})
+			return nil
+		})
+	})}
+}
+
+func exprQueue(num, total uint16, flags uint16) nftExpr {
+	return nftExpr{"queue", encodeAttrs(func(ae *netlink.AttributeEncoder) {
+		ae.Uint16(1, num)   // NFTA_QUEUE_NUM
+		ae.Uint16(2, total) // NFTA_QUEUE_TOTAL
+		ae.Uint16(3, flags) // NFTA_QUEUE_FLAGS
+	})}
+}
+
+// Matchers mirroring the nft syntax they are named after.
+
+func matchNfproto(proto uint8) []nftExpr {
+	return []nftExpr{exprMeta(nftMetaNfproto), exprCmp(nftCmpEq, []byte{proto})}
+}
+
+func matchL4proto(proto uint8) []nftExpr {
+	return []nftExpr{exprMeta(nftMetaL4proto), exprCmp(nftCmpEq, []byte{proto})}
+}
+
+func matchPort(proto uint8, dst bool, port uint16) []nftExpr {
+	offset := uint32(0)
+	if dst {
+		offset = 2
+	}
+	return append(matchL4proto(proto),
+		exprPayload(nftPayloadTransport, offset, 2),
+		exprCmp(nftCmpEq, binary.BigEndian.AppendUint16(nil, port)))
+}
+
+func matchPortSet(proto uint8, set *nftSet) []nftExpr {
+	return append(matchL4proto(proto),
+		exprPayload(nftPayloadTransport, 2, 2),
+		exprLookup(set))
+}
+
+func matchAddrSet(nfproto uint8, dst bool, set *nftSet) []nftExpr {
+	offset, length := uint32(12), uint32(4)
+	if nfproto == nfprotoIPv6 {
+		offset, length = 8, 16
+	}
+	if dst {
+		offset += length
+	}
+	return append(matchNfproto(nfproto),
+		exprPayload(nftPayloadNetwork, offset, length),
+		exprLookup(set))
+}
+
+func matchOrigPacketsBelow(limit uint64) []nftExpr {
+	return []nftExpr{
+		exprCt(nftCtPkts, nftCtDirOriginal),
+		exprByteorder(nftByteorderHton, 8, 8),
+		exprCmp(nftCmpLt, binary.BigEndian.AppendUint64(nil, limit)),
+	}
+}
+
+func matchMark(mark uint32) []nftExpr {
+	return []nftExpr{exprMeta(nftMetaMark), exprCmp(nftCmpEq, binary.NativeEndian.AppendUint32(nil, mark))}
+}
+
+func matchOifname(name string) []nftExpr {
+	ifname := make([]byte, unix.IFNAMSIZ)
+	copy(ifname, name)
+	return []nftExpr{exprMeta(nftMetaOifname), exprCmp(nftCmpEq, ifname)}
+}
+
+func matchEtherSaddr(mac []byte) []nftExpr {
+	return []nftExpr{
+		exprMeta(nftMetaIiftype),
+		exprCmp(nftCmpEq, binary.NativeEndian.AppendUint16(nil, unix.ARPHRD_ETHER)),
+		exprPayload(nftPayloadLL, 6, 6),
+		exprCmp(nftCmpEq, mac),
+	}
+}
+
+func matchTCPFlags(mask, value uint8) []nftExpr {
+	return append(matchL4proto(unix.IPPROTO_TCP),
+		exprPayload(nftPayloadTransport, 13, 1),
+		exprBitwise([]byte{mask}, []byte{0}),
+		exprCmp(nftCmpEq, []byte{value}))
+}
+
+// tag identifies a rule by its content. It is stored as the rule comment so
+// drift can be detected by reading the ruleset back.
+func (r *nftRule) tag() string {
+	h := fnv.New32a()
+	h.Write([]byte(r.chain))
+	for _, e := range r.exprs {
+		h.Write([]byte(e.name))
+		h.Write(e.data)
+	}
+	return fmt.Sprintf("b4:%08x", h.Sum32())
+}
+
+func nftUserdataComment(comment string) []byte {
+	b := []byte{nftUdataComment, byte(len(comment) + 1)}
+	b = append(b, comment...)
+	return append(b, 0)
+}
+
+func parseUserdataComment(b []byte) string {
+	for len(b) >= 2 {
+		typ, l := b[0], int(b[1])
+		if len(b) < 2+l {
+			break
+		}
+		if typ == nftUdataComment {
+			return strings.TrimRight(string(b[2:2+l]), "\x00")
+		}
+		b = b[2+l:]
+	}
+	return ""
+}
+
+func nftMsg(msgType uint16, family uint8, flags netlink.HeaderFlags, attrs []byte) netlink.Message {
+	return netlink.Message{
+		Header: netlink.Header{
+			Type:  netlink.HeaderType(nfnlSubsysNFTables<<8 | msgType),
+			Flags: netlink.Request | flags,
+		},
+		Data: append([]byte{family, 0, 0, 0}, attrs...),
+	}
+}
+
+func nftTableMsg(msgType uint16, table string) netlink.Message {
+	flags := netlink.Acknowledge
+	if msgType == nftMsgNewTable {
+		flags |= netlink.Create
+	}
+	return nftMsg(msgType, nfprotoInet, flags, encodeAttrs(func(ae *netlink.AttributeEncoder) {
+		ae.String(nftaTableName, table)
+	}))
+}
+
+func nftChainMsg(table string, c nftChain) netlink.Message {
+	return nftMsg(nftMsgNewChain, nfprotoInet, netlink.Create|netlink.Acknowledge, encodeAttrs(func(ae *netlink.AttributeEncoder) {
+		ae.String(nftaChainTable, table)
+		ae.String(nftaChainName, c.name)
+		if c.hook {
+			ae.Nested(nftaChainHook, func(h *netlink.AttributeEncoder) error {
+				h.Uint32(nftaHookHooknum, c.hookNum)
+				h.Uint32(nftaHookPriority, uint32(c.priority))
+				return nil
+			})
+			ae.Uint32(nftaChainPolicy, nfAccept)
+			ae.String(nftaChainType, "filter")
+		}
+	}))
+}
+
+func nftRuleMsg(table string, r *nftRule) netlink.Message {
+	return nftMsg(nftMsgNewRule, nfprotoInet, netlink.Create|netlink.Append|netlink.Acknowledge, encodeAttrs(func(ae *netlink.AttributeEncoder) {
+		ae.String(nftaRuleTable, table)
+		ae.String(nftaRuleChain, r.chain)
+		ae.Nested(nftaRuleExpressions, func(list *netlink.AttributeEncoder) error {
+			for _, e := range r.exprs {
+				list.Nested(nftaListElem, func(el *netlink.AttributeEncoder) error {
+					el.String(nftaExprName, e.name)
+					el.Bytes(netlink.Nested|nftaExprData, e.data)
+					return nil
+				})
+			}
+			return nil
+		})
+		ae.Bytes(nftaRuleUserdata, nftUserdataComment(r.tag()))
+	}))
+}
+
+func nftSetMsg(table string, s *nftSet) netlink.Message {
+	return nftMsg(nftMsgNewSet, nfprotoInet, netlink.Create|netlink.Acknowledge, encodeAttrs(func(ae *netlink.AttributeEncoder) {
+		ae.String(nftaSetTable, table)
+		ae.String(nftaSetName, s.name)
+		if s.timeout > 0 {
+			ae.Uint32(nftaSetFlags, nftSetTimeout)
+		} else {
+			ae.Uint32(nftaSetFlags, nftSetInterval)
+		}
+		ae.Uint32(nftaSetKeyType, s.keyType)
+		ae.Uint32(nftaSetKeyLen, s.keyLen)
+		ae.Uint32(nftaSetID, s.id)
+		if s.timeout > 0 {
+			ae.Uint64(nftaSetTimeout, uint64(s.timeout.Milliseconds()))
+		}
+	}))
+}
+
+// nftSetElemMsgs adds the elements of s, split over several messages to
+// stay below the netlink attribute size limit.
+func nftSetElemMsgs(table string, s *nftSet) []netlink.Message {
+	return nftElemMsgs(nftMsgNewSetElem, netlink.Create|netlink.Acknowledge, table, s)
+}
+
+// nftSetElemDelMsgs removes the elements of s.
+func nftSetElemDelMsgs(table string, s *nftSet) []netlink.Message {
+	return nftElemMsgs(nftMsgDelSetElem, netlink.Acknowledge, table, s)
+}
+
+func nftElemMsgs(msgType uint16, flags netlink.HeaderFlags, table string, s *nftSet) []netlink.Message {
+	var msgs []netlink.Message
+	for start := 0; start < len(s.elems); start += nftElemsPerMsg {
+		chunk := s.elems[start:min(start+nftElemsPerMsg, len(s.elems))]
+		msgs = append(msgs, nftMsg(msgType, nfprotoInet, flags, encodeAttrs(func(ae *netlink.AttributeEncoder) {
+			ae.String(nftaSetElemListTable, table)
+			ae.String(nftaSetElemListSet, s.name)
+			ae.Uint32(nftaSetElemListSetID, s.id)
+			ae.Nested(nftaSetElemListElements, func(list *netlink.AttributeEncoder) error {
+				for _, el := range chunk {
+					list.Nested(nftaListElem, func(e *netlink.AttributeEncoder) error {
+						nftData(e, nftaSetElemKey, el.key)
+						if el.end {
+							e.Uint32(nftaSetElemFlags, nftSetElemIntervalEnd)
+						}
+						if el.timeout > 0 {
+							e.Uint64(nftaSetElemTimeout, uint64(el.timeout.Milliseconds()))
+						}
+						return nil
+					})
+				}
+				return nil
+			})
+		})))
+	}
+	return msgs
+}
+
+// nftSetFlushMsg removes all elements of a set.
+func nftSetFlushMsg(table, set string) netlink.Message {
+	return nftMsg(nftMsgDelSetElem, nfprotoInet, netlink.Acknowledge, encodeAttrs(func(ae *netlink.AttributeEncoder) {
+		ae.String(nftaSetElemListTable, table)
+		ae.String(nftaSetElemListSet, set)
+	}))
+}
+
+type nftConn struct {
+	c *netlink.Conn
+}
+
+func dialNft() (*nftConn, error) {
+	c, err := netlink.Dial(unix.NETLINK_NETFILTER, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open netfilter netlink socket: %w", err)
+	}
+	return &nftConn{c: c}, nil
+}
+
+func (n *nftConn) Close() {
+	_ = n.c.Close()
+}
+
+// commit sends msgs as one nfnetlink batch. The kernel applies the batch as a
+// single transaction: either every message succeeds or nothing changes.
+func (n *nftConn) commit(msgs []netlink.Message) error {
+	batch := make([]netlink.Message, 0, len(msgs)+2)
+	batch = append(batch, nftBatchMsg(nfnlMsgBatchBegin))
+	batch = append(batch, msgs...)
+	batch = append(batch, nftBatchMsg(nfnlMsgBatchEnd))
+
+	if _, err := n.c.SendMessages(batch); err != nil {
+		return err
+	}
+
+	_ = n.c.SetReadDeadline(time.Now().Add(nftNetlinkTimeout))
+	for acked := 0; acked < len(msgs); {
+		replies, err := n.c.Receive()
+		if err != nil {
+			return err
+		}
+		acked += len(replies)
+	}
+	return nil
+}
+
+func nftBatchMsg(typ uint16) netlink.Message {
+	return netlink.Message{
+		Header: netlink.Header{Type: netlink.HeaderType(typ), Flags: netlink.Request},
+		Data:   []byte{unix.AF_UNSPEC, 0, 0, nfnlSubsysNFTables},
+	}
+}
+
+func (n *nftConn) dump(msgType uint16, attrs []byte) ([]netlink.Message, error) {
+	_ = n.c.SetReadDeadline(time.Now().Add(nftNetlinkTimeout))
+	return n.c.Execute(nftMsg(msgType, nfprotoInet, netlink.Dump, attrs))
+}
+
+// ruleTags returns the tags of all rules of table, per chain in rule order.
+func (n *nftConn) ruleTags(table string) (map[string][]string, error) {
+	msgs, err := n.dump(nftMsgGetRule, encodeAttrs(func(ae *netlink.AttributeEncoder) {
+		ae.String(nftaRuleTable, table)
+	}))
+	if err != nil {
+		return nil, err
+	}
+
+	tags := make(map[string][]string)
+	for _, m := range msgs {
+		if len(m.Data) < 4 {
+			continue
+		}
+		ad, err := netlink.NewAttributeDecoder(m.Data[4:])
+		if err != nil {
+			return nil, err
+		}
+		var rtable, chain, tag string
+		for ad.Next() {
+			switch ad.Type() {
+			case nftaRuleTable:
+				rtable = ad.String()
+			case nftaRuleChain:
+				chain = ad.String()
+			case nftaRuleUserdata:
+				tag = parseUserdataComment(ad.Bytes())
+			}
+		}
+		if err := ad.Err(); err != nil {
+			return nil, err
+		}
+		if rtable == table {
+			tags[chain] = append(tags[chain], tag)
+		}
+	}
+	return tags, nil
+}
+
+// setElems returns the elements of a set in a comparable form.
+func (n *nftConn) setElems(table, set string) ([]string, error) {
+	msgs, err := n.dump(nftMsgGetSetElem, encodeAttrs(func(ae *netlink.AttributeEncoder) {
+		ae.String(nftaSetElemListTable, table)
+		ae.String(nftaSetElemListSet, set)
+	}))
+	if err != nil {
+		return nil, err
+	}
+
+	var elems []string
+	for _, m := range msgs {
+		if len(m.Data) < 4 {
+			continue
+		}
+		ad, err := netlink.NewAttributeDecoder(m.Data[4:])
+		if err != nil {
+			return nil, err
+		}
+		ad.ByteOrder = binary.BigEndian
+		for ad.Next() {
+			if ad.Type() != nftaSetElemListElements {
+				continue
+			}
+			ad.Nested(func(list *netlink.AttributeDecoder) error {
+				for list.Next() {
+					var el nftSetElem
+					list.Nested(func(e *netlink.AttributeDecoder) error {
+						for e.Next() {
+							switch e.Type() {
+							case nftaSetElemKey:
+								e.Nested(func(d *netlink.AttributeDecoder) error {
+									for d.Next() {
+										if d.Type() == nftaDataValue {
+											el.key = d.Bytes()
+										}
+									}
+									return nil
+								})
+							case nftaSetElemFlags:
+								el.end = e.Uint32()&nftSetElemIntervalEnd != 0
+							}
+						}
+						return nil
+					})
+					elems = append(elems, el.String())
+				}
+				return nil
+			})
+		}
+		if err := ad.Err(); err != nil {
+			return nil, err
+		}
+	}
+	sort.Strings(elems)
+	return elems, nil
+}
+
+func (e nftSetElem) String() string {
+	if e.end {
+		return fmt.Sprintf("%x-end", e.key)
+	}
+	return fmt.Sprintf("%x", e.key)
+}
+
+// intervalElems converts [start, end) ranges into interval set elements.
+// Ranges must be sorted and non-overlapping. A range reaching the top of the
+// key space has no end element.
+func intervalElems(ranges [][2][]byte) []nftSetElem {
+	var elems []nftSetElem
+	for _, r := range ranges {
+		elems = append(elems, nftSetElem{key: r[0]})
+		if r[1] != nil {
+			elems = append(elems, nftSetElem{key: r[1], end: true})
+		}
+	}
+	return elems
+}
+
+// mergeRanges sorts [start, end) ranges and merges overlapping or adjacent
+// ones; the kernel rejects overlapping intervals. A nil end means the top of
+// the key space.
+func mergeRanges(ranges [][2][]byte) [][2][]byte {
+	sort.Slice(ranges, func(i, j int) bool {
+		return bytes.Compare(ranges[i][0], ranges[j][0]) < 0
+	})
+	var out [][2][]byte
+	for _, r := range ranges {
+		if len(out) > 0 {
+			last := &out[len(out)-1]
+			if last[1] == nil {
+				continue
+			}
+			if bytes.Compare(r[0], last[1]) <= 0 {
+				if r[1] == nil || bytes.Compare(r[1], last[1]) > 0 {
+					last[1] = r[1]
+				}
+				continue
+			}
+		}
+		out = append(out, r)
+	}
+	return out
+}
+
+// nextKey returns b+1, or nil when b is the largest key.
+func nextKey(b []byte) []byte {
+	out := append([]byte(nil), b...)
+	for i := len(out) - 1; i >= 0; i-- {
+		out[i]++
+		if out[i] != 0 {
+			return out
+		}
+	}
+	return nil
+}
+
+// addrRanges parses IPs and CIDRs of one family into interval elements.
+// Entries of the other family and invalid entries are skipped.
+func addrRanges(entries []string, ipv6 bool) []nftSetElem {
+	var ranges [][2][]byte
+	for _, entry := range entries {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		var prefix netip.Prefix
+		if strings.Contains(entry, "/") {
+			p, err := netip.ParsePrefix(entry)
+			if err != nil {
+				continue
+			}
+			prefix = p.Masked()
+		} else {
+			addr, err := netip.ParseAddr(entry)
+			if err != nil {
+				continue
+			}
+			prefix = netip.PrefixFrom(addr, addr.BitLen())
+		}
+		if prefix.Addr().Is4In6() {
+			prefix = netip.PrefixFrom(prefix.Addr().Unmap(), prefix.Bits()-96)
+		}
+		if prefix.Addr().Is6() != ipv6 {
+			continue
+		}
+
+		start := prefix.Addr().AsSlice()
+		last := append([]byte(nil), start...)
+		for bit := prefix.Bits(); bit < len(last)*8; bit++ {
+			last[bit/8] |= 0x80 >> (bit % 8)
+		}
+		ranges = append(ranges, [2][]byte{start, nextKey(last)})
+	}
+	return intervalElems(mergeRanges(ranges))
+}
+
+// portRanges parses ports and "from-to" ranges into interval elements.
+func portRanges(ports []string) []nftSetElem {
+	var ranges [][2][]byte
+	for _, p := range ports {
+		from, to, isRange := strings.Cut(strings.TrimSpace(p), "-")
+		lo, err := strconv.ParseUint(from, 10, 16)
+		if err != nil {
+			continue
+		}
+		hi := lo
+		if isRange {
+			if hi, err = strconv.ParseUint(to, 10, 16); err != nil || hi < lo {
+				continue
+			}
+		}
+		ranges = append(ranges, [2][]byte{
+			binary.BigEndian.AppendUint16(nil, uint16(lo)),
+			nextKey(binary.BigEndian.AppendUint16(nil, uint16(hi))),
+		})
+	}
+	return intervalElems(mergeRanges(ranges))
+}
@@ -1,7 +1,11 @@
 package tables
 
 import (
+	"fmt"
+	"net"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/daniellavrushin/b4/config"
 )
@@ -48,6 +52,18 @@ func TestIPTablesManager_BuildNFQSpec(t *testing.T) {
 	})
 }
 
+func TestIPTablesManager_ProbeSpec(t *testing.T) {
+	cfg := config.NewConfig()
+	cfg.System.Checker.ProbeMark = 0x4000
+	manager := NewIPTablesManager(&cfg)
+
+	spec := manager.probeSpec(100, 1)
+	expected := []string{"-m", "mark", "--mark", "0x4000", "-j", "NFQUEUE", "--queue-num", "100", "--queue-bypass"}
+	if strings.Join(spec, " ") != strings.Join(expected, " ") {
+		t.Errorf("spec = %v, want %v", spec, expected)
+	}
+}
+
 func TestNFTablesManager_BuildNFQueueAction(t *testing.T) {
 	t.Run("single thread", func(t *testing.T) {
 		cfg := config.NewConfig()
@@ -293,3 +309,306 @@ func TestLoadSysctlSnapshot_NoFile(t *testing.T) {
 		t.Error("should return empty map for non-existent file")
 	}
 }
+
+func TestNFTablesManager_BuildRuleset(t *testing.T) {
+	cfg := config.NewConfig()
+	cfg.Queue.StartNum = 537
+	cfg.Queue.Threads = 4
+	cfg.Queue.IPv4Enabled = true
+	cfg.Queue.IPv6Enabled = false
+	manager := NewNFTablesManager(&cfg)
+
+	rs := manager.buildRuleset()
+
+	chains := map[string]bool{}
+	for _, c := range rs.chains {
+		chains[c.name] = true
+	}
+	for _, name := range []string{nftChainName, "prerouting", "output", "postrouting"} {
+		if !chains[name] {
+			t.Errorf("missing chain %s", name)
+		}
+	}
+	if chains["forward"] {
+		t.Error("forward chain should only exist with device filtering")
+	}
+
+	for _, name := range []string{nftSetDupV4, nftSetDupV6, nftSetUDPPorts} {
+		if rs.set(name) == nil {
+			t.Errorf("missing set %s", name)
+		}
+	}
+
+	for _, r := range rs.rules {
+		if strings.Contains(r.desc, "queue") {
+			if !strings.HasSuffix(r.desc, "queue num 537-540 bypass") {
+				t.Errorf("unexpected queue action in %q", r.desc)
+			}
+			if r.chain != "output" && r.chain != "postrouting" && !strings.Contains(r.desc, "ip") {
+				t.Errorf("queue rule not limited to IPv4: %q", r.desc)
+			}
+		}
+	}
+
+	dnsTCP := false
+	for _, r := range rs.rules {
+		if r.chain == nftChainName && strings.Contains(r.desc, fmt.Sprintf("tcp dport 53 ct original packets < %d", dnsTCPPacketLimit)) {
+			dnsTCP = true
+		}
+	}
+	if !dnsTCP {
+		t.Error("missing queue rule for DNS over TCP")
+	}
+
+	probeDesc := fmt.Sprintf("meta mark 0x%x", cfg.System.Checker.ProbeMark)
+	probe := -1
+	for i, r := range rs.rules {
+		if r.chain == nftChainName && strings.Contains(r.desc, probeDesc) && strings.Contains(r.desc, "queue") {
+			probe = i
+			break
+		}
+	}
+	if probe < 0 {
+		t.Error("missing queue rule for discovery probes")
+	} else {
+		for _, r := range rs.rules[:probe] {
+			if r.chain == nftChainName && strings.Contains(r.desc, "queue") {
+				t.Errorf("probe rule should come before %q", r.desc)
+			}
+		}
+	}
+
+	again := manager.buildRuleset()
+	if len(again.rules) != len(rs.rules) {
+		t.Fatalf("rule count changed between builds: %d vs %d", len(rs.rules), len(again.rules))
+	}
+	for i := range rs.rules {
+		if rs.rules[i].tag() != again.rules[i].tag() {
+			t.Errorf("rule %d tag is not stable", i)
+		}
+	}
+
+	cfg.MainSet.TCP.ConnBytesLimit++
+	changed := manager.buildRuleset()
+	same := true
+	for i := range rs.rules {
+		if rs.rules[i].tag() != changed.rules[i].tag() {
+			same = false
+		}
+	}
+	if same {
+		t.Error("changing the connbytes limit should change rule tags")
+	}
+}
+
+func TestNFTablesManager_BuildRuleset_Devices(t *testing.T) {
+	cfg := config.NewConfig()
+	cfg.Queue.Devices.Enabled = true
+	cfg.Queue.Devices.Mac = []string{"aa:bb:cc:dd:ee:ff", "invalid"}
+	manager := NewNFTablesManager(&cfg)
+
+	rs := manager.buildRuleset()
+
+	var forward []*nftRule
+	for _, r := range rs.rules {
+		if r.chain == "forward" {
+			forward = append(forward, r)
+		}
+		if r.chain == "postrouting" {
+			t.Error("postrouting jump should not exist with device filtering")
+		}
+	}
+	if len(forward) != 1 || forward[0].desc != "ether saddr AA:BB:CC:DD:EE:FF jump "+nftChainName {
+		t.Errorf("unexpected forward rules: %+v", forward)
+	}
+}
+
+func TestNFTablesManager_BuildRuleset_IPSets(t *testing.T) {
+	cfg := config.NewConfig()
+	cfg.Queue.IPv4Enabled = true
+	cfg.Queue.IPv6Enabled = false
+	cfg.MainSet.Targets.IpsToMatch = []string{"1.2.3.0/24"}
+	cfg.Sets = []*config.SetConfig{cfg.MainSet}
+	manager := NewNFTablesManager(&cfg)
+
+	if rs := manager.buildRuleset(); rs.set(nftSetTargetsV4) != nil {
+		t.Error("IP sets should only exist when enabled")
+	}
+
+	cfg.System.Tables.IPSets.Enabled = true
+	rs := manager.buildRuleset()
+	targets, learned := rs.set(nftSetTargetsV4), rs.set(nftSetLearnedV4)
+	if targets == nil || learned == nil {
+		t.Fatal("missing IPv4 IP sets")
+	}
+	if rs.set(nftSetTargetsV6) != nil {
+		t.Error("IPv6 sets should not exist with IPv6 disabled")
+	}
+	if len(targets.elems) != 2 {
+		t.Errorf("expected target range as 2 elements, got %v", targets.elems)
+	}
+	if learned.timeout == 0 || len(learned.elems) != 0 {
+		t.Error("learned set should be an empty timeout set")
+	}
+
+	countQueue := func(rs *nftRuleset, substr string) int {
+		n := 0
+		for _, r := range rs.rules {
+			if strings.Contains(r.desc, substr) && strings.Contains(r.desc, "queue") {
+				n++
+			}
+		}
+		return n
+	}
+	if n := countQueue(rs, "@"+nftSetTargetsV4); n != 0 {
+		t.Errorf("sets alone should not change queue rules, found %d", n)
+	}
+
+	cfg.System.Tables.IPSets.TargetsOnly = true
+	rs = manager.buildRuleset()
+	for _, r := range rs.rules {
+		// Probes are queued whatever the targets, the sandbox decides
+		if !strings.Contains(r.desc, "queue") || strings.Contains(r.desc, "port 53") || strings.Contains(r.desc, "@"+nftSetDupV4) ||
+			strings.Contains(r.desc, fmt.Sprintf("meta mark 0x%x", cfg.System.Checker.ProbeMark)) {
+			continue
+		}
+		if !strings.Contains(r.desc, "@"+nftSetTargetsV4) && !strings.Contains(r.desc, "@"+nftSetLearnedV4) {
+			t.Errorf("queue rule not limited to the IP sets: %q", r.desc)
+		}
+	}
+	if n := countQueue(rs, fmt.Sprintf("meta mark 0x%x", cfg.System.Checker.ProbeMark)); n != 1 {
+		t.Errorf("expected the probe rule with TargetsOnly, got %d", n)
+	}
+	if n := countQueue(rs, "ip saddr @"+nftSetLearnedV4); n != 2 {
+		t.Errorf("expected 2 incoming rules for learned IPs, got %d", n)
+	}
+
+	cfg.System.Tables.IPSets.TargetsOnly = false
+	cfg.System.Tables.IPSets.QueueAll = true
+	rs = manager.buildRuleset()
+	found := false
+	for _, r := range rs.rules {
+		if r.desc == "ip daddr @"+nftSetTargetsV4+" tcp dport 443 counter "+manager.buildNFQueueAction() {
+			found = true
+		}
+	}
+	if !found {
+		t.Error("missing unlimited queue rule for target IPs")
+	}
+}
+
+type fakeLearnedWriter struct {
+	add, refresh []learnedIP
+	calls        int
+}
+
+func (f *fakeLearnedWriter) addLearnedIPs(add, refresh []learnedIP) error {
+	f.add, f.refresh = add, refresh
+	f.calls++
+	return nil
+}
+
+func TestLearnedSync(t *testing.T) {
+	l := &learnedSync{entries: make(map[string]*learnedEntry)}
+	l.once.Do(func() {}) // flushed by hand
+	w := &fakeLearnedWriter{}
+	l.writer = w
+
+	ip := net.ParseIP("1.2.3.4")
+	l.learn(ip, time.Minute)
+	l.learn(ip, time.Minute)
+	l.flush()
+	if w.calls != 1 || len(w.add) != 1 || len(w.refresh) != 0 {
+		t.Fatalf("expected one add, got %+v", w)
+	}
+
+	// Relearning shortly after does not rewrite the kernel element
+	l.learn(ip, time.Minute)
+	l.flush()
+	if w.calls != 1 {
+		t.Errorf("fresh element should not be rewritten, got %d calls", w.calls)
+	}
+
+	// Once the kernel element is half a TTL behind it is refreshed
+	l.entries[ip.String()].inKernel = time.Now().Add(20 * time.Second)
+	l.learn(ip, time.Minute)
+	l.flush()
+	if w.calls != 2 || len(w.refresh) != 1 || len(w.add) != 0 {
+		t.Errorf("expected one refresh, got %+v", w)
+	}
+
+	// A restart replays everything as adds
+	l.start(w)
+	l.flush()
+	if w.calls != 3 || len(w.add) != 1 {
+		t.Errorf("expected replay as add, got %+v", w)
+	}
+
+	l.stop()
+	l.learn(net.ParseIP("5.6.7.8"), time.Minute)
+	l.flush()
+	if w.calls != 3 {
+		t.Error("stopped sync should not write")
+	}
+}
+
+func TestLearnedSyncCopiesIP(t *testing.T) {
+	l := &learnedSync{entries: make(map[string]*learnedEntry)}
+
+	// The packet path learns a view into the queue's receive buffer
+	buf := []byte{0x45, 0, 0, 0, 10, 0, 0, 1}
+	l.learn(net.IP(buf[4:8]), time.Minute)
+	copy(buf[4:8], []byte{192, 0, 2, 1})
+
+	e := l.entries["10.0.0.1"]
+	if e == nil || !e.ip.Equal(net.IPv4(10, 0, 0, 1)) {
+		t.Fatalf("learned IP changed with the buffer: %+v", e)
+	}
+	if &e.ip[0] == &buf[4] {
+		t.Error("learned IP keeps the packet buffer")
+	}
+}
+
+func TestNFTablesAddrRanges(t *testing.T) {
+	elems := addrRanges([]string{"10.1.0.0/16", "10.0.0.0/8", "1.2.3.4", "2001:db8::/32", "bogus"}, false)
+	var got []string
+	for _, e := range elems {
+		got = append(got, e.String())
+	}
+	want := []string{"01020304", "01020305-end", "0a000000", "0b000000-end"}
+	if strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	elems = addrRanges([]string{"0.0.0.0/0"}, false)
+	if len(elems) != 1 || elems[0].end {
+		t.Errorf("full range should have no end element, got %v", elems)
+	}
+
+	elems = addrRanges([]string{"2001:db8::/32"}, true)
+	if len(elems) != 2 || elems[1].String() != "20010db9000000000000000000000000-end" {
+		t.Errorf("unexpected IPv6 elements: %v", elems)
+	}
+}
+
+func TestNFTablesPortRanges(t *testing.T) {
+	elems := portRanges([]string{"443", "50000-50100", "50050-50200", "65535"})
+	var got []string
+	for _, e := range elems {
+		got = append(got, e.String())
+	}
+	want := []string{"01bb", "01bc-end", "c350", "c419-end", "ffff"}
+	if strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestNFTablesUserdataComment(t *testing.T) {
+	b := nftUserdataComment("b4:0badf00d")
+	if got := parseUserdataComment(b); got != "b4:0badf00d" {
+		t.Errorf("got %q", got)
+	}
+	if got := parseUserdataComment([]byte{1, 2, 'x'}); got != "" {
+		t.Errorf("truncated userdata should be ignored, got %q", got)
+	}
+}